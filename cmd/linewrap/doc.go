@@ -51,7 +51,7 @@ The linewrap flags are:
    where \n menas newline.
       https://golang.org/ref/spec#String_literals
  -width=<terminal width>
-   Target line width in runes.  If negative the line width is unlimited; each
+   Target line width in cells.  If negative the line width is unlimited; each
    paragraph is output as a single line.  If 0 each word is output on its own
    line. Defaults to the terminal width.
 
@@ -63,7 +63,7 @@ func init() {
 		width = 80 // reasonable default for unknown terminal width
 	}
 	cmdLineWrap.Flags.IntVar(&flagWidth, "width", width, `
-Target line width in runes.  If negative the line width is unlimited; each
+Target line width in cells.  If negative the line width is unlimited; each
 paragraph is output as a single line.  If 0 each word is output on its own line.
 Defaults to the terminal width.
 `)
@@ -0,0 +1,77 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CommandSpec describes a single command in a flat list of commands, which may
+// be used to build a command tree via BuildTree.
+type CommandSpec struct {
+	// Path of the command, starting with the name of the root command, with
+	// names separated by dots or slashes; e.g. "prog.sub.leaf" or "prog/sub".
+	Path     string
+	Short    string // Short description, shown in help called on parent.
+	Long     string // Long description, shown in help called on itself.
+	ArgsName string // Name of the args, shown in usage line.
+	ArgsLong string // Long description of the args, shown in help.
+	Runner   Runner // Runner that runs the command.
+}
+
+// BuildTree builds a command tree from specs, and returns the root command.
+// Parent commands that aren't described by specs are created as needed, with
+// only a name; children are ordered by their first appearance in specs.  An
+// error is returned if the specs have different roots, or if more than one
+// spec has the same path.
+//
+// BuildTree is meant to ease migrating from libraries where commands are
+// described by a flat list.  The returned tree may be modified before calling
+// Parse; e.g. to add flags.
+func BuildTree(specs []CommandSpec) (*Command, error) {
+	var root *Command
+	cmds := make(map[string]*Command)
+	specified := make(map[string]bool)
+	for _, spec := range specs {
+		names := strings.FieldsFunc(spec.Path, func(r rune) bool { return r == '.' || r == '/' })
+		if len(names) == 0 {
+			return nil, fmt.Errorf("cmdline: empty command spec path %q", spec.Path)
+		}
+		path := strings.Join(names, " ")
+		if specified[path] {
+			return nil, fmt.Errorf("cmdline: multiple command specs with path %q", path)
+		}
+		specified[path] = true
+		if root == nil {
+			root = &Command{Name: names[0]}
+			cmds[names[0]] = root
+		}
+		if names[0] != root.Name {
+			return nil, fmt.Errorf("cmdline: command spec path %q has root %q, want %q", spec.Path, names[0], root.Name)
+		}
+		// Walk down from the root, creating parents as needed.
+		cmd := root
+		for ix := 1; ix < len(names); ix++ {
+			subPath := strings.Join(names[:ix+1], " ")
+			child := cmds[subPath]
+			if child == nil {
+				child = &Command{Name: names[ix]}
+				cmds[subPath] = child
+				cmd.Children = append(cmd.Children, child)
+			}
+			cmd = child
+		}
+		cmd.Short = spec.Short
+		cmd.Long = spec.Long
+		cmd.ArgsName = spec.ArgsName
+		cmd.ArgsLong = spec.ArgsLong
+		cmd.Runner = spec.Runner
+	}
+	if root == nil {
+		return nil, fmt.Errorf("cmdline: no command specs")
+	}
+	return root, nil
+}
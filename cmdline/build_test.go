@@ -0,0 +1,79 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBuildTree(t *testing.T) {
+	root, err := BuildTree([]CommandSpec{
+		{Path: "prog", Short: "Prog is a program", Long: "Prog has commands."},
+		{Path: "prog.echo", Short: "Print strings on stdout", Long: "Echo prints args.", ArgsName: "[strings]", Runner: RunnerFunc(runEcho)},
+		{Path: "prog/sub/hello", Short: "Print strings on stdout preceded by Hello", Long: "Hello prints args.", ArgsName: "[strings]", Runner: RunnerFunc(runHello)},
+		{Path: "prog.sub", Short: "Sub has a command", Long: "Sub has a command."},
+		{Path: "prog/other/leaf", Short: "Leaf", Long: "Leaf runs.", Runner: RunnerFunc(runEcho)},
+	})
+	if err != nil {
+		t.Fatalf("BuildTree failed: %v", err)
+	}
+	tests := []testCase{
+		{
+			Args:   []string{"echo", "foo"},
+			Stdout: "[foo]\n",
+		},
+		{
+			Args:   []string{"sub", "hello", "foo"},
+			Stdout: "Hello foo\n",
+		},
+		{
+			Args:   []string{"other", "leaf"},
+			Stdout: "[]\n",
+		},
+		{
+			Args: []string{"help", "-style=shortonly", "sub"},
+			Stdout: `Sub has a command
+`,
+		},
+	}
+	runTestCases(t, root, tests)
+	var buf bytes.Buffer
+	if err := root.SummaryTree(&buf); err != nil {
+		t.Fatalf("SummaryTree failed: %v", err)
+	}
+	if got, want := buf.String(), `prog        Prog is a program
+   echo        Print strings on stdout
+   sub         Sub has a command
+      hello       Print strings on stdout preceded by Hello
+   other       No description available
+      leaf        Leaf
+`; got != want {
+		t.Errorf("got summary tree %q, want %q", got, want)
+	}
+}
+
+func TestBuildTreeErrors(t *testing.T) {
+	tests := []struct {
+		Specs []CommandSpec
+		Err   string
+	}{
+		{nil, "cmdline: no command specs"},
+		{[]CommandSpec{{Path: ""}}, `cmdline: empty command spec path ""`},
+		{[]CommandSpec{{Path: "./"}}, `cmdline: empty command spec path "./"`},
+		{[]CommandSpec{{Path: "a.b"}, {Path: "c.d"}}, `cmdline: command spec path "c.d" has root "c", want "a"`},
+		{[]CommandSpec{{Path: "a.b"}, {Path: "a/b"}}, `cmdline: multiple command specs with path "a b"`},
+		{[]CommandSpec{{Path: "a"}, {Path: "a.b"}, {Path: "a"}}, `cmdline: multiple command specs with path "a"`},
+	}
+	for _, test := range tests {
+		root, err := BuildTree(test.Specs)
+		if got, want := errString(err), test.Err; got != want {
+			t.Errorf("%v got error %q, want %q", test.Specs, got, want)
+		}
+		if root != nil {
+			t.Errorf("%v got root %v, want nil", test.Specs, root)
+		}
+	}
+}
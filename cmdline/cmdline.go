@@ -15,12 +15,17 @@
 //
 // Each sequence of flags is associated with the command that immediately
 // precedes it.  Flags registered on flag.CommandLine are considered global
-// flags, and are allowed anywhere a command-specific flag is allowed.
+// flags, and are allowed anywhere a command-specific flag is allowed.  The set
+// of global flags is captured the first time a command tree is parsed; flags
+// registered on flag.CommandLine after that, e.g. by a library that is
+// initialized late, aren't shown in help, and are only accepted before the
+// first subcommand.  Help always shows the current values of the flags.
 //
 // Pretty usage documentation is automatically generated, and accessible either
 // via the standard -h / -help flags from the Go flag package, or a special help
 // command.  The help command is automatically appended to commands that already
-// have at least one child, and don't already have a "help" child.  Commands
+// have at least one child, and don't already have a "help" child.  The help
+// command may be renamed or disabled via options on the root command.  Commands
 // that do not have any children will exit with an error if invoked with the
 // arguments "help ..."; this behavior is relied on when generating recursive
 // help to distinguish between external subcommands with and without children.
@@ -39,20 +44,29 @@
 package cmdline
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unicode"
 
 	"v.io/x/lib/envvar"
 	_ "v.io/x/lib/metadata" // for the -metadata flag
+	"v.io/x/lib/textutil"
 	"v.io/x/lib/timing"
 )
 
@@ -61,11 +75,17 @@ import (
 // each subcommand.  The command graph must be a tree; each command may either
 // have no parent (the root) or exactly one parent, and cycles are not allowed.
 type Command struct {
-	Name     string // Name of the command.
-	Short    string // Short description, shown in help called on parent.
-	Long     string // Long description, shown in help called on itself.
-	ArgsName string // Name of the args, shown in usage line.
-	ArgsLong string // Long description of the args, shown in help.
+	Name     string    // Name of the command.
+	Short    string    // Short description, shown in help called on parent.
+	Long     string    // Long description, shown in help called on itself.
+	ArgsName string    // Name of the args, shown in usage line.
+	ArgsLong string    // Long description of the args, shown in help.
+	Examples []Example // Examples of usage, shown in help after the args.
+
+	// Annotations holds arbitrary metadata about the command for external
+	// tools; e.g. {"stability": "beta", "since": "1.4"}.  It is ignored when
+	// parsing and in help output, and included in the output of DumpJSON.
+	Annotations map[string]string
 
 	// Flags defined for this command.  When a flag F is defined on a command C,
 	// we allow F to be specified on the command line immediately after C, or
@@ -74,6 +94,14 @@ type Command struct {
 	// methods on FlagSet that are generally used after parsing cannot be
 	// used on Flags. ParsedFlags should be used instead.
 	Flags flag.FlagSet
+	// FlagsFunc, if set, defines more flags for this command on fs.  It is
+	// called at most once, and only when the flags are needed: when the command
+	// is on the path of the parsed command line, when its usage is printed, or
+	// when a sibling is given a flag it doesn't define.  Use it to avoid the
+	// cost of defining flags for commands that aren't run.  The flags are added
+	// to Flags; if both define a flag with the same name, the flag defined in
+	// Flags takes precedence.
+	FlagsFunc func(fs *flag.FlagSet)
 	// ParsedFlags contains the FlagSet created by the Command
 	// implementation and that has had its Parse method called. It
 	// should be used instead of the Flags field for handling methods
@@ -88,6 +116,13 @@ type Command struct {
 	// ancestor commands. The flags for the ancestor commands will not be
 	// propagated to the child commands as well.
 	DontInheritFlags bool
+	// AllowFlagShadow indicates whether the flags of this command may have the
+	// same names as global flags, or as flags inherited from ancestor commands.
+	// By default such a flag is reported as an error by Parse and Validate, since
+	// only one of the two flags is set when the name is specified, which is easy
+	// to miss: global flags take precedence for the root command, and command
+	// flags for the others.
+	AllowFlagShadow bool
 
 	// Children of the command.
 	Children []*Command
@@ -110,10 +145,337 @@ type Command struct {
 	// and the runner args, and an error is returned from Parse.
 	Runner Runner
 
+	// CompleteFunc, if set, returns the candidate completions of the arg
+	// toComplete, given the preceding args of the command.  It is called by
+	// Complete; candidates that don't start with toComplete are ignored.
+	CompleteFunc func(args []string, toComplete string) []string
+
+	// RetryFunc, if set, reports whether an error returned by the Runner is
+	// transient; e.g. a network timeout.  The Runner is re-run while RetryFunc
+	// returns true, up to MaxRetries times, and the error or success of the last
+	// run is returned.  Usage errors are never retried, since their usage has
+	// already been printed.  Parse and flag parsing aren't re-run.
+	RetryFunc func(err error) bool
+
+	// MaxRetries is the maximum number of times the Runner is re-run after it
+	// returns an error for which RetryFunc returns true.
+	MaxRetries int
+
+	// RetryBackoff, if set, returns the duration to wait before the given retry,
+	// which starts at 1.  By default there's no wait between retries.
+	RetryBackoff func(retry int) time.Duration
+
 	// Topics that provide additional info via the default help command.
 	Topics []Topic
+
+	// HelpFunc, if set, prints the usage of this command to w, instead of the
+	// usage generated from the fields above.  It is called by the help command
+	// and when printing usage errors, with the resolved style and width of the
+	// output.  The Short description is still used in the usage of the parent.
+	HelpFunc func(cmd *Command, w io.Writer, style string, width int) error
+
+	// HelpSections, if non-nil, lists the sections of the usage of this command
+	// in the order they're printed.  The section names are "long", "usage",
+	// "commands", "args", "examples", "topics", "flags" and "globals"; sections
+	// that aren't listed are omitted.  If nil, all sections are printed in that
+	// order.
+	HelpSections []string
+
+	// PrintRunErrors indicates whether ParseAndRun should print errors returned
+	// by the Runner to Env.Stderr, prefixed by the command name.  Only used on
+	// the root command.  Errors that are or wrap ErrExitCode, including usage
+	// errors, are never printed, since usage errors have already been reported.
+	PrintRunErrors bool
+
+	// DisableHelpCommand indicates whether to omit the default help command.
+	// Usage is still available via the -h / -help flags, and is still printed
+	// for usage errors.  Only used on the root command.
+	DisableHelpCommand bool
+
+	// HelpCommandName is the name of the default help command; if empty the name
+	// is "help".  It is an error for any command in the tree to have a child with
+	// this name.  Only used on the root command.
+	HelpCommandName string
+
+	// DumpFlagsCommandName, if non-empty, is the name of a hidden built-in
+	// command, e.g. "__dumpflags", that may follow any command in the args.
+	// Instead of running the command, it prints the effective value of every
+	// flag of the command in name=value form, after parsing the preceding args;
+	// the command flags, those inherited from ancestors, and the global flags.
+	// Children with the same name take precedence.  Only used on the root
+	// command.
+	DumpFlagsCommandName string
+
+	// CompleteFlag indicates whether to support a hidden -complete flag as the
+	// first arg, e.g. for shell completion scripts.  Instead of running a
+	// command, it prints the completions of the remaining args, as returned by
+	// Complete, one per line.  Only used on the root command.
+	CompleteFlag bool
+
+	// DescribeFlag indicates whether to support a hidden -describe flag, which
+	// may follow any command; e.g. "prog sub leaf -describe".  Instead of running
+	// the command, it prints a single line of JSON with the name, short
+	// description and ArgsName of the command, and the names of the flags it
+	// accepts, sorted: its own and those inherited from ancestors, without hidden
+	// and global flags.  This is lighter than DumpJSON for tools that need a
+	// single command, e.g. shell plugins.  The flag isn't supported by commands
+	// with PassthroughArgs, nor by commands that define a flag of the same name.
+	// Only used on the root command.
+	DescribeFlag bool
+
+	// SuppressUsageOnError indicates whether to omit the usage of the command
+	// when printing usage errors, so that only the error line is printed.  The
+	// usage is still available via the help command.  Only used on the root
+	// command.
+	SuppressUsageOnError bool
+
+	// DeferUnknownCommands indicates whether usage errors for unknown commands
+	// and help topics are returned without being printed, so that the caller may
+	// handle them; e.g. by resolving plugins, or suggesting similar names.  The
+	// errors wrap an *UnknownCommandError or *UnknownTopicError respectively.
+	// Only used on the root command.
+	DeferUnknownCommands bool
+
+	// ErrorPrefix determines the prefix of the error messages that are reported
+	// by this package; e.g. for unknown commands and flags.  By default the
+	// prefix is the full path of the command.  Errors reported via
+	// Env.UsageErrorf aren't prefixed.  Only used on the root command.
+	ErrorPrefix ErrorPrefix
+
+	// ErrorLabel is the label that starts each line that reports an error; if
+	// empty the label is "ERROR:".  Only used on the root command.
+	ErrorLabel string
+
+	// ErrorColor determines whether the error label is printed in bold red.  By
+	// default the label is colored when it's written to a terminal, unless the
+	// NO_COLOR environment variable is set or TERM is "dumb".  The rest of the
+	// error message and the usage are never colored.  Only used on the root
+	// command.
+	ErrorColor ErrorColor
+
+	// LongFile is the path of a file in the DocsFS of the root command, which
+	// contains the long description of the command.  If non-empty, it overrides
+	// Long.  The file is only read when help is displayed, and an error is
+	// returned if it can't be read.
+	LongFile string
+
+	// DocsFS is the file system that LongFile for commands and topics is read
+	// from; e.g. an embed.FS.  Only used on the root command.
+	DocsFS fs.FS
+
+	// AlignGlobalFlags indicates whether to print the global flags as a table,
+	// with the usage of each flag aligned in a column, rather than on separate
+	// lines.  Global flags are always sorted by name, since they're visited via
+	// flag.FlagSet.VisitAll, which doesn't reorder the FlagSet.  Only used on
+	// the root command.
+	AlignGlobalFlags bool
+
+	// GlobalFlagFilter, if set, reports whether the global flag with the given
+	// name, defined on flag.CommandLine, is exposed by the program; e.g. to
+	// exclude flags registered by dependencies.  Global flags that are excluded
+	// aren't shown in help output, and are rejected when parsing the args.  Only
+	// used on the root command.
+	GlobalFlagFilter func(name string) bool
+
+	// CompactUsage indicates whether the usage line of commands with children
+	// enumerates the names of the immediate children, e.g. "prog {foo|bar} ...",
+	// rather than showing a "<command>" placeholder.  The help command isn't
+	// enumerated.  Only used on the root command.
+	CompactUsage bool
+
+	// CaseInsensitive indicates whether the names of commands and help topics,
+	// including the help command, are matched ignoring case; e.g. "prog ECHO"
+	// runs the echo command.  Exact matches are preferred over matches that
+	// ignore case.  Only used on the root command.
+	CaseInsensitive bool
+
+	// Width is the width of help and usage output in cells, or unlimited if
+	// negative.  It takes precedence over the CMDLINE_WIDTH environment variable
+	// and the terminal width, which are used if it is 0; it is overridden by the
+	// help -width flag.  Only used on the root command.
+	Width int
+
+	// RuneWidthFunc returns the width of a rune in cells, used to wrap help and
+	// usage output, and to align the columns of listings of commands, topics and
+	// flags.  If nil, East Asian wide and fullwidth runes are 2 cells, combining
+	// marks are 0 cells, and other runes are 1 cell; set it to measure runes
+	// differently, e.g. to match how a terminal renders emoji.  Only used on the
+	// root command.
+	RuneWidthFunc func(rune) int
+
+	// TabWidth is the distance in cells between tab stops, used to expand tabs
+	// in the descriptions and flag usage in help output.  If 0 the distance is 8,
+	// and if negative tabs aren't expanded.  Only used on the root command.
+	TabWidth int
+
+	// Hyperlinks indicates whether links in the Long descriptions of commands and
+	// topics, written as [text](url), are printed as clickable OSC 8 hyperlinks
+	// when help is written to a terminal.  Otherwise links are printed as
+	// "text (url)".  Only used on the root command.
+	Hyperlinks bool
+
+	// HelpSeparator is the rune repeated to form the line that separates the
+	// usage of each command when help is displayed for multiple commands; e.g.
+	// via "help ...".  If 0 the rune is '='.  Only used on the root command.
+	HelpSeparator rune
+
+	// HelpSeparatorWidth is the width of the separator line in cells.  If 0 the
+	// separator spans the output width, or 80 cells if the width is unlimited.
+	// Only used on the root command.
+	HelpSeparatorWidth int
+
+	// HelpIndent is the indent of usage lines, and of the listings of commands
+	// and topics, in help output.  If empty the indent is 3 spaces.  Note that
+	// lines that don't start with spaces may be wrapped.  Only used on the root
+	// command.
+	HelpIndent string
+
+	// IndentWidth is the width in spaces of the indent of the listings of
+	// commands, topics and flags in help output; the flag descriptions are
+	// indented by this width.  If <= 0 the width is 3.  HelpIndent takes
+	// precedence for the listings of commands and topics, if set.  Only used on
+	// the root command.
+	IndentWidth int
+
+	// PassthroughArgs indicates whether all args following the command name are
+	// passed verbatim to the Runner, without parsing any flags.  This is useful
+	// for commands that wrap other programs, so that the user doesn't need to
+	// specify "--" before the wrapped args.  Since flags aren't parsed, -help
+	// is also passed to the Runner.  If set, Children must be empty.
+	PassthroughArgs bool
+
+	// PreParse, if set, is called with the args following the command name,
+	// before any flags are parsed for the command, and returns the args to use
+	// instead.  It may be used to rewrite args; e.g. to translate legacy flag
+	// names.  The args include those destined for descendant commands, which
+	// have their own PreParse.  If an error is returned, it is reported as a
+	// usage error, and Parse returns an error wrapping ErrUsage.
+	PreParse func(args []string) ([]string, error)
+
+	// FlagParseErrorFunc, if set, is called when parsing the flags of the
+	// command fails, with the parse error and the args following the command
+	// name, as passed to the flag parser.  If it returns nil the Runner is run
+	// with those args verbatim; e.g. to treat unknown flags as args for commands
+	// that wrap other programs.  Flags preceding the failure may have been set.
+	// If it returns an error, the error is reported as a usage error, and Parse
+	// returns an error wrapping ErrUsage.  Only called if Runner is set.
+	FlagParseErrorFunc func(cmd *Command, err error, args []string) error
+
+	// PostParse, if set, is called after the flags of the command are parsed, if
+	// the command's Runner is about to be returned by Parse, with the args that
+	// will be passed to the Runner.  It returns every problem it finds with the
+	// flags and args; e.g. missing required flags, or mutually exclusive flags.
+	// If any are returned, they are reported together as a single usage error,
+	// one per line, and Parse returns a *UsageError that wraps them.
+	//
+	// PostParse may also derive flag values from other flags, by setting the
+	// variables bound to the flags; e.g. setting -addr from -host and -port if
+	// -addr is empty.  ParsedFlags is set when it's called, so Visit reports the
+	// flags that were set on the command line.
+	PostParse func(args []string) []error
+
+	// OutputFilter, if set, is called by Parse to wrap Env.Stdout when the Runner
+	// of this command or one of its descendants is returned, with the command
+	// whose Runner is returned and the writer to wrap; e.g. to pretty-print JSON
+	// output only when Stdout is a terminal.  The filters of the commands in the
+	// path are applied from the root down, so each filter writes to the writer
+	// returned by the filter of its nearest ancestor.  Output of the help command
+	// and external children isn't filtered.
+	OutputFilter func(cmd *Command, w io.Writer) io.Writer
+
+	secretEnvFlags      []secretEnvFlag
+	relevantGlobalFlags []string
+	hiddenFlags         []string
+	flagGroups          []flagGroup
+	flagsFuncCalled     bool
+	cmdLineFlags        map[string]string
+	flagSources         map[string]string
+	childIndex          *nameIndex
+	topicIndex          *nameIndex
+}
+
+// flagGroup is a titled group of flags, shown together in help output.
+type flagGroup struct {
+	title string
+	names []string
+}
+
+// secretEnvFlag is a value that may only be set via an environment variable.
+type secretEnvFlag struct {
+	p      *string
+	envVar string
 }
 
+// SecretEnvFlag defines a secret string value, which is set from the
+// environment variable envVar when Parse is called with a path that includes
+// cmd.  The Runner reads the value via p, which is left unchanged if envVar
+// isn't set.
+//
+// Secret values are intended for tokens and passwords; they are never parsed
+// from the command-line args, and aren't shown in help output, so that neither
+// the value nor the name of the variable is leaked.
+func (cmd *Command) SecretEnvFlag(p *string, envVar string) {
+	cmd.secretEnvFlags = append(cmd.secretEnvFlags, secretEnvFlag{p, envVar})
+}
+
+// RelevantGlobalFlags declares the names of the global flags that are relevant
+// to cmd.  The default compact-style usage of cmd only shows those global
+// flags, along with a note that more flags exist.  Global flags hidden via
+// HideGlobalFlagsExcept remain hidden.  Multiple calls behave as if all names
+// were provided in a single call.  If never called, all global flags are
+// relevant.
+//
+// All global flags are always shown in non-compact style usage messages.
+func (cmd *Command) RelevantGlobalFlags(names ...string) {
+	cmd.relevantGlobalFlags = append(cmd.relevantGlobalFlags, names...)
+	if cmd.relevantGlobalFlags == nil {
+		cmd.relevantGlobalFlags = []string{}
+	}
+}
+
+// HideFlag hides the flag with the given name, which must be defined in
+// cmd.Flags or by cmd.FlagsFunc, from help output.  The flag is still accepted
+// on the command line.  Flags that are inherited by descendant commands are
+// hidden from their help output as well.
+func (cmd *Command) HideFlag(name string) {
+	cmd.hiddenFlags = append(cmd.hiddenFlags, name)
+}
+
+// FlagGroup groups the flags with the given names, which must be defined in
+// cmd.Flags or by cmd.FlagsFunc, under a subsection with the given title in
+// the help output of cmd; e.g. "Connection flags".  Groups are shown in the
+// order of the calls, followed by the ungrouped flags under the title "Other
+// flags".  Multiple calls with the same title add names to the same group.
+// Descendants that inherit the flags show them ungrouped.  Grouping only
+// affects help output; parsing and completion are unchanged.
+func (cmd *Command) FlagGroup(title string, names ...string) {
+	for i := range cmd.flagGroups {
+		if cmd.flagGroups[i].title == title {
+			cmd.flagGroups[i].names = append(cmd.flagGroups[i].names, names...)
+			return
+		}
+	}
+	cmd.flagGroups = append(cmd.flagGroups, flagGroup{title, names})
+}
+
+// ErrorPrefix describes the prefix of error messages; see Command.ErrorPrefix.
+type ErrorPrefix int
+
+const (
+	ErrorPrefixPath ErrorPrefix = iota // Full command path; e.g. "prog sub: ".
+	ErrorPrefixRoot                    // Root command name; e.g. "prog: ".
+	ErrorPrefixNone                    // No prefix.
+)
+
+// ErrorColor describes when the error label is colored; see Command.ErrorColor.
+type ErrorColor int
+
+const (
+	ErrorColorAuto   ErrorColor = iota // Color on terminals, unless disabled.
+	ErrorColorAlways                   // Always color, even if disabled.
+	ErrorColorNever                    // Never color.
+)
+
 // Runner is the interface for running commands.  Return ErrExitCode to indicate
 // the command should exit with a specific exit code.
 type Runner interface {
@@ -128,11 +490,20 @@ func (f RunnerFunc) Run(env *Env, args []string) error {
 	return f(env, args)
 }
 
+// Example represents an example invocation of a command, shown in help.
+type Example struct {
+	Description string // Description of what the example does.
+	Command     string // Command line of the example; e.g. "prog echo hello".
+}
+
 // Topic represents a help topic that is accessed via the help command.
 type Topic struct {
-	Name  string // Name of the topic.
-	Short string // Short description, shown in help for the command.
-	Long  string // Long description, shown in help for this topic.
+	Name     string  // Name of the topic.
+	Short    string  // Short description, shown in help for the command.
+	Long     string  // Long description, shown in help for this topic.
+	LongFile string  // File in the root DocsFS to read Long from, if non-empty.
+	URL      string  // Online docs, shown as "See: URL" after Long, if non-empty.
+	Children []Topic // Sub-topics, shown in help for this topic.
 }
 
 // Main implements the main function for the command tree rooted at root.
@@ -149,17 +520,58 @@ type Topic struct {
 //     cmdline.Main(root)
 //   }
 func Main(root *Command) {
+	mainArgs(root, os.Args[1:])
+}
+
+// MainFlagArgs is like Main, but parses flag.Args() against the root command,
+// rather than os.Args[1:].  It is intended for hybrid programs that parse some
+// flags with the flag package in main, before handing off to the command tree
+// rooted at root; flag.Parse must already have been called.  The flags that
+// were defined on flag.CommandLine are global flags of the tree, so they may
+// also be specified after the commands.  See SetFlagUsage for the usage
+// printed by flag.Parse, and for the flags of root, which flag.Parse only
+// accepts once SetFlagUsage has been called.
+func MainFlagArgs(root *Command) {
+	mainArgs(root, flag.Args())
+}
+
+// SetFlagUsage sets flag.Usage to print the usage of root, which is printed by
+// flag.Parse for -h or -help, and for errors parsing flag.CommandLine.  The
+// usage is the same as for the help command of root; the style and width come
+// from the Width of root and the CMDLINE_STYLE and CMDLINE_WIDTH environment
+// variables.  It is written to the output of flag.CommandLine, so that tests
+// may capture it via flag.CommandLine.SetOutput.
+//
+// The flags of root are listed in the usage, so they're also merged into
+// flag.CommandLine, as Parse would, so that flag.Parse accepts them.  The
+// global flags of the tree are those defined on flag.CommandLine when
+// SetFlagUsage is called, so it must be called after they're defined, and
+// after the flags of root are defined, but before flag.Parse.
+func SetFlagUsage(root *Command) {
+	initGlobalFlags()
+	mergeFlags(flag.CommandLine, root.flags())
+	flag.Usage = func() {
+		initGlobalFlags()
+		cleanNames(root)
+		env := EnvFromOS()
+		env.root = root
+		path := []*Command{root}
+		makeHelpRunner(path, env).usageFunc(env, flag.CommandLine.Output())
+	}
+}
+
+// mainArgs implements Main for the given args.
+func mainArgs(root *Command, args []string) {
 	env := EnvFromOS()
 	if env.Timer != nil && len(env.Timer.Intervals) > 0 {
 		env.Timer.Intervals[0].Name = pathName(env.prefix(), []*Command{root})
 	}
-	err := ParseAndRun(root, env, os.Args[1:])
-	code := ExitCode(err, env.Stderr)
+	code := exitCode(ParseAndRun(root, env, args), env.Stderr, env)
 	if *flagTime && env.Timer != nil {
 		env.Timer.Finish()
 		p := timing.IntervalPrinter{Zero: env.Timer.Zero}
 		if err := p.Print(env.Stderr, env.Timer.Intervals, env.Timer.Now()); err != nil {
-			code2 := ExitCode(err, env.Stderr)
+			code2 := exitCode(err, env.Stderr, env)
 			if code == 0 {
 				code = code2
 			}
@@ -204,21 +616,26 @@ var flagTime = flag.Bool("time", false, "Dump timing information to stderr befor
 func Parse(root *Command, env *Env, args []string) (Runner, []string, error) {
 	env.TimerPush("cmdline parse")
 	defer env.TimerPop()
-	if globalFlags == nil {
-		// Initialize our global flags to a cleaned copy.  We don't want the merging
-		// in parseFlags to contaminate the global flags, even if Parse is called
-		// multiple times, so we keep a single package-level copy.
-		cleanFlags(flag.CommandLine)
-		globalFlags = copyFlags(flag.CommandLine)
-	}
+	initGlobalFlags()
 	// Set env.Usage to the usage of the root command, in case the parse fails.
 	path := []*Command{root}
-	env.Usage = makeHelpRunner(path, env).usageFunc
-	cleanTree(root)
+	env.Usage, env.path = makeHelpRunner(path, env).usageFunc, path
+	env.root, env.pathPrefix, env.widthVar = root, env.prefix(), env.Vars["CMDLINE_WIDTH"]
+	cleanNames(root)
 	if err := checkTreeInvariants(path, env); err != nil {
 		return nil, nil, err
 	}
-	runner, args, err := root.parse(nil, env, args, make(map[string]string))
+	if root.CompleteFlag && env.resolved == nil && len(args) > 0 && (args[0] == "-"+completeFlagName || args[0] == "--"+completeFlagName) {
+		// No flags are set while completing, but flag.Parsed should still return
+		// true, as described above.
+		flag.CommandLine.Parse(nil)
+		return completeRunner{root}, args[1:], nil
+	}
+	start := path
+	if env.resolved != nil {
+		start = env.resolved
+	}
+	runner, args, err := start[len(start)-1].parse(start[:len(start)-1:len(start)-1], env, args, make(map[string]string))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -227,8 +644,8 @@ func Parse(root *Command, env *Env, args []string) (Runner, []string, error) {
 	// and CMDLINE_FIRST_CALL are only meant to be passed to external children,
 	// and shouldn't be propagated through the user's runner.
 	switch runner.(type) {
-	case helpRunner, binaryRunner:
-		// The help and binary runners need the envvars to be set.
+	case helpRunner, binaryRunner, treeRunner, dumpFlagsRunner, describeRunner:
+		// The built-in runners need the envvars to be set.
 	default:
 		for key, _ := range env.Vars {
 			if strings.HasPrefix(key, "CMDLINE_") {
@@ -238,14 +655,320 @@ func Parse(root *Command, env *Env, args []string) (Runner, []string, error) {
 				}
 			}
 		}
+		cmd := env.path[len(env.path)-1]
+		for _, c := range env.path {
+			if c.OutputFilter != nil {
+				env.Stdout = c.OutputFilter(cmd, env.Stdout)
+			}
+		}
+		if cmd.RetryFunc != nil && cmd.MaxRetries > 0 {
+			runner = retryRunner{cmd, runner}
+		}
 	}
 	return runner, args, nil
 }
 
+// Parse parses args against the command tree rooted at cmd, in the same way as
+// the Parse function, but only resolves the command and parses flags; no
+// Runner is run, and no output is written.  It is intended for programs that
+// need the resolution without execution, and for fuzzing the parser.  The
+// environment is empty, so e.g. external children aren't found via LookPath,
+// and the returned command is never an external child.
+//
+// On success returns the leaf command selected by args, along with the args to
+// pass to its Runner.  If args select the default help command, it is returned
+// even though it isn't in the tree.  If args contain the -help flag, returns
+// the command that the flag applies to, along with flag.ErrHelp.
+func (cmd *Command) Parse(args []string) (*Command, []string, error) {
+	env := &Env{
+		Stdin:         strings.NewReader(""),
+		Stdout:        ioutil.Discard,
+		Stderr:        ioutil.Discard,
+		Vars:          map[string]string{},
+		Deterministic: true,
+	}
+	runner, args, err := Parse(cmd, env, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf := env.path[len(env.path)-1]
+	if _, ok := runner.(helpRunner); ok {
+		if _, ok := leaf.Runner.(helpRunner); !ok {
+			return leaf, nil, flag.ErrHelp
+		}
+	}
+	return leaf, args, nil
+}
+
+// ExecuteResolved runs target, a command in the tree rooted at cmd, with args,
+// in the same way as ParseAndRun with the args following the name of target;
+// e.g. for plugin hosts and REPLs that have already selected the command and
+// parsed the global flags.  The flags of target and those inherited from its
+// ancestors are parsed from args, and if args select a child of target,
+// parsing continues with the child.  The environment comes from the process,
+// as with Main.
+//
+// Global flags aren't parsed, since the caller is expected to have parsed them
+// already; they keep their current values, and specifying one in args is a
+// usage error.  Unlike Parse, the flags of cmd aren't merged into
+// flag.CommandLine, even if target is cmd.  Flags of the ancestors of target
+// that aren't specified in args also keep their current values.  Returns an
+// error without running anything if target isn't in the tree rooted at cmd.
+func (cmd *Command) ExecuteResolved(target *Command, args []string) error {
+	return cmd.executeResolved(EnvFromOS(), target, args)
+}
+
+// executeResolved implements ExecuteResolved with the given env.
+func (cmd *Command) executeResolved(env *Env, target *Command, args []string) error {
+	path := resolvePath([]*Command{cmd}, target)
+	if path == nil {
+		return fmt.Errorf("%s: command %q isn't in the tree", cmd.Name, target.Name)
+	}
+	env.resolved = path
+	defer func() { env.resolved = nil }()
+	return ParseAndRun(cmd, env, args)
+}
+
+// resolvePath returns path extended with the commands down to target, if
+// target is the last command in path or one of its descendants, otherwise nil.
+func resolvePath(path []*Command, target *Command) []*Command {
+	cmd := path[len(path)-1]
+	if cmd == target {
+		return path
+	}
+	for _, child := range cmd.Children {
+		if found := resolvePath(append(path[:len(path):len(path)], child), target); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// Capture parses and runs cmd with args via ParseAndRunIsolated, and returns
+// the output written to stdout and stderr, along with the returned error.  It
+// is intended for tests of programs built on this package.  The environment is
+// empty and Deterministic, so the output width is 80 cells by default, and
+// Stdin is empty.
+func (cmd *Command) Capture(args []string) (stdout, stderr string, err error) {
+	var outBuf, errBuf bytes.Buffer
+	env := &Env{
+		Stdin:         strings.NewReader(""),
+		Stdout:        &outBuf,
+		Stderr:        &errBuf,
+		Vars:          map[string]string{},
+		Deterministic: true,
+	}
+	err = ParseAndRunIsolated(cmd, env, args)
+	return outBuf.String(), errBuf.String(), err
+}
+
+var (
+	// isolatedMu serializes calls to ParseAndRunIsolated, since the flags of the
+	// root command are merged into the global flag.CommandLine.
+	isolatedMu sync.Mutex
+	// isolatedGlobalFlags holds the flags of flag.CommandLine before the first
+	// call to ParseAndRunIsolated.
+	isolatedGlobalFlags *flag.FlagSet
+)
+
+// ParseAndRunIsolated is like ParseAndRun, but isolates the run from previous
+// runs.  It is intended for tests of programs built on this package, which run
+// the same command tree many times in one process; see Capture, and the
+// cmdlinetest package.
+//
+// Before each run, flag.CommandLine is replaced by a new FlagSet with the
+// global flags that were defined before the first call, so that flags of the
+// root command of a previous run aren't parsed, and the flags of the commands
+// in the tree rooted at cmd are reset to their default values, and forget
+// where their values came from; see FlagSource.  Thus runs are isolated from
+// each other, except for the values of global flags, and flags whose default
+// value can't be set.  Calls are serialized, so ParseAndRunIsolated may be
+// called from tests that call t.Parallel.
+func ParseAndRunIsolated(cmd *Command, env *Env, args []string) error {
+	isolatedMu.Lock()
+	defer isolatedMu.Unlock()
+	if isolatedGlobalFlags == nil {
+		isolatedGlobalFlags = copyFlags(flag.CommandLine)
+	}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	mergeFlags(flag.CommandLine, isolatedGlobalFlags)
+	resetFlags(cmd)
+	return ParseAndRun(cmd, env, args)
+}
+
+// resetFlags resets the flags of the commands in the tree rooted at cmd to
+// their default values.  Flags that haven't been defined yet by FlagsFunc
+// already have their default values.
+func resetFlags(cmd *Command) {
+	cmd.Flags.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() != f.DefValue {
+			f.Value.Set(f.DefValue)
+		}
+	})
+	cmd.cmdLineFlags, cmd.flagSources = nil, nil
+	for _, child := range cmd.Children {
+		resetFlags(child)
+	}
+}
+
+// Validate checks that the command tree rooted at cmd satisfies the invariants
+// that are checked by Parse, and returns an error describing the first
+// violation.  It may be called during initialization or in tests, to catch
+// programming errors in the tree before any args are parsed; e.g. a command
+// with both Children and a Runner that takes args.
+//
+// Validate also checks every command for flags that shadow global or inherited
+// flags, which Parse only checks for the commands on the parsed path.  Flags
+// that haven't been defined yet by FlagsFunc aren't checked.
+func (cmd *Command) Validate() error {
+	cleanTree(cmd)
+	if err := checkTreeInvariants([]*Command{cmd}, &Env{}); err != nil {
+		return err
+	}
+	initGlobalFlags()
+	return checkTreeFlagShadow([]*Command{cmd}, &Env{})
+}
+
+// checkTreeFlagShadow calls checkFlagShadow for each command in the tree rooted
+// at the last command in path.
+func checkTreeFlagShadow(path []*Command, env *Env) error {
+	if err := checkFlagShadow(path, env); err != nil {
+		return err
+	}
+	for _, child := range path[len(path)-1].Children {
+		if err := checkTreeFlagShadow(append(path[:len(path):len(path)], child), env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFlagShadow returns an error if a flag of the last command in path has
+// the same name as a global flag, or as a flag inherited from an ancestor, as
+// determined by pathFlags, unless the command sets AllowFlagShadow.  The error
+// names the scopes of both flags.
+func checkFlagShadow(path []*Command, env *Env) error {
+	cmd := path[len(path)-1]
+	if cmd.AllowFlagShadow || len(path) > 1 && cmd.Name == helpCommandName(path) {
+		return nil
+	}
+	// inherited maps the name of each inherited flag to the length of the path of
+	// the nearest ancestor that defines it.
+	inherited := make(map[string]int)
+	if !cmd.DontInheritFlags {
+		for p := len(path) - 2; p >= 0; p-- {
+			if path[p].DontPropagateFlags {
+				break
+			}
+			path[p].Flags.VisitAll(func(f *flag.Flag) {
+				if inherited[f.Name] == 0 {
+					inherited[f.Name] = p + 1
+				}
+			})
+			if path[p].DontInheritFlags {
+				break
+			}
+		}
+	}
+	globals := rootGlobalFlags(path[0])
+	var err error
+	cmd.Flags.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		var scope string
+		if global := globals.Lookup(f.Name); global != nil && !sameValue(global.Value, f.Value) {
+			scope = "the global flag"
+		} else if n := inherited[f.Name]; n > 0 {
+			scope = fmt.Sprintf("the flag of %q", pathName(env.prefix(), path[:n]))
+		} else {
+			return
+		}
+		err = fmt.Errorf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+Flag %q of the command shadows %s of the same name.
+Rename one of the flags, or set AllowFlagShadow to allow it.`, pathName(env.prefix(), path), f.Name, scope)
+	})
+	return err
+}
+
+// sameValue returns true iff a and b are the same flag value; e.g. when the
+// flags of a root command have been merged into flag.CommandLine before the
+// global flags were initialized.
+func sameValue(a, b flag.Value) bool {
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	return ta == tb && ta.Comparable() && a == b
+}
+
+// BuildFlagSet returns a new FlagSet with the flags that Parse accepts for the
+// command selected by names in the tree rooted at cmd; e.g. no names for cmd
+// itself, or "sub", "leaf" for "cmd sub leaf".  The FlagSet contains the flags
+// of the command, those inherited from its ancestors, and the global flags,
+// with the same precedence as Parse: global flags take precedence for the root
+// command, and command flags for the others.  Hidden flags are included, since
+// they may still be specified.
+//
+// The flags share their values with the commands, so parsing the FlagSet sets
+// the same variables as Parse, but the Flags of the commands aren't modified.
+// It is intended for introspection; e.g. to feed flag completion libraries.
+// Returns an *UnknownCommandError if names don't select a command.
+func (cmd *Command) BuildFlagSet(names ...string) (*flag.FlagSet, error) {
+	initGlobalFlags()
+	cleanNames(cmd)
+	path := []*Command{cmd}
+	for nx, name := range names {
+		child := findChild(cmd, path[len(path)-1], name)
+		if child == nil {
+			return nil, &UnknownCommandError{Parent: path[len(path)-1], Name: name, Args: names[nx+1:]}
+		}
+		path = append(path, child)
+	}
+	last := path[len(path)-1]
+	flags := flag.NewFlagSet(last.Name, flag.ContinueOnError)
+	if len(path) == 1 {
+		mergeFlags(flags, rootGlobalFlags(cmd))
+		mergeFlags(flags, cmd.flags())
+	} else {
+		mergeFlags(flags, pathFlags(path))
+		mergeFlags(flags, rootGlobalFlags(cmd))
+	}
+	return flags, nil
+}
+
 var globalFlags *flag.FlagSet
 
+// initGlobalFlags initializes globalFlags, if it hasn't already been
+// initialized.
+func initGlobalFlags() {
+	if globalFlags == nil {
+		// Initialize our global flags to a cleaned copy.  We don't want the merging
+		// in parseFlags to contaminate the global flags, even if Parse is called
+		// multiple times, so we keep a single package-level copy.
+		cleanFlags(flag.CommandLine)
+		globalFlags = copyFlags(flag.CommandLine)
+	}
+}
+
+// rootGlobalFlags returns the global flags of the tree rooted at root; those
+// accepted by root.GlobalFlagFilter, or all of them if it isn't set.
+func rootGlobalFlags(root *Command) *flag.FlagSet {
+	if root.GlobalFlagFilter == nil {
+		return globalFlags
+	}
+	flags := new(flag.FlagSet)
+	globalFlags.VisitAll(func(f *flag.Flag) {
+		if root.GlobalFlagFilter(f.Name) {
+			flags.Var(f.Value, f.Name, f.Usage)
+			flags.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	return flags
+}
+
 // ParseAndRun is a convenience that calls Parse, and then calls Run on the
-// returned runner with the given env and parsed args.
+// returned runner with the given env and parsed args.  If the error returned by
+// the runner is printed, based on root.PrintRunErrors, ExitCode recognizes the
+// returned error, and doesn't print it again.
 func ParseAndRun(root *Command, env *Env, args []string) error {
 	runner, args, err := Parse(root, env, args)
 	if err != nil {
@@ -253,26 +976,93 @@ func ParseAndRun(root *Command, env *Env, args []string) error {
 	}
 	env.TimerPush("cmdline run")
 	defer env.TimerPop()
-	return runner.Run(env, args)
+	err = runner.Run(env, args)
+	var code ErrExitCode
+	if err == nil || errors.As(err, &code) || !root.PrintRunErrors {
+		return err
+	}
+	fmt.Fprintf(env.Stderr, "%s: %v\n", root.Name, err)
+	printHints(env.Stderr, env.outputWidth(env.Stderr), errorHints(err))
+	return &printedError{err}
+}
+
+// printedError wraps an error returned by a runner that ParseAndRun has already
+// printed, so that ExitCode doesn't print it again.
+type printedError struct {
+	err error
 }
 
+func (e *printedError) Error() string { return e.err.Error() }
+func (e *printedError) Unwrap() error { return e.err }
+
 func trimSpace(s *string) { *s = strings.TrimSpace(*s) }
 
+// NormalizeLong returns the Long description s of a command or topic as it is
+// used by help and the other renderers, such as GenerateDocs and DumpJSON:
+// leading and trailing white space, including blank lines, is removed.  Thus
+// Long may be written as a raw string that starts and ends with a newline.
+// Lines within s are kept as-is, including their indentation, except that the
+// first line loses its leading spaces.  The contents of LongFile are
+// normalized in the same way.
+func NormalizeLong(s string) string { return strings.TrimSpace(s) }
+
+func cleanTopics(topics []Topic) {
+	for tx := range topics {
+		trimSpace(&topics[tx].Name)
+		trimSpace(&topics[tx].Short)
+		topics[tx].Long = NormalizeLong(topics[tx].Long)
+		trimSpace(&topics[tx].URL)
+		cleanTopics(topics[tx].Children)
+	}
+}
+
+// cleanNames trims the fields of the tree rooted at cmd that Parse depends on:
+// the names of commands and topics, and the ArgsName and ArgsLong that are
+// checked by checkTreeInvariants.  The remaining fields are only used by help,
+// which calls cleanTree before rendering; they aren't cleaned by Parse, so that
+// running a command doesn't visit the flags of every command in the tree.
+func cleanNames(cmd *Command) {
+	trimSpace(&cmd.Name)
+	trimSpace(&cmd.ArgsName)
+	trimSpace(&cmd.ArgsLong)
+	cleanTopicNames(cmd.Topics)
+	for _, child := range cmd.Children {
+		cleanNames(child)
+	}
+	indexTree(cmd)
+}
+
+// indexTree updates the indexes of the children and topics of cmd; see
+// nameIndex.  The names must already be cleaned.
+func indexTree(cmd *Command) {
+	children, topics := cmd.Children, cmd.Topics
+	cmd.childIndex = indexNames(cmd.childIndex, len(children), func(i int) string { return children[i].Name })
+	cmd.topicIndex = indexNames(cmd.topicIndex, len(topics), func(i int) string { return topics[i].Name })
+}
+
+func cleanTopicNames(topics []Topic) {
+	for tx := range topics {
+		trimSpace(&topics[tx].Name)
+		cleanTopicNames(topics[tx].Children)
+	}
+}
+
 func cleanTree(cmd *Command) {
 	trimSpace(&cmd.Name)
 	trimSpace(&cmd.Short)
-	trimSpace(&cmd.Long)
+	cmd.Long = NormalizeLong(cmd.Long)
 	trimSpace(&cmd.ArgsName)
 	trimSpace(&cmd.ArgsLong)
-	for tx := range cmd.Topics {
-		trimSpace(&cmd.Topics[tx].Name)
-		trimSpace(&cmd.Topics[tx].Short)
-		trimSpace(&cmd.Topics[tx].Long)
+	for ex := range cmd.Examples {
+		trimSpace(&cmd.Examples[ex].Description)
+		trimSpace(&cmd.Examples[ex].Command)
 	}
+	cleanTopics(cmd.Topics)
 	cleanFlags(&cmd.Flags)
 	for _, child := range cmd.Children {
 		cleanTree(child)
 	}
+	indexTree(cmd)
 }
 
 func cleanFlags(flags *flag.FlagSet) {
@@ -282,26 +1072,29 @@ func cleanFlags(flags *flag.FlagSet) {
 }
 
 func checkTreeInvariants(path []*Command, env *Env) error {
-	cmd, cmdPath := path[len(path)-1], pathName(env.prefix(), path)
+	// The path is only formatted for errors, since every Parse checks the whole
+	// tree.
+	cmd := path[len(path)-1]
+	cmdPath := func() string { return pathName(env.prefix(), path) }
 	// Check that the root name is non-empty.
-	if cmdPath == "" {
+	if len(path) == 1 && cmdPath() == "" {
 		return fmt.Errorf(`CODE INVARIANT BROKEN; FIX YOUR CODE
 
 Root command name cannot be empty.`)
 	}
 	// Check that the children and topic names are non-empty and unique.
-	seen := make(map[string]bool)
+	seen := make(map[string]bool, len(cmd.Children)+len(cmd.Topics))
 	checkName := func(name string) error {
 		if name == "" {
 			return fmt.Errorf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
 
-Command and topic names cannot be empty.`, cmdPath)
+Command and topic names cannot be empty.`, cmdPath())
 		}
 		if seen[name] {
 			return fmt.Errorf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
 
 Each command must have unique children and topic names.
-Saw %q multiple times.`, cmdPath, name)
+Saw %q multiple times.`, cmdPath(), name)
 		}
 		seen[name] = true
 		return nil
@@ -315,6 +1108,49 @@ Saw %q multiple times.`, cmdPath, name)
 		if err := checkName(topic.Name); err != nil {
 			return err
 		}
+		if err := checkTopicInvariants(cmdPath()+" "+topic.Name, topic.Children); err != nil {
+			return err
+		}
+	}
+	// Check that the renamed help command doesn't collide with a real child.
+	if name := path[0].HelpCommandName; name != "" && seen[name] {
+		return fmt.Errorf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+HelpCommandName %q collides with a child or topic of the same name.`, cmdPath(), name)
+	}
+	// Check that help sections are known.
+	for _, name := range cmd.HelpSections {
+		if !isHelpSection(name) {
+			return fmt.Errorf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+HelpSections has unknown section %q.`, cmdPath(), name)
+		}
+	}
+	// Check that hidden flags are defined.  Flags defined by FlagsFunc aren't
+	// known yet, so the check is skipped for them.
+	for _, name := range cmd.hiddenFlags {
+		if cmd.FlagsFunc == nil && cmd.Flags.Lookup(name) == nil {
+			return fmt.Errorf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+HideFlag %q doesn't match any flag of the command.`, cmdPath(), name)
+		}
+	}
+	// Check that grouped flags are defined, and only in a single group.
+	grouped := make(map[string]string)
+	for _, group := range cmd.flagGroups {
+		for _, name := range group.names {
+			if cmd.FlagsFunc == nil && cmd.Flags.Lookup(name) == nil {
+				return fmt.Errorf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+FlagGroup %q flag %q doesn't match any flag of the command.`, cmdPath(), group.title, name)
+			}
+			if title, ok := grouped[name]; ok {
+				return fmt.Errorf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+Flag %q is in both FlagGroup %q and %q.`, cmdPath(), name, title, group.title)
+			}
+			grouped[name] = group.title
+		}
 	}
 	// Check that our Children / Runner invariant is satisfied.  At least one must
 	// be specified, and if both are specified then ArgsName and ArgsLong must be
@@ -323,12 +1159,17 @@ Saw %q multiple times.`, cmdPath, name)
 	case !hasC && !hasR:
 		return fmt.Errorf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
 
-At least one of Children or Runner must be specified.`, cmdPath)
+At least one of Children or Runner must be specified.`, cmdPath())
+	case hasC && cmd.PassthroughArgs:
+		return fmt.Errorf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+Since PassthroughArgs is specified, Children cannot be specified.
+All args are passed to the Runner, so the children are unreachable.`, cmdPath())
 	case hasC && hasR && (cmd.ArgsName != "" || cmd.ArgsLong != ""):
 		return fmt.Errorf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
 
 Since both Children and Runner are specified, the Runner cannot take args.
-Otherwise a conflict between child names and runner args is possible.`, cmdPath)
+Otherwise a conflict between child names and runner args is possible.`, cmdPath())
 	}
 	// Check recursively for all children
 	for _, child := range cmd.Children {
@@ -339,6 +1180,154 @@ Otherwise a conflict between child names and runner args is possible.`, cmdPath)
 	return nil
 }
 
+// checkTopicInvariants checks that the sub-topics of the topic with the given
+// path have non-empty and unique names, recursively.
+func checkTopicInvariants(topicPath string, topics []Topic) error {
+	seen := make(map[string]bool)
+	for _, topic := range topics {
+		if topic.Name == "" {
+			return fmt.Errorf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+Topic names cannot be empty.`, topicPath)
+		}
+		if seen[topic.Name] {
+			return fmt.Errorf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+Each topic must have unique sub-topic names.
+Saw %q multiple times.`, topicPath, topic.Name)
+		}
+		seen[topic.Name] = true
+		if err := checkTopicInvariants(topicPath+" "+topic.Name, topic.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchName returns true iff arg matches the name of a command or topic in the
+// tree rooted at root, ignoring case if root.CaseInsensitive is set.
+func matchName(root *Command, name, arg string) bool {
+	return name == arg || root.CaseInsensitive && strings.EqualFold(name, arg)
+}
+
+// findChild returns the child of cmd whose name matches arg, or nil if there's
+// no match.  Exact matches are preferred over matches that ignore case.
+func findChild(root, cmd *Command, arg string) *Command {
+	children := cmd.Children
+	if i := lookupName(root, cmd.childIndex, len(children), func(i int) string { return children[i].Name }, arg); i >= 0 {
+		return children[i]
+	}
+	return nil
+}
+
+// findTopic returns the topic whose name matches arg, and true, or false if
+// there's no match.  Exact matches are preferred over matches that ignore case.
+func findTopic(root *Command, topics []Topic, arg string) (Topic, bool) {
+	if i := scanNames(root, len(topics), func(i int) string { return topics[i].Name }, arg); i >= 0 {
+		return topics[i], true
+	}
+	return Topic{}, false
+}
+
+// findCmdTopic is like findTopic, for the topics of cmd.
+func findCmdTopic(root, cmd *Command, arg string) (Topic, bool) {
+	topics := cmd.Topics
+	if i := lookupName(root, cmd.topicIndex, len(topics), func(i int) string { return topics[i].Name }, arg); i >= 0 {
+		return topics[i], true
+	}
+	return Topic{}, false
+}
+
+// minIndexedNames is the number of children or topics at which lookups use a
+// nameIndex; scanning fewer is faster than hashing.
+const minIndexedNames = 16
+
+// nameIndex maps the names of the children or topics of a command to their
+// position, so that commands with many of them are resolved in constant time.
+// It's built by cleanNames and cleanTree, which every parse and help output
+// call first, and only read by lookups, so changes to the tree are picked up
+// by the next parse.  It's rebuilt only if the names have changed.
+type nameIndex struct {
+	names  []string       // The names when the index was built.
+	exact  map[string]int // Position of the first of each name.
+	folded map[string]int // Position of the first name with each foldKey.
+}
+
+// indexNames returns ix if it indexes the n names returned by name, or else a
+// new index of them, or nil if there are too few names to index.
+func indexNames(ix *nameIndex, n int, name func(int) string) *nameIndex {
+	if n < minIndexedNames {
+		return nil
+	}
+	if ix != nil && len(ix.names) == n {
+		same := true
+		for i := 0; i < n && same; i++ {
+			same = ix.names[i] == name(i)
+		}
+		if same {
+			return ix
+		}
+	}
+	ix = &nameIndex{names: make([]string, n), exact: make(map[string]int, n), folded: make(map[string]int, n)}
+	for i := n - 1; i >= 0; i-- {
+		ix.names[i] = name(i)
+		ix.exact[ix.names[i]] = i
+		ix.folded[foldKey(ix.names[i])] = i
+	}
+	return ix
+}
+
+// foldKey returns s with each rune replaced by the smallest rune it's equal to
+// under simple case folding, so that foldKey(a) == foldKey(b) iff
+// strings.EqualFold(a, b).
+func foldKey(s string) string {
+	return strings.Map(func(r rune) rune {
+		min := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
+		}
+		return min
+	}, s)
+}
+
+// lookupName returns the position of the name that matches arg among the n
+// names returned by name, or -1 if there's no match, in the same way as
+// scanNames.  The index, if any, is authoritative, unless the number of names
+// has changed since it was built.
+func lookupName(root *Command, index *nameIndex, n int, name func(int) string, arg string) int {
+	if index == nil || len(index.names) != n {
+		return scanNames(root, n, name, arg)
+	}
+	if i, ok := index.exact[arg]; ok {
+		return i
+	}
+	if root.CaseInsensitive {
+		if i, ok := index.folded[foldKey(arg)]; ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// scanNames returns the position of the first of the n names returned by name
+// that is arg, or failing that, the first that matches arg via matchName, or -1
+// if there's no match.
+func scanNames(root *Command, n int, name func(int) string, arg string) int {
+	for i := 0; i < n; i++ {
+		if name(i) == arg {
+			return i
+		}
+	}
+	for i := 0; i < n; i++ {
+		if matchName(root, name(i), arg) {
+			return i
+		}
+	}
+	return -1
+}
+
 func pathName(prefix string, path []*Command) string {
 	name := prefix
 	for _, cmd := range path {
@@ -353,41 +1342,83 @@ func pathName(prefix string, path []*Command) string {
 func (cmd *Command) parse(path []*Command, env *Env, args []string, setFlags map[string]string) (Runner, []string, error) {
 	path = append(path, cmd)
 	cmdPath := pathName(env.prefix(), path)
+	// The flags set on the command line are added to setFlags as the path is
+	// parsed, for FlagSource.
+	cmd.cmdLineFlags = setFlags
+	// Define the flags of FlagsFunc before checking them; they're parsed below.
+	cmd.flags()
+	if err := checkFlagShadow(path, env); err != nil {
+		return nil, nil, err
+	}
 	runHelp := makeHelpRunner(path, env)
-	env.Usage = runHelp.usageFunc
+	env.Usage, env.path = runHelp.usageFunc, path
+	for _, secret := range cmd.secretEnvFlags {
+		if value, ok := env.Vars[secret.envVar]; ok {
+			*secret.p = value
+		}
+	}
+	if cmd.PreParse != nil {
+		var err error
+		if args, err = cmd.PreParse(args); err != nil {
+			return nil, nil, cmdErrorf(env, BadArgs, path, cmdPath, env.Usage, "%v", err)
+		}
+	}
+	if cmd.PassthroughArgs {
+		// Parse no flags, so that the flags still get their default values, and
+		// hand all args to the runner verbatim.
+		if _, _, err := parseFlags(path, env, nil); err != nil {
+			return nil, nil, cmdErrorf(env, FlagParse, path, cmdPath, env.Usage, "%v", err)
+		}
+		return cmd.Runner, args, nil
+	}
 	// Parse flags and retrieve the args remaining after the parse, as well as the
 	// flags that were set.
-	args, setF, err := parseFlags(path, env, args)
+	flagArgs, setF, err := parseFlags(path, env, args)
 	switch {
 	case err == flag.ErrHelp:
 		return runHelp, nil, nil
+	case err != nil && isDescribeFlag(path[0], err):
+		return describeRunner{path}, nil, nil
 	case err != nil:
-		return nil, nil, env.UsageErrorf("%s: %v", cmdPath, err)
+		if cmd.FlagParseErrorFunc != nil && cmd.Runner != nil {
+			if err = cmd.FlagParseErrorFunc(cmd, err, args); err == nil {
+				return cmd.Runner, args, nil
+			}
+		}
+		return nil, nil, cmdErrorf(env, FlagParse, path, cmdPath, env.Usage, "%v", siblingFlagHint(env, path, err))
 	}
+	args = flagArgs
 	for key, val := range setF {
 		setFlags[key] = val
 	}
 	// First handle the no-args case.
 	if len(args) == 0 {
 		if cmd.Runner != nil {
+			if err := postParse(env, path, nil); err != nil {
+				return nil, nil, err
+			}
 			return cmd.Runner, nil, nil
 		}
-		return nil, nil, env.UsageErrorf("%s: no command specified", cmdPath)
+		return nil, nil, cmdErrorf(env, Structural, path, cmdPath, env.Usage, "no command specified")
 	}
 	// INVARIANT: len(args) > 0
 	// Look for matching children.
 	subName, subArgs := args[0], args[1:]
 	if len(cmd.Children) > 0 {
-		for _, child := range cmd.Children {
-			if child.Name == subName {
-				return child.parse(path, env, subArgs, setFlags)
-			}
+		if child := findChild(path[0], cmd, subName); child != nil {
+			return child.parse(path, env, subArgs, setFlags)
 		}
 		// Every non-leaf command gets a default help command.
-		if helpName == subName {
+		if name := helpCommandName(path); name != "" && matchName(path[0], name, subName) {
 			return runHelp.newCommand().parse(path, env, subArgs, setFlags)
 		}
 	}
+	if name := path[0].DumpFlagsCommandName; name != "" && matchName(path[0], name, subName) {
+		if len(subArgs) > 0 {
+			return nil, nil, cmdErrorf(env, BadArgs, path, cmdPath, env.Usage, "%s doesn't take arguments", name)
+		}
+		return dumpFlagsRunner{path}, nil, nil
+	}
 	if cmd.LookPath {
 		// Look for a matching executable in PATH.
 		if subCmd, _ := env.LookPath(cmd.Name + "-" + subName); subCmd != "" {
@@ -397,40 +1428,80 @@ func (cmd *Command) parse(path []*Command, env *Env, args []string, setFlags map
 	}
 	// No matching subcommands, check various error cases.
 	switch {
-	case cmd.Runner == nil:
-		return nil, nil, env.UsageErrorf("%s: unknown command %q", cmdPath, subName)
+	case cmd.Runner == nil, cmd.ArgsName == "" && len(cmd.Children) > 0:
+		unknown := &UnknownCommandError{Parent: cmd, Name: subName, Args: subArgs}
+		return nil, nil, cmdErrorf(env, UnknownCommand, path, cmdPath, env.Usage, "%w", unknown)
 	case cmd.ArgsName == "":
-		if len(cmd.Children) > 0 {
-			return nil, nil, env.UsageErrorf("%s: unknown command %q", cmdPath, subName)
-		}
-		return nil, nil, env.UsageErrorf("%s: doesn't take arguments", cmdPath)
+		return nil, nil, cmdErrorf(env, BadArgs, path, cmdPath, env.Usage, "doesn't take arguments")
 	case reflect.DeepEqual(args, []string{helpName, "..."}):
-		return nil, nil, env.UsageErrorf("%s: unsupported help invocation", cmdPath)
+		return nil, nil, cmdErrorf(env, BadArgs, path, cmdPath, env.Usage, "unsupported help invocation")
 	}
 	// INVARIANT:
 	// cmd.Runner != nil && len(args) > 0 &&
 	// cmd.ArgsName != "" && args != []string{"help", "..."}
+	if err := postParse(env, path, args); err != nil {
+		return nil, nil, err
+	}
 	return cmd.Runner, args, nil
 }
 
+// postParse calls PostParse on the last command in path, if it's set, and
+// returns a usage error that reports all of the problems it finds.
+func postParse(env *Env, path []*Command, args []string) error {
+	cmd, cmdPath := path[len(path)-1], pathName(env.prefix(), path)
+	if cmd.PostParse == nil {
+		return nil
+	}
+	errs := cmd.PostParse(args)
+	if len(errs) == 0 {
+		return nil
+	}
+	var usageErr *UsageError
+	if len(errs) == 1 {
+		usageErr = cmdErrorf(env, BadArgs, path, cmdPath, env.Usage, "%v", errs[0])
+	} else {
+		usageErr = cmdErrorf(env, BadArgs, path, cmdPath, env.Usage, "invalid usage:%v", errorList(errs))
+	}
+	usageErr.Errs = errs
+	return usageErr
+}
+
+// errorList is a list of errors, formatted with one error per line.
+type errorList []error
+
+func (e errorList) Error() string {
+	var list string
+	for _, err := range e {
+		list += "\n - " + err.Error()
+	}
+	return list
+}
+
+func (e errorList) Unwrap() []error { return e }
+
 // parseFlags parses the flags from args for the command with the given path and
 // env.  Returns the remaining non-flag args and the flags that were set.
 func parseFlags(path []*Command, env *Env, args []string) ([]string, map[string]string, error) {
-	cmd, isRoot := path[len(path)-1], len(path) == 1
+	cmd, isRoot := path[len(path)-1], len(path) == 1 && env.resolved == nil
 	// Parse the merged command-specific and global flags.
 	var flags *flag.FlagSet
-	if isRoot {
+	switch {
+	case isRoot:
 		// The root command is special, due to the pitfall described above in the
 		// package doc.  Merge into flag.CommandLine and use that for parsing.  This
 		// ensures that subsequent calls to flag.Parsed will return true, so the
 		// user can check whether flags have already been parsed.  Global flags take
 		// precedence over command flags for the root command.
 		flags = flag.CommandLine
-		mergeFlags(flags, &cmd.Flags)
-	} else {
+		mergeFlags(flags, cmd.flags())
+	case env.resolved != nil:
+		// The global flags have already been parsed by the caller of
+		// ExecuteResolved.
+		flags = pathFlags(path)
+	default:
 		// Command flags take precedence over global flags for non-root commands.
 		flags = pathFlags(path)
-		mergeFlags(flags, globalFlags)
+		mergeFlags(flags, rootGlobalFlags(path[0]))
 	}
 	// Silence the many different ways flags.Parse can produce ugly output; we
 	// just want it to return any errors and handle the output ourselves.
@@ -450,13 +1521,137 @@ func parseFlags(path []*Command, env *Env, args []string) ([]string, map[string]
 			flags.Usage = func() { env.Usage(env, env.Stderr) }
 		}()
 	}
+	if isRoot && cmd.GlobalFlagFilter != nil {
+		// The root command parses all of flag.CommandLine, so first check the args
+		// against the flags without those excluded by the filter.
+		if err := checkExcludedFlags(flags, cmd.GlobalFlagFilter, args); err != nil {
+			if isDescribeFlag(cmd, err) {
+				// No flags are set while describing, but flag.Parsed should still
+				// return true, as for -help.
+				flags.Parse(nil)
+			}
+			return nil, nil, err
+		}
+	}
 	if err := flags.Parse(args); err != nil {
-		return nil, nil, err
+		return nil, nil, flagValueError(flags, err)
 	}
 	cmd.ParsedFlags = flags
 	return flags.Args(), extractSetFlags(flags), nil
 }
 
+// flagValueErrorRE matches the error returned by flag.FlagSet.Parse for an
+// invalid value of one of the standard flag types, which hides the reason that
+// the value is invalid.
+var flagValueErrorRE = regexp.MustCompile(`^invalid (?:boolean )?value ("(?:[^"\\]|\\.)*") for (?:flag )?-(.+): parse error$`)
+
+// flagValueError returns err, the error returned by parsing flags, with the
+// generic "parse error" reason for an invalid flag value replaced by the reason
+// the value couldn't be parsed; e.g. the error from time.ParseDuration.  Other
+// errors are returned unchanged.
+func flagValueError(flags *flag.FlagSet, err error) error {
+	match := flagValueErrorRE.FindStringSubmatch(err.Error())
+	if match == nil {
+		return err
+	}
+	value, uerr := strconv.Unquote(match[1])
+	f := flags.Lookup(match[2])
+	if uerr != nil || f == nil {
+		return err
+	}
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return err
+	}
+	// Re-parse the value in the same way as the flag package, without setting
+	// the flag, to find the reason.
+	var reason error
+	switch getter.Get().(type) {
+	case bool:
+		_, reason = strconv.ParseBool(value)
+	case int:
+		_, reason = strconv.ParseInt(value, 0, strconv.IntSize)
+	case int64:
+		_, reason = strconv.ParseInt(value, 0, 64)
+	case uint:
+		_, reason = strconv.ParseUint(value, 0, strconv.IntSize)
+	case uint64:
+		_, reason = strconv.ParseUint(value, 0, 64)
+	case float64:
+		_, reason = strconv.ParseFloat(value, 64)
+	case time.Duration:
+		_, reason = time.ParseDuration(value)
+	}
+	var numErr *strconv.NumError
+	if errors.As(reason, &numErr) {
+		// The value and the function are redundant with the rest of the message.
+		reason = numErr.Err
+	}
+	if reason == nil {
+		return err
+	}
+	return fmt.Errorf("%s%w", strings.TrimSuffix(err.Error(), "parse error"), reason)
+}
+
+// undefinedFlagPrefix is the prefix of the error returned by flag.FlagSet.Parse
+// for a flag that isn't defined.
+const undefinedFlagPrefix = "flag provided but not defined: -"
+
+// siblingFlagHint returns err, the error returned by parsing flags for the last
+// command in path, with a hint attached if the flag is undefined, but is
+// defined by exactly one sibling of the command; e.g. when the user ran the
+// wrong variant of a command.  Other errors are returned unchanged.
+func siblingFlagHint(env *Env, path []*Command, err error) error {
+	if len(path) < 2 || !strings.HasPrefix(err.Error(), undefinedFlagPrefix) {
+		return err
+	}
+	name := strings.TrimPrefix(err.Error(), undefinedFlagPrefix)
+	cmd, parent := path[len(path)-1], path[len(path)-2]
+	var match *Command
+	for _, sibling := range parent.Children {
+		if sibling == cmd || sibling.flags().Lookup(name) == nil {
+			continue
+		}
+		if match != nil {
+			return err
+		}
+		match = sibling
+	}
+	if match == nil {
+		return err
+	}
+	siblingPath := append(path[:len(path)-1:len(path)-1], match)
+	return WithHint(err, fmt.Sprintf("Did you mean %q?", pathName(env.prefix(), siblingPath)+" -"+name))
+}
+
+// checkExcludedFlags returns an error if args set any of the global flags in
+// flags that are excluded by filter, without setting the values of any flags.
+// The error is the same as the flag package returns for undefined flags.
+func checkExcludedFlags(flags *flag.FlagSet, filter func(string) bool, args []string) error {
+	check := flag.NewFlagSet("", flag.ContinueOnError)
+	check.SetOutput(ioutil.Discard)
+	flags.VisitAll(func(f *flag.Flag) {
+		if globalFlags.Lookup(f.Name) == nil || filter(f.Name) {
+			b, ok := f.Value.(interface{ IsBoolFlag() bool })
+			check.Var(discardValue{ok && b.IsBoolFlag()}, f.Name, f.Usage)
+		}
+	})
+	if err := check.Parse(args); err != nil && err != flag.ErrHelp {
+		return err
+	}
+	return nil
+}
+
+// discardValue is a flag.Value that discards the values it is set to, and
+// reports whether it is a bool flag, so that args are parsed the same way.
+type discardValue struct {
+	isBool bool
+}
+
+func (v discardValue) String() string   { return "" }
+func (v discardValue) Set(string) error { return nil }
+func (v discardValue) IsBoolFlag() bool { return v.isBool }
+
 func mergeFlags(dst, src *flag.FlagSet) {
 	src.VisitAll(func(f *flag.Flag) {
 		// If there is a collision in flag names, the existing flag in dst wins.
@@ -478,15 +1673,15 @@ func copyFlags(flags *flag.FlagSet) *flag.FlagSet {
 // path.  Flags defined on ancestors are also allowed, except on "help".
 func pathFlags(path []*Command) *flag.FlagSet {
 	cmd := path[len(path)-1]
-	flags := copyFlags(&cmd.Flags)
-	if cmd.Name != helpName && !cmd.DontInheritFlags {
+	flags := copyFlags(cmd.flags())
+	if cmd.Name != helpCommandName(path) && !cmd.DontInheritFlags {
 		// Walk backwards to merge flags up to the root command.  If this takes too
 		// long, we could consider memoizing previous results.
 		for p := len(path) - 2; p >= 0; p-- {
 			if path[p].DontPropagateFlags {
 				break
 			}
-			mergeFlags(flags, &path[p].Flags)
+			mergeFlags(flags, path[p].flags())
 			if path[p].DontInheritFlags {
 				break
 			}
@@ -495,6 +1690,44 @@ func pathFlags(path []*Command) *flag.FlagSet {
 	return flags
 }
 
+// visibleFlags returns a copy of flags, without the flags hidden via HideFlag on
+// any command in path.
+func visibleFlags(flags *flag.FlagSet, path []*Command) *flag.FlagSet {
+	visible, hidden := new(flag.FlagSet), hiddenFlags(path)
+	flags.VisitAll(func(f *flag.Flag) {
+		if hidden[f.Name] {
+			return
+		}
+		visible.Var(f.Value, f.Name, f.Usage)
+		visible.Lookup(f.Name).DefValue = f.DefValue
+	})
+	return visible
+}
+
+// flags returns the flags defined for cmd, calling FlagsFunc the first time.
+func (cmd *Command) flags() *flag.FlagSet {
+	if cmd.FlagsFunc != nil && !cmd.flagsFuncCalled {
+		cmd.flagsFuncCalled = true
+		fs := new(flag.FlagSet)
+		cmd.FlagsFunc(fs)
+		cleanFlags(fs)
+		mergeFlags(&cmd.Flags, fs)
+	}
+	return &cmd.Flags
+}
+
+// hiddenFlags returns the names of the flags hidden via HideFlag on any command
+// in path, so that each flag is checked in constant time.
+func hiddenFlags(path []*Command) map[string]bool {
+	hidden := make(map[string]bool)
+	for _, cmd := range path {
+		for _, name := range cmd.hiddenFlags {
+			hidden[name] = true
+		}
+	}
+	return hidden
+}
+
 func extractSetFlags(flags *flag.FlagSet) map[string]string {
 	// Use FlagSet.Visit rather than VisitAll to restrict to flags that are set.
 	setFlags := make(map[string]string)
@@ -514,9 +1747,10 @@ func flagsAsArgs(x map[string]string) []string {
 }
 
 // subNames returns the sub names of c which should be ignored when using look
-// path to find external binaries.
-func (c *Command) subNames(prefix string) map[string]bool {
-	m := map[string]bool{prefix + "help": true}
+// path to find external binaries.  The help command name is passed in, since
+// it's configured on the root command.
+func (c *Command) subNames(prefix, helpName string) map[string]bool {
+	m := map[string]bool{prefix + helpName: true}
 	for _, child := range c.Children {
 		m[prefix+child.Name] = true
 	}
@@ -533,28 +1767,215 @@ func (x ErrExitCode) Error() string {
 }
 
 // ErrUsage indicates an error in command usage; e.g. unknown flags, subcommands
-// or args.  It corresponds to exit code 2.
+// or args.  It corresponds to exit code 2.  Usage errors are returned as a
+// *UsageError that wraps ErrUsage; use errors.Is(err, ErrUsage) to check for
+// them.
 const ErrUsage = ErrExitCode(2)
 
+// UsageErrorKind describes the kind of a usage error.
+type UsageErrorKind int
+
+const (
+	// BadArgs indicates invalid args, including errors reported via
+	// Env.UsageErrorf and PreParse.
+	BadArgs UsageErrorKind = iota
+	// UnknownCommand indicates that a command name didn't match any children.
+	UnknownCommand
+	// UnknownTopic indicates that the help command was given a name that didn't
+	// match any command or topic.
+	UnknownTopic
+	// FlagParse indicates that the flags couldn't be parsed.
+	FlagParse
+	// Structural indicates that no command was specified for a command that has
+	// children but no Runner.
+	Structural
+)
+
+func (k UsageErrorKind) String() string {
+	switch k {
+	case BadArgs:
+		return "BadArgs"
+	case UnknownCommand:
+		return "UnknownCommand"
+	case UnknownTopic:
+		return "UnknownTopic"
+	case FlagParse:
+		return "FlagParse"
+	case Structural:
+		return "Structural"
+	}
+	return fmt.Sprintf("UsageErrorKind(%d)", int(k))
+}
+
+// UsageError is the error returned for usage errors, after the message and the
+// usage of the command have been printed.  Use errors.As to retrieve it.
+//
+// Since a UsageError has already been reported, nothing is printed for usage
+// errors that are formatted from an error wrapping a UsageError; e.g. when a
+// Runner calls ParseAndRun for another command, and returns the result of
+// Env.UsageErrorf with the error.  Main and ParseAndRun never print errors
+// wrapping a UsageError either, so the usage is printed exactly once.
+type UsageError struct {
+	Cmd     *Command       // Command whose usage was printed, or nil if unknown.
+	CmdPath string         // Path of Cmd; e.g. "prog sub".
+	Message string         // Formatted error message, without the "ERROR: " label.
+	Kind    UsageErrorKind // Kind of the error.
+	Errs    []error        // Errors wrapped via %w, or returned by PostParse.
+}
+
+// Error implements the error interface method.
+func (e *UsageError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns ErrUsage followed by Errs, so that errors.Is(err, ErrUsage) is
+// true, and errors.Is and errors.As also match each of Errs.
+func (e *UsageError) Unwrap() []error {
+	return append([]error{ErrUsage}, e.Errs...)
+}
+
+// UnknownCommandError describes a command name that doesn't match any child of
+// the Parent command.  Usage errors of kind UnknownCommand returned by Parse
+// wrap it; use errors.As to retrieve it.
+type UnknownCommandError struct {
+	Parent *Command // Command whose children were searched.
+	Name   string   // Name of the unknown command.
+	Args   []string // Args following the name.
+}
+
+// Error implements the error interface method.
+func (e *UnknownCommandError) Error() string {
+	return fmt.Sprintf("unknown command %q", e.Name)
+}
+
+// UnknownTopicError describes a name passed to the help command that doesn't
+// match any child or topic of the Parent command, or any sub-topic of the
+// Topic of the Parent command if it's non-empty.  Usage errors of kind
+// UnknownTopic returned by the help command wrap it; use errors.As to retrieve
+// it.
+type UnknownTopicError struct {
+	Parent *Command // Command whose children and topics were searched.
+	Topic  string   // Topic whose sub-topics were searched, if non-empty.
+	Name   string   // Name of the unknown command or topic.
+	Args   []string // Args following the name.
+}
+
+// Error implements the error interface method.
+func (e *UnknownTopicError) Error() string {
+	return fmt.Sprintf("unknown command or topic %q", e.Name)
+}
+
 // ExitCode returns the exit code corresponding to err.
 //   0:    if err == nil
-//   code: if err is ErrExitCode(code)
+//   code: if err is or wraps ErrExitCode(code), including *UsageError
 //   1:    all other errors
-// Writes the error message for "all other errors" to w, if w is non-nil.
+// Writes the error message for "all other errors" to w, if w is non-nil,
+// followed by the hints attached to err via WithHint, unless err was already
+// printed by ParseAndRun, based on PrintRunErrors.  The environment of the
+// process is used as for Main; e.g. the label is colored only if w is a
+// terminal, and neither NO_COLOR nor TERM=dumb is set.
 func ExitCode(err error, w io.Writer) int {
+	return exitCode(err, w, &Env{Vars: envvar.SliceToMap(os.Environ())})
+}
+
+// exitCode implements ExitCode, where the error label and width of the hints
+// are taken from env.
+func exitCode(err error, w io.Writer, env *Env) int {
 	if err == nil {
 		return 0
 	}
-	if code, ok := err.(ErrExitCode); ok {
+	var code ErrExitCode
+	if errors.As(err, &code) {
 		return int(code)
 	}
-	if w != nil {
+	var printed *printedError
+	if w != nil && !errors.As(err, &printed) {
 		// We don't print "ERROR: exit code N" above to avoid cluttering the output.
-		fmt.Fprintf(w, "ERROR: %v\n", err)
+		fmt.Fprintf(w, "%s %v\n", env.errorLabelFor(w), err)
+		printHints(w, env.outputWidth(w), errorHints(err))
 	}
 	return 1
 }
 
+// WithHint returns an error that wraps err with a hint, which suggests how to
+// fix the error.  Hints are printed on indented lines under the error message,
+// for both usage errors and errors returned by Runner.Run, in the order they
+// were added; call WithHint multiple times to attach multiple hints.  The
+// Error method of the returned error is the same as err, and errors.Is and
+// errors.As see through the wrapper.  Returns nil if err is nil.
+//
+// Usage errors pick up the hints of errors passed as arguments to
+// Env.UsageErrorf, and of errors returned by PreParse, PostParse and
+// FlagParseErrorFunc.
+func WithHint(err error, hint string) error {
+	if err == nil {
+		return nil
+	}
+	return &hintError{err, hint}
+}
+
+// hintError is the error returned by WithHint.
+type hintError struct {
+	err  error
+	hint string
+}
+
+func (e *hintError) Error() string { return e.err.Error() }
+func (e *hintError) Unwrap() error { return e.err }
+
+// errorHints returns the hints attached to err and the errors it wraps, in the
+// order they were added.
+func errorHints(err error) []string {
+	switch e := err.(type) {
+	case *hintError:
+		return append(errorHints(e.err), e.hint)
+	case interface{ Unwrap() error }:
+		return errorHints(e.Unwrap())
+	case interface{ Unwrap() []error }:
+		var hints []string
+		for _, err := range e.Unwrap() {
+			hints = append(hints, errorHints(err)...)
+		}
+		return hints
+	}
+	return nil
+}
+
+// printHints prints each hint on its own line, indented and wrapped to width.
+func printHints(w io.Writer, width int, hints []string) {
+	if len(hints) == 0 {
+		return
+	}
+	ww := textutil.NewUTF8WrapWriter(w, width)
+	ww.SetIndents(spaces(3))
+	for _, hint := range hints {
+		fmt.Fprintln(ww, hint)
+		ww.Flush()
+	}
+}
+
+// retryRunner is a Runner that re-runs the Runner of cmd while it returns
+// transient errors, based on cmd.RetryFunc and cmd.MaxRetries.
+type retryRunner struct {
+	cmd    *Command
+	runner Runner
+}
+
+func (r retryRunner) Run(env *Env, args []string) error {
+	err := r.runner.Run(env, args)
+	for retry := 1; retry <= r.cmd.MaxRetries && err != nil; retry++ {
+		var usageErr *UsageError
+		if errors.As(err, &usageErr) || !r.cmd.RetryFunc(err) {
+			break
+		}
+		if r.cmd.RetryBackoff != nil {
+			time.Sleep(r.cmd.RetryBackoff(retry))
+		}
+		err = r.runner.Run(env, args)
+	}
+	return err
+}
+
 type binaryRunner struct {
 	subCmd  string
 	cmdPath string
@@ -565,6 +1986,10 @@ func (b binaryRunner) Run(env *Env, args []string) error {
 	defer env.TimerPop()
 	vars := envvar.CopyMap(env.Vars)
 	vars["CMDLINE_PREFIX"] = b.cmdPath
+	if env.root != nil && env.root.Width != 0 {
+		// Pass the width set by the program on to the external child.
+		vars["CMDLINE_WIDTH"] = strconv.Itoa(env.root.Width)
+	}
 	cmd := exec.Command(b.subCmd, args...)
 	cmd.Stdin = env.Stdin
 	cmd.Stdout = env.Stdout
@@ -6,9 +6,12 @@ package cmdline
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -18,6 +21,8 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"v.io/x/lib/envvar"
 )
@@ -76,13 +81,8 @@ type testCase struct {
 	Stderr      string
 	GlobalFlag1 string
 	GlobalFlag2 int64
-}
-
-func stripTestFlags(got string) string {
-	// The global flags include the flags from the testing package, so strip them
-	// out before the comparison.
-	re := regexp.MustCompile(" -test[^\n]+\n(?:   [^\n]+\n)+")
-	return re.ReplaceAllLiteralString(got, "")
+	// Run without Env.Deterministic; e.g. when faking isTerminal.
+	NonDeterministic bool
 }
 
 func errString(err error) string {
@@ -92,11 +92,46 @@ func errString(err error) string {
 	return fmt.Sprint(err)
 }
 
+// errMatches returns true iff err matches want, which is either errUsageStr for
+// usage errors, or the error string.
+func errMatches(err error, want string) bool {
+	if want == errUsageStr {
+		return errors.Is(err, ErrUsage)
+	}
+	return errString(err) == want
+}
+
 var baseVars = map[string]string{
 	"CMDLINE_WIDTH": "80", // make sure formatting stays the same.
 }
 
+// notTestFlag excludes the flags of the testing package from the global flags,
+// which are registered on flag.CommandLine when running tests.
+func notTestFlag(name string) bool {
+	return !strings.HasPrefix(name, "test.")
+}
+
+// isolateGlobalFlags gives the test a fresh flag.CommandLine with the global
+// flags defined by runTestCases, and clears the snapshots of the global flags so
+// that the next parse takes them from it.  Both are restored when the test
+// finishes.  Tests that parse outside of runTestCases call it first, so that
+// they neither depend on nor leak into the global flags seen by other tests,
+// whatever order the tests run in.
+func isolateGlobalFlags(t *testing.T) {
+	savedGlobal, savedIsolated, savedCommandLine := globalFlags, isolatedGlobalFlags, flag.CommandLine
+	t.Cleanup(func() {
+		globalFlags, isolatedGlobalFlags, flag.CommandLine = savedGlobal, savedIsolated, savedCommandLine
+	})
+	globalFlags, isolatedGlobalFlags = nil, nil
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	flag.String("global1", "", "global test flag 1")
+	flag.Int64("global2", 0, "global test flag 2")
+}
+
 func runTestCases(t *testing.T, cmd *Command, tests []testCase) {
+	if cmd.GlobalFlagFilter == nil {
+		cmd.GlobalFlagFilter = notTestFlag
+	}
 	for _, test := range tests {
 		// Reset global variables before running each test case.
 		var stdout, stderr bytes.Buffer
@@ -114,22 +149,23 @@ func runTestCases(t *testing.T, cmd *Command, tests []testCase) {
 		// Parse and run the command and check against expected results.
 		parseOK := false
 		env := &Env{
-			Stdout: &stdout,
-			Stderr: &stderr,
-			Vars:   envvar.MergeMaps(baseVars, test.Vars),
+			Stdout:        &stdout,
+			Stderr:        &stderr,
+			Vars:          envvar.MergeMaps(baseVars, test.Vars),
+			Deterministic: !test.NonDeterministic,
 		}
 		runner, args, err := Parse(cmd, env, test.Args)
 		if err == nil {
 			err = runner.Run(env, args)
 			parseOK = true
 		}
-		if got, want := errString(err), test.Err; got != want {
+		if got, want := errString(err), test.Err; !errMatches(err, want) {
 			t.Errorf("Ran with args %q vars %q\n GOT error:\n%q\nWANT error:\n%q", test.Args, test.Vars, got, want)
 		}
-		if got, want := stripTestFlags(stdout.String()), test.Stdout; got != want {
+		if got, want := stdout.String(), test.Stdout; got != want {
 			t.Errorf("Ran with args %q vars %q\n GOT stdout:\n%q\nWANT stdout:\n%q", test.Args, test.Vars, got, want)
 		}
-		if got, want := stripTestFlags(stderr.String()), test.Stderr; got != want {
+		if got, want := stderr.String(), test.Stderr; got != want {
 			t.Errorf("Ran with args %q vars %q\n GOT stderr:\n%q\nWANT stderr:\n%q", test.Args, test.Vars, got, want)
 		}
 		if got, want := globalFlag1, test.GlobalFlag1; got != want {
@@ -462,17 +498,30 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The cmdrun help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
  -style=compact
    The formatting style for help output:
-      compact   - Good for compact cmdline output.
-      full      - Good for cmdline output, shows all global flags.
-      godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
-   Format output to this target width in runes, or unlimited if width < 0.
-   Defaults to the terminal width if available.  Override the default by setting
-   the CMDLINE_WIDTH environment variable.
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
 `,
 		},
 		{
@@ -641,17 +690,30 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The onecmd help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
  -style=compact
    The formatting style for help output:
-      compact   - Good for compact cmdline output.
-      full      - Good for cmdline output, shows all global flags.
-      godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
-   Format output to this target width in runes, or unlimited if width < 0.
-   Defaults to the terminal width if available.  Override the default by setting
-   the CMDLINE_WIDTH environment variable.
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
 
 The global flags are:
  -global1=
@@ -701,17 +763,30 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The onecmd help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
  -style=compact
    The formatting style for help output:
-      compact   - Good for compact cmdline output.
-      full      - Good for cmdline output, shows all global flags.
-      godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
-   Format output to this target width in runes, or unlimited if width < 0.
-   Defaults to the terminal width if available.  Override the default by setting
-   the CMDLINE_WIDTH environment variable.
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
 `,
 		},
 		{
@@ -915,17 +990,30 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The multi help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
  -style=compact
    The formatting style for help output:
-      compact   - Good for compact cmdline output.
-      full      - Good for cmdline output, shows all global flags.
-      godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
-   Format output to this target width in runes, or unlimited if width < 0.
-   Defaults to the terminal width if available.  Override the default by setting
-   the CMDLINE_WIDTH environment variable.
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
 `,
 		},
 		{
@@ -1039,6 +1127,17 @@ The global flags are:
 			GlobalFlag1: "globalStringOtherValue",
 			GlobalFlag2: 43,
 		},
+		{
+			Args:        []string{"-global2", "42", "echoopt", "-n", "foo", "bar"},
+			Stdout:      "[foo bar]",
+			GlobalFlag2: 42,
+		},
+		{
+			Args:        []string{"-global1", "globalStringOtherValue", "-global2", "43", "-extra", "echoopt", "-n", "foo", "bar"},
+			Stdout:      "[foo bar extra]",
+			GlobalFlag1: "globalStringOtherValue",
+			GlobalFlag2: 43,
+		},
 		{
 			Args: []string{"echoopt", "error"},
 			Err:  errEchoStr,
@@ -1047,6 +1146,7 @@ The global flags are:
 			Args: []string{"echo", "-n", "foo", "bar"},
 			Err:  errUsageStr,
 			Stderr: `ERROR: multi echo: flag provided but not defined: -n
+   Did you mean "multi echoopt -n"?
 
 Echo prints any strings passed in to stdout.
 
@@ -1316,17 +1416,30 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The toplevelprog help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
  -style=compact
    The formatting style for help output:
-      compact   - Good for compact cmdline output.
-      full      - Good for cmdline output, shows all global flags.
-      godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
-   Format output to this target width in runes, or unlimited if width < 0.
-   Defaults to the terminal width if available.  Override the default by setting
-   the CMDLINE_WIDTH environment variable.
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
 ================================================================================
 Toplevelprog topic1 - Help topic 1 short
 
@@ -1446,17 +1559,30 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The toplevelprog echoprog help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
  -style=compact
    The formatting style for help output:
-      compact   - Good for compact cmdline output.
-      full      - Good for cmdline output, shows all global flags.
-      godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
-   Format output to this target width in runes, or unlimited if width < 0.
-   Defaults to the terminal width if available.  Override the default by setting
-   the CMDLINE_WIDTH environment variable.
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
 ================================================================================
 Toplevelprog echoprog topic3 - Help topic 3 short
 
@@ -1593,6 +1719,7 @@ The global flags are:
 			Args: []string{"hello", "--extra", "foo", "bar"},
 			Err:  errUsageStr,
 			Stderr: `ERROR: toplevelprog hello: flag provided but not defined: -extra
+   Did you mean "toplevelprog echoprog -extra"?
 
 Hello prints any strings passed in to stdout preceded by "Hello".
 
@@ -1644,6 +1771,32 @@ The global flags are:
 		},
 	}
 	runTestCases(t, prog, tests)
+
+	// Check that the topics are nested under the commands that declare them.
+	var buf bytes.Buffer
+	if err := prog.DumpJSON(&buf); err != nil {
+		t.Fatalf("DumpJSON failed: %v", err)
+	}
+	var dump jsonCommand
+	if err := json.Unmarshal(buf.Bytes(), &dump); err != nil {
+		t.Fatalf("Unmarshal failed: %v\n%s", err, buf.String())
+	}
+	wantTopics := []jsonTopic{
+		{Name: "topic1", Short: "Help topic 1 short", Long: "Help topic 1 long."},
+		{Name: "topic2", Short: "Help topic 2 short", Long: "Help topic 2 long."},
+	}
+	if got, want := dump.Topics, wantTopics; !reflect.DeepEqual(got, want) {
+		t.Errorf("got toplevelprog topics %+v, want %+v", got, want)
+	}
+	wantTopics = []jsonTopic{
+		{Name: "topic3", Short: "Help topic 3 short", Long: "Help topic 3 long."},
+	}
+	if got, want := dump.Children[0].Topics, wantTopics; dump.Children[0].Name != "echoprog" || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s topics %+v, want echoprog topics %+v", dump.Children[0].Name, got, want)
+	}
+	if got, want := dump.Children[0].Flags, []jsonFlag{{"extra", "Print an extra arg", "false"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got echoprog flags %+v, want %+v", got, want)
+	}
 }
 
 func TestMultiLevelCommandsOrdering(t *testing.T) {
@@ -1883,17 +2036,30 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The prog1 help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
  -style=compact
    The formatting style for help output:
-      compact   - Good for compact cmdline output.
-      full      - Good for cmdline output, shows all global flags.
-      godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
-   Format output to this target width in runes, or unlimited if width < 0.
-   Defaults to the terminal width if available.  Override the default by setting
-   the CMDLINE_WIDTH environment variable.
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
 `,
 		},
 		{
@@ -1977,17 +2143,30 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The prog1 prog2 help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
  -style=compact
    The formatting style for help output:
-      compact   - Good for compact cmdline output.
-      full      - Good for cmdline output, shows all global flags.
-      godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
-   Format output to this target width in runes, or unlimited if width < 0.
-   Defaults to the terminal width if available.  Override the default by setting
-   the CMDLINE_WIDTH environment variable.
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
 `,
 		},
 		{
@@ -2041,17 +2220,30 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The prog1 prog2 prog3 help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
  -style=compact
    The formatting style for help output:
-      compact   - Good for compact cmdline output.
-      full      - Good for cmdline output, shows all global flags.
-      godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
-   Format output to this target width in runes, or unlimited if width < 0.
-   Defaults to the terminal width if available.  Override the default by setting
-   the CMDLINE_WIDTH environment variable.
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
 `,
 		},
 		{
@@ -2105,17 +2297,30 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The prog1 prog2 prog3 help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
  -style=compact
    The formatting style for help output:
-      compact   - Good for compact cmdline output.
-      full      - Good for cmdline output, shows all global flags.
-      godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
-   Format output to this target width in runes, or unlimited if width < 0.
-   Defaults to the terminal width if available.  Override the default by setting
-   the CMDLINE_WIDTH environment variable.
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
 `,
 		},
 		{
@@ -2228,17 +2433,30 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The prog1 help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
  -style=compact
    The formatting style for help output:
-      compact   - Good for compact cmdline output.
-      full      - Good for cmdline output, shows all global flags.
-      godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=<terminal width>
-   Format output to this target width in runes, or unlimited if width < 0.
-   Defaults to the terminal width if available.  Override the default by setting
-   the CMDLINE_WIDTH environment variable.
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
 `,
 		},
 	}
@@ -2305,147 +2523,5325 @@ The global flags are:
 	runTestCases(t, prog, tests)
 }
 
-func TestHideGlobalFlags(t *testing.T) {
-	HideGlobalFlagsExcept(regexp.MustCompile(`^global2$`))
-	cmdChild := &Command{
-		Name:   "child",
-		Short:  "description of child command.",
-		Long:   "blah blah blah",
+func TestHelpSearch(t *testing.T) {
+	cmdEcho := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout, without a hello.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	cmdHello := &Command{
+		Name:     "hello",
+		Short:    "Print strings on stdout preceded by Hello",
+		Long:     "Hello prints any strings passed in to stdout preceded by a greeting.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runHello),
+	}
+	cmdSettings := &Command{
+		Name:     "settings",
+		Short:    "Manage settings",
+		Long:     "Settings manages the configuration of the program.",
+		Children: []*Command{cmdHello},
+		Topics: []Topic{
+			{Name: "files", Short: "Where settings are stored", Long: "Config files live in $HOME."},
+		},
+	}
+	prog := &Command{
+		Name:     "program",
+		Short:    "Test help search.",
+		Long:     "Test help search.",
+		Children: []*Command{cmdEcho, cmdSettings},
+	}
+	var tests = []testCase{
+		{
+			Args: []string{"help", "-search=strings"},
+			Stdout: `program echo — Print strings on stdout
+program settings hello — Print strings on stdout preceded by Hello
+`,
+		},
+		{
+			Args: []string{"help", "-search=CONFIG"},
+			Stdout: `program settings — Manage settings
+program settings files — Where settings are stored
+`,
+		},
+		{
+			Args: []string{"help", "-search=greeting", "settings"},
+			Stdout: `program settings hello — Print strings on stdout preceded by Hello
+`,
+		},
+		{
+			// Name matches come first, as for Search.
+			Args: []string{"help", "-search=hello"},
+			Stdout: `program settings hello — Print strings on stdout preceded by Hello
+program echo — Print strings on stdout
+`,
+		},
+		{
+			Args: []string{"help", "-search=nomatch"},
+			Err:  "exit code 1",
+		},
+		{
+			Args: []string{"help", "-search=preceded", "-width=30"},
+			Stdout: `program settings hello — Print
+   strings on stdout preceded
+   by Hello
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestCommandSearch(t *testing.T) {
+	isolateGlobalFlags(t)
+	cmdEcho := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	cmdSettings := &Command{
+		Name:   "settings",
+		Short:  "Manage the config",
+		Long:   "Settings manages the configuration of echo.",
 		Runner: RunnerFunc(runEcho),
+		Topics: []Topic{
+			{Name: "files", Short: "Where settings are stored", Long: "Config files live in $HOME."},
+		},
 	}
 	prog := &Command{
 		Name:     "program",
-		Short:    "Test hiding global flags.",
-		Long:     "Test hiding global flags.",
-		Children: []*Command{cmdChild},
+		Short:    "Test search",
+		Long:     "Test search.",
+		Children: []*Command{cmdSettings, cmdEcho},
+	}
+	tests := []struct {
+		term string
+		want []SearchResult
+	}{
+		{"ECHO", []SearchResult{
+			{"program echo", "Print strings on stdout", false, SearchName},
+			{"program settings", "Manage the config", false, SearchLong},
+		}},
+		{"config", []SearchResult{
+			{"program settings", "Manage the config", false, SearchShort},
+			{"program settings files", "Where settings are stored", true, SearchLong},
+		}},
+		{"settings", []SearchResult{
+			{"program settings", "Manage the config", false, SearchName},
+			{"program settings files", "Where settings are stored", true, SearchShort},
+		}},
+		{"nomatch", nil},
+	}
+	for _, test := range tests {
+		if got := prog.Search(test.term); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Search(%q) got %v, want %v", test.term, got, test.want)
+		}
+	}
+}
+
+func TestHelpPattern(t *testing.T) {
+	newHello := func(name string) *Command {
+		return &Command{
+			Name:     name,
+			Short:    "Print strings on stdout preceded by Hello",
+			Long:     "Hello prints any strings passed in to stdout preceded by \"Hello\".",
+			ArgsName: "[strings]",
+			Runner:   RunnerFunc(runHello),
+		}
+	}
+	prog2 := &Command{
+		Name:     "prog2",
+		Short:    "Set of hello commands",
+		Long:     "Prog2 has two variants of hello.",
+		Children: []*Command{newHello("hello21"), newHello("hello22")},
+	}
+	prog1 := &Command{
+		Name:     "prog1",
+		Short:    "Set of hello commands",
+		Long:     "Prog1 has two variants of hello and a subprogram prog2.",
+		Children: []*Command{newHello("hello11"), newHello("hello12"), prog2},
 	}
 	var tests = []testCase{
 		{
-			Args: []string{"help"},
-			Stdout: `Test hiding global flags.
+			Args: []string{"help", "hello*"},
+			Stdout: `================================================================================
+Prog1 hello11 - Print strings on stdout preceded by Hello
 
-Usage:
-   program [flags] <command>
+Hello prints any strings passed in to stdout preceded by "Hello".
 
-The program commands are:
-   child       description of child command.
-   help        Display help for commands or topics
-Run "program help [command]" for command usage.
+Usage:
+   prog1 hello11 [flags] [strings]
+================================================================================
+Prog1 hello12 - Print strings on stdout preceded by Hello
 
-The global flags are:
- -global2=0
-   global test flag 2
+Hello prints any strings passed in to stdout preceded by "Hello".
 
-Run "program help -style=full" to show all flags.
+Usage:
+   prog1 hello12 [flags] [strings]
 `,
 		},
 		{
-			Args: []string{"help", "child"},
-			Stdout: `blah blah blah
+			Args: []string{"help", "prog?", "hello2?"},
+			Stdout: `================================================================================
+Prog1 prog2 hello21 - Print strings on stdout preceded by Hello
+
+Hello prints any strings passed in to stdout preceded by "Hello".
 
 Usage:
-   program child [flags]
+   prog1 prog2 hello21 [flags] [strings]
+================================================================================
+Prog1 prog2 hello22 - Print strings on stdout preceded by Hello
 
-The global flags are:
- -global2=0
-   global test flag 2
+Hello prints any strings passed in to stdout preceded by "Hello".
 
-Run "program help -style=full child" to show all flags.
+Usage:
+   prog1 prog2 hello22 [flags] [strings]
 `,
 		},
 		{
-			Args: []string{"help", "-style=full"},
-			Stdout: `Test hiding global flags.
+			Args: []string{"help", "x*"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog1: no commands match "x*"
+
+Prog1 has two variants of hello and a subprogram prog2.
 
 Usage:
-   program [flags] <command>
+   prog1 [flags] <command>
 
-The program commands are:
-   child       description of child command.
+The prog1 commands are:
+   hello11     Print strings on stdout preceded by Hello
+   hello12     Print strings on stdout preceded by Hello
+   prog2       Set of hello commands
    help        Display help for commands or topics
-Run "program help [command]" for command usage.
+Run "prog1 help [command]" for command usage.
 
 The global flags are:
+ -global1=
+   global test flag 1
  -global2=0
    global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog1, tests)
+}
+
+func TestHelpCommandName(t *testing.T) {
+	echo := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:            "prog",
+		Short:           "Test help command renaming",
+		Long:            "Prog has an echo command and a renamed help command.",
+		Children:        []*Command{echo},
+		HelpCommandName: "docs",
+	}
+	var tests = []testCase{
+		{
+			Args: []string{"docs"},
+			Stdout: `Prog has an echo command and a renamed help command.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   echo        Print strings on stdout
+   docs        Display help for commands or topics
+Run "prog docs [command]" for command usage.
 
+The global flags are:
  -global1=
    global test flag 1
+ -global2=0
+   global test flag 2
 `,
 		},
 		{
-			Args: []string{"help", "-style=full", "child"},
-			Stdout: `blah blah blah
+			Args: []string{"docs", "docs"},
+			Stdout: `Help with no args displays the usage of the parent command.
+
+Help with args displays the usage of the specified sub-command or help topic.
+
+"docs ..." recursively displays help for all commands and topics.
 
 Usage:
-   program child [flags]
+   prog docs [flags] [command/topic ...]
+
+[command/topic ...] optionally identifies a specific sub-command or help topic.
+
+The prog docs flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
+ -style=compact
+   The formatting style for help output:
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
+   Override the default by setting the CMDLINE_STYLE environment variable.
+ -width=80
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
 
 The global flags are:
+ -global1=
+   global test flag 1
  -global2=0
    global test flag 2
+`,
+		},
+		{
+			Args: []string{"help"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog: unknown command "help"
+
+Prog has an echo command and a renamed help command.
+
+Usage:
+   prog [flags] <command>
 
+The prog commands are:
+   echo        Print strings on stdout
+   docs        Display help for commands or topics
+Run "prog docs [command]" for command usage.
+
+The global flags are:
  -global1=
    global test flag 1
+ -global2=0
+   global test flag 2
 `,
 		},
 	}
 	runTestCases(t, prog, tests)
-	nonHiddenGlobalFlags = nil
+	prog.Children = append(prog.Children, &Command{
+		Name:   "docs",
+		Short:  "Collides with the help command",
+		Long:   "Collides with the help command.",
+		Runner: RunnerFunc(runEcho),
+	})
+	wantErr := `prog: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+HelpCommandName "docs" collides with a child or topic of the same name.`
+	runTestCases(t, prog, []testCase{{Args: []string{}, Err: wantErr}})
 }
 
-func TestHideGlobalFlagsRootNoChildren(t *testing.T) {
-	HideGlobalFlagsExcept(regexp.MustCompile(`^global2$`))
+func TestDisableHelpCommand(t *testing.T) {
+	echo := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
 	prog := &Command{
-		Name:   "program",
-		Short:  "Test hiding global flags, root no children.",
-		Long:   "Test hiding global flags, root no children.",
-		Runner: RunnerFunc(runEcho),
+		Name:               "prog",
+		Short:              "Test disabled help command",
+		Long:               "Prog has an echo command and no help command.",
+		Children:           []*Command{echo},
+		Topics:             []Topic{{Name: "topic", Short: "Topic short", Long: "Topic long."}},
+		DisableHelpCommand: true,
 	}
 	var tests = []testCase{
 		{
 			Args: []string{"-help"},
-			Stdout: `Test hiding global flags, root no children.
+			Stdout: `Prog has an echo command and no help command.
 
 Usage:
-   program [flags]
+   prog [flags] <command>
+
+The prog commands are:
+   echo        Print strings on stdout
+
+The prog additional help topics are:
+   topic       Topic short
 
 The global flags are:
+ -global1=
+   global test flag 1
  -global2=0
    global test flag 2
-
-Run "CMDLINE_STYLE=full program -help" to show all flags.
 `,
 		},
 		{
-			Args: []string{"-help"},
-			Vars: map[string]string{"CMDLINE_STYLE": "full"},
-			Stdout: `Test hiding global flags, root no children.
+			Args: []string{"help"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog: unknown command "help"
+
+Prog has an echo command and no help command.
 
 Usage:
-   program [flags]
+   prog [flags] <command>
 
-The global flags are:
- -global2=0
-   global test flag 2
+The prog commands are:
+   echo        Print strings on stdout
 
+The prog additional help topics are:
+   topic       Topic short
+
+The global flags are:
  -global1=
    global test flag 1
+ -global2=0
+   global test flag 2
 `,
 		},
 	}
 	runTestCases(t, prog, tests)
-	nonHiddenGlobalFlags = nil
 }
 
-func TestRootCommandFlags(t *testing.T) {
-	root := &Command{
-		Name:   "root",
-		Short:  "Test root command flags.",
-		Long:   "Test root command flags.",
-		Runner: RunnerFunc(runHello),
+func TestHelpFunc(t *testing.T) {
+	dyn := &Command{
+		Name:     "dyn",
+		Short:    "Command with dynamic help",
+		Long:     "Not displayed.",
+		ArgsName: "[args]",
+		Runner:   RunnerFunc(runEcho),
+		HelpFunc: func(cmd *Command, w io.Writer, style string, width int) error {
+			fmt.Fprintf(w, "Help for %s, style=%s width=%d\n", cmd.Name, style, width)
+			fmt.Fprintln(w, "  valid args: a b c")
+			return nil
+		},
 	}
-	rb := root.Flags.Bool("rbool", false, "rbool desc")
-	rs := root.Flags.String("rstring", "abc", "rstring desc")
+	bad := &Command{
+		Name:   "bad",
+		Short:  "Command with failing help",
+		Long:   "Not displayed.",
+		Runner: RunnerFunc(runEcho),
+		HelpFunc: func(*Command, io.Writer, string, int) error {
+			return errors.New("help failed")
+		},
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test custom help functions",
+		Long:     "Prog has commands with custom help functions.",
+		Children: []*Command{dyn, bad},
+	}
+	var tests = []testCase{
+		{
+			Args: []string{"help"},
+			Stdout: `Prog has commands with custom help functions.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   dyn         Command with dynamic help
+   bad         Command with failing help
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"help", "dyn"},
+			Stdout: `Help for dyn, style=compact width=80
+  valid args: a b c
+`,
+		},
+		{
+			Args: []string{"help", "-style=godoc", "-width=60", "dyn"},
+			Stdout: `Help for dyn, style=godoc width=60
+  valid args: a b c
+`,
+		},
+		{
+			Args: []string{"dyn", "-help"},
+			Stdout: `Help for dyn, style=compact width=80
+  valid args: a b c
+`,
+		},
+		{
+			Args: []string{"dyn", "-foo"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog dyn: flag provided but not defined: -foo
+
+Help for dyn, style=compact width=80
+  valid args: a b c
+`,
+		},
+		{
+			Args: []string{"help", "..."},
+			Err:  "help failed",
+			Stdout: `Prog has commands with custom help functions.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   dyn         Command with dynamic help
+   bad         Command with failing help
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+================================================================================
+Prog dyn - Command with dynamic help
+
+Help for dyn, style=compact width=80
+  valid args: a b c
+================================================================================
+Prog bad - Command with failing help
+
+================================================================================
+Prog help - Display help for commands or topics
+
+Help with no args displays the usage of the parent command.
+
+Help with args displays the usage of the specified sub-command or help topic.
+
+"help ..." recursively displays help for all commands and topics.
+
+Usage:
+   prog help [flags] [command/topic ...]
+
+[command/topic ...] optionally identifies a specific sub-command or help topic.
+
+The prog help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
+ -style=compact
+   The formatting style for help output:
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
+   Override the default by setting the CMDLINE_STYLE environment variable.
+ -width=80
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
+`,
+		},
+		{
+			Args: []string{"help", "bad"},
+			Err:  "help failed",
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestSuppressUsageOnError(t *testing.T) {
+	echo := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:                 "prog",
+		Short:                "Test suppressed usage",
+		Long:                 "Prog only prints the error line for usage errors.",
+		Children:             []*Command{echo},
+		SuppressUsageOnError: true,
+	}
+	var tests = []testCase{
+		{
+			Args:   []string{"foo"},
+			Err:    errUsageStr,
+			Stderr: "ERROR: prog: unknown command \"foo\"\n",
+		},
+		{
+			Args:   []string{"echo", "-foo"},
+			Err:    errUsageStr,
+			Stderr: "ERROR: prog echo: flag provided but not defined: -foo\n",
+		},
+		{
+			Args:   []string{"echo", "bad_arg"},
+			Err:    errUsageStr,
+			Stderr: "ERROR: Invalid argument bad_arg\n",
+		},
+		{
+			Args:   []string{"help", "foo"},
+			Err:    errUsageStr,
+			Stderr: "ERROR: prog: unknown command or topic \"foo\"\n",
+		},
+		{
+			Args: []string{"help", "echo"},
+			Stdout: `Echo prints any strings passed in to stdout.
+
+Usage:
+   prog echo [flags] [strings]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestNestedTopics(t *testing.T) {
+	tutorials := Topic{
+		Name:  "tutorials",
+		Short: "Tutorials for prog",
+		Long:  "Tutorials describe how to use prog.",
+		Children: []Topic{
+			{Name: "basics", Short: "Basic tutorial", Long: "Basics of prog."},
+			{Name: "advanced", Short: "Advanced tutorial", Long: "Advanced prog."},
+		},
+	}
+	prog := &Command{
+		Name:  "prog",
+		Short: "Test nested topics",
+		Long:  "Prog has nested help topics.",
+		Children: []*Command{{
+			Name:   "echo",
+			Short:  "Print strings on stdout",
+			Long:   "Echo prints any strings passed in to stdout.",
+			Runner: RunnerFunc(runEcho),
+		}},
+		Topics: []Topic{
+			tutorials,
+			{Name: "flat", Short: "Flat topic", Long: "Flat topic long."},
+		},
+	}
+	var tests = []testCase{
+		{
+			Args: []string{"-help"},
+			Stdout: `Prog has nested help topics.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   echo        Print strings on stdout
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+
+The prog additional help topics are:
+   tutorials   Tutorials for prog (has sub-topics)
+   flat        Flat topic
+Run "prog help [topic]" for topic details.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"help", "tutorials"},
+			Stdout: `Tutorials describe how to use prog.
+
+The prog tutorials sub-topics are:
+   basics      Basic tutorial
+   advanced    Advanced tutorial
+Run "prog help tutorials [topic]" for topic details.
+`,
+		},
+		{
+			Args:   []string{"help", "tutorials", "basics"},
+			Stdout: "Basics of prog.\n",
+		},
+		{
+			Args: []string{"help", "tutorials", "foo"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog tutorials: unknown command or topic "foo"
+
+Tutorials describe how to use prog.
+
+The prog tutorials sub-topics are:
+   basics      Basic tutorial
+   advanced    Advanced tutorial
+Run "prog help tutorials [topic]" for topic details.
+`,
+		},
+		{
+			Args:   []string{"help", "flat", "foo"},
+			Err:    errUsageStr,
+			Stderr: "ERROR: prog flat: unknown command or topic \"foo\"\n\nFlat topic long.\n",
+		},
+		{
+			Args: []string{"help", "..."},
+			Stdout: `Prog has nested help topics.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   echo        Print strings on stdout
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+
+The prog additional help topics are:
+   tutorials   Tutorials for prog (has sub-topics)
+   flat        Flat topic
+Run "prog help [topic]" for topic details.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+================================================================================
+Prog echo - Print strings on stdout
+
+Echo prints any strings passed in to stdout.
+
+Usage:
+   prog echo [flags]
+================================================================================
+Prog help - Display help for commands or topics
+
+Help with no args displays the usage of the parent command.
+
+Help with args displays the usage of the specified sub-command or help topic.
+
+"help ..." recursively displays help for all commands and topics.
+
+Usage:
+   prog help [flags] [command/topic ...]
+
+[command/topic ...] optionally identifies a specific sub-command or help topic.
+
+The prog help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
+ -style=compact
+   The formatting style for help output:
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
+   Override the default by setting the CMDLINE_STYLE environment variable.
+ -width=80
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
+================================================================================
+Prog tutorials - Tutorials for prog
+
+Tutorials describe how to use prog.
+================================================================================
+Prog tutorials basics - Basic tutorial
+
+Basics of prog.
+================================================================================
+Prog tutorials advanced - Advanced tutorial
+
+Advanced prog.
+================================================================================
+Prog flat - Flat topic
+
+Flat topic long.
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+	prog.Topics[0].Children = append(prog.Topics[0].Children, Topic{Name: "basics"})
+	wantErr := `prog tutorials: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+Each topic must have unique sub-topic names.
+Saw "basics" multiple times.`
+	runTestCases(t, prog, []testCase{{Args: []string{}, Err: wantErr}})
+}
+
+func TestDocsFS(t *testing.T) {
+	echo := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		LongFile: "echo.txt",
+		Runner:   RunnerFunc(runEcho),
+	}
+	missing := &Command{
+		Name:     "missing",
+		Short:    "Command with missing docs",
+		LongFile: "missing.txt",
+		Runner:   RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test docs read from files",
+		Long:     "Prog has docs in files.",
+		Children: []*Command{echo, missing},
+		Topics: []Topic{
+			{Name: "topic", Short: "Topic short", LongFile: "docs/topic.txt"},
+		},
+		DocsFS: fstest.MapFS{
+			"echo.txt":       {Data: []byte("\nEcho prints any strings passed in to stdout.\n\n")},
+			"docs/topic.txt": {Data: []byte("Topic from a file.\n")},
+		},
+	}
+	var tests = []testCase{
+		{
+			Args: []string{"help", "echo"},
+			Stdout: `Echo prints any strings passed in to stdout.
+
+Usage:
+   prog echo [flags]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args:   []string{"help", "topic"},
+			Stdout: "Topic from a file.\n",
+		},
+		{
+			Args: []string{"help", "missing"},
+			Err: `prog missing: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+Can't read LongFile "missing.txt": open missing.txt: file does not exist`,
+		},
+	}
+	runTestCases(t, prog, tests)
+	prog.DocsFS = nil
+	wantErr := `prog echo: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+LongFile "echo.txt" is specified, but DocsFS isn't set on the root command.`
+	runTestCases(t, prog, []testCase{{Args: []string{"help", "echo"}, Err: wantErr}})
+}
+
+func TestTreeCommand(t *testing.T) {
+	newCmd := func(name, short string) *Command {
+		return &Command{Name: name, Short: short, Long: short + ".", Runner: RunnerFunc(runEcho)}
+	}
+	echoProg := &Command{
+		Name:     "echoprog",
+		Short:    "Set of echo commands",
+		Long:     "Echoprog has two variants of echo.",
+		Children: []*Command{newCmd("echo", "Print strings on stdout"), newCmd("echoopt", "Print strings on stdout with opts")},
+		Topics:   []Topic{{Name: "topic2", Short: "Help topic 2 short", Long: "Help topic 2 long."}},
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Top level prog",
+		Long:     "Prog has the echo subprogram and the tree command.",
+		Children: []*Command{echoProg, newCmd("hello", "Print strings on stdout preceded by Hello"), NewTreeCommand()},
+		Topics:   []Topic{{Name: "topic1", Short: "Help topic 1 short", Long: "Help topic 1 long."}},
+	}
+	var tests = []testCase{
+		{
+			Args: []string{"tree"},
+			Stdout: `prog             Top level prog
+├── echoprog     Set of echo commands
+│   ├── echo     Print strings on stdout
+│   └── echoopt  Print strings on stdout with opts
+├── hello        Print strings on stdout preceded by Hello
+└── tree         Display the command hierarchy
+`,
+		},
+		{
+			Args: []string{"tree", "-topics"},
+			Stdout: `prog             Top level prog
+├── echoprog     Set of echo commands
+│   ├── echo     Print strings on stdout
+│   ├── echoopt  Print strings on stdout with opts
+│   └── topic2   [topic] Help topic 2 short
+├── hello        Print strings on stdout preceded by Hello
+├── tree         Display the command hierarchy
+└── topic1       [topic] Help topic 1 short
+`,
+		},
+		{
+			Args: []string{"tree", "-topics=false", "-depth=1"},
+			Stdout: `prog          Top level prog
+├── echoprog  Set of echo commands
+├── hello     Print strings on stdout preceded by Hello
+└── tree      Display the command hierarchy
+`,
+		},
+		{
+			Args: []string{"tree", "-depth=0"},
+			Vars: map[string]string{"CMDLINE_WIDTH": "30"},
+			Stdout: `prog             Top level pro
+├── echoprog     Set of echo c
+│   ├── echo     Print strings
+│   └── echoopt  Print strings
+├── hello        Print strings
+└── tree         Display the c
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestGenerateDot(t *testing.T) {
+	newCmd := func(name string) *Command {
+		return &Command{Name: name, Short: name, Long: name + ".", Runner: RunnerFunc(runEcho)}
+	}
+	prog := &Command{
+		Name:  "prog",
+		Short: "Top level prog",
+		Long:  "Prog has nested commands.",
+		Children: []*Command{
+			{Name: "sub", Short: "sub", Long: "sub.", Children: []*Command{newCmd("echo"), newCmd(`a"b`)}},
+			newCmd("echo"),
+		},
+		Topics: []Topic{{Name: "topic", Short: "topic", Long: "topic.", Children: []Topic{{Name: "sub", Short: "sub", Long: "sub."}}}},
+	}
+	var buf bytes.Buffer
+	if err := prog.GenerateDot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph "prog" {
+  node [shape=box];
+  "prog" [label="prog"];
+  "prog" -> "prog sub";
+  "prog sub" [label="sub"];
+  "prog sub" -> "prog sub echo";
+  "prog sub echo" [label="echo"];
+  "prog sub" -> "prog sub a\"b";
+  "prog sub a\"b" [label="a\"b"];
+  "prog" -> "prog echo";
+  "prog echo" [label="echo"];
+  "prog topic" [label="topic", shape=note];
+  "prog" -> "prog topic" [style=dashed];
+  "prog topic sub" [label="sub", shape=note];
+  "prog topic" -> "prog topic sub" [style=dashed];
+}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got dot graph:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestAlignGlobalFlags(t *testing.T) {
+	prog := &Command{
+		Name:             "prog",
+		Short:            "Test aligned global flags",
+		Long:             "Prog prints aligned global flags.",
+		Runner:           RunnerFunc(runEcho),
+		AlignGlobalFlags: true,
+	}
+	prog.Flags.StringVar(new(string), "local", "", "local flag")
+	var tests = []testCase{
+		{
+			Args: []string{"-help"},
+			Stdout: `Prog prints aligned global flags.
+
+Usage:
+   prog [flags]
+
+The prog flags are:
+ -local=
+   local flag
+
+The global flags are:
+ -global1=   global test flag 1
+ -global2=0  global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestPassthroughArgs(t *testing.T) {
+	exec := &Command{
+		Name:            "exec",
+		Short:           "Run a program",
+		Long:            "Exec runs a program with the given args.",
+		ArgsName:        "<program> [args]",
+		Runner:          RunnerFunc(runEcho),
+		PassthroughArgs: true,
+	}
+	exec.Flags.BoolVar(&optNoNewline, "n", false, "Do not output trailing newline")
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test passthrough args",
+		Long:     "Prog has a command that receives all args verbatim.",
+		Children: []*Command{exec},
+	}
+	var tests = []testCase{
+		{
+			Args:   []string{"exec"},
+			Stdout: "[]\n",
+		},
+		{
+			Args:   []string{"exec", "ls", "-l", "--", "-help"},
+			Stdout: "[ls -l -- -help]\n",
+		},
+		{
+			Args:   []string{"exec", "-n", "-global1=x", "help", "..."},
+			Stdout: "[-n -global1=x help ...]\n",
+		},
+		{
+			Args:        []string{"-global1=x", "exec", "ls"},
+			Stdout:      "[ls]\n",
+			GlobalFlag1: "x",
+		},
+	}
+	runTestCases(t, prog, tests)
+	exec.Children = []*Command{{Name: "sub", Short: "sub", Long: "sub", Runner: RunnerFunc(runEcho)}}
+	wantErr := `prog exec: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+Since PassthroughArgs is specified, Children cannot be specified.
+All args are passed to the Runner, so the children are unreachable.`
+	runTestCases(t, prog, []testCase{{Args: []string{"exec"}, Err: wantErr}})
+}
+
+func TestWideChars(t *testing.T) {
+	hello := &Command{
+		Name:   "hello",
+		Short:  "Print strings on stdout preceded by Hello",
+		Long:   "Hello prints any strings passed in to stdout preceded by \"Hello\".",
+		Runner: RunnerFunc(runHello),
+	}
+	sekai := &Command{
+		Name:     "世界世界世界",
+		Short:    "引数を標準出力に表示します",
+		Long:     "世界世界世界は引数を標準出力に表示します。",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test wide characters",
+		Long:     "Prog has commands with wide names and descriptions.",
+		Children: []*Command{hello, sekai},
+	}
+	var tests = []testCase{
+		{
+			Args:   []string{"世界世界世界", "a"},
+			Stdout: "[a]\n",
+		},
+		{
+			Args: []string{"-help"},
+			Stdout: `Prog has commands with wide names and descriptions.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   hello        Print strings on stdout preceded by Hello
+   世界世界世界 引数を標準出力に表示します
+   help         Display help for commands or topics
+Run "prog help [command]" for command usage.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+// renameArgs returns a PreParse func that renames args based on renames, and
+// returns an error for removed args.
+func renameArgs(renames map[string]string, removed string) func([]string) ([]string, error) {
+	return func(args []string) ([]string, error) {
+		var result []string
+		for _, arg := range args {
+			if arg == removed {
+				return nil, fmt.Errorf("flag %s has been removed", arg)
+			}
+			if rename, ok := renames[arg]; ok {
+				arg = rename
+			}
+			result = append(result, arg)
+		}
+		return result, nil
+	}
+}
+
+func TestPreParse(t *testing.T) {
+	echo := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+		PreParse: renameArgs(map[string]string{"--no-newline": "-n"}, "--removed"),
+	}
+	echo.Flags.BoolVar(&optNoNewline, "n", false, "Do not output trailing newline")
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test pre-parse hooks",
+		Long:     "Prog has commands that rewrite their args before parsing.",
+		Children: []*Command{echo},
+		PreParse: renameArgs(map[string]string{"--extra-arg": "-extra"}, ""),
+	}
+	prog.Flags.BoolVar(&flagExtra, "extra", false, "Print an extra arg")
+	var tests = []testCase{
+		{
+			Args:   []string{"echo", "foo"},
+			Stdout: "[foo]\n",
+		},
+		{
+			Args:   []string{"--extra-arg", "echo", "--no-newline", "foo"},
+			Stdout: "[foo extra]",
+		},
+		{
+			Args:   []string{"echo", "--extra-arg", "-n", "foo"},
+			Stdout: "[foo extra]",
+		},
+		{
+			Args: []string{"echo", "--removed", "foo"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog echo: flag --removed has been removed
+
+Echo prints any strings passed in to stdout.
+
+Usage:
+   prog echo [flags] [strings]
+
+The prog echo flags are:
+ -n=false
+   Do not output trailing newline
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+
+Run "prog help -style=full echo" to show all flags.
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestListWrapping(t *testing.T) {
+	echo := &Command{
+		Name:  "echo",
+		Short: "Print strings on stdout",
+		Long: `
+Echo prints any strings passed in to stdout, with these features:
+- Strings are separated by a single space on output.
+- Output is terminated with a newline, unless the
+  -n flag is specified.
+  * Nested items keep their relative indent when they are wrapped.
+
+1. Numbered items are also wrapped with a hanging indent.
+
+2. Blank lines between items are preserved.
+Text after the list is wrapped as usual, as a regular paragraph.
+`,
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test list wrapping",
+		Long:     "Prog has a command with lists in its long description.",
+		Children: []*Command{echo},
+	}
+	vars := map[string]string{"CMDLINE_WIDTH": "40"}
+	var tests = []testCase{
+		{
+			Args: []string{"help", "echo"},
+			Vars: vars,
+			Stdout: `Echo prints any strings passed in to
+stdout, with these features:
+- Strings are separated by a single
+  space on output.
+- Output is terminated with a newline,
+  unless the -n flag is specified.
+  * Nested items keep their relative
+    indent when they are wrapped.
+
+1. Numbered items are also wrapped with
+   a hanging indent.
+
+2. Blank lines between items are
+   preserved.
+Text after the list is wrapped as usual,
+as a regular paragraph.
+
+Usage:
+   prog echo [flags] [strings]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"help", "-style=godoc", "echo"},
+			Vars: vars,
+			Stdout: `Echo prints any strings passed in to
+stdout, with these features:
+- Strings are separated by a single
+  space on output.
+- Output is terminated with a newline,
+  unless the -n flag is specified.
+  * Nested items keep their relative
+    indent when they are wrapped.
+
+1. Numbered items are also wrapped with
+   a hanging indent.
+
+2. Blank lines between items are
+   preserved.
+Text after the list is wrapped as usual,
+as a regular paragraph.
+
+Usage:
+   prog echo [flags] [strings]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"help", "..."},
+			Vars: vars,
+			Stdout: `Prog has a command with lists in its
+long description.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   echo        Print strings on stdout
+   help        Display help for commands
+               or topics
+Run "prog help [command]" for command
+usage.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+========================================
+Prog echo - Print strings on stdout
+
+Echo prints any strings passed in to
+stdout, with these features:
+- Strings are separated by a single
+  space on output.
+- Output is terminated with a newline,
+  unless the -n flag is specified.
+  * Nested items keep their relative
+    indent when they are wrapped.
+
+1. Numbered items are also wrapped with
+   a hanging indent.
+
+2. Blank lines between items are
+   preserved.
+Text after the list is wrapped as usual,
+as a regular paragraph.
+
+Usage:
+   prog echo [flags] [strings]
+========================================
+Prog help - Display help for commands or topics
+
+Help with no args displays the usage of
+the parent command.
+
+Help with args displays the usage of the
+specified sub-command or help topic.
+
+"help ..." recursively displays help for
+all commands and topics.
+
+Usage:
+   prog help [flags] [command/topic ...]
+
+[command/topic ...] optionally
+identifies a specific sub-command or
+help topic.
+
+The prog help flags are:
+ -all-flags=false
+   Display every flag defined on the
+   commands from the given command
+   onward, sorted by command path,
+   instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage,
+   including for recursive help.
+ -search=
+   Display the commands and topics whose
+   name or description contains the
+   given term, ignoring case, instead of
+   displaying usage.
+ -strict=false
+   Stop recursive help at the first
+   error, e.g. a long description that
+   can't be read, instead of displaying
+   the remaining commands and topics.
+ -style=compact
+   The formatting style for help output:
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
+   Override the default by setting the
+   CMDLINE_STYLE environment variable.
+ -width=40
+   Format output to this target width in
+   cells, or unlimited if width < 0.
+   Defaults to the terminal width if
+   available, or unlimited if the output
+   isn't a terminal.  Override the
+   default by setting the CMDLINE_WIDTH
+   environment variable.
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestCompactUsage(t *testing.T) {
+	hello := func(name string) *Command {
+		return &Command{
+			Name:     name,
+			Short:    "Print strings on stdout preceded by Hello",
+			Long:     "Hello prints any strings passed in to stdout preceded by \"Hello\".",
+			ArgsName: "[strings]",
+			Runner:   RunnerFunc(runHello),
+		}
+	}
+	prog3 := &Command{
+		Name:     "prog3",
+		Short:    "Set of hello commands",
+		Long:     "Prog3 has two variants of hello.",
+		Children: []*Command{hello("hello31"), hello("hello32")},
+	}
+	prog2 := &Command{
+		Name:     "prog2",
+		Short:    "Set of hello commands",
+		Long:     "Prog2 has a variant of hello and a subprogram prog3.",
+		Children: []*Command{hello("hello21"), prog3},
+	}
+	prog1 := &Command{
+		Name:         "prog1",
+		Short:        "Set of hello commands",
+		Long:         "Prog1 has two variants of hello and a subprogram prog2.",
+		Children:     []*Command{hello("hello11"), hello("hello12"), prog2},
+		CompactUsage: true,
+	}
+	var tests = []testCase{
+		{
+			Args: []string{"help"},
+			Stdout: `Prog1 has two variants of hello and a subprogram prog2.
+
+Usage:
+   prog1 [flags] {hello11|hello12|prog2} ...
+
+The prog1 commands are:
+   hello11     Print strings on stdout preceded by Hello
+   hello12     Print strings on stdout preceded by Hello
+   prog2       Set of hello commands
+   help        Display help for commands or topics
+Run "prog1 help [command]" for command usage.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"prog2", "-help"},
+			Stdout: `Prog2 has a variant of hello and a subprogram prog3.
+
+Usage:
+   prog1 prog2 [flags] {hello21|prog3} ...
+
+The prog1 prog2 commands are:
+   hello21     Print strings on stdout preceded by Hello
+   prog3       Set of hello commands
+   help        Display help for commands or topics
+Run "prog1 prog2 help [command]" for command usage.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"help", "prog2", "prog3"},
+			Stdout: `Prog3 has two variants of hello.
+
+Usage:
+   prog1 prog2 prog3 [flags] {hello31|hello32} ...
+
+The prog1 prog2 prog3 commands are:
+   hello31     Print strings on stdout preceded by Hello
+   hello32     Print strings on stdout preceded by Hello
+   help        Display help for commands or topics
+Run "prog1 prog2 prog3 help [command]" for command usage.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog1, tests)
+}
+
+func TestSecretEnvFlag(t *testing.T) {
+	var token string
+	show := &Command{
+		Name:  "show",
+		Short: "Show the token",
+		Long:  "Show prints the token.",
+		Runner: RunnerFunc(func(env *Env, args []string) error {
+			fmt.Fprintf(env.Stdout, "token=%s\n", token)
+			return nil
+		}),
+	}
+	show.SecretEnvFlag(&token, "PROG_TOKEN")
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test secret env flags",
+		Long:     "Prog has a command with a secret env flag.",
+		Children: []*Command{show},
+	}
+	var tests = []testCase{
+		{
+			Args:   []string{"show"},
+			Stdout: "token=\n",
+		},
+		{
+			Args:   []string{"show"},
+			Vars:   map[string]string{"PROG_TOKEN": "s3cret"},
+			Stdout: "token=s3cret\n",
+		},
+		{
+			Args: []string{"show", "-PROG_TOKEN=s3cret"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog show: flag provided but not defined: -PROG_TOKEN
+
+Show prints the token.
+
+Usage:
+   prog show [flags]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"help", "show"},
+			Vars: map[string]string{"PROG_TOKEN": "s3cret"},
+			Stdout: `Show prints the token.
+
+Usage:
+   prog show [flags]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestTabExpansion(t *testing.T) {
+	echo := &Command{
+		Name:  "echo",
+		Short: "Print strings on stdout",
+		Long: `
+Echo prints any strings passed in to stdout.
+Tabs:	mid-line
+	line start	then mid-line
+`,
+		ArgsName: "[strings]",
+		ArgsLong: "[strings]\tare arbitrary strings that will be echoed.",
+		Runner:   RunnerFunc(runEcho),
+	}
+	echo.Flags.BoolVar(&optNoNewline, "n", false, "Do not output\ttrailing newline")
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test tab expansion",
+		Long:     "Prog has a command with tabs in its descriptions.",
+		Children: []*Command{echo},
+	}
+	var tests = []testCase{
+		{
+			Args: []string{"help", "echo"},
+			Stdout: `Echo prints any strings passed in to stdout. Tabs:      mid-line
+        line start      then mid-line
+
+Usage:
+   prog echo [flags] [strings]
+
+[strings]       are arbitrary strings that will be echoed.
+
+The prog echo flags are:
+ -n=false
+   Do not output        trailing newline
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+	prog.TabWidth = 4
+	tests = []testCase{
+		{
+			Args: []string{"help", "echo"},
+			Stdout: `Echo prints any strings passed in to stdout. Tabs:  mid-line
+    line start  then mid-line
+
+Usage:
+   prog echo [flags] [strings]
+
+[strings]   are arbitrary strings that will be echoed.
+
+The prog echo flags are:
+ -n=false
+   Do not output    trailing newline
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestValidate(t *testing.T) {
+	isolateGlobalFlags(t)
+	newTree := func(argsName string) *Command {
+		child := &Command{
+			Name:   "child",
+			Short:  "Child command.",
+			Long:   "Child command.",
+			Runner: RunnerFunc(runEcho),
+		}
+		return &Command{
+			Name:  "parent",
+			Short: "parent",
+			Long:  "parent",
+			Children: []*Command{{
+				Name:     "both",
+				Short:    "Both has children and a runner.",
+				Long:     "Both has children and a runner.",
+				ArgsName: argsName,
+				Children: []*Command{child},
+				Runner:   RunnerFunc(runEcho),
+			}},
+		}
+	}
+	if err := newTree("").Validate(); err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+	wantErr := `parent both: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+Since both Children and Runner are specified, the Runner cannot take args.
+Otherwise a conflict between child names and runner args is possible.`
+	if got, want := errString(newTree("[strings]").Validate()), wantErr; got != want {
+		t.Errorf("got error %q, want %q", got, want)
+	}
+	if got, want := errString((&Command{Name: "empty"}).Validate()), `empty: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+At least one of Children or Runner must be specified.`; got != want {
+		t.Errorf("got error %q, want %q", got, want)
+	}
+}
+
+func TestNonTerminalWidth(t *testing.T) {
+	defer func(orig func(interface{}) bool) { isTerminal = orig }(isTerminal)
+	echo := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout.  This long description is longer than forty cells.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test non-terminal width",
+		Long:     "Prog has a command with a long description.",
+		Children: []*Command{echo},
+	}
+	noWidth := map[string]string{"CMDLINE_WIDTH": ""}
+	for _, terminal := range []bool{false, true} {
+		isTerminal = func(interface{}) bool { return terminal }
+		var tests = []testCase{
+			{
+				Args: []string{"help", "echo"},
+				Vars: map[string]string{"CMDLINE_WIDTH": "40"},
+				Stdout: `Echo prints any strings passed in to
+stdout.  This long description is longer
+than forty cells.
+
+Usage:
+   prog echo [flags] [strings]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+			},
+			{
+				Args: []string{"help", "-width=40", "-style=shortonly", "echo"},
+				Vars: noWidth,
+				Stdout: `Print strings on stdout
+`,
+			},
+		}
+		runTestCases(t, prog, tests)
+	}
+	isTerminal = func(interface{}) bool { return false }
+	var tests = []testCase{
+		{
+			Args: []string{"help", "echo"},
+			Vars: noWidth,
+			Stdout: `Echo prints any strings passed in to stdout.  This long description is longer than forty cells.
+
+Usage:
+   prog echo [flags] [strings]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"help", "-width=40", "echo"},
+			Vars: noWidth,
+			Stdout: `Echo prints any strings passed in to
+stdout.  This long description is longer
+than forty cells.
+
+Usage:
+   prog echo [flags] [strings]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"echo", "-foo"},
+			Vars: noWidth,
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog echo: flag provided but not defined: -foo
+
+Echo prints any strings passed in to stdout.  This long description is longer than forty cells.
+
+Usage:
+   prog echo [flags] [strings]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestFlagParseErrorFunc(t *testing.T) {
+	wrap := &Command{
+		Name:     "wrap",
+		Short:    "Wrap a program",
+		Long:     "Wrap runs a program, passing through unknown flags.",
+		ArgsName: "[args]",
+		Runner:   RunnerFunc(runEcho),
+		FlagParseErrorFunc: func(cmd *Command, err error, args []string) error {
+			if strings.Contains(err.Error(), "-strict") {
+				return fmt.Errorf("%v (wrap %s)", err, strings.Join(args, " "))
+			}
+			return nil
+		},
+	}
+	wrap.Flags.BoolVar(&optNoNewline, "n", false, "Do not output trailing newline")
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test flag parse errors",
+		Long:     "Prog has a command with lenient flag parsing.",
+		Children: []*Command{wrap},
+	}
+	var tests = []testCase{
+		{
+			Args:   []string{"wrap", "-n", "a", "b"},
+			Stdout: "[a b]",
+		},
+		{
+			Args:   []string{"wrap", "-l", "a", "-n"},
+			Stdout: "[-l a -n]\n",
+		},
+		{
+			Args:   []string{"wrap", "-n=foo", "a"},
+			Stdout: "[-n=foo a]\n",
+		},
+		{
+			Args: []string{"wrap", "-strict", "a"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog wrap: flag provided but not defined: -strict (wrap -strict a)
+
+Wrap runs a program, passing through unknown flags.
+
+Usage:
+   prog wrap [flags] [args]
+
+The prog wrap flags are:
+ -n=false
+   Do not output trailing newline
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"-l", "wrap"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog: flag provided but not defined: -l
+
+Prog has a command with lenient flag parsing.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   wrap        Wrap a program
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestNoArgsName(t *testing.T) {
+	leaf := &Command{
+		Name:   "leaf",
+		Short:  "Leaf takes no args",
+		Long:   "Leaf takes no args, since ArgsName is empty.",
+		Runner: RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test commands without args",
+		Long:     "Prog has a command that takes no args.",
+		Children: []*Command{leaf},
+	}
+	var tests = []testCase{
+		{
+			Args:   []string{"leaf"},
+			Stdout: "[]\n",
+		},
+		{
+			Args: []string{"leaf", "foo"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog leaf: doesn't take arguments
+
+Leaf takes no args, since ArgsName is empty.
+
+Usage:
+   prog leaf [flags]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"leaf", "--", "-foo"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog leaf: doesn't take arguments
+
+Leaf takes no args, since ArgsName is empty.
+
+Usage:
+   prog leaf [flags]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestHyperlinks(t *testing.T) {
+	defer func(orig func(interface{}) bool) { isTerminal = orig }(isTerminal)
+	prog := &Command{
+		Name:  "prog",
+		Short: "Test hyperlinks",
+		Long: `
+Prog is documented at [the prog docs](https://example.com/prog/docs), which
+are linked.  Bare urls like https://example.com/bare and [relative](docs/prog)
+links are printed as-is.
+`,
+		Runner: RunnerFunc(runEcho),
+	}
+	plain := `Prog is documented at the prog docs (https://example.com/prog/docs), which are
+linked.  Bare urls like https://example.com/bare and [relative](docs/prog) links
+are printed as-is.
+
+Usage:
+   prog [flags]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`
+	const (
+		linkStart = "\x1b]8;;https://example.com/prog/docs\x1b\\"
+		linkEnd   = "\x1b]8;;\x1b\\"
+	)
+	linked := `Prog is documented at ` + linkStart + `the prog docs` + linkEnd + `, which are linked.  Bare urls like
+https://example.com/bare and [relative](docs/prog) links are printed as-is.
+
+Usage:
+   prog [flags]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`
+	tests := []struct {
+		Hyperlinks, Terminal bool
+		Vars                 map[string]string
+		Stdout               string
+	}{
+		{false, false, nil, plain},
+		{false, true, nil, plain},
+		{true, false, nil, plain},
+		{true, true, nil, linked},
+		{true, true, map[string]string{"TERM": "dumb"}, plain},
+	}
+	for _, test := range tests {
+		prog.Hyperlinks = test.Hyperlinks
+		isTerminal = func(interface{}) bool { return test.Terminal }
+		runTestCases(t, prog, []testCase{{Args: []string{"-help"}, Vars: test.Vars, Stdout: test.Stdout, NonDeterministic: true}})
+	}
+}
+
+func TestHelpFormat(t *testing.T) {
+	child := &Command{
+		Name:     "child",
+		Short:    "Child command",
+		Long:     "Child is a child command.",
+		ArgsName: "[args]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:               "prog",
+		Short:              "Test help format",
+		Long:               "Prog has formatted help.",
+		HelpSeparator:      '-',
+		HelpSeparatorWidth: 20,
+		HelpIndent:         "  ",
+		Children:           []*Command{child},
+		Topics:             []Topic{{Name: "topic", Short: "Help topic", Long: "Topic is a help topic."}},
+	}
+	tests := []testCase{
+		{
+			Args: []string{"help", "..."},
+			Stdout: `Prog has formatted help.
+
+Usage:
+  prog [flags] <command>
+
+The prog commands are:
+  child       Child command
+  help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+
+The prog additional help topics are:
+  topic       Help topic
+Run "prog help [topic]" for topic details.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+--------------------
+Prog child - Child command
+
+Child is a child command.
+
+Usage:
+  prog child [flags] [args]
+--------------------
+Prog help - Display help for commands or topics
+
+Help with no args displays the usage of the parent command.
+
+Help with args displays the usage of the specified sub-command or help topic.
+
+"help ..." recursively displays help for all commands and topics.
+
+Usage:
+  prog help [flags] [command/topic ...]
+
+[command/topic ...] optionally identifies a specific sub-command or help topic.
+
+The prog help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
+ -style=compact
+   The formatting style for help output:
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
+   Override the default by setting the CMDLINE_STYLE environment variable.
+ -width=80
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
+--------------------
+Prog topic - Help topic
+
+Topic is a help topic.
+`,
+		},
+		{
+			Args: []string{"foo"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog: unknown command "foo"
+
+Prog has formatted help.
+
+Usage:
+  prog [flags] <command>
+
+The prog commands are:
+  child       Child command
+  help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+
+The prog additional help topics are:
+  topic       Help topic
+Run "prog help [topic]" for topic details.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+	prog.HelpSeparator = '＝'
+	prog.HelpSeparatorWidth = 0
+	runTestCases(t, prog, []testCase{{
+		Args: []string{"help", "-style=full", "..."},
+		Vars: map[string]string{"CMDLINE_WIDTH": "30"},
+		Stdout: `Prog has formatted help.
+
+Usage:
+  prog [flags] <command>
+
+The prog commands are:
+  child       Child command
+  help        Display help for
+              commands or
+              topics
+Run "prog help [command]" for
+command usage.
+
+The prog additional help
+topics are:
+  topic       Help topic
+Run "prog help [topic]" for
+topic details.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+＝＝＝＝＝＝＝＝＝＝＝＝＝＝＝
+Prog child - Child command
+
+Child is a child command.
+
+Usage:
+  prog child [flags] [args]
+＝＝＝＝＝＝＝＝＝＝＝＝＝＝＝
+Prog help - Display help for commands or topics
+
+Help with no args displays the
+usage of the parent command.
+
+Help with args displays the
+usage of the specified
+sub-command or help topic.
+
+"help ..." recursively
+displays help for all commands
+and topics.
+
+Usage:
+  prog help [flags] [command/topic ...]
+
+[command/topic ...] optionally
+identifies a specific
+sub-command or help topic.
+
+The prog help flags are:
+ -all-flags=false
+   Display every flag defined
+   on the commands from the
+   given command onward,
+   sorted by command path,
+   instead of displaying
+   usage.
+ -no-globals=false
+   Omit the global flags from
+   the usage, including for
+   recursive help.
+ -search=
+   Display the commands and
+   topics whose name or
+   description contains the
+   given term, ignoring case,
+   instead of displaying
+   usage.
+ -strict=false
+   Stop recursive help at the
+   first error, e.g. a long
+   description that can't be
+   read, instead of displaying
+   the remaining commands and
+   topics.
+ -style=full
+   The formatting style for
+   help output:
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
+   Override the default by
+   setting the CMDLINE_STYLE
+   environment variable.
+ -width=30
+   Format output to this
+   target width in cells, or
+   unlimited if width < 0.
+   Defaults to the terminal
+   width if available, or
+   unlimited if the output
+   isn't a terminal.  Override
+   the default by setting the
+   CMDLINE_WIDTH environment
+   variable.
+＝＝＝＝＝＝＝＝＝＝＝＝＝＝＝
+Prog topic - Help topic
+
+Topic is a help topic.
+`,
+	}})
+}
+
+func TestLongWords(t *testing.T) {
+	const (
+		url  = "https://example.com/a/very/long/path/to/the/documentation/for/prog/v1/index.html" // 80 chars
+		path = "/usr/local/share/prog/config"
+	)
+	var flag string
+	child := &Command{
+		Name:     "child",
+		Short:    "Child command",
+		Long:     "Child is documented at " + url + " and reads " + path + " on startup.",
+		ArgsName: "[args]",
+		ArgsLong: "[args] are described at " + url + ".",
+		Runner:   RunnerFunc(runEcho),
+	}
+	child.Flags.StringVar(&flag, "flag", "", "Flag is described at "+url+".")
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test long words",
+		Long:     "Prog has long words.",
+		Children: []*Command{child},
+		Topics:   []Topic{{Name: "topic", Short: "Help topic", Long: "Topic is described at " + url + " too."}},
+	}
+	tests := []testCase{
+		{
+			Args: []string{"help", "child"},
+			Vars: map[string]string{"CMDLINE_WIDTH": "30"},
+			Stdout: `Child is documented at
+https://example.com/a/very/long/path/to/the/documentation/for/prog/v1/index.html
+and reads
+/usr/local/share/prog/config
+on startup.
+
+Usage:
+   prog child [flags] [args]
+
+[args] are described at
+https://example.com/a/very/long/path/to/the/documentation/for/prog/v1/index.html.
+
+The prog child flags are:
+ -flag=
+   Flag is described at
+   https://example.com/a/very/long/path/to/the/documentation/for/prog/v1/index.html.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"help", "topic"},
+			Vars: map[string]string{"CMDLINE_WIDTH": "30"},
+			Stdout: `Topic is described at
+https://example.com/a/very/long/path/to/the/documentation/for/prog/v1/index.html
+too.
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestCheatSheet(t *testing.T) {
+	prog := &Command{
+		Name:  "prog",
+		Short: "Test cheat sheet",
+		Long:  "Prog has a cheat sheet.",
+		Children: []*Command{
+			{Name: "echo", Short: "Print strings on stdout", Long: "Echo prints strings.", Runner: RunnerFunc(runEcho)},
+			{
+				Name:  "remote",
+				Short: "Manage remotes",
+				Long:  "Remote manages remotes.",
+				Children: []*Command{
+					{Name: "add", Short: "Add a remote with the given name, which must be unique", Long: "Add adds a remote.", Runner: RunnerFunc(runEcho)},
+					{Name: "remove", Short: "Remove a remote", Long: "Remove removes a remote.", Runner: RunnerFunc(runEcho)},
+				},
+			},
+		},
+		Topics: []Topic{{Name: "topic", Short: "Help topic", Long: "Topic is a help topic."}},
+	}
+	vars := map[string]string{"CMDLINE_WIDTH": "50"}
+	tests := []testCase{
+		{
+			Args: []string{"help", "-style=cheatsheet"},
+			Vars: vars,
+			Stdout: `prog echo           Print strings on stdout
+prog remote add     Add a remote with the given
+                    name, which must be unique
+prog remote remove  Remove a remote
+prog help           Display help for commands or
+                    topics
+`,
+		},
+		{
+			Args: []string{"help", "-style=cheatsheet", "..."},
+			Vars: vars,
+			Stdout: `prog echo           Print strings on stdout
+prog remote add     Add a remote with the given
+                    name, which must be unique
+prog remote remove  Remove a remote
+prog help           Display help for commands or
+                    topics
+`,
+		},
+		{
+			Args: []string{"help", "-style=cheatsheet", "remote"},
+			Vars: vars,
+			Stdout: `prog remote add     Add a remote with the given
+                    name, which must be unique
+prog remote remove  Remove a remote
+prog remote help    Display help for commands or
+                    topics
+`,
+		},
+		{
+			Args: []string{"remote", "-help"},
+			Vars: map[string]string{"CMDLINE_WIDTH": "50", "CMDLINE_STYLE": "cheatsheet"},
+			Stdout: `prog remote add     Add a remote with the given
+                    name, which must be unique
+prog remote remove  Remove a remote
+prog remote help    Display help for commands or
+                    topics
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestRelevantGlobalFlags(t *testing.T) {
+	child1 := &Command{
+		Name:   "child1",
+		Short:  "description of child1 command.",
+		Long:   "Child1 only cares about global1.",
+		Runner: RunnerFunc(runEcho),
+	}
+	child1.RelevantGlobalFlags("global1")
+	child2 := &Command{
+		Name:   "child2",
+		Short:  "description of child2 command.",
+		Long:   "Child2 doesn't care about global flags.",
+		Runner: RunnerFunc(runEcho),
+	}
+	child2.RelevantGlobalFlags()
+	prog := &Command{
+		Name:     "program",
+		Short:    "Test relevant global flags.",
+		Long:     "Test relevant global flags.",
+		Children: []*Command{child1, child2},
+	}
+	var tests = []testCase{
+		{
+			Args: []string{"help"},
+			Stdout: `Test relevant global flags.
+
+Usage:
+   program [flags] <command>
+
+The program commands are:
+   child1      description of child1 command.
+   child2      description of child2 command.
+   help        Display help for commands or topics
+Run "program help [command]" for command usage.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"help", "child1"},
+			Stdout: `Child1 only cares about global1.
+
+Usage:
+   program child1 [flags]
+
+The global flags are:
+ -global1=
+   global test flag 1
+
+Run "program help -style=full child1" to show all flags.
+`,
+		},
+		{
+			Args: []string{"child2", "-help"},
+			Stdout: `Child2 doesn't care about global flags.
+
+Usage:
+   program child2 [flags]
+
+Run "program help -style=full child2" to show all flags.
+`,
+		},
+		{
+			Args: []string{"help", "-style=full", "child1"},
+			Stdout: `Child1 only cares about global1.
+
+Usage:
+   program child1 [flags]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+	HideGlobalFlagsExcept(regexp.MustCompile(`^global2$`))
+	runTestCases(t, prog, []testCase{{
+		Args: []string{"help", "child1"},
+		Stdout: `Child1 only cares about global1.
+
+Usage:
+   program child1 [flags]
+
+Run "program help -style=full child1" to show all flags.
+`,
+	}})
+	nonHiddenGlobalFlags = nil
+}
+
+func TestUsageError(t *testing.T) {
+	isolateGlobalFlags(t)
+	child := &Command{
+		Name:     "child",
+		Short:    "Child command",
+		Long:     "Child is a child command.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	leaf := &Command{
+		Name:   "leaf",
+		Short:  "Leaf command",
+		Long:   "Leaf doesn't take arguments.",
+		Runner: RunnerFunc(runEcho),
+		PreParse: func(args []string) ([]string, error) {
+			if len(args) > 0 && args[0] == "-legacy" {
+				return nil, errors.New("-legacy is no longer supported")
+			}
+			return args, nil
+		},
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test usage errors",
+		Long:     "Prog has usage errors.",
+		Children: []*Command{child, leaf},
+		Topics:   []Topic{{Name: "topic", Short: "Help topic", Long: "Topic is a help topic."}},
+	}
+	tests := []struct {
+		args    []string
+		cmd     *Command
+		cmdPath string
+		msg     string
+		kind    UsageErrorKind
+	}{
+		{nil, prog, "prog", "prog: no command specified", Structural},
+		{[]string{"foo"}, prog, "prog", `prog: unknown command "foo"`, UnknownCommand},
+		{[]string{"-foo"}, prog, "prog", "prog: flag provided but not defined: -foo", FlagParse},
+		{[]string{"child", "-foo"}, child, "prog child", "prog child: flag provided but not defined: -foo", FlagParse},
+		{[]string{"child", "bad_arg"}, child, "prog child", "Invalid argument bad_arg", BadArgs},
+		{[]string{"leaf", "arg"}, leaf, "prog leaf", "prog leaf: doesn't take arguments", BadArgs},
+		{[]string{"leaf", "-legacy"}, leaf, "prog leaf", "prog leaf: -legacy is no longer supported", BadArgs},
+		{[]string{"help", "foo"}, prog, "prog", `prog: unknown command or topic "foo"`, UnknownTopic},
+		{[]string{"help", "topic", "foo"}, prog, "prog", `prog topic: unknown command or topic "foo"`, UnknownTopic},
+		{[]string{"help", "f*"}, prog, "prog", `prog: no commands match "f*"`, UnknownCommand},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars), Deterministic: true}
+		err := ParseAndRun(prog, env, test.args)
+		if !errors.Is(err, ErrUsage) {
+			t.Errorf("%q got error %v, want %v", test.args, err, ErrUsage)
+		}
+		var usageErr *UsageError
+		if !errors.As(err, &usageErr) {
+			t.Errorf("%q got error %T, want *UsageError", test.args, err)
+			continue
+		}
+		if got, want := usageErr.Cmd, test.cmd; got != want {
+			t.Errorf("%q got command %p, want %p", test.args, got, want)
+		}
+		if got, want := usageErr.CmdPath, test.cmdPath; got != want {
+			t.Errorf("%q got path %q, want %q", test.args, got, want)
+		}
+		if got, want := usageErr.Message, test.msg; got != want {
+			t.Errorf("%q got message %q, want %q", test.args, got, want)
+		}
+		if got, want := usageErr.Kind, test.kind; got != want {
+			t.Errorf("%q got kind %v, want %v", test.args, got, want)
+		}
+		if got, want := stderr.String(), "ERROR: "+test.msg+"\n\n"; !strings.HasPrefix(got, want) {
+			t.Errorf("%q got stderr %q, want prefix %q", test.args, got, want)
+		}
+		if got, want := ExitCode(err, nil), 2; got != want {
+			t.Errorf("%q got exit code %d, want %d", test.args, got, want)
+		}
+	}
+}
+
+func TestUsageErrorWrap(t *testing.T) {
+	isolateGlobalFlags(t)
+	errConfig := fmt.Errorf("open prog.json: %w", fs.ErrNotExist)
+	errOther := errors.New("other")
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test wrapped usage errors",
+		Long:     "Prog wraps errors in usage errors.",
+		ArgsName: "<mode>",
+		Runner: RunnerFunc(func(env *Env, args []string) error {
+			switch args[0] {
+			case "one":
+				return env.UsageErrorf("parsing config: %w", errConfig)
+			case "two":
+				return env.UsageErrorf("parsing config: %w, then %w", errConfig, errOther)
+			}
+			return env.UsageErrorf("parsing config: %v", errConfig)
+		}),
+	}
+	tests := []struct {
+		mode       string
+		msg        string
+		isNotExist bool
+		isOther    bool
+	}{
+		{"one", "parsing config: open prog.json: file does not exist", true, false},
+		{"two", "parsing config: open prog.json: file does not exist, then other", true, true},
+		{"none", "parsing config: open prog.json: file does not exist", false, false},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars), Deterministic: true}
+		err := ParseAndRun(prog, env, []string{test.mode})
+		if !errors.Is(err, ErrUsage) {
+			t.Errorf("%s got error %v, want it to wrap ErrUsage", test.mode, err)
+		}
+		if got, want := errors.Is(err, fs.ErrNotExist), test.isNotExist; got != want {
+			t.Errorf("%s got errors.Is(fs.ErrNotExist) %v, want %v", test.mode, got, want)
+		}
+		if got, want := errors.Is(err, errOther), test.isOther; got != want {
+			t.Errorf("%s got errors.Is(errOther) %v, want %v", test.mode, got, want)
+		}
+		if got, want := errString(err), test.msg; got != want {
+			t.Errorf("%s got error %q, want %q", test.mode, got, want)
+		}
+		if got, want := stderr.String(), "ERROR: "+test.msg+"\n\nProg wraps errors in usage errors.\n"; !strings.HasPrefix(got, want) {
+			t.Errorf("%s got stderr %q, want prefix %q", test.mode, got, want)
+		}
+	}
+}
+
+func TestHideFlag(t *testing.T) {
+	var visible, experimental string
+	child := &Command{
+		Name:     "child",
+		Short:    "Child command",
+		Long:     "Child is a child command.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test hidden flags",
+		Long:     "Prog has a hidden flag.",
+		Children: []*Command{child},
+	}
+	prog.Flags.StringVar(&visible, "visible", "", "A visible flag.")
+	prog.Flags.StringVar(&experimental, "experimental-long-name", "", "An experimental flag.")
+	prog.HideFlag("experimental-long-name")
+	tests := []testCase{
+		{
+			Args: []string{"-help"},
+			Stdout: `Prog has a hidden flag.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   child       Child command
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+
+The prog flags are:
+ -visible=
+   A visible flag.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"help", "-style=full", "child"},
+			Stdout: `Child is a child command.
+
+Usage:
+   prog child [flags] [strings]
+
+The prog child flags are:
+ -visible=
+   A visible flag.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args:   []string{"-experimental-long-name=x", "-visible=y", "child", "a"},
+			Stdout: "[a]\n",
+		},
+	}
+	runTestCases(t, prog, tests)
+	if got, want := experimental, "x"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	prog.HideFlag("unknown")
+	runTestCases(t, prog, []testCase{{
+		Args: []string{},
+		Err: `prog: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+HideFlag "unknown" doesn't match any flag of the command.`,
+	}})
+}
+
+func TestPostParse(t *testing.T) {
+	isolateGlobalFlags(t)
+	var name, output string
+	var verbose, quiet bool
+	errNoName := errors.New("-name is required")
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test post-parse validation",
+		Long:     "Prog validates its flags.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+		PostParse: func(args []string) []error {
+			var errs []error
+			if name == "" {
+				errs = append(errs, errNoName)
+			}
+			if verbose && quiet {
+				errs = append(errs, errors.New("-verbose and -quiet are mutually exclusive"))
+			}
+			if output != "" && output != "json" && output != "text" {
+				errs = append(errs, fmt.Errorf("-output must be json or text, not %q", output))
+			}
+			return errs
+		},
+	}
+	prog.Flags.StringVar(&name, "name", "", "Name to use.")
+	prog.Flags.StringVar(&output, "output", "", "Output format.")
+	prog.Flags.BoolVar(&verbose, "verbose", false, "Print more output.")
+	prog.Flags.BoolVar(&quiet, "quiet", false, "Print less output.")
+	// The errors are listed before the usage.
+	runTestCases(t, prog, []testCase{{
+		Args: []string{"-verbose", "-quiet", "-output=xml"},
+		Err:  errUsageStr,
+		Stderr: `ERROR: prog: invalid usage:
+ - -name is required
+ - -verbose and -quiet are mutually exclusive
+ - -output must be json or text, not "xml"
+
+Prog validates its flags.
+
+Usage:
+   prog [flags] [strings]
+
+The prog flags are:
+ -name=
+   Name to use.
+ -output=xml
+   Output format.
+ -quiet=true
+   Print less output.
+ -verbose=true
+   Print more output.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+	}})
+	// Check the errors directly, without the usage.
+	prog.SuppressUsageOnError = true
+	tests := []struct {
+		args    []string
+		numErrs int
+		stderr  string
+	}{
+		{[]string{"-name=x", "a"}, 0, ""},
+		{[]string{"-verbose"}, 1, "ERROR: prog: -name is required\n"},
+		{[]string{"-verbose", "-quiet", "-output=xml", "a"}, 3, `ERROR: prog: invalid usage:
+ - -name is required
+ - -verbose and -quiet are mutually exclusive
+ - -output must be json or text, not "xml"
+`},
+	}
+	for _, test := range tests {
+		name, output, verbose, quiet = "", "", false, false
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars), Deterministic: true}
+		err := ParseAndRun(prog, env, test.args)
+		if got, want := stderr.String(), test.stderr; got != want {
+			t.Errorf("%q got stderr %q, want %q", test.args, got, want)
+		}
+		if test.numErrs == 0 {
+			if err != nil {
+				t.Errorf("%q got error %v", test.args, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrUsage) || !errors.Is(err, errNoName) {
+			t.Errorf("%q got error %v, want %v and %v", test.args, err, ErrUsage, errNoName)
+		}
+		var usageErr *UsageError
+		if !errors.As(err, &usageErr) {
+			t.Errorf("%q got error %T, want *UsageError", test.args, err)
+		} else if got, want := len(usageErr.Errs), test.numErrs; got != want {
+			t.Errorf("%q got %d errors, want %d", test.args, got, want)
+		}
+	}
+}
+
+func TestErrorPrefix(t *testing.T) {
+	child := &Command{
+		Name:     "child",
+		Short:    "Child command",
+		Long:     "Child is a child command.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:                 "prog",
+		Short:                "Test error prefixes",
+		Long:                 "Prog has error prefixes.",
+		Children:             []*Command{child},
+		SuppressUsageOnError: true,
+	}
+	args := [][]string{
+		{"foo"},
+		{"child", "-foo"},
+		{"child", "bad_arg"},
+		{"help", "child", "foo"},
+	}
+	tests := []struct {
+		prefix ErrorPrefix
+		label  string
+		stderr []string
+	}{
+		{ErrorPrefixPath, "", []string{
+			`ERROR: prog: unknown command "foo"`,
+			"ERROR: prog child: flag provided but not defined: -foo",
+			"ERROR: Invalid argument bad_arg",
+			`ERROR: prog child: unknown command or topic "foo"`,
+		}},
+		{ErrorPrefixRoot, "", []string{
+			`ERROR: prog: unknown command "foo"`,
+			"ERROR: prog: flag provided but not defined: -foo",
+			"ERROR: Invalid argument bad_arg",
+			`ERROR: prog: unknown command or topic "foo"`,
+		}},
+		{ErrorPrefixNone, "error:", []string{
+			`error: unknown command "foo"`,
+			"error: flag provided but not defined: -foo",
+			"error: Invalid argument bad_arg",
+			`error: unknown command or topic "foo"`,
+		}},
+	}
+	for _, test := range tests {
+		prog.ErrorPrefix, prog.ErrorLabel = test.prefix, test.label
+		var cases []testCase
+		for i, arg := range args {
+			cases = append(cases, testCase{Args: arg, Err: errUsageStr, Stderr: test.stderr[i] + "\n"})
+		}
+		runTestCases(t, prog, cases)
+	}
+}
+
+func TestExamples(t *testing.T) {
+	echo := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout.",
+		ArgsName: "[strings]",
+		ArgsLong: "[strings] are arbitrary strings that will be echoed.",
+		Examples: []Example{
+			{Description: "Print a greeting:", Command: "prog echo hello"},
+			{Description: "Print a long greeting, which has a description that is wrapped to the width:", Command: "prog echo hello to all of the people in the world, which is longer than the width"},
+		},
+		Runner: RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test examples",
+		Long:     "Prog has examples.",
+		Children: []*Command{echo},
+	}
+	tests := []testCase{
+		{
+			Args: []string{"help", "echo"},
+			Vars: map[string]string{"CMDLINE_WIDTH": "60"},
+			Stdout: `Echo prints any strings passed in to stdout.
+
+Usage:
+   prog echo [flags] [strings]
+
+[strings] are arbitrary strings that will be echoed.
+
+Examples:
+   Print a greeting:
+      prog echo hello
+
+   Print a long greeting, which has a description that is
+   wrapped to the width:
+      prog echo hello to all of the people in the world, which is longer than the width
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"help", "-style=godoc", "..."},
+			Stdout: `Prog has examples.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   echo        Print strings on stdout
+   help        Display help for commands or topics
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+
+Prog echo - Print strings on stdout
+
+Echo prints any strings passed in to stdout.
+
+Usage:
+   prog echo [flags] [strings]
+
+[strings] are arbitrary strings that will be echoed.
+
+Examples:
+   Print a greeting:
+      prog echo hello
+
+   Print a long greeting, which has a description that is wrapped to the width:
+      prog echo hello to all of the people in the world, which is longer than the width
+
+Prog help - Display help for commands or topics
+
+Help with no args displays the usage of the parent command.
+
+Help with args displays the usage of the specified sub-command or help topic.
+
+"help ..." recursively displays help for all commands and topics.
+
+Usage:
+   prog help [flags] [command/topic ...]
+
+[command/topic ...] optionally identifies a specific sub-command or help topic.
+
+The prog help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
+ -style=compact
+   The formatting style for help output:
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
+   Override the default by setting the CMDLINE_STYLE environment variable.
+ -width=<terminal width>
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestWithHint(t *testing.T) {
+	isolateGlobalFlags(t)
+	errRun := errors.New("can't open config")
+	longHint := "the config file is read from $HOME/.config/prog/config.json unless -config is set to a different path"
+	prog := &Command{
+		Name:                 "prog",
+		Short:                "Test error hints",
+		Long:                 "Prog reports errors with hints.",
+		ArgsName:             "<mode>",
+		PrintRunErrors:       true,
+		SuppressUsageOnError: true,
+		Runner: RunnerFunc(func(env *Env, args []string) error {
+			switch args[0] {
+			case "run":
+				return WithHint(WithHint(errRun, "check that the file exists"), longHint)
+			case "usage":
+				return env.UsageErrorf("bad mode: %v", WithHint(errors.New("usage"), "try \"prog run\""))
+			case "wrapped":
+				return fmt.Errorf("wrapped: %w", WithHint(ErrExitCode(3), "ignored"))
+			}
+			return nil
+		}),
+		PostParse: func(args []string) []error {
+			if len(args) == 0 {
+				return []error{WithHint(errors.New("no mode"), "pass run or usage"), errors.New("no args")}
+			}
+			return nil
+		},
+	}
+	tests := []struct {
+		args   []string
+		err    string
+		stderr string
+	}{
+		{[]string{"run"}, errRun.Error(), `prog: can't open config
+   check that the file exists
+   the config file is read from $HOME/.config/prog/config.json unless -config is
+   set to a different path
+`},
+		{[]string{"usage"}, errUsageStr, `ERROR: bad mode: usage
+   try "prog run"
+`},
+		{nil, errUsageStr, `ERROR: prog: invalid usage:
+ - no mode
+ - no args
+   pass run or usage
+`},
+		// Exit codes are found through hints, and aren't printed.
+		{[]string{"wrapped"}, "wrapped: exit code 3", ""},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars), Deterministic: true}
+		err := ParseAndRun(prog, env, test.args)
+		if got, want := errString(err), test.err; !errMatches(err, want) {
+			t.Errorf("%q got error %q, want %q", test.args, got, want)
+		}
+		if got, want := stderr.String(), test.stderr; got != want {
+			t.Errorf("%q got stderr %q, want %q", test.args, got, want)
+		}
+		if test.args != nil && test.args[0] == "run" && !errors.Is(err, errRun) {
+			t.Errorf("%q got error %v, want it to wrap %v", test.args, err, errRun)
+		}
+	}
+	// ExitCode prints the hints, and isn't fooled by the wrapper.
+	var buf bytes.Buffer
+	if got, want := ExitCode(WithHint(errRun, "hint"), &buf), 1; got != want {
+		t.Errorf("got exit code %d, want %d", got, want)
+	}
+	if got, want := buf.String(), "ERROR: can't open config\n   hint\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+	if got, want := ExitCode(WithHint(ErrExitCode(4), "hint"), nil), 4; got != want {
+		t.Errorf("got exit code %d, want %d", got, want)
+	}
+	if err := WithHint(nil, "hint"); err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+}
+
+func TestFlagsFunc(t *testing.T) {
+	isolateGlobalFlags(t)
+	var calls []string
+	var level int
+	var format, bFormat string
+	newChild := func(name string) *Command {
+		return &Command{
+			Name:     name,
+			Short:    "Child " + name,
+			Long:     "Child " + name + " has lazy flags.",
+			ArgsName: "[strings]",
+			Runner:   RunnerFunc(runEcho),
+			FlagsFunc: func(fs *flag.FlagSet) {
+				calls = append(calls, name)
+				fs.IntVar(&level, name+"-level", 1, "  Level of "+name+".  ")
+				fs.StringVar(&format, "format", "lazy", "Output format.")
+			},
+		}
+	}
+	a, b := newChild("a"), newChild("b")
+	// The flag defined in Flags takes precedence over the one from FlagsFunc.
+	b.Flags.StringVar(&bFormat, "format", "text", "Output format.")
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test lazy flags",
+		Long:     "Prog has children with lazy flags.",
+		Children: []*Command{a, b},
+	}
+	runTestCases(t, prog, []testCase{{
+		Args: []string{"help", "b"},
+		Stdout: `Child b has lazy flags.
+
+Usage:
+   prog b [flags] [strings]
+
+The prog b flags are:
+ -b-level=1
+   Level of b.
+ -format=text
+   Output format.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+	}})
+	if got, want := calls, []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got calls %v, want %v", got, want)
+	}
+	// Only the flags of commands on the path are defined.
+	calls = nil
+	a.flagsFuncCalled, b.flagsFuncCalled = false, false
+	b.Flags = flag.FlagSet{}
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars), Deterministic: true}
+	if err := ParseAndRun(prog, env, []string{"a", "-a-level=3", "-format=json", "x"}); err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+	if got, want := calls, []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got calls %v, want %v", got, want)
+	}
+	if got, want := level, 3; got != want {
+		t.Errorf("got level %d, want %d", got, want)
+	}
+	if got, want := format, "json"; got != want {
+		t.Errorf("got format %q, want %q", got, want)
+	}
+	if got, want := stdout.String(), "[x]\n"; got != want {
+		t.Errorf("got stdout %q, want %q", got, want)
+	}
+}
+
+func TestErrorColor(t *testing.T) {
+	defer func(orig func(interface{}) bool) { isTerminal = orig }(isTerminal)
+	prog := &Command{
+		Name:                 "prog",
+		Short:                "Test error color",
+		Long:                 "Prog colors its errors.",
+		Runner:               RunnerFunc(runEcho),
+		SuppressUsageOnError: true,
+	}
+	const (
+		plain   = "ERROR: prog: flag provided but not defined: -xx\n"
+		colored = "\x1b[1;31mERROR:\x1b[0m prog: flag provided but not defined: -xx\n"
+	)
+	tests := []struct {
+		Color    ErrorColor
+		Terminal bool
+		Vars     map[string]string
+		Stderr   string
+	}{
+		{ErrorColorAuto, false, nil, plain},
+		{ErrorColorAuto, true, nil, colored},
+		{ErrorColorAuto, true, map[string]string{"NO_COLOR": "1"}, plain},
+		{ErrorColorAuto, true, map[string]string{"TERM": "dumb"}, plain},
+		{ErrorColorAlways, false, map[string]string{"NO_COLOR": "1"}, colored},
+		{ErrorColorNever, true, nil, plain},
+	}
+	for _, test := range tests {
+		prog.ErrorColor = test.Color
+		isTerminal = func(interface{}) bool { return test.Terminal }
+		runTestCases(t, prog, []testCase{{Args: []string{"-xx"}, Vars: test.Vars, Err: errUsageStr, Stderr: test.Stderr, NonDeterministic: true}})
+	}
+	// ExitCode colors the label for terminals, unless the environment of the
+	// process opts out.
+	isTerminal = func(interface{}) bool { return true }
+	t.Setenv("TERM", "xterm")
+	for _, test := range []struct {
+		noColor, want string
+	}{
+		{"", "\x1b[1;31mERROR:\x1b[0m failed\n"},
+		{"1", "ERROR: failed\n"},
+	} {
+		t.Setenv("NO_COLOR", test.noColor)
+		var buf bytes.Buffer
+		ExitCode(errors.New("failed"), &buf)
+		if got, want := buf.String(), test.want; got != want {
+			t.Errorf("NO_COLOR=%q got output %q, want %q", test.noColor, got, want)
+		}
+	}
+}
+
+// tagWriter writes each chunk of data to w preceded by tag.
+type tagWriter struct {
+	tag string
+	w   io.Writer
+}
+
+func (t tagWriter) Write(data []byte) (int, error) {
+	if _, err := fmt.Fprintf(t.w, "%s%s", t.tag, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func TestOutputFilter(t *testing.T) {
+	isolateGlobalFlags(t)
+	var filtered []string
+	newFilter := func(tag string) func(*Command, io.Writer) io.Writer {
+		return func(cmd *Command, w io.Writer) io.Writer {
+			filtered = append(filtered, tag+cmd.Name)
+			return tagWriter{tag, w}
+		}
+	}
+	child := &Command{
+		Name:         "child",
+		Short:        "Child command",
+		Long:         "Child has an output filter.",
+		ArgsName:     "[strings]",
+		Runner:       RunnerFunc(runEcho),
+		OutputFilter: newFilter("<child>"),
+	}
+	other := &Command{
+		Name:     "other",
+		Short:    "Other command",
+		Long:     "Other has no output filter.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:         "prog",
+		Short:        "Test output filters",
+		Long:         "Prog filters the output of its children.",
+		Children:     []*Command{child, other},
+		OutputFilter: newFilter("<prog>"),
+	}
+	tests := []struct {
+		args     []string
+		stdout   string
+		filtered []string
+	}{
+		{[]string{"child", "a"}, "<prog><child>[a]\n", []string{"<prog>child", "<child>child"}},
+		{[]string{"other", "a"}, "<prog>[a]\n", []string{"<prog>other"}},
+		{[]string{"help", "-style=shortonly", "other"}, "Other command\n", nil},
+	}
+	for _, test := range tests {
+		filtered = nil
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(prog, env, test.args); err != nil {
+			t.Errorf("%q got error %v, want nil", test.args, err)
+		}
+		if got, want := stdout.String(), test.stdout; got != want {
+			t.Errorf("%q got stdout %q, want %q", test.args, got, want)
+		}
+		if got, want := filtered, test.filtered; !reflect.DeepEqual(got, want) {
+			t.Errorf("%q got filtered %q, want %q", test.args, got, want)
+		}
+	}
+}
+
+func TestNestedUsageErrors(t *testing.T) {
+	isolateGlobalFlags(t)
+	inner := &Command{
+		Name:     "inner",
+		Short:    "Inner command",
+		Long:     "Inner is run by outer commands.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	newDelegate := func(name string, wrap func(*Env, error) error) *Command {
+		return &Command{
+			Name:     name,
+			Short:    "Run inner",
+			Long:     "Runs inner with the args.",
+			ArgsName: "[args]",
+			Runner: RunnerFunc(func(env *Env, args []string) error {
+				if err := ParseAndRun(inner, env, args); err != nil {
+					return wrap(env, err)
+				}
+				return nil
+			}),
+		}
+	}
+	prog := &Command{
+		Name:           "prog",
+		Short:          "Test nested usage errors",
+		Long:           "Prog delegates to inner.",
+		PrintRunErrors: true,
+		Children: []*Command{
+			newDelegate("usage", func(env *Env, err error) error { return env.UsageErrorf("inner failed: %v", err) }),
+			newDelegate("wrap", func(env *Env, err error) error { return fmt.Errorf("inner failed: %w", err) }),
+			newDelegate("plain", func(env *Env, err error) error { return err }),
+		},
+	}
+	for _, name := range []string{"usage", "wrap", "plain"} {
+		args := []string{name, "--", "-bad"}
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars), Deterministic: true}
+		err := ParseAndRun(prog, env, args)
+		if !errors.Is(err, ErrUsage) {
+			t.Errorf("%q got error %v, want it to wrap ErrUsage", args, err)
+		}
+		code := ExitCode(err, &stderr)
+		if got, want := code, 2; got != want {
+			t.Errorf("%q got exit code %d, want %d", args, got, want)
+		}
+		got := stderr.String()
+		if want := "ERROR: inner: flag provided but not defined: -bad\n"; !strings.HasPrefix(got, want) {
+			t.Errorf("%q got stderr %q, want prefix %q", args, got, want)
+		}
+		if n := strings.Count(got, "Usage:"); n != 1 {
+			t.Errorf("%q got usage %d times in stderr %q, want once", args, n, got)
+		}
+	}
+}
+
+func TestHelpAllFlags(t *testing.T) {
+	var verbose, dryRun bool
+	var format, name string
+	sub := &Command{
+		Name:     "sub",
+		Short:    "Sub command",
+		Long:     "Sub has flags of its own.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	sub.Flags.StringVar(&format, "format", "text", "Output format.")
+	sub.Flags.BoolVar(&dryRun, "dry-run", false, "Don't change anything.")
+	other := &Command{
+		Name:     "other",
+		Short:    "Other command",
+		Long:     "Other has a hidden flag.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	other.Flags.StringVar(&name, "name", "", "Name to use.")
+	other.Flags.StringVar(&format, "format", "json", "Output format, which isn't consistent with sub.")
+	other.HideFlag("name")
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test all flags",
+		Long:     "Prog has flags on several commands.",
+		Children: []*Command{sub, other},
+	}
+	prog.Flags.BoolVar(&verbose, "verbose", false, "Print more output.")
+	runTestCases(t, prog, []testCase{
+		{
+			Args: []string{"help", "-all-flags"},
+			Stdout: `prog -verbose=false
+   Print more output.
+prog help -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+prog help -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+prog help -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+prog help -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
+prog help -style=compact
+   The formatting style for help output:
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
+   Override the default by setting the CMDLINE_STYLE environment variable.
+prog help -width=<terminal width>
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
+prog other -format=json
+   Output format, which isn't consistent with sub.
+prog sub -dry-run=false
+   Don't change anything.
+prog sub -format=text
+   Output format.
+`,
+		},
+		{
+			Args: []string{"help", "-all-flags", "sub"},
+			Stdout: `prog sub -dry-run=false
+   Don't change anything.
+prog sub -format=text
+   Output format.
+`,
+		},
+	})
+}
+
+func TestUnknownCommandError(t *testing.T) {
+	isolateGlobalFlags(t)
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test unknown commands",
+		Long:     "Prog adds plugins on demand.",
+		Children: []*Command{{Name: "builtin", Short: "Builtin", Long: "Builtin.", ArgsName: "[strings]", Runner: RunnerFunc(runEcho)}},
+		Topics:   []Topic{{Name: "topic", Short: "Topic", Long: "Topic.", Children: []Topic{{Name: "sub", Short: "Sub", Long: "Sub."}}}},
+	}
+	// Unknown commands and topics are printed by default.
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars), Deterministic: true}
+	err := ParseAndRun(prog, env, []string{"plugin", "a", "b"})
+	var unknownCmd *UnknownCommandError
+	if !errors.As(err, &unknownCmd) || !errors.Is(err, ErrUsage) {
+		t.Fatalf("got error %v, want it to wrap *UnknownCommandError and ErrUsage", err)
+	}
+	if got, want := *unknownCmd, (UnknownCommandError{prog, "plugin", []string{"a", "b"}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	if got, want := stderr.String(), "ERROR: prog: unknown command \"plugin\"\n\nProg adds plugins on demand.\n"; !strings.HasPrefix(got, want) {
+		t.Errorf("got stderr %q, want prefix %q", got, want)
+	}
+	// With DeferUnknownCommands, nothing is printed, and the caller may dispatch
+	// to a dynamically added child.
+	prog.DeferUnknownCommands = true
+	stderr.Reset()
+	err = ParseAndRun(prog, env, []string{"plugin", "a", "b"})
+	if !errors.As(err, &unknownCmd) {
+		t.Fatalf("got error %v, want it to wrap *UnknownCommandError", err)
+	}
+	if got := stderr.String(); got != "" {
+		t.Errorf("got stderr %q, want none", got)
+	}
+	unknownCmd.Parent.Children = append(unknownCmd.Parent.Children, &Command{
+		Name:     unknownCmd.Name,
+		Short:    "Plugin",
+		Long:     "Plugin is added on demand.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	})
+	if err := ParseAndRun(prog, env, append([]string{unknownCmd.Name}, unknownCmd.Args...)); err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+	if got, want := stdout.String(), "[a b]\n"; got != want {
+		t.Errorf("got stdout %q, want %q", got, want)
+	}
+	// Unknown help topics are deferred too.
+	tests := []struct {
+		args []string
+		want UnknownTopicError
+	}{
+		{[]string{"help", "nosuch", "x"}, UnknownTopicError{prog, "", "nosuch", []string{"x"}}},
+		{[]string{"help", "topic", "nosuch"}, UnknownTopicError{prog, "topic", "nosuch", []string{}}},
+	}
+	for _, test := range tests {
+		stderr.Reset()
+		err := ParseAndRun(prog, env, test.args)
+		var unknownTopic *UnknownTopicError
+		if !errors.As(err, &unknownTopic) || !errors.Is(err, ErrUsage) {
+			t.Errorf("%q got error %v, want it to wrap *UnknownTopicError and ErrUsage", test.args, err)
+			continue
+		}
+		if got, want := *unknownTopic, test.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("%q got %#v, want %#v", test.args, got, want)
+		}
+		if got := stderr.String(); got != "" {
+			t.Errorf("%q got stderr %q, want none", test.args, got)
+		}
+	}
+}
+
+func TestHelpSections(t *testing.T) {
+	isolateGlobalFlags(t)
+	echo := &Command{
+		Name:         "echo",
+		Short:        "Print strings on stdout",
+		Long:         "Echo prints any strings passed in to stdout.",
+		ArgsName:     "[strings]",
+		ArgsLong:     "[strings] are arbitrary strings that will be echoed.",
+		Runner:       RunnerFunc(runEcho),
+		HelpSections: []string{"usage", "args", "long"},
+	}
+	prog := &Command{
+		Name:         "prog",
+		Short:        "Test help sections",
+		Long:         "Prog shows its flags before its commands.",
+		Children:     []*Command{echo},
+		HelpSections: []string{"long", "usage", "flags", "commands"},
+	}
+	prog.Flags.Bool("verbose", false, "Print verbose output.")
+	runTestCases(t, prog, []testCase{
+		{
+			Args: []string{"help"},
+			Stdout: `Prog shows its flags before its commands.
+
+Usage:
+   prog [flags] <command>
+
+The prog flags are:
+ -verbose=false
+   Print verbose output.
+
+The prog commands are:
+   echo        Print strings on stdout
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+`,
+		},
+		{
+			Args: []string{"help", "echo"},
+			Stdout: `Usage:
+   prog echo [flags] [strings]
+
+[strings] are arbitrary strings that will be echoed.
+
+Echo prints any strings passed in to stdout.
+`,
+		},
+	})
+	echo.HelpSections = []string{"usage", "footer"}
+	wantErr := `prog echo: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+HelpSections has unknown section "footer".`
+	if err := prog.Validate(); err == nil || err.Error() != wantErr {
+		t.Errorf("got error %v, want %q", err, wantErr)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	isolateGlobalFlags(t)
+	errTransient, errFatal := errors.New("transient"), errors.New("fatal")
+	var runs int
+	var backoffs []int
+	var errs []error
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test retries",
+		Long:     "Prog returns the next error on each run.",
+		ArgsName: "[args]",
+		Runner: RunnerFunc(func(env *Env, args []string) error {
+			runs++
+			if len(errs) == 0 {
+				return nil
+			}
+			err := errs[0]
+			errs = errs[1:]
+			return err
+		}),
+		RetryFunc:  func(err error) bool { return err == errTransient },
+		MaxRetries: 2,
+		RetryBackoff: func(retry int) time.Duration {
+			backoffs = append(backoffs, retry)
+			return 0
+		},
+	}
+	usageErr := &UsageError{Message: "bad arg", Errs: []error{errTransient}}
+	tests := []struct {
+		errs     []error
+		err      error
+		runs     int
+		backoffs []int
+	}{
+		{nil, nil, 1, nil},
+		{[]error{errTransient}, nil, 2, []int{1}},
+		{[]error{errTransient, errTransient}, nil, 3, []int{1, 2}},
+		{[]error{errTransient, errTransient, errTransient}, errTransient, 3, []int{1, 2}},
+		{[]error{errTransient, errFatal}, errFatal, 2, []int{1}},
+		{[]error{errFatal}, errFatal, 1, nil},
+		{[]error{usageErr}, usageErr, 1, nil},
+	}
+	for _, test := range tests {
+		runs, backoffs, errs = 0, nil, test.errs
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars), Deterministic: true}
+		if got, want := ParseAndRun(prog, env, nil), test.err; got != want {
+			t.Errorf("%v got error %v, want %v", test.errs, got, want)
+		}
+		if got, want := runs, test.runs; got != want {
+			t.Errorf("%v got %d runs, want %d", test.errs, got, want)
+		}
+		if got, want := backoffs, test.backoffs; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v got backoffs %v, want %v", test.errs, got, want)
+		}
+	}
+}
+
+func TestHelpNoGlobals(t *testing.T) {
+	echo := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test help without global flags",
+		Long:     "Prog has a single command.",
+		Children: []*Command{echo},
+	}
+	runTestCases(t, prog, []testCase{
+		{
+			Args: []string{"help", "-no-globals"},
+			Stdout: `Prog has a single command.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   echo        Print strings on stdout
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+`,
+		},
+		{
+			Args: []string{"help", "-no-globals", "echo"},
+			Stdout: `Echo prints any strings passed in to stdout.
+
+Usage:
+   prog echo [flags] [strings]
+`,
+		},
+		{
+			Args: []string{"help", "-no-globals", "..."},
+			Stdout: `Prog has a single command.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   echo        Print strings on stdout
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+================================================================================
+Prog echo - Print strings on stdout
+
+Echo prints any strings passed in to stdout.
+
+Usage:
+   prog echo [flags] [strings]
+================================================================================
+Prog help - Display help for commands or topics
+
+Help with no args displays the usage of the parent command.
+
+Help with args displays the usage of the specified sub-command or help topic.
+
+"help ..." recursively displays help for all commands and topics.
+
+Usage:
+   prog help [flags] [command/topic ...]
+
+[command/topic ...] optionally identifies a specific sub-command or help topic.
+
+The prog help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
+ -style=compact
+   The formatting style for help output:
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
+   Override the default by setting the CMDLINE_STYLE environment variable.
+ -width=80
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
+`,
+		},
+	})
+}
+
+func TestGlobalFlagFilter(t *testing.T) {
+	child := &Command{
+		Name:     "child",
+		Short:    "Child command",
+		Long:     "Child is a child command.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test global flag filters",
+		Long:     "Prog only exposes the global1 flag.",
+		Children: []*Command{child},
+		GlobalFlagFilter: func(name string) bool {
+			return name == "global1"
+		},
+	}
+	runTestCases(t, prog, []testCase{
+		{
+			Args: []string{"-help"},
+			Stdout: `Prog only exposes the global1 flag.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   child       Child command
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+
+The global flags are:
+ -global1=
+   global test flag 1
+`,
+		},
+		{
+			Args:        []string{"-global1=a", "child", "b"},
+			Stdout:      "[b]\n",
+			GlobalFlag1: "a",
+		},
+		{
+			Args: []string{"-global2=1", "child"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog: flag provided but not defined: -global2
+
+Prog only exposes the global1 flag.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   child       Child command
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+
+The global flags are:
+ -global1=
+   global test flag 1
+`,
+		},
+		{
+			Args: []string{"child", "-global2=1"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog child: flag provided but not defined: -global2
+
+Child is a child command.
+
+Usage:
+   prog child [flags] [strings]
+
+The global flags are:
+ -global1=
+   global test flag 1
+`,
+		},
+	})
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	newEcho := func(name, prefix string) *Command {
+		return &Command{
+			Name:     name,
+			Short:    "Print strings with prefix " + prefix,
+			Long:     "Echo prints any strings passed in to stdout.",
+			ArgsName: "[strings]",
+			Runner: RunnerFunc(func(env *Env, args []string) error {
+				fmt.Fprintln(env.Stdout, prefix, args)
+				return nil
+			}),
+		}
+	}
+	sub := &Command{
+		Name:     "sub",
+		Short:    "Sub command",
+		Long:     "Sub has children that only differ by case.",
+		Children: []*Command{newEcho("echo", "lower"), newEcho("ECHO", "upper")},
+		Topics: []Topic{{
+			Name:     "Topic",
+			Short:    "Topic short",
+			Long:     "Topic long.",
+			Children: []Topic{{Name: "nested", Short: "Nested short", Long: "Nested long."}},
+		}},
+	}
+	prog := &Command{
+		Name:                 "prog",
+		Short:                "Test case-insensitive names",
+		Long:                 "Prog matches names ignoring case.",
+		Children:             []*Command{sub, newEcho("print", "print")},
+		CaseInsensitive:      true,
+		SuppressUsageOnError: true,
+	}
+	tests := []testCase{
+		{Args: []string{"SUB", "echo", "a"}, Stdout: "lower [a]\n"},
+		{Args: []string{"Sub", "ECHO", "a"}, Stdout: "upper [a]\n"},
+		{Args: []string{"sub", "Echo", "a"}, Stdout: "lower [a]\n"},
+		{Args: []string{"PRINT", "a"}, Stdout: "print [a]\n"},
+		{Args: []string{"HELP", "-style=shortonly", "PRINT"}, Stdout: "Print strings with prefix print\n"},
+		{Args: []string{"help", "-style=shortonly", "sub", "ECHO"}, Stdout: "Print strings with prefix upper\n"},
+		{Args: []string{"sub", "Help", "topic", "NESTED"}, Stdout: "Nested long.\n"},
+		{
+			Args: []string{"Sub", "help", "TOPIC"},
+			Stdout: `Topic long.
+
+The prog sub Topic sub-topics are:
+   nested      Nested short
+Run "prog sub help Topic [topic]" for topic details.
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+	prog.CaseInsensitive = false
+	runTestCases(t, prog, []testCase{
+		{Args: []string{"sub", "ECHO", "a"}, Stdout: "upper [a]\n"},
+		{
+			Args:   []string{"SUB", "echo", "a"},
+			Err:    errUsageStr,
+			Stderr: "ERROR: prog: unknown command \"SUB\"\n",
+		},
+		{
+			Args:   []string{"help", "sub", "Topic", "NESTED"},
+			Err:    errUsageStr,
+			Stderr: "ERROR: prog sub Topic: unknown command or topic \"NESTED\"\n",
+		},
+	})
+}
+
+func TestRuneWidthFunc(t *testing.T) {
+	newChild := func(name string) *Command {
+		return &Command{
+			Name:   name,
+			Short:  "Short of " + name,
+			Long:   "Long of " + name + ".",
+			Runner: RunnerFunc(func(*Env, []string) error { return nil }),
+		}
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test rune widths",
+		Long:     "世界世界世界世界世界 世界世界世界世界世界",
+		Children: []*Command{newChild("世界世界世界世界"), newChild("echo")},
+	}
+	args := []string{"help", "-no-globals", "-width=30"}
+	// By default wide runes are 2 cells.
+	runTestCases(t, prog, []testCase{{Args: args, Stdout: `世界世界世界世界世界
+世界世界世界世界世界
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   世界世界世界世界 Short of
+                    世界世界世界世界
+   echo             Short of
+                    echo
+   help             Display
+                    help for
+                    commands
+                    or topics
+Run "prog help [command]" for
+command usage.
+`}})
+	// Treat all runes as 1 cell.
+	prog.RuneWidthFunc = func(rune) int { return 1 }
+	runTestCases(t, prog, []testCase{{Args: args, Stdout: `世界世界世界世界世界 世界世界世界世界世界
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   世界世界世界世界    Short of
+               世界世界世界世界
+   echo        Short of echo
+   help        Display help
+               for commands or
+               topics
+Run "prog help [command]" for
+command usage.
+`}})
+}
+
+// newParseTree returns a tree of commands with flags, for tests of
+// Command.Parse.
+func newParseTree() *Command {
+	noop := RunnerFunc(func(*Env, []string) error { return errors.New("ran") })
+	echo := &Command{
+		Name:     "echo",
+		Short:    "Print strings",
+		Long:     "Echo prints strings.",
+		ArgsName: "[strings]",
+		Runner:   noop,
+	}
+	echo.Flags.Bool("n", false, "Omit the trailing newline.")
+	echo.Flags.String("sep", " ", "Separator between strings.")
+	sleep := &Command{
+		Name:   "sleep",
+		Short:  "Sleep",
+		Long:   "Sleep sleeps for the duration.",
+		Runner: noop,
+	}
+	sleep.Flags.Duration("duration", time.Second, "Duration to sleep.")
+	sub := &Command{
+		Name:     "sub",
+		Short:    "Sub command",
+		Long:     "Sub has children.",
+		Children: []*Command{echo, sleep},
+		Topics:   []Topic{{Name: "topic", Short: "Topic short", Long: "Topic long."}},
+	}
+	sub.Flags.Int("level", 0, "Level of sub.")
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test Parse",
+		Long:     "Prog tests Parse.",
+		Children: []*Command{sub},
+	}
+	prog.Flags.Bool("verbose", false, "Verbose output.")
+	return prog
+}
+
+func TestCommandParse(t *testing.T) {
+	isolateGlobalFlags(t)
+	tests := []struct {
+		args     []string
+		wantCmd  string
+		wantArgs []string
+		wantErr  error
+	}{
+		{[]string{"sub", "echo", "a", "b"}, "echo", []string{"a", "b"}, nil},
+		{[]string{"-verbose", "sub", "-level=2", "echo", "-n", "-sep=,", "a"}, "echo", []string{"a"}, nil},
+		{[]string{"sub", "echo", "a", "-n"}, "echo", []string{"a", "-n"}, nil},
+		{[]string{"sub", "echo", "--", "-n"}, "echo", []string{"-n"}, nil},
+		{[]string{"sub", "sleep", "-duration=2s"}, "sleep", nil, nil},
+		{[]string{"sub", "help", "echo"}, "help", []string{"echo"}, nil},
+		{[]string{"sub", "-help"}, "sub", nil, flag.ErrHelp},
+		{[]string{"sub", "echo", "-h"}, "echo", nil, flag.ErrHelp},
+		{[]string{"sub"}, "", nil, ErrUsage},
+		{[]string{"sub", "unknown"}, "", nil, ErrUsage},
+		{[]string{"sub", "sleep", "a"}, "", nil, ErrUsage},
+		{[]string{"sub", "echo", "-unknown"}, "", nil, ErrUsage},
+		{[]string{"sub", "sleep", "-duration=10x"}, "", nil, ErrUsage},
+	}
+	for _, test := range tests {
+		cmd, args, err := newParseTree().Parse(test.args)
+		if !errors.Is(err, test.wantErr) || test.wantErr == nil && err != nil {
+			t.Errorf("%q got error %v, want %v", test.args, err, test.wantErr)
+		}
+		name := ""
+		if cmd != nil {
+			name = cmd.Name
+		}
+		if got, want := name, test.wantCmd; got != want {
+			t.Errorf("%q got command %q, want %q", test.args, got, want)
+		}
+		if got, want := args, test.wantArgs; !reflect.DeepEqual(got, want) {
+			t.Errorf("%q got args %q, want %q", test.args, got, want)
+		}
+	}
+}
+
+// FuzzCommandParse checks invariants of Command.Parse for arbitrary args,
+// which are separated by spaces in the fuzzed input.
+func FuzzCommandParse(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"sub echo a b",
+		"-verbose sub -level=2 echo -n -sep=, a",
+		"sub echo -- -n",
+		"sub sleep -duration 10x",
+		"sub help ...",
+		"help -style=compact sub topic",
+		"sub -level= echo",
+		"--verbose=false sub --help",
+	} {
+		f.Add(seed)
+	}
+	root := newParseTree()
+	inTree := make(map[*Command]bool)
+	var walk func(cmd *Command)
+	walk = func(cmd *Command) {
+		inTree[cmd] = true
+		for _, child := range cmd.Children {
+			walk(child)
+		}
+	}
+	walk(root)
+	f.Fuzz(func(t *testing.T, input string) {
+		args := strings.Split(input, " ")
+		cmd, rest, err := root.Parse(args)
+		switch {
+		case err == flag.ErrHelp:
+			if !inTree[cmd] {
+				t.Errorf("%q got command %v not in the tree for -help", args, cmd)
+			}
+			return
+		case err != nil:
+			if !errors.Is(err, ErrUsage) {
+				t.Errorf("%q got error %v, want it to wrap ErrUsage", args, err)
+			}
+			if cmd != nil || rest != nil {
+				t.Errorf("%q got command %v and args %q with error %v", args, cmd, rest, err)
+			}
+			return
+		}
+		if _, isHelp := cmd.Runner.(helpRunner); !inTree[cmd] && !isHelp {
+			t.Errorf("%q got command %v not in the tree", args, cmd)
+		}
+		// The remaining args are a suffix of args, and only start with a flag if
+		// it follows "--".
+		if len(rest) > len(args) || len(rest) > 0 && !reflect.DeepEqual(rest, args[len(args)-len(rest):]) {
+			t.Errorf("%q got args %q, want a suffix", args, rest)
+			return
+		}
+		if n := len(args) - len(rest); len(rest) > 0 && len(rest[0]) > 1 && rest[0][0] == '-' && (n == 0 || args[n-1] != "--") {
+			t.Errorf("%q got args %q starting with a flag", args, rest)
+		}
+	})
+}
+
+func TestFlagValueError(t *testing.T) {
+	isolateGlobalFlags(t)
+	sleep := &Command{
+		Name:   "sleep",
+		Short:  "Sleep",
+		Long:   "Sleep sleeps for the duration.",
+		Runner: RunnerFunc(func(*Env, []string) error { return nil }),
+	}
+	sleep.Flags.Duration("duration", time.Second, "Duration to sleep.")
+	sleep.Flags.Int("n", 1, "Number of times to sleep.")
+	sleep.Flags.Bool("v", false, "Verbose output.")
+	sleep.Flags.Var(&sepValue{}, "sep", "Separator.")
+	// Only check the ERROR line, not the usage that follows it.
+	errorLine := func(args ...string) string {
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars), Deterministic: true}
+		if err := ParseAndRun(sleep, env, args); !errors.Is(err, ErrUsage) {
+			t.Errorf("%q got error %v, want usage error", args, err)
+		}
+		line, _, _ := strings.Cut(stderr.String(), "\n")
+		return line
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-duration=10x"}, `ERROR: sleep: invalid value "10x" for flag -duration: time: unknown unit "x" in duration "10x"`},
+		{[]string{"-duration", "soon"}, `ERROR: sleep: invalid value "soon" for flag -duration: time: invalid duration "soon"`},
+		{[]string{"-n=1x"}, `ERROR: sleep: invalid value "1x" for flag -n: invalid syntax`},
+		{[]string{"-n=99999999999999999999"}, `ERROR: sleep: invalid value "99999999999999999999" for flag -n: value out of range`},
+		{[]string{"-v=maybe"}, `ERROR: sleep: invalid boolean value "maybe" for -v: invalid syntax`},
+		{[]string{`-duration="\x`}, `ERROR: sleep: invalid value "\"\\x" for flag -duration: time: invalid duration "\"\\x"`},
+		// Errors from custom values are unchanged.
+		{[]string{"-sep=ab"}, `ERROR: sleep: invalid value "ab" for flag -sep: separator must be a single rune`},
+		{[]string{"-unknown"}, `ERROR: sleep: flag provided but not defined: -unknown`},
+	}
+	for _, test := range tests {
+		if got, want := errorLine(test.args...), test.want; got != want {
+			t.Errorf("%q got %q, want %q", test.args, got, want)
+		}
+	}
+}
+
+// sepValue is a custom flag.Value that only accepts a single rune.
+type sepValue struct {
+	sep rune
+}
+
+func (v *sepValue) String() string { return string(v.sep) }
+
+func (v *sepValue) Set(value string) error {
+	if len([]rune(value)) != 1 {
+		return errors.New("separator must be a single rune")
+	}
+	v.sep = []rune(value)[0]
+	return nil
+}
+
+func TestDumpFlagsCommand(t *testing.T) {
+	echo := &Command{
+		Name:     "echo",
+		Short:    "Print strings",
+		Long:     "Echo prints strings.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	echo.Flags.Bool("n", false, "Omit the trailing newline.")
+	echo.Flags.String("sep", " ", "Separator between strings.")
+	prog := &Command{
+		Name:                 "prog",
+		Short:                "Test the dump flags command",
+		Long:                 "Prog dumps its flags.",
+		Children:             []*Command{echo},
+		DumpFlagsCommandName: "__dumpflags",
+		SuppressUsageOnError: true,
+	}
+	prog.Flags.Int("level", 0, "Level of prog.")
+	tests := []testCase{
+		{Args: []string{"__dumpflags"}, Stdout: `global1=
+global2=0
+level=0
+`},
+		{Args: []string{"-level=2", "echo", "-sep=,", "__dumpflags"}, Stdout: `global1=
+global2=0
+level=2
+n=false
+sep=,
+`},
+		{Args: []string{"-global1=x", "-level=3", "__dumpflags"}, GlobalFlag1: "x", Stdout: `global1=x
+global2=0
+level=3
+`},
+		{Args: []string{"-level=0", "echo", "-n", "-sep=;", "__dumpflags"}, Stdout: `global1=
+global2=0
+level=0
+n=true
+sep=;
+`},
+		{Args: []string{"echo", "a", "__dumpflags"}, Stdout: "[a __dumpflags]\n"},
+		{
+			Args: []string{"echo", "__dumpflags", "a"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog echo: __dumpflags doesn't take arguments
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+	// The command is hidden from help.
+	runTestCases(t, prog, []testCase{{Args: []string{"help", "-no-globals"}, Stdout: `Prog dumps its flags.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   echo        Print strings
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+
+The prog flags are:
+ -level=0
+   Level of prog.
+`}})
+}
+
+func TestDumpJSONAnnotations(t *testing.T) {
+	isolateGlobalFlags(t)
+	beta := &Command{
+		Name:        "beta",
+		Short:       "Beta command",
+		Long:        "Beta is still changing.",
+		Runner:      RunnerFunc(runEcho),
+		Annotations: map[string]string{"stability": "beta", "since": "1.4"},
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test annotations",
+		Long:     "Prog has an annotated command.",
+		Children: []*Command{beta},
+	}
+	var buf bytes.Buffer
+	if err := prog.DumpJSON(&buf); err != nil {
+		t.Fatalf("DumpJSON failed: %v", err)
+	}
+	var dump jsonCommand
+	if err := json.Unmarshal(buf.Bytes(), &dump); err != nil {
+		t.Fatalf("Unmarshal failed: %v\n%s", err, buf.String())
+	}
+	if got := dump.Annotations; got != nil {
+		t.Errorf("got prog annotations %v, want nil", got)
+	}
+	if got, want := dump.Children[0].Annotations, beta.Annotations; !reflect.DeepEqual(got, want) {
+		t.Errorf("got beta annotations %v, want %v", got, want)
+	}
+	if strings.Contains(buf.String(), `"annotations": null`) {
+		t.Errorf("got null annotations in %s", buf.String())
+	}
+	// Annotations are ignored by help.
+	runTestCases(t, prog, []testCase{{Args: []string{"help", "-style=shortonly", "beta"}, Stdout: "Beta command\n"}})
+}
+
+func TestNormalizeLong(t *testing.T) {
+	tests := []struct {
+		long, want string
+	}{
+		{"", ""},
+		{"Long.", "Long."},
+		{"\nLong.\n", "Long."},
+		{"\n\n  Long.\n\n  ", "Long."},
+		{"\nFirst.\n\n  Indented.\nLast.\n", "First.\n\n  Indented.\nLast."},
+		{"  Leading spaces.\n  Kept.", "Leading spaces.\n  Kept."},
+	}
+	for _, test := range tests {
+		if got, want := NormalizeLong(test.long), test.want; got != want {
+			t.Errorf("NormalizeLong(%q) got %q, want %q", test.long, got, want)
+		}
+	}
+}
+
+func newCompleteTree() *Command {
+	echo := &Command{
+		Name:     "echo",
+		Short:    "Print strings",
+		Long:     "Echo prints strings.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+		CompleteFunc: func(args []string, toComplete string) []string {
+			if len(args) > 0 {
+				return []string{"later"}
+			}
+			return []string{"apple", "apricot", "banana"}
+		},
+	}
+	echo.Flags.Bool("n", false, "Omit the trailing newline.")
+	echo.Flags.String("sep", " ", "Separator between strings.")
+	exit := &Command{
+		Name:   "exit",
+		Short:  "Exit with a code",
+		Long:   "Exit exits with a code.",
+		Runner: RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:         "prog",
+		Short:        "Test completion",
+		Long:         "Prog completes its args.",
+		Children:     []*Command{echo, exit},
+		CompleteFlag: true,
+	}
+	prog.Flags.Int("level", 0, "Level of prog.")
+	return prog
+}
+
+func TestComplete(t *testing.T) {
+	isolateGlobalFlags(t)
+	prog := newCompleteTree()
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"echo", "exit", "help"}},
+		{[]string{""}, []string{"echo", "exit", "help"}},
+		{[]string{"e"}, []string{"echo", "exit"}},
+		{[]string{"ec"}, []string{"echo"}},
+		{[]string{"x"}, nil},
+		{[]string{"echo"}, []string{"echo"}},
+		{[]string{"echo", ""}, []string{"apple", "apricot", "banana"}},
+		{[]string{"echo", "ap"}, []string{"apple", "apricot"}},
+		{[]string{"echo", "apple", ""}, []string{"later"}},
+		{[]string{"-l"}, []string{"-level"}},
+		{[]string{"--l"}, []string{"--level"}},
+		{[]string{"echo", "-s"}, []string{"-sep"}},
+		{[]string{"-level", ""}, nil},
+		{[]string{"-level", "2", "ec"}, []string{"echo"}},
+		{[]string{"-level=2", "ec"}, []string{"echo"}},
+		{[]string{"echo", "-n", "b"}, []string{"banana"}},
+		{[]string{"echo", "-sep", "ap"}, nil},
+		{[]string{"echo", "--", "-"}, nil},
+		{[]string{"echo", "--", "ap"}, []string{"apple", "apricot"}},
+		{[]string{"exit", ""}, nil},
+		{[]string{"help", ""}, nil},
+	}
+	for _, test := range tests {
+		if got := prog.Complete(test.args); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Complete(%q) got %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestCompleteFlag(t *testing.T) {
+	isolateGlobalFlags(t)
+	prog := newCompleteTree()
+	runTestCases(t, prog, []testCase{
+		{Args: []string{"-complete", "e"}, Stdout: "echo\nexit\n"},
+		{Args: []string{"--complete", "echo", "--s"}, Stdout: "--sep\n"},
+		{Args: []string{"-complete"}, Stdout: "echo\nexit\nhelp\n"},
+		{Args: []string{"echo", "--", "-complete"}, Stdout: "[-complete]\n"},
+	})
+}
+
+func TestDescribeFlag(t *testing.T) {
+	isolateGlobalFlags(t)
+	prog := newCompleteTree()
+	prog.DescribeFlag = true
+	echo := prog.Children[0]
+	echo.ArgsName = "<strings>"
+	echo.Flags.Bool("secret", false, "A hidden flag.")
+	echo.HideFlag("secret")
+	runTestCases(t, prog, []testCase{
+		{Args: []string{"-describe"}, Stdout: `{"name":"prog","short":"Test completion","flags":["level"]}` + "\n"},
+		{Args: []string{"echo", "--describe"}, Stdout: `{"name":"echo","short":"Print strings","argsName":"<strings>","flags":["level","n","sep"]}` + "\n"},
+		{Args: []string{"-level=1", "exit", "-describe", "x"}, Stdout: `{"name":"exit","short":"Exit with a code","flags":["level"]}` + "\n"},
+		{Args: []string{"echo", "--", "-describe"}, Stdout: "[-describe]\n"},
+	})
+	// The flag isn't supported unless it's enabled.
+	prog.DescribeFlag = false
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr}
+	if err := ParseAndRun(prog, env, []string{"echo", "-describe"}); !errors.Is(err, ErrUsage) {
+		t.Errorf("got error %v, want %v", err, ErrUsage)
+	}
+}
+
+func TestFlagGroup(t *testing.T) {
+	var host, format string
+	child := &Command{
+		Name:     "child",
+		Short:    "Child command",
+		Long:     "Child is a child command.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test flag groups",
+		Long:     "Prog has grouped flags.",
+		Children: []*Command{child},
+	}
+	prog.Flags.StringVar(&host, "host", "localhost", "Host to connect to.")
+	prog.Flags.Int("port", 80, "Port to connect to.")
+	prog.Flags.StringVar(&format, "format", "text", "Output format.")
+	prog.Flags.Bool("verbose", false, "Print more output.")
+	prog.Flags.Bool("secret", false, "A hidden flag.")
+	prog.HideFlag("secret")
+	prog.FlagGroup("Output flags", "format")
+	prog.FlagGroup("Connection flags", "port", "host")
+	prog.FlagGroup("Output flags", "secret")
+	tests := []testCase{
+		{
+			Args: []string{"-help"},
+			Stdout: `Prog has grouped flags.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   child       Child command
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+
+The prog flags are:
+Output flags:
+ -format=text
+   Output format.
+
+Connection flags:
+ -host=localhost
+   Host to connect to.
+ -port=80
+   Port to connect to.
+
+Other flags:
+ -verbose=false
+   Print more output.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"help", "-style=full", "child"},
+			Stdout: `Child is a child command.
+
+Usage:
+   prog child [flags] [strings]
+
+The prog child flags are:
+ -format=text
+   Output format.
+ -host=localhost
+   Host to connect to.
+ -port=80
+   Port to connect to.
+ -verbose=false
+   Print more output.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args:   []string{"-host=example.com", "-format=json", "child", "a"},
+			Stdout: "[a]\n",
+		},
+	}
+	runTestCases(t, prog, tests)
+	if host != "example.com" || format != "json" {
+		t.Errorf("got host %q format %q, want example.com json", host, format)
+	}
+	// Only grouped flags, without other flags.
+	only := &Command{
+		Name:   "only",
+		Short:  "Test flag groups",
+		Long:   "Only has grouped flags.",
+		Runner: RunnerFunc(runEcho),
+	}
+	only.Flags.Bool("n", false, "Omit the trailing newline.")
+	only.FlagGroup("Output flags", "n")
+	runTestCases(t, only, []testCase{{
+		Args: []string{"-help"},
+		Stdout: `Only has grouped flags.
+
+Usage:
+   only [flags]
+
+The only flags are:
+Output flags:
+ -n=false
+   Omit the trailing newline.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+	}})
+	only.FlagGroup("Output flags", "unknown")
+	runTestCases(t, only, []testCase{{
+		Args: []string{},
+		Err: `only: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+FlagGroup "Output flags" flag "unknown" doesn't match any flag of the command.`,
+	}})
+	prog.FlagGroup("Other", "format")
+	runTestCases(t, prog, []testCase{{
+		Args: []string{},
+		Err: `prog: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+Flag "format" is in both FlagGroup "Output flags" and "Other".`,
+	}})
+}
+
+func TestHelpStrict(t *testing.T) {
+	missing := &Command{
+		Name:     "missing",
+		Short:    "Command with missing docs",
+		LongFile: "missing.txt",
+		Runner:   RunnerFunc(runEcho),
+	}
+	echo := &Command{
+		Name:   "echo",
+		Short:  "Print strings on stdout",
+		Long:   "Echo prints any strings passed in to stdout.",
+		Runner: RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test strict help",
+		Long:     "Prog has a command with missing docs.",
+		Children: []*Command{missing, echo},
+		DocsFS:   fstest.MapFS{},
+	}
+	wantErr := `prog missing: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+Can't read LongFile "missing.txt": open missing.txt: file does not exist`
+	runTestCases(t, prog, []testCase{
+		{
+			Args: []string{"help", "-no-globals", "..."},
+			Err:  wantErr,
+			Stdout: `Prog has a command with missing docs.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   missing     Command with missing docs
+   echo        Print strings on stdout
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+================================================================================
+Prog missing - Command with missing docs
+
+================================================================================
+Prog echo - Print strings on stdout
+
+Echo prints any strings passed in to stdout.
+
+Usage:
+   prog echo [flags]
+================================================================================
+Prog help - Display help for commands or topics
+
+Help with no args displays the usage of the parent command.
+
+Help with args displays the usage of the specified sub-command or help topic.
+
+"help ..." recursively displays help for all commands and topics.
+
+Usage:
+   prog help [flags] [command/topic ...]
+
+[command/topic ...] optionally identifies a specific sub-command or help topic.
+
+The prog help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
+ -style=compact
+   The formatting style for help output:
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
+   Override the default by setting the CMDLINE_STYLE environment variable.
+ -width=80
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
+`,
+		},
+		{
+			Args: []string{"help", "-no-globals", "-strict", "..."},
+			Err:  wantErr,
+			Stdout: `Prog has a command with missing docs.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   missing     Command with missing docs
+   echo        Print strings on stdout
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+================================================================================
+Prog missing - Command with missing docs
+
+================================================================================
+Prog help - Display help for commands or topics
+
+Help with no args displays the usage of the parent command.
+
+Help with args displays the usage of the specified sub-command or help topic.
+
+"help ..." recursively displays help for all commands and topics.
+
+Usage:
+   prog help [flags] [command/topic ...]
+
+[command/topic ...] optionally identifies a specific sub-command or help topic.
+
+The prog help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
+ -style=compact
+   The formatting style for help output:
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
+   Override the default by setting the CMDLINE_STYLE environment variable.
+ -width=80
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
+`,
+		},
+		{
+			Args: []string{"help", "-no-globals", "-strict", "echo"},
+			Stdout: `Echo prints any strings passed in to stdout.
+
+Usage:
+   prog echo [flags]
+`,
+		},
+	})
+}
+
+func TestIndentWidth(t *testing.T) {
+	newProg := func(indentWidth int) *Command {
+		long := &Command{
+			Name:   "thisisaverylongcommand",
+			Short:  "Command with a long name, and a short description that wraps",
+			Long:   "Thisisaverylongcommand has a long name.",
+			Runner: RunnerFunc(runEcho),
+		}
+		echo := &Command{
+			Name:   "echo",
+			Short:  "Print strings",
+			Long:   "Echo prints strings.",
+			Runner: RunnerFunc(runEcho),
+		}
+		prog := &Command{
+			Name:        "prog",
+			Short:       "Test indent width",
+			Long:        "Prog has an indent width.",
+			Children:    []*Command{long, echo},
+			Topics:      []Topic{{Name: "topic", Short: "Help topic", Long: "Topic is a help topic."}},
+			IndentWidth: indentWidth,
+		}
+		prog.Flags.Bool("verbose", false, "Print more output, which is described at length so that it wraps.")
+		return prog
+	}
+	vars := map[string]string{"CMDLINE_WIDTH": "50"}
+	tests := []testCase{{Args: []string{"-help"}, Vars: vars, Stdout: `Prog has an indent width.
+
+Usage:
+      prog [flags] <command>
+
+The prog commands are:
+      thisisaverylongcommand Command with a long
+                             name, and a short
+                             description that
+                             wraps
+      echo                   Print strings
+      help                   Display help for
+                             commands or topics
+Run "prog help [command]" for command usage.
+
+The prog additional help topics are:
+      topic       Help topic
+Run "prog help [topic]" for topic details.
+
+The prog flags are:
+ -verbose=false
+      Print more output, which is described at
+      length so that it wraps.
+
+The global flags are:
+ -global1=
+      global test flag 1
+ -global2=0
+      global test flag 2
+`}}
+	runTestCases(t, newProg(6), tests)
+	// Zero and negative widths use the default of 3.
+	want := `Prog has an indent width.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   thisisaverylongcommand Command with a long
+                          name, and a short
+                          description that wraps
+   echo                   Print strings
+   help                   Display help for
+                          commands or topics
+Run "prog help [command]" for command usage.
+
+The prog additional help topics are:
+   topic       Help topic
+Run "prog help [topic]" for topic details.
+
+The prog flags are:
+ -verbose=false
+   Print more output, which is described at length
+   so that it wraps.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`
+	for _, width := range []int{0, -1} {
+		runTestCases(t, newProg(width), []testCase{{Args: []string{"-help"}, Vars: vars, Stdout: want}})
+	}
+}
+
+func TestPostParseDerivedFlags(t *testing.T) {
+	var addr, host string
+	var port int
+	var prog *Command
+	prog = &Command{
+		Name:  "prog",
+		Short: "Test derived flags",
+		Long:  "Prog derives -addr from -host and -port.",
+		Runner: RunnerFunc(func(env *Env, args []string) error {
+			fmt.Fprintln(env.Stdout, addr)
+			return nil
+		}),
+		PostParse: func(args []string) []error {
+			if addr != "" {
+				return nil
+			}
+			set := false
+			prog.ParsedFlags.Visit(func(f *flag.Flag) {
+				set = set || f.Name == "port"
+			})
+			if !set {
+				return []error{errors.New("-port is required if -addr isn't set")}
+			}
+			addr = fmt.Sprintf("%s:%d", host, port)
+			return nil
+		},
+		SuppressUsageOnError: true,
+	}
+	prog.Flags.StringVar(&addr, "addr", "", "Address to listen on.")
+	prog.Flags.StringVar(&host, "host", "localhost", "Host to listen on.")
+	prog.Flags.IntVar(&port, "port", 0, "Port to listen on.")
+	tests := []testCase{
+		{Args: []string{"-port=80"}, Stdout: "localhost:80\n"},
+		{Args: []string{"-host=example.com", "-port=0"}, Stdout: "example.com:0\n"},
+		{Args: []string{"-addr=:8080", "-port=80"}, Stdout: ":8080\n"},
+		{Args: []string{"-host=example.com"}, Err: errUsageStr, Stderr: "ERROR: prog: -port is required if -addr isn't set\n"},
+	}
+	for _, test := range tests {
+		addr, host, port = "", "localhost", 0
+		runTestCases(t, prog, []testCase{test})
+	}
+}
+
+func TestExecuteResolved(t *testing.T) {
+	isolateGlobalFlags(t)
+	var got []string
+	record := func(name string, flags ...*string) Runner {
+		return RunnerFunc(func(env *Env, args []string) error {
+			line := name
+			for _, f := range flags {
+				line += " " + *f
+			}
+			got = append(got, fmt.Sprint(line, args))
+			return nil
+		})
+	}
+	leaf := &Command{Name: "leaf", Short: "Leaf", Long: "Leaf.", ArgsName: "[args]"}
+	leafFlag := leaf.Flags.String("leaf", "l", "Leaf flag.")
+	sub := &Command{Name: "sub", Short: "Sub", Long: "Sub.", Children: []*Command{leaf}}
+	subFlag := sub.Flags.String("sub", "s", "Sub flag.")
+	prog := &Command{Name: "prog", Short: "Prog", Long: "Prog.", Children: []*Command{sub}}
+	progFlag := prog.Flags.String("resolved-prog", "p", "Prog flag.")
+	leaf.Runner = record("leaf", progFlag, subFlag, leafFlag)
+	prog.Runner = record("prog", progFlag)
+	prog.ArgsName = ""
+	initGlobalFlags()
+	var global *flag.Flag
+	globalFlags.VisitAll(func(f *flag.Flag) {
+		if global == nil {
+			global = f
+		}
+	})
+	globalValue := global.Value.String()
+	tests := []struct {
+		Target *Command
+		Args   []string
+		Want   string
+		Err    bool
+	}{
+		{leaf, []string{"a"}, "leaf p s l[a]", false},
+		{leaf, []string{"-leaf=1", "-sub=2", "-resolved-prog=3", "a"}, "leaf 3 2 1[a]", false},
+		// The flag of prog keeps the value set by the previous case.
+		{sub, []string{"-sub=4", "leaf", "-leaf=5"}, "leaf 3 4 5[]", false},
+		{prog, []string{"-resolved-prog=6"}, "prog 6[]", false},
+		{leaf, []string{"-" + global.Name + "=x"}, "", true},
+		{&Command{Name: "other"}, nil, "", true},
+	}
+	for _, test := range tests {
+		got = nil
+		var stderr bytes.Buffer
+		env := &Env{Stdout: ioutil.Discard, Stderr: &stderr, Vars: map[string]string{}, Deterministic: true}
+		err := prog.executeResolved(env, test.Target, test.Args)
+		switch {
+		case (err != nil) != test.Err:
+			t.Errorf("%v %v: got error %v, want error %v", test.Target.Name, test.Args, err, test.Err)
+		case err == nil && (len(got) != 1 || got[0] != test.Want):
+			t.Errorf("%v %v: got %q, want %q", test.Target.Name, test.Args, got, test.Want)
+		}
+	}
+	// Global flags keep their values, and the root flags aren't merged into
+	// flag.CommandLine.
+	if got := global.Value.String(); got != globalValue {
+		t.Errorf("got global flag %s=%q, want %q", global.Name, got, globalValue)
+	}
+	if flag.CommandLine.Lookup("resolved-prog") != nil {
+		t.Errorf("got root flag in flag.CommandLine")
+	}
+}
+
+func TestBuildFlagSet(t *testing.T) {
+	isolateGlobalFlags(t)
+	leaf := &Command{Name: "leaf", Short: "Leaf", Long: "Leaf.", Runner: RunnerFunc(runEcho)}
+	leaf.Flags.Bool("leaf", false, "Leaf flag.")
+	leaf.Flags.Int("shared", 1, "Leaf shared flag.")
+	leaf.HideFlag("leaf")
+	alone := &Command{Name: "alone", Short: "Alone", Long: "Alone.", Runner: RunnerFunc(runEcho), DontInheritFlags: true}
+	alone.Flags.Bool("alone", false, "Alone flag.")
+	sub := &Command{Name: "sub", Short: "Sub", Long: "Sub.", Children: []*Command{leaf, alone}}
+	sub.Flags.Bool("sub", false, "Sub flag.")
+	prog := &Command{Name: "prog", Short: "Prog", Long: "Prog.", Children: []*Command{sub}}
+	prog.Flags.String("shared", "root", "Root shared flag.")
+	prog.Flags.String("global1", "root", "Shadows a global flag.")
+	tests := []struct {
+		Names []string
+		Want  []string
+	}{
+		// Global flags take precedence for the root command, and command flags for
+		// the others.
+		{nil, []string{"global1=global test flag 1", "shared=Root shared flag."}},
+		{[]string{"sub"}, []string{"global1=Shadows a global flag.", "shared=Root shared flag.", "sub=Sub flag."}},
+		{[]string{"sub", "leaf"}, []string{"global1=Shadows a global flag.", "leaf=Leaf flag.", "shared=Leaf shared flag.", "sub=Sub flag."}},
+		{[]string{"sub", "alone"}, []string{"alone=Alone flag.", "global1=global test flag 1"}},
+	}
+	for _, test := range tests {
+		flags, err := prog.BuildFlagSet(test.Names...)
+		if err != nil {
+			t.Fatalf("%v: %v", test.Names, err)
+		}
+		var got []string
+		flags.VisitAll(func(f *flag.Flag) {
+			// Of the global flags, only check global1, which is shadowed.
+			if f.Name == "global1" || globalFlags.Lookup(f.Name) == nil {
+				got = append(got, f.Name+"="+f.Usage)
+			}
+		})
+		if !reflect.DeepEqual(got, test.Want) {
+			t.Errorf("%v: got flags %q, want %q", test.Names, got, test.Want)
+		}
+	}
+	// Parsing the FlagSet sets the variables of the commands, without changing
+	// their Flags.
+	flags, err := prog.BuildFlagSet("sub", "leaf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := flags.Parse([]string{"-shared=3", "-leaf"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := leaf.Flags.Lookup("shared").Value.String(), "3"; got != want {
+		t.Errorf("got shared %v, want %v", got, want)
+	}
+	leaf.Flags.Lookup("shared").Value.Set("1")
+	leaf.Flags.Lookup("leaf").Value.Set("false")
+	if got, want := countFlags(&leaf.Flags, nil, true), 2; got != want {
+		t.Errorf("got %d leaf flags, want %d", got, want)
+	}
+	_, err = prog.BuildFlagSet("sub", "bad", "x")
+	var unknown *UnknownCommandError
+	if !errors.As(err, &unknown) || unknown.Parent != sub || unknown.Name != "bad" || !reflect.DeepEqual(unknown.Args, []string{"x"}) {
+		t.Errorf("got error %#v, want unknown command bad", err)
+	}
+}
+
+func TestTopicURL(t *testing.T) {
+	isolateGlobalFlags(t)
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test topic URLs",
+		Long:     "Prog has topics with URLs.",
+		Children: []*Command{{Name: "echo", Short: "Print strings", Long: "Echo prints strings.", ArgsName: "[strings]", Runner: RunnerFunc(runEcho)}},
+		Topics: []Topic{
+			{Name: "online", Short: "Online docs", Long: "The full docs are online.", URL: " https://example.com/docs "},
+			{Name: "link", Short: "Only a link", URL: "https://example.com/link"},
+			{Name: "plain", Short: "No URL", Long: "Plain has no URL."},
+		},
+	}
+	runTestCases(t, prog, []testCase{
+		{
+			Args: []string{"help", "online"},
+			Stdout: `The full docs are online.
+
+See: https://example.com/docs
+`,
+		},
+		{
+			Args: []string{"help", "link"},
+			Stdout: `See: https://example.com/link
+`,
+		},
+		{
+			Args: []string{"help", "plain"},
+			Stdout: `Plain has no URL.
+`,
+		},
+		{
+			Args: []string{"help", "-style=godoc", "-no-globals", "..."},
+			Stdout: `Prog has topics with URLs.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   echo        Print strings
+   help        Display help for commands or topics
+
+The prog additional help topics are:
+   online      Online docs
+   link        Only a link
+   plain       No URL
+
+Prog echo - Print strings
+
+Echo prints strings.
+
+Usage:
+   prog echo [flags] [strings]
+
+Prog help - Display help for commands or topics
+
+Help with no args displays the usage of the parent command.
+
+Help with args displays the usage of the specified sub-command or help topic.
+
+"help ..." recursively displays help for all commands and topics.
+
+Usage:
+   prog help [flags] [command/topic ...]
+
+[command/topic ...] optionally identifies a specific sub-command or help topic.
+
+The prog help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
+ -style=compact
+   The formatting style for help output:
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
+   Override the default by setting the CMDLINE_STYLE environment variable.
+ -width=<terminal width>
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
+
+Prog online - Online docs
+
+The full docs are online.
+
+See: https://example.com/docs
+
+Prog link - Only a link
+
+See: https://example.com/link
+
+Prog plain - No URL
+
+Plain has no URL.
+`,
+		},
+	})
+	var buf bytes.Buffer
+	if err := prog.DumpJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), `"url": "https://example.com/docs"`; !strings.Contains(got, want) {
+		t.Errorf("got JSON %s, want it to contain %s", got, want)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	isolateGlobalFlags(t)
+	var n bool
+	echo := &Command{Name: "echo", Short: "Echo", Long: "Echo.", ArgsName: "[strings]", Runner: RunnerFunc(func(env *Env, args []string) error {
+		fmt.Fprintf(env.Stdout, "%v n=%v\n", args, n)
+		return nil
+	})}
+	echo.Flags.BoolVar(&n, "n", false, "No newline.")
+	prog := &Command{Name: "prog", Short: "Prog", Long: "Prog.", Children: []*Command{echo}, SuppressUsageOnError: true}
+	tests := []struct {
+		Args           []string
+		Stdout, Stderr string
+		Err            string
+	}{
+		{[]string{"echo", "-n", "a"}, "[a] n=true\n", "", ""},
+		// The flag set by the previous call is reset.
+		{[]string{"echo", "a"}, "[a] n=false\n", "", ""},
+		{[]string{"bad"}, "", "ERROR: prog: unknown command \"bad\"\n", `prog: unknown command "bad"`},
+	}
+	for _, test := range tests {
+		stdout, stderr, err := prog.Capture(test.Args)
+		if got, want := stdout, test.Stdout; got != want {
+			t.Errorf("%v: got stdout %q, want %q", test.Args, got, want)
+		}
+		if got, want := stderr, test.Stderr; got != want {
+			t.Errorf("%v: got stderr %q, want %q", test.Args, got, want)
+		}
+		if got, want := fmt.Sprint(err), test.Err; (err != nil || want != "") && got != want {
+			t.Errorf("%v: got error %q, want %q", test.Args, got, want)
+		}
+	}
+}
+
+func TestSiblingFlagHint(t *testing.T) {
+	newCmd := func(name string, flags ...string) *Command {
+		cmd := &Command{Name: name, Short: name, Long: name, Runner: RunnerFunc(runEcho), ArgsName: "[args]"}
+		for _, f := range flags {
+			cmd.Flags.Bool(f, false, "Flag "+f+".")
+		}
+		return cmd
+	}
+	lazy := newCmd("lazy")
+	lazy.FlagsFunc = func(fs *flag.FlagSet) { fs.Bool("z", false, "z") }
+	sub := &Command{Name: "sub", Short: "sub", Long: "sub", Children: []*Command{newCmd("echo"), newCmd("echoopt", "n", "x"), newCmd("other", "x"), lazy}}
+	prog := &Command{Name: "prog", Short: "prog", Long: "prog", Children: []*Command{sub}, SuppressUsageOnError: true}
+	prog.Flags.Bool("p", false, "p")
+	runTestCases(t, prog, []testCase{
+		{
+			Args: []string{"sub", "echo", "-n", "a"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog sub echo: flag provided but not defined: -n
+   Did you mean "prog sub echoopt -n"?
+`,
+		},
+		{
+			Args: []string{"sub", "echo", "--z=1", "a"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog sub echo: flag provided but not defined: -z
+   Did you mean "prog sub lazy -z"?
+`,
+		},
+		{
+			// More than one sibling defines -x, so there's no suggestion.
+			Args: []string{"sub", "echo", "-x", "a"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog sub echo: flag provided but not defined: -x
+`,
+		},
+		{
+			// The root command has no siblings.
+			Args: []string{"-n", "sub"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: prog: flag provided but not defined: -n
+`,
+		},
+		{
+			Args: []string{"sub", "echo", "-n", "a"},
+			Vars: map[string]string{"CMDLINE_PREFIX": "parent"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: parent prog sub echo: flag provided but not defined: -n
+   Did you mean "parent prog sub echoopt -n"?
+`,
+		},
+	})
+}
+
+// TestParseFastPath checks that running a command doesn't clean the usage
+// strings of the tree, which are only needed by help.
+func TestParseFastPath(t *testing.T) {
+	isolateGlobalFlags(t)
+	run := &Command{Name: "run", Short: "Run", Long: "Run.", ArgsName: "[args]", Runner: RunnerFunc(runEcho)}
+	other := &Command{Name: "other", Short: "  Other short  ", Long: "  Other long.  ", Runner: RunnerFunc(runEcho)}
+	other.Flags.Bool("padded", false, "  Padded usage.  ")
+	prog := &Command{Name: "prog", Short: "Prog", Long: "Prog.", Children: []*Command{run, other}}
+	var stdout bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stdout, Vars: map[string]string{}}
+	if err := ParseAndRun(prog, env, []string{"run", "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "[a]\n"; got != want {
+		t.Errorf("got stdout %q, want %q", got, want)
+	}
+	if got, want := other.Short, "  Other short  "; got != want {
+		t.Errorf("got Short %q, want %q", got, want)
+	}
+	if got, want := other.Flags.Lookup("padded").Usage, "  Padded usage.  "; got != want {
+		t.Errorf("got flag usage %q, want %q", got, want)
+	}
+	stdout.Reset()
+	env = &Env{Stdout: &stdout, Stderr: &stdout, Vars: map[string]string{"CMDLINE_WIDTH": "80"}}
+	if err := ParseAndRun(prog, env, []string{"help", "-no-globals", "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), `Other long.
+
+Usage:
+   prog other [flags]
+
+The prog other flags are:
+ -padded=false
+   Padded usage.
+`; got != want {
+		t.Errorf("got help %q, want %q", got, want)
+	}
+}
+
+// TestFindChildIndex tests that lookups via the name index of a command with
+// many children and topics follow changes to the tree, which are picked up by
+// the next parse.
+func TestFindChildIndex(t *testing.T) {
+	root := newBenchTree("c", 1, 40)
+	for i := 0; i < 40; i++ {
+		root.Topics = append(root.Topics, Topic{Name: fmt.Sprintf("t%d", i), Short: "Short", Long: "Long"})
+	}
+	check := func(arg, want string) {
+		t.Helper()
+		cleanNames(root)
+		if root.childIndex == nil || root.topicIndex == nil {
+			t.Fatal("got no index, want one")
+		}
+		got := ""
+		if child := findChild(root, root, arg); child != nil {
+			got = child.Name
+		}
+		if got != want {
+			t.Errorf("findChild(%q) got %q, want %q", arg, got, want)
+		}
+	}
+	check("c7", "c7")
+	check("C7", "")
+	check("x", "")
+	// Rename in place.
+	root.Children[7].Name = "renamed"
+	check("c7", "")
+	check("renamed", "renamed")
+	root.Children[7].Name = "c7"
+	check("c7", "c7")
+	check("renamed", "")
+	// Replace in place.
+	root.Children[8] = &Command{Name: "new", Short: "Short", Long: "Long", Runner: RunnerFunc(runEcho)}
+	check("new", "new")
+	check("c8", "")
+	// Append.
+	root.Children = append(root.Children, &Command{Name: "appended", Short: "Short", Long: "Long", Runner: RunnerFunc(runEcho)})
+	check("appended", "appended")
+	// Exact matches are preferred, and otherwise the first match ignoring case.
+	root.CaseInsensitive = true
+	root.Children[9].Name = "Dup"
+	root.Children[10].Name = "dup"
+	check("DUP", "Dup")
+	check("dup", "dup")
+	check("C7", "c7")
+	check("C77", "")
+	if topic, ok := findCmdTopic(root, root, "T39"); !ok || topic.Name != "t39" {
+		t.Errorf("findCmdTopic got %v %v, want t39", topic.Name, ok)
+	}
+	root.Topics[39].Name = "moved"
+	cleanNames(root)
+	if topic, ok := findCmdTopic(root, root, "moved"); !ok || topic.Name != "moved" {
+		t.Errorf("findCmdTopic got %v %v, want moved", topic.Name, ok)
+	}
+}
+
+func TestFlagShadow(t *testing.T) {
+	isolateGlobalFlags(t)
+	initGlobalFlags()
+	var global string
+	globalFlags.VisitAll(func(f *flag.Flag) {
+		if global == "" {
+			global = f.Name
+		}
+	})
+	newTree := func() (prog, sub, leaf *Command) {
+		leaf = &Command{Name: "leaf", Short: "Leaf", Long: "Leaf.", Runner: RunnerFunc(runEcho)}
+		sub = &Command{Name: "sub", Short: "Sub", Long: "Sub.", Children: []*Command{leaf}}
+		other := &Command{Name: "other", Short: "Other", Long: "Other.", Runner: RunnerFunc(runEcho)}
+		prog = &Command{Name: "prog", Short: "Prog", Long: "Prog.", Children: []*Command{sub, other}}
+		prog.Flags.String("shared", "prog", "Prog shared flag.")
+		return prog, sub, leaf
+	}
+	wantErr := func(cmdPath, name, scope string) string {
+		return fmt.Sprintf(`%s: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+Flag %q of the command shadows %s of the same name.
+Rename one of the flags, or set AllowFlagShadow to allow it.`, cmdPath, name, scope)
+	}
+	parse := func(prog *Command, args ...string) error {
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr}
+		_, _, err := Parse(prog, env, args)
+		return err
+	}
+	// Inherited flags are reported with the nearest ancestor that defines them.
+	prog, sub, leaf := newTree()
+	sub.Flags.String("shared", "sub", "Sub shared flag.")
+	leaf.Flags.String("shared", "leaf", "Leaf shared flag.")
+	want := wantErr("prog sub", "shared", `the flag of "prog"`)
+	if got := errString(prog.Validate()); got != want {
+		t.Errorf("got error %q, want %q", got, want)
+	}
+	sub.AllowFlagShadow = true
+	want = wantErr("prog sub leaf", "shared", `the flag of "prog sub"`)
+	if got := errString(prog.Validate()); got != want {
+		t.Errorf("got error %q, want %q", got, want)
+	}
+	// Parse only checks the commands on the parsed path.
+	if got := errString(parse(prog, "sub", "leaf")); got != want {
+		t.Errorf("got error %q, want %q", got, want)
+	}
+	if err := parse(prog, "other"); err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+	leaf.AllowFlagShadow = true
+	if err := prog.Validate(); err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+	// Flags aren't inherited with DontInheritFlags.
+	prog, sub, leaf = newTree()
+	leaf.Flags.String("shared", "leaf", "Leaf shared flag.")
+	leaf.DontInheritFlags = true
+	if err := prog.Validate(); err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+	// Global flags are shadowed by the flags of children, and shadow the flags of
+	// the root.
+	prog, sub, leaf = newTree()
+	leaf.FlagsFunc = func(fs *flag.FlagSet) { fs.String(global, "leaf", "Leaf flag.") }
+	if err := prog.Validate(); err != nil {
+		t.Errorf("got error %v, want nil, since FlagsFunc isn't called", err)
+	}
+	want = wantErr("prog sub leaf", global, "the global flag")
+	if got := errString(parse(prog, "sub", "leaf")); got != want {
+		t.Errorf("got error %q, want %q", got, want)
+	}
+	prog, _, _ = newTree()
+	prog.Flags.String(global, "prog", "Prog flag.")
+	want = wantErr("prog", global, "the global flag")
+	if got := errString(prog.Validate()); got != want {
+		t.Errorf("got error %q, want %q", got, want)
+	}
+}
+
+func TestFlagSource(t *testing.T) {
+	isolateGlobalFlags(t)
+	sub := &Command{Name: "sub", Short: "Sub", Long: "Sub."}
+	name := sub.Flags.String("name", "default", "Name.")
+	mode := sub.Flags.String("mode", "default", "Mode.")
+	sub.PostParse = func([]string) []error {
+		if err := sub.SetFlagFrom(SourceFile, "mode", "file"); err != nil {
+			return []error{err}
+		}
+		return nil
+	}
+	sub.Runner = RunnerFunc(func(env *Env, _ []string) error {
+		for _, flag := range []string{"level", "name", "mode", "other"} {
+			fmt.Fprintf(env.Stdout, "%s=%s ", flag, sub.FlagSource(flag))
+		}
+		fmt.Fprintf(env.Stdout, "name=%s mode=%s\n", *name, *mode)
+		return nil
+	})
+	prog := &Command{Name: "prog", Short: "Prog", Long: "Prog.", Children: []*Command{sub}}
+	prog.Flags.Int("level", 0, "Level.")
+	// Values from the environment are applied before parsing, and values from a
+	// file in PostParse; the command line takes precedence over both.
+	tests := []struct {
+		Args []string
+		Want string
+	}{
+		{[]string{"sub"}, "level=default name=env mode=file other=default name=env mode=file\n"},
+		{[]string{"-level=1", "sub", "-name=cl"}, "level=flag name=flag mode=file other=default name=cl mode=file\n"},
+		{[]string{"sub", "-level=1", "-mode=cl"}, "level=flag name=env mode=flag other=default name=env mode=cl\n"},
+	}
+	for _, test := range tests {
+		resetFlags(prog)
+		if err := sub.SetFlagFrom(SourceEnv, "name", "env"); err != nil {
+			t.Fatal(err)
+		}
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr}
+		if err := ParseAndRun(prog, env, test.Args); err != nil {
+			t.Errorf("%v: %v", test.Args, err)
+		}
+		if got := stdout.String(); got != test.Want {
+			t.Errorf("%v: got %q, want %q", test.Args, got, test.Want)
+		}
+	}
+	if got, want := errString(sub.SetFlagFrom(SourceFlag, "name", "x")), `sub: unknown flag source "flag"`; got != want {
+		t.Errorf("got error %q, want %q", got, want)
+	}
+	if got, want := errString(sub.SetFlagFrom(SourceEnv, "nope", "x")), "sub: flag -nope isn't defined"; got != want {
+		t.Errorf("got error %q, want %q", got, want)
+	}
+}
+
+func TestSetFlagUsage(t *testing.T) {
+	isolateGlobalFlags(t)
+	defer func(usage func(), commandLine *flag.FlagSet) {
+		flag.Usage = usage
+		flag.CommandLine = commandLine
+	}(flag.Usage, flag.CommandLine)
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	echo := &Command{Name: "echo", Short: "Print strings", Long: "Echo prints strings.", ArgsName: "[strings]", Runner: RunnerFunc(runEcho)}
+	prog := &Command{Name: "prog", Short: "Prog", Long: "Prog has a flag usage.", Children: []*Command{echo}, Width: 80}
+	prog.Flags.Bool("verbose", false, "Print more output.")
+	SetFlagUsage(prog)
+	var output bytes.Buffer
+	flag.CommandLine.SetOutput(&output)
+	flag.Usage()
+	want := `Prog has a flag usage.
+
+Usage:
+   prog [flags] <command>
+
+The prog commands are:
+   echo        Print strings
+   help        Display help for commands or topics
+Run "prog help [command]" for command usage.
+
+The prog flags are:
+ -verbose=false
+   Print more output.
+`
+	if got := output.String(); !strings.HasPrefix(got, want) {
+		t.Errorf("got usage %q, want prefix %q", got, want)
+	}
+	// The flags of prog are listed in the usage, so flag.Parse accepts them.
+	if err := flag.CommandLine.Parse([]string{"-verbose", "echo", "a"}); err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+	if got, want := flag.Args(), []string{"echo", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got args %q, want %q", got, want)
+	}
+	if got, want := flag.Lookup("verbose").Value.String(), "true"; got != want {
+		t.Errorf("got -verbose=%s, want %s", got, want)
+	}
+}
+
+func TestHideGlobalFlags(t *testing.T) {
+	HideGlobalFlagsExcept(regexp.MustCompile(`^global2$`))
+	cmdChild := &Command{
+		Name:   "child",
+		Short:  "description of child command.",
+		Long:   "blah blah blah",
+		Runner: RunnerFunc(runEcho),
+	}
+	prog := &Command{
+		Name:     "program",
+		Short:    "Test hiding global flags.",
+		Long:     "Test hiding global flags.",
+		Children: []*Command{cmdChild},
+	}
+	var tests = []testCase{
+		{
+			Args: []string{"help"},
+			Stdout: `Test hiding global flags.
+
+Usage:
+   program [flags] <command>
+
+The program commands are:
+   child       description of child command.
+   help        Display help for commands or topics
+Run "program help [command]" for command usage.
+
+The global flags are:
+ -global2=0
+   global test flag 2
+
+Run "program help -style=full" to show all flags.
+`,
+		},
+		{
+			Args: []string{"help", "child"},
+			Stdout: `blah blah blah
+
+Usage:
+   program child [flags]
+
+The global flags are:
+ -global2=0
+   global test flag 2
+
+Run "program help -style=full child" to show all flags.
+`,
+		},
+		{
+			Args: []string{"help", "-style=full"},
+			Stdout: `Test hiding global flags.
+
+Usage:
+   program [flags] <command>
+
+The program commands are:
+   child       description of child command.
+   help        Display help for commands or topics
+Run "program help [command]" for command usage.
+
+The global flags are:
+ -global2=0
+   global test flag 2
+
+ -global1=
+   global test flag 1
+`,
+		},
+		{
+			Args: []string{"help", "-style=full", "child"},
+			Stdout: `blah blah blah
+
+Usage:
+   program child [flags]
+
+The global flags are:
+ -global2=0
+   global test flag 2
+
+ -global1=
+   global test flag 1
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+	nonHiddenGlobalFlags = nil
+}
+
+func TestHideGlobalFlagsRootNoChildren(t *testing.T) {
+	HideGlobalFlagsExcept(regexp.MustCompile(`^global2$`))
+	prog := &Command{
+		Name:   "program",
+		Short:  "Test hiding global flags, root no children.",
+		Long:   "Test hiding global flags, root no children.",
+		Runner: RunnerFunc(runEcho),
+	}
+	var tests = []testCase{
+		{
+			Args: []string{"-help"},
+			Stdout: `Test hiding global flags, root no children.
+
+Usage:
+   program [flags]
+
+The global flags are:
+ -global2=0
+   global test flag 2
+
+Run "CMDLINE_STYLE=full program -help" to show all flags.
+`,
+		},
+		{
+			Args: []string{"-help"},
+			Vars: map[string]string{"CMDLINE_STYLE": "full"},
+			Stdout: `Test hiding global flags, root no children.
+
+Usage:
+   program [flags]
+
+The global flags are:
+ -global2=0
+   global test flag 2
+
+ -global1=
+   global test flag 1
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+	nonHiddenGlobalFlags = nil
+}
+
+func TestRootCommandFlags(t *testing.T) {
+	isolateGlobalFlags(t)
+	root := &Command{
+		Name:   "root",
+		Short:  "Test root command flags.",
+		Long:   "Test root command flags.",
+		Runner: RunnerFunc(runHello),
+	}
+	rb := root.Flags.Bool("rbool", false, "rbool desc")
+	rs := root.Flags.String("rstring", "abc", "rstring desc")
 	origFlags := flag.CommandLine
 	// Parse and make sure the flags get set appropriately.
 	_, _, err := Parse(root, EnvFromOS(), []string{"-rbool=true", "-rstring=XYZ"})
@@ -2665,17 +8061,30 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The unlikely help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
  -style=compact
    The formatting style for help output:
-      compact   - Good for compact cmdline output.
-      full      - Good for cmdline output, shows all global flags.
-      godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
-   Format output to this target width in runes, or unlimited if width < 0.
-   Defaults to the terminal width if available.  Override the default by setting
-   the CMDLINE_WIDTH environment variable.
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
 ================================================================================
 Unlikely exitcode - Short description of command exitcode
 
@@ -2799,17 +8208,30 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The unlikely help flags are:
+ -all-flags=false
+   Display every flag defined on the commands from the given command onward,
+   sorted by command path, instead of displaying usage.
+ -no-globals=false
+   Omit the global flags from the usage, including for recursive help.
+ -search=
+   Display the commands and topics whose name or description contains the given
+   term, ignoring case, instead of displaying usage.
+ -strict=false
+   Stop recursive help at the first error, e.g. a long description that can't be
+   read, instead of displaying the remaining commands and topics.
  -style=compact
    The formatting style for help output:
-      compact   - Good for compact cmdline output.
-      full      - Good for cmdline output, shows all global flags.
-      godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      compact    - Good for compact cmdline output.
+      full       - Good for cmdline output, shows all global flags.
+      godoc      - Good for godoc processing.
+      shortonly  - Only output short description.
+      cheatsheet - Only output the path and short description of each leaf command.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=<terminal width>
-   Format output to this target width in runes, or unlimited if width < 0.
-   Defaults to the terminal width if available.  Override the default by setting
-   the CMDLINE_WIDTH environment variable.
+   Format output to this target width in cells, or unlimited if width < 0.
+   Defaults to the terminal width if available, or unlimited if the output isn't
+   a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+   variable.
 
 Unlikely exitcode - Short description of command exitcode
 
@@ -2975,6 +8397,7 @@ The global flags are:
 }
 
 func TestParsedFlags(t *testing.T) {
+	isolateGlobalFlags(t)
 	root := &Command{
 		Name:   "root",
 		Short:  "short",
@@ -3033,12 +8456,55 @@ func TestParsedFlags(t *testing.T) {
 	}
 }
 
+func TestPrintRunErrors(t *testing.T) {
+	isolateGlobalFlags(t)
+	tests := []struct {
+		print  bool
+		args   []string
+		err    string
+		stderr string
+		// exit is the output of ExitCode, which doesn't print errors again.
+		exit string
+	}{
+		{false, []string{"error"}, errEchoStr, "", "ERROR: " + errEchoStr + "\n"},
+		{true, []string{"error"}, errEchoStr, "echo: " + errEchoStr + "\n", ""},
+		{true, []string{"foo"}, "", "", ""},
+		// Usage errors are only reported once, with the usage block.
+		{true, []string{"bad_arg"}, errUsageStr, "ERROR: Invalid argument bad_arg\n\n", ""},
+	}
+	for _, test := range tests {
+		root := &Command{
+			Name:           "echo",
+			Short:          "short",
+			Long:           "long.",
+			ArgsName:       "[strings]",
+			Runner:         RunnerFunc(runEcho),
+			PrintRunErrors: test.print,
+		}
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		err := ParseAndRun(root, env, test.args)
+		if got, want := errString(err), test.err; !errMatches(err, want) {
+			t.Errorf("%v %q got error %q, want %q", test.print, test.args, got, want)
+		}
+		if got, want := stderr.String(), test.stderr; !strings.HasPrefix(got, want) || (want == "" && got != "") {
+			t.Errorf("%v %q got stderr %q, want prefix %q", test.print, test.args, got, want)
+		}
+		var exit bytes.Buffer
+		ExitCode(err, &exit)
+		if got, want := exit.String(), test.exit; got != want {
+			t.Errorf("%v %q got ExitCode output %q, want %q", test.print, test.args, got, want)
+		}
+	}
+}
+
 type fc struct {
 	DontPropagateFlags bool
 	DontInheritFlags   bool
 }
 
 func TestFlagPropagation(t *testing.T) {
+	isolateGlobalFlags(t)
 	var err error
 	env := EnvFromOS()
 
@@ -3134,3 +8600,41 @@ func createCommandTree(flagConfigs []fc) []*Command {
 
 	return result
 }
+
+// BenchmarkParseAndRun benchmarks a successful invocation of a command 3 levels
+// below the root, in a tree of 1111 commands.
+func BenchmarkParseAndRun(b *testing.B) {
+	root := newBenchTree("c", 3, 10)
+	args := []string{"-c-verbose", "c0", "c00", "-c00-format=json", "c000", "-c000-verbose", "arg"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		env := &Env{Stdout: ioutil.Discard, Stderr: ioutil.Discard, Vars: map[string]string{}}
+		if err := ParseAndRun(root, env, args); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkParseWide benchmarks resolving the last child of a parent with 1000
+// children, by itself and via Parse.
+func BenchmarkParseWide(b *testing.B) {
+	root := newBenchTree("c", 1, 1000)
+	name := root.Children[999].Name
+	b.Run("findChild", func(b *testing.B) {
+		cleanNames(root)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if findChild(root, root, name) == nil {
+				b.Fatal("no child")
+			}
+		}
+	})
+	b.Run("Parse", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := root.Parse([]string{name, "arg"}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
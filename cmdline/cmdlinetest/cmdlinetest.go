@@ -0,0 +1,197 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cmdlinetest implements utilities for testing programs built with the
+// cmdline package.
+//
+// Run parses and runs a command with captured output, in the same way as
+// cmdline.ParseAndRun, and returns the result:
+//
+//   func TestHello(t *testing.T) {
+//     result := cmdlinetest.Run(t, cmdRoot, []string{"hello", "world"})
+//     cmdlinetest.Expect(t, "stdout", result.Stdout, "Hello world\n")
+//   }
+//
+// GoldenRun compares the output of a run with a golden file instead, which is
+// rewritten when tests are run with CMDLINETEST_UPDATE=1.  RunScript describes
+// both the args and the expected output of a run as a txtar archive, so that
+// regression cases may be added without writing Go code.
+package cmdlinetest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"v.io/x/lib/cmdline"
+)
+
+// Result is the result of running a command via Run.  The Require methods
+// check the result, and stop the test via t.Fatalf if the check fails,
+// reporting the full captured output of the run.  E.g.
+//
+//   result := cmdlinetest.Run(t, cmdRoot, []string{"bad"})
+//   result.RequireExitCode(t, 2)
+//   result.RequireStderrMatches(t, `^ERROR: .*unknown command "bad"`)
+type Result struct {
+	Stdout string // Output written to Stdout.
+	Stderr string // Output written to Stderr.
+	Err    error  // Error returned by cmdline.ParseAndRun.
+}
+
+// Option is an option for Run.
+type Option func(*config)
+
+type config struct {
+	stdin io.Reader
+	vars  map[string]string
+}
+
+// Vars sets the environment variables of the run; they are added to the vars
+// set by previous options.
+func Vars(vars map[string]string) Option {
+	return func(c *config) {
+		for key, value := range vars {
+			c.vars[key] = value
+		}
+	}
+}
+
+// Width sets the width of the output in cells, or unlimited if width < 0, via
+// the CMDLINE_WIDTH environment variable.  The default width is 80.
+func Width(width int) Option {
+	return func(c *config) {
+		c.vars["CMDLINE_WIDTH"] = strconv.Itoa(width)
+	}
+}
+
+// Style sets the style of help output, via the CMDLINE_STYLE environment
+// variable; e.g. "compact", "full" or "godoc".
+func Style(style string) Option {
+	return func(c *config) {
+		c.vars["CMDLINE_STYLE"] = style
+	}
+}
+
+// Stdin sets the Stdin of the run.  By default Stdin is empty.  Either way,
+// Env.StdinIsPipe returns true, as if the input were piped to the program.
+func Stdin(r io.Reader) Option {
+	return func(c *config) {
+		c.stdin = r
+	}
+}
+
+// Run parses and runs cmd with args via cmdline.ParseAndRunIsolated, and
+// returns the captured output and error.  The environment variables are empty,
+// other than those set via opts, the output width is 80 cells by default, and
+// the Env is Deterministic, so that the output doesn't depend on the
+// environment of the test.
+//
+// Runs are isolated from each other, and serialized, as described by
+// cmdline.ParseAndRunIsolated, so Run may be called from tests that call
+// t.Parallel.
+//
+// The global flags of the testing package are stripped from the help output,
+// so that the output is the same as for the real program.
+func Run(t testing.TB, cmd *cmdline.Command, args []string, opts ...Option) Result {
+	t.Helper()
+	c := &config{
+		stdin: strings.NewReader(""),
+		vars:  map[string]string{"CMDLINE_WIDTH": "80"},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	var stdout, stderr bytes.Buffer
+	env := &cmdline.Env{
+		Stdin:         c.stdin,
+		Stdout:        &stdout,
+		Stderr:        &stderr,
+		Vars:          c.vars,
+		Deterministic: true,
+	}
+	err := cmdline.ParseAndRunIsolated(cmd, env, args)
+	return Result{
+		Stdout: StripTestFlags(stdout.String()),
+		Stderr: StripTestFlags(stderr.String()),
+		Err:    err,
+	}
+}
+
+// testFlagsRE matches the usage of a flag of the testing package, in the
+// format of the help output.
+var testFlagsRE = regexp.MustCompile(" -test[^\n]+\n(?:   [^\n]+\n)+")
+
+// StripTestFlags returns output with the usage of the flags of the testing
+// package removed.  These flags are global flags when running tests, so they
+// appear in the help output.
+func StripTestFlags(output string) string {
+	return testFlagsRE.ReplaceAllLiteralString(output, "")
+}
+
+// Expect reports an error via t if got isn't want, where name describes the
+// output being checked; e.g. "stdout".  The error shows the lines that differ.
+func Expect(t testing.TB, name, got, want string) {
+	t.Helper()
+	if got != want {
+		t.Errorf("%s differs (-want +got):\n%s", name, Diff(want, got))
+	}
+}
+
+// Diff returns a line by line diff between a and b, where lines only in a are
+// prefixed by "-", lines only in b are prefixed by "+", and common lines are
+// prefixed by a space.  Returns "" if a and b are the same.
+func Diff(a, b string) string {
+	if a == b {
+		return ""
+	}
+	aLines, bLines := strings.SplitAfter(a, "\n"), strings.SplitAfter(b, "\n")
+	// lcs[i][j] is the length of the longest common subsequence of aLines[i:]
+	// and bLines[j:].
+	lcs := make([][]int, len(aLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bLines)+1)
+	}
+	for i := len(aLines) - 1; i >= 0; i-- {
+		for j := len(bLines) - 1; j >= 0; j-- {
+			switch {
+			case aLines[i] == bLines[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var diff strings.Builder
+	line := func(prefix, text string) {
+		if text == "" {
+			return
+		}
+		if !strings.HasSuffix(text, "\n") {
+			text += "\n\\ No newline at end\n"
+		}
+		fmt.Fprintf(&diff, "%s%s", prefix, text)
+	}
+	i, j := 0, 0
+	for i < len(aLines) || j < len(bLines) {
+		switch {
+		case i < len(aLines) && j < len(bLines) && aLines[i] == bLines[j]:
+			line(" ", aLines[i])
+			i, j = i+1, j+1
+		case j == len(bLines) || i < len(aLines) && lcs[i+1][j] >= lcs[i][j+1]:
+			line("-", aLines[i])
+			i++
+		default:
+			line("+", bLines[j])
+			j++
+		}
+	}
+	return diff.String()
+}
@@ -0,0 +1,139 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdlinetest_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"v.io/x/lib/cmdline"
+	"v.io/x/lib/cmdline/cmdlinetest"
+)
+
+const errEchoStr = "echo error"
+
+// runEcho prints args, or returns an error for the args "error" and "bad_arg".
+func runEcho(env *cmdline.Env, args []string) error {
+	if len(args) == 1 {
+		switch args[0] {
+		case "error":
+			return errors.New(errEchoStr)
+		case "bad_arg":
+			return env.UsageErrorf("Invalid argument %v", args[0])
+		}
+	}
+	fmt.Fprintln(env.Stdout, args)
+	return nil
+}
+
+// newEcho returns a new echo command, and the value of its -prefix flag.
+func newEcho() (*cmdline.Command, *string) {
+	cmd := &cmdline.Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints its args on stdout, preceded by the prefix.",
+		ArgsName: "[strings]",
+	}
+	prefix := cmd.Flags.String("prefix", "", "Prefix of the output.")
+	cmd.Runner = cmdline.RunnerFunc(func(env *cmdline.Env, args []string) error {
+		if *prefix != "" {
+			fmt.Fprint(env.Stdout, *prefix)
+		}
+		return runEcho(env, args)
+	})
+	return cmd, prefix
+}
+
+func TestRun(t *testing.T) {
+	cmd, _ := newEcho()
+	result := cmdlinetest.Run(t, cmd, []string{"-prefix=>", "a", "b"})
+	cmdlinetest.Expect(t, "stdout", result.Stdout, ">[a b]\n")
+	cmdlinetest.Expect(t, "stderr", result.Stderr, "")
+	if result.Err != nil {
+		t.Errorf("got error %v, want nil", result.Err)
+	}
+}
+
+func TestRunResetsFlags(t *testing.T) {
+	cmd, prefix := newEcho()
+	cmdlinetest.Run(t, cmd, []string{"-prefix=>", "a"})
+	if got, want := *prefix, ">"; got != want {
+		t.Errorf("got prefix %q, want %q", got, want)
+	}
+	result := cmdlinetest.Run(t, cmd, []string{"b"})
+	cmdlinetest.Expect(t, "stdout", result.Stdout, "[b]\n")
+	// The sources of flag values are reset too.
+	if err := cmd.SetFlagFrom(cmdline.SourceEnv, "prefix", "env>"); err != nil {
+		t.Fatal(err)
+	}
+	result = cmdlinetest.Run(t, cmd, []string{"c"})
+	cmdlinetest.Expect(t, "stdout", result.Stdout, "[c]\n")
+	if got, want := cmd.FlagSource("prefix"), cmdline.SourceDefault; got != want {
+		t.Errorf("got source %q, want %q", got, want)
+	}
+}
+
+func TestRunStdin(t *testing.T) {
+	cat := &cmdline.Command{
+		Name:     "cat",
+		Short:    "Print files on stdout",
+		Long:     "Cat prints its args on stdout, or its stdin if it's piped.",
+		ArgsName: "[files]",
+		Runner: cmdline.RunnerFunc(func(env *cmdline.Env, args []string) error {
+			if len(args) == 0 && env.StdinIsPipe() {
+				_, err := io.Copy(env.Stdout, env.Stdin)
+				return err
+			}
+			return runEcho(env, args)
+		}),
+	}
+	result := cmdlinetest.Run(t, cat, nil, cmdlinetest.Stdin(strings.NewReader("a\nb\n")))
+	cmdlinetest.Expect(t, "stdout", result.Stdout, "a\nb\n")
+	result = cmdlinetest.Run(t, cat, []string{"c"}, cmdlinetest.Stdin(strings.NewReader("a\nb\n")))
+	cmdlinetest.Expect(t, "stdout", result.Stdout, "[c]\n")
+}
+
+func TestRunParallel(t *testing.T) {
+	cmd, _ := newEcho()
+	for i := 0; i < 10; i++ {
+		arg := fmt.Sprint(i)
+		t.Run(arg, func(t *testing.T) {
+			t.Parallel()
+			result := cmdlinetest.Run(t, cmd, []string{"-prefix=" + arg, arg})
+			cmdlinetest.Expect(t, "stdout", result.Stdout, arg+"["+arg+"]\n")
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"same\n", "same\n", ""},
+		{"a\nb\nc\n", "a\nc\n", " a\n-b\n c\n"},
+		{"a\nc\n", "a\nb\nc\n", " a\n+b\n c\n"},
+		{"a\nb\n", "a\nc\n", " a\n-b\n+c\n"},
+		{"a\n", "a", "-a\n+a\n\\ No newline at end\n"},
+	}
+	for _, test := range tests {
+		if got, want := cmdlinetest.Diff(test.a, test.b), test.want; got != want {
+			t.Errorf("Diff(%q, %q) got %q, want %q", test.a, test.b, got, want)
+		}
+	}
+}
+
+func TestRunError(t *testing.T) {
+	cmd, _ := newEcho()
+	cmd.PrintRunErrors = true
+	result := cmdlinetest.Run(t, cmd, []string{"error"})
+	cmdlinetest.Expect(t, "stdout", result.Stdout, "")
+	cmdlinetest.Expect(t, "stderr", result.Stderr, "echo: "+errEchoStr+"\n")
+	if result.Err == nil || result.Err.Error() != errEchoStr {
+		t.Errorf("got error %v, want %v", result.Err, errEchoStr)
+	}
+}
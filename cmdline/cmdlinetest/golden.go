@@ -0,0 +1,82 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdlinetest
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"v.io/x/lib/cmdline"
+)
+
+// UpdateEnv is the environment variable that causes golden files to be
+// rewritten when it is set to a non-empty value.
+const UpdateEnv = "CMDLINETEST_UPDATE"
+
+// stderrSeparator separates stdout and stderr in golden files.
+const stderrSeparator = "-- stderr --\n"
+
+// Golden compares got with the contents of the golden file at path,
+// conventionally under testdata/, and reports an error via t showing the lines
+// that differ if they aren't the same.
+//
+// If the test binary defines a boolean -update flag that is set to true, or the
+// UpdateEnv environment variable is non-empty, the golden file is rewritten
+// with got instead, creating its directory if necessary.  This package doesn't
+// define the -update flag itself, since that would add it to the global flags
+// shown in help output.
+func Golden(t testing.TB, path, got string) {
+	t.Helper()
+	if updateGolden() {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("updated golden file %s", path)
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; set %s=1 or run with -update to create it", err, UpdateEnv)
+	}
+	Expect(t, path, got, string(want))
+}
+
+// GoldenRun runs cmd with args via Run, and compares the output with the golden
+// file at path via Golden.  The golden file holds stdout, followed by stderr
+// after a "-- stderr --" line if stderr isn't empty.  E.g. args may be
+// []string{"help", "..."} to check the recursive help of the tree, or args
+// with a usage error to check the usage printed to stderr.
+//
+// The result of the run is returned, so that the error may be checked.
+func GoldenRun(t testing.TB, cmd *cmdline.Command, path string, args []string, opts ...Option) Result {
+	t.Helper()
+	result := Run(t, cmd, args, opts...)
+	got := result.Stdout
+	if result.Stderr != "" {
+		got += stderrSeparator + result.Stderr
+	}
+	Golden(t, path, got)
+	return result
+}
+
+// updateGolden returns true iff golden files should be rewritten.
+func updateGolden() bool {
+	if os.Getenv(UpdateEnv) != "" {
+		return true
+	}
+	if f := flag.Lookup("update"); f != nil {
+		if getter, ok := f.Value.(flag.Getter); ok {
+			update, _ := getter.Get().(bool)
+			return update
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdlinetest_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"v.io/x/lib/cmdline"
+	"v.io/x/lib/cmdline/cmdlinetest"
+)
+
+func newProg() *cmdline.Command {
+	echo, _ := newEcho()
+	return &cmdline.Command{
+		Name:     "prog",
+		Short:    "Test golden files",
+		Long:     "Prog has a single echo command.",
+		Children: []*cmdline.Command{echo},
+	}
+}
+
+func TestGoldenRun(t *testing.T) {
+	prog := newProg()
+	cmdlinetest.GoldenRun(t, prog, "testdata/help.golden", []string{"help", "..."})
+	cmdlinetest.GoldenRun(t, prog, "testdata/help_compact.golden", []string{"help", "echo"}, cmdlinetest.Style("compact"), cmdlinetest.Width(40))
+	result := cmdlinetest.GoldenRun(t, prog, "testdata/usage_error.golden", []string{"echo", "bad_arg"})
+	if result.Err == nil {
+		t.Errorf("got nil error, want usage error")
+	}
+}
+
+func TestGoldenUpdate(t *testing.T) {
+	t.Setenv(cmdlinetest.UpdateEnv, "1")
+	path := filepath.Join(t.TempDir(), "testdata", "echo.golden")
+	cmdlinetest.GoldenRun(t, newProg(), path, []string{"echo", "a", "b"})
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmdlinetest.Expect(t, "golden file", string(got), "[a b]\n")
+}
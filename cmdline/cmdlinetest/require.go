@@ -0,0 +1,81 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdlinetest
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"v.io/x/lib/cmdline"
+)
+
+// ExitCode returns the exit code that the user would see for the run, as
+// returned by cmdline.ExitCode; e.g. 2 for usage errors, and 0 if Err is nil.
+func (r Result) ExitCode() int {
+	return cmdline.ExitCode(r.Err, nil)
+}
+
+// RequireExitCode requires the exit code of the run to be code.
+func (r Result) RequireExitCode(t testing.TB, code int) {
+	t.Helper()
+	if got := r.ExitCode(); got != code {
+		t.Fatalf("got exit code %d, want %d\n%s", got, code, r.dump())
+	}
+}
+
+// RequireStdout requires Stdout to be want.  The failure shows the lines that
+// differ.
+func (r Result) RequireStdout(t testing.TB, want string) {
+	t.Helper()
+	if r.Stdout != want {
+		t.Fatalf("stdout differs (-want +got):\n%s\n%s", Diff(want, r.Stdout), r.dump())
+	}
+}
+
+// RequireStdoutContains requires Stdout to contain substr.
+func (r Result) RequireStdoutContains(t testing.TB, substr string) {
+	t.Helper()
+	if !strings.Contains(r.Stdout, substr) {
+		t.Fatalf("stdout doesn't contain %q\n%s", substr, r.dump())
+	}
+}
+
+// RequireStderrMatches requires Stderr to match the regular expression
+// pattern.  Use (?m) in pattern to match the start and end of each line with ^
+// and $.
+func (r Result) RequireStderrMatches(t testing.TB, pattern string) {
+	t.Helper()
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		t.Fatalf("invalid stderr pattern: %v", err)
+		return
+	}
+	if !re.MatchString(r.Stderr) {
+		t.Fatalf("stderr doesn't match %q\n%s", pattern, r.dump())
+	}
+}
+
+// RequireUsageError requires Err to be a usage error of the given kind, and
+// returns the *cmdline.UsageError for further checks.
+func (r Result) RequireUsageError(t testing.TB, kind cmdline.UsageErrorKind) *cmdline.UsageError {
+	t.Helper()
+	var usageErr *cmdline.UsageError
+	switch {
+	case !errors.As(r.Err, &usageErr):
+		t.Fatalf("got error %v, want usage error of kind %v\n%s", r.Err, kind, r.dump())
+	case usageErr.Kind != kind:
+		t.Fatalf("got usage error of kind %v, want %v\n%s", usageErr.Kind, kind, r.dump())
+	}
+	return usageErr
+}
+
+// dump returns the full captured output and error of the run, for reporting
+// failures.
+func (r Result) dump() string {
+	return fmt.Sprintf("--- error:\n%v\n--- stdout:\n%s--- stderr:\n%s--- end", r.Err, fixNewline(r.Stdout), fixNewline(r.Stderr))
+}
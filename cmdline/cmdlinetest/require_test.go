@@ -0,0 +1,74 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdlinetest_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"v.io/x/lib/cmdline"
+	"v.io/x/lib/cmdline/cmdlinetest"
+)
+
+// fakeT records the failures reported via Fatalf, without stopping the test.
+type fakeT struct {
+	testing.TB
+	failures []string
+}
+
+func (t *fakeT) Helper() {}
+
+func (t *fakeT) Fatalf(format string, args ...interface{}) {
+	t.failures = append(t.failures, fmt.Sprintf(format, args...))
+}
+
+func TestRequire(t *testing.T) {
+	prog := newProg()
+	ok := cmdlinetest.Run(t, prog, []string{"echo", "a", "b"})
+	ok.RequireExitCode(t, 0)
+	ok.RequireStdout(t, "[a b]\n")
+	ok.RequireStdoutContains(t, "a b")
+	ok.RequireStderrMatches(t, `^$`)
+
+	usage := cmdlinetest.Run(t, prog, []string{"unknown"})
+	usage.RequireExitCode(t, 2)
+	usage.RequireStderrMatches(t, `^ERROR: prog: unknown command "unknown"`)
+	usage.RequireStderrMatches(t, `(?m)^Usage:$`)
+	if err := usage.RequireUsageError(t, cmdline.UnknownCommand); err.CmdPath != "prog" {
+		t.Errorf("got CmdPath %q, want %q", err.CmdPath, "prog")
+	}
+
+	runErr := cmdlinetest.Run(t, prog, []string{"echo", "error"})
+	runErr.RequireExitCode(t, 1)
+}
+
+func TestRequireFailures(t *testing.T) {
+	result := cmdlinetest.Run(t, newProg(), []string{"echo", "bad_arg"})
+	tests := []struct {
+		require func(t testing.TB)
+		want    string
+	}{
+		{func(t testing.TB) { result.RequireExitCode(t, 0) }, "got exit code 2, want 0"},
+		{func(t testing.TB) { result.RequireStdout(t, "x\n") }, "stdout differs (-want +got):\n-x\n"},
+		{func(t testing.TB) { result.RequireStdoutContains(t, "x") }, `stdout doesn't contain "x"`},
+		{func(t testing.TB) { result.RequireStderrMatches(t, `^usage`) }, "stderr doesn't match \"^usage\""},
+		{func(t testing.TB) { result.RequireStderrMatches(t, `(`) }, "invalid stderr pattern: "},
+		{func(t testing.TB) { result.RequireUsageError(t, cmdline.FlagParse) }, "got usage error of kind BadArgs, want FlagParse"},
+	}
+	for _, test := range tests {
+		fake := &fakeT{TB: t}
+		test.require(fake)
+		if len(fake.failures) != 1 || !strings.HasPrefix(fake.failures[0], test.want) {
+			t.Errorf("got failures %q, want one starting with %q", fake.failures, test.want)
+		}
+	}
+	// Failures other than an invalid pattern include the captured output.
+	fake := &fakeT{TB: t}
+	result.RequireExitCode(fake, 0)
+	if got, want := fake.failures[0], "--- stderr:\nERROR: Invalid argument bad_arg\n"; !strings.Contains(got, want) {
+		t.Errorf("got failure %q, want it to contain %q", got, want)
+	}
+}
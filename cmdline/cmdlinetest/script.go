@@ -0,0 +1,203 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdlinetest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"v.io/x/lib/cmdline"
+)
+
+// RunScript runs the script in the txtar archive at path against cmd via Run,
+// and reports an error via t for each expectation of the script that isn't
+// met.  A txtar archive is a comment, followed by a sequence of sections, each
+// starting with a "-- name --" line.  The script sections are:
+//
+//   args    The args to run cmd with, one per line.
+//   env     Environment variables of the run, one KEY=VALUE per line; e.g.
+//           CMDLINE_WIDTH=40 or CMDLINE_STYLE=compact.
+//   stdin   The contents of Stdin.
+//   stdout  The expected output written to Stdout.
+//   stderr  The expected output written to Stderr.
+//   exit    The expected exit code, as returned by cmdline.ExitCode.
+//
+// All sections are optional; missing output sections are expected to be empty,
+// and a missing exit section is expected to be 0.  Since sections consist of
+// whole lines, output that doesn't end with a newline is compared as if it
+// did.  Unlike Main, the error returned by a Runner isn't written to stderr;
+// only its exit code is checked.
+//
+// If golden files are being updated, as described by Golden, the stdout,
+// stderr and exit sections are rewritten with the results of the run instead,
+// omitting those that are empty or 0.  The comment and other sections are kept.
+func RunScript(t testing.TB, cmd *cmdline.Command, path string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := parseArchive(data)
+	var opts []Option
+	var args []string
+	if section, ok := archive.section("args"); ok {
+		args = splitLines(section)
+	}
+	if section, ok := archive.section("env"); ok {
+		vars := make(map[string]string)
+		for _, line := range splitLines(section) {
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				t.Fatalf("%s: env line %q isn't KEY=VALUE", path, line)
+			}
+			vars[key] = value
+		}
+		opts = append(opts, Vars(vars))
+	}
+	if section, ok := archive.section("stdin"); ok {
+		opts = append(opts, Stdin(strings.NewReader(section)))
+	}
+	result := Run(t, cmd, args, opts...)
+	got := map[string]string{
+		"stdout": fixNewline(result.Stdout),
+		"stderr": fixNewline(result.Stderr),
+		"exit":   "",
+	}
+	if code := cmdline.ExitCode(result.Err, nil); code != 0 {
+		got["exit"] = strconv.Itoa(code) + "\n"
+	}
+	if updateGolden() {
+		archive.update(got)
+		if err := ioutil.WriteFile(path, archive.format(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("updated script %s", path)
+		return
+	}
+	for _, name := range []string{"stdout", "stderr", "exit"} {
+		want, _ := archive.section(name)
+		Expect(t, path+" "+name, got[name], want)
+	}
+}
+
+// RunScripts runs each script in the files matching the glob pattern against
+// cmd via RunScript, in a subtest named by the base name of the file.  E.g.
+// pattern may be "testdata/*.txtar".
+func RunScripts(t *testing.T, cmd *cmdline.Command, pattern string) {
+	t.Helper()
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("no scripts match %q", pattern)
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			RunScript(t, cmd, path)
+		})
+	}
+}
+
+// archive is a txtar archive; a comment followed by a sequence of sections.
+type archive struct {
+	comment  string
+	sections []archiveSection
+}
+
+type archiveSection struct {
+	name, data string
+}
+
+// parseArchive parses data in the txtar format.
+func parseArchive(data []byte) *archive {
+	a := new(archive)
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		switch name, ok := sectionName(line); {
+		case ok:
+			a.sections = append(a.sections, archiveSection{name: name})
+		case len(a.sections) == 0:
+			a.comment += line
+		default:
+			a.sections[len(a.sections)-1].data += line
+		}
+	}
+	return a
+}
+
+// sectionName returns the name of the section started by line, and true iff
+// line is a "-- name --" line.
+func sectionName(line string) (string, bool) {
+	line = strings.TrimSuffix(line, "\n")
+	if !strings.HasPrefix(line, "-- ") || !strings.HasSuffix(line, " --") || len(line) < len("-- x --") {
+		return "", false
+	}
+	return strings.TrimSpace(line[len("-- ") : len(line)-len(" --")]), true
+}
+
+// section returns the data of the section with the given name, and true iff
+// the section exists.
+func (a *archive) section(name string) (string, bool) {
+	for _, section := range a.sections {
+		if section.name == name {
+			return section.data, true
+		}
+	}
+	return "", false
+}
+
+// update sets the output sections to their values in got, removing those with
+// empty values, and appending missing sections in the order stdout, stderr and
+// exit.
+func (a *archive) update(got map[string]string) {
+	var sections []archiveSection
+	for _, section := range a.sections {
+		data, ok := got[section.name]
+		switch {
+		case !ok:
+			sections = append(sections, section)
+		case data != "":
+			sections = append(sections, archiveSection{section.name, data})
+		}
+	}
+	for _, name := range []string{"stdout", "stderr", "exit"} {
+		if _, ok := a.section(name); !ok && got[name] != "" {
+			sections = append(sections, archiveSection{name, got[name]})
+		}
+	}
+	a.sections = sections
+}
+
+// format returns the archive in the txtar format.
+func (a *archive) format() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(fixNewline(a.comment))
+	for _, section := range a.sections {
+		fmt.Fprintf(&buf, "-- %s --\n%s", section.name, fixNewline(section.data))
+	}
+	return buf.Bytes()
+}
+
+// fixNewline returns s with a newline appended, if s is non-empty and doesn't
+// already end with a newline.
+func fixNewline(s string) string {
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	return s
+}
+
+// splitLines returns the lines of s, without their newlines.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
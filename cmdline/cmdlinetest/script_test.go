@@ -0,0 +1,64 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdlinetest_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"v.io/x/lib/cmdline"
+	"v.io/x/lib/cmdline/cmdlinetest"
+)
+
+func TestRunScripts(t *testing.T) {
+	cmdlinetest.RunScripts(t, newProg(), "testdata/scripts/*.txtar")
+}
+
+func TestRunScriptStdin(t *testing.T) {
+	cat := &cmdline.Command{
+		Name:  "cat",
+		Short: "Print stdin",
+		Long:  "Cat prints stdin, preceded by $GREETING.",
+		Runner: cmdline.RunnerFunc(func(env *cmdline.Env, _ []string) error {
+			data, err := ioutil.ReadAll(env.Stdin)
+			fmt.Fprintf(env.Stdout, "%s %s", env.Vars["GREETING"], data)
+			return err
+		}),
+	}
+	cmdlinetest.RunScript(t, cat, "testdata/cat.txtar")
+}
+
+func TestRunScriptUpdate(t *testing.T) {
+	t.Setenv(cmdlinetest.UpdateEnv, "1")
+	path := filepath.Join(t.TempDir(), "echo.txtar")
+	script := `Echo a and b.
+-- args --
+echo
+a
+b
+-- stdout --
+stale
+-- stderr --
+stale
+`
+	if err := ioutil.WriteFile(path, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmdlinetest.RunScript(t, newProg(), path)
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmdlinetest.Expect(t, "script", string(got), `Echo a and b.
+-- args --
+echo
+a
+b
+-- stdout --
+[a b]
+`)
+}
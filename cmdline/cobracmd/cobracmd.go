@@ -0,0 +1,253 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cobracmd converts between cobra and cmdline command trees, so that a
+// cobra-based program may adopt the cmdline package incrementally.
+//
+// FromCobra converts a cobra tree into a cmdline tree, which runs the cobra
+// hooks and RunE of each command with the flags and args parsed by cmdline:
+//
+//   func main() {
+//     cmdline.Main(cobracmd.FromCobra(cobraRoot))
+//   }
+//
+// ToCobra goes the other way, wrapping a cmdline tree in a cobra command that
+// may be added under a cobra root:
+//
+//   cobraRoot.AddCommand(cobracmd.ToCobra(cmdRoot))
+//
+// Help output is always rendered by cmdline; the conversion preserves how
+// commands are run, not how they're described.
+package cobracmd
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"v.io/x/lib/cmdline"
+	"v.io/x/lib/cmdline/pflagcmd"
+)
+
+// FromCobra returns a cmdline tree equivalent to the cobra tree rooted at c.
+// Use, Short, Long and Annotations become the Name, ArgsName, Short, Long and
+// Annotations of each command.  If Use doesn't name any args, a runnable cobra
+// command without children gets the ArgsName "[args]", so that its Args
+// validator decides which args it takes, as with cobra.
+//
+// The local flags of each command, including its persistent flags, become its
+// Flags via pflagcmd.AddFlags, so they share the values of the cobra flags,
+// and the Changed field of each cobra flag is set when the flag is specified
+// on the command line.  Persistent flags are thus inherited by descendants,
+// but so are the other flags of commands with children, since cmdline doesn't
+// distinguish them.  Flags may follow the args of commands without children,
+// as with pflag by default, but inherited flags that follow the args must use
+// the "-flag=value" form unless they're bool-like.
+//
+// Each runnable cobra command is run by its Runner in the same way as by
+// cobra.Command.Execute: the Args validator is called, then the persistent
+// and regular pre-run hooks, the required flag and flag group checks, Run or
+// RunE, and the post-run hooks.  Args validation failures are returned as
+// usage errors.  Output of the cobra command goes to the Env of the run.  A
+// cobra command that isn't runnable prints its usage if it's invoked.
+//
+// Aliases, Hidden, Example, Version, OnInitialize functions, disabling
+// interspersed flags, and combined shorthand flags like "-abc" aren't
+// supported.  The cobra commands are modified when they run, as their output
+// and the Changed field of their flags are set.
+func FromCobra(c *cobra.Command) *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name:        c.Name(),
+		Short:       c.Short,
+		Long:        c.Long,
+		ArgsName:    useArgs(c.Use),
+		Annotations: c.Annotations,
+	}
+	for _, child := range c.Commands() {
+		cmd.Children = append(cmd.Children, FromCobra(child))
+	}
+	pflagcmd.AddFlags(cmd, c.LocalFlags())
+	hasChildren := len(cmd.Children) > 0
+	switch {
+	case hasChildren:
+		// A Runner can't take args if there are also Children.
+		cmd.ArgsName = ""
+	case c.DisableFlagParsing:
+		cmd.PassthroughArgs = true
+	}
+	switch {
+	case c.Runnable():
+		if cmd.ArgsName == "" && !hasChildren {
+			cmd.ArgsName = "[args]"
+		}
+		cmd.PostParse = func(args []string) []error {
+			if err := c.ValidateArgs(args); err != nil {
+				return []error{err}
+			}
+			return nil
+		}
+		cmd.Runner = cmdline.RunnerFunc(func(env *cmdline.Env, args []string) error {
+			return run(c, env, args)
+		})
+	case !hasChildren:
+		cmd.Runner = cmdline.RunnerFunc(func(env *cmdline.Env, _ []string) error {
+			env.Usage(env, env.Stdout)
+			return nil
+		})
+	}
+	if c.ValidArgsFunction != nil || len(c.ValidArgs) > 0 {
+		cmd.CompleteFunc = func(args []string, toComplete string) []string {
+			candidates := c.ValidArgs
+			if c.ValidArgsFunction != nil {
+				candidates, _ = c.ValidArgsFunction(c, args, toComplete)
+			}
+			return completions(candidates)
+		}
+	}
+	return cmd
+}
+
+// useArgs returns the args named by the cobra use line, without the command
+// name and "[flags]"; e.g. "<src> <dst>" for "cp [flags] <src> <dst>".
+func useArgs(use string) string {
+	var args []string
+	for i, field := range strings.Fields(use) {
+		if i > 0 && field != "[flags]" {
+			args = append(args, field)
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// run runs the runnable cobra command c with args, in the same way as
+// cobra.Command.Execute once the args are parsed and validated.
+func run(c *cobra.Command, env *cmdline.Env, args []string) error {
+	c.SetIn(env.Stdin)
+	c.SetOut(env.Stdout)
+	c.SetErr(env.Stderr)
+	if c.Context() == nil {
+		c.SetContext(context.Background())
+	}
+	if c.Deprecated != "" {
+		c.Printf("Command %q is deprecated, %s\n", c.Name(), c.Deprecated)
+	}
+	var parents []*cobra.Command
+	for p := c; p != nil; p = p.Parent() {
+		if cobra.EnableTraverseRunHooks {
+			parents = append([]*cobra.Command{p}, parents...)
+		} else {
+			parents = append(parents, p)
+		}
+	}
+	for _, p := range parents {
+		if p.PersistentPreRunE != nil {
+			if err := p.PersistentPreRunE(c, args); err != nil {
+				return err
+			}
+		} else if p.PersistentPreRun != nil {
+			p.PersistentPreRun(c, args)
+		} else {
+			continue
+		}
+		if !cobra.EnableTraverseRunHooks {
+			break
+		}
+	}
+	if c.PreRunE != nil {
+		if err := c.PreRunE(c, args); err != nil {
+			return err
+		}
+	} else if c.PreRun != nil {
+		c.PreRun(c, args)
+	}
+	if err := c.ValidateRequiredFlags(); err != nil {
+		return err
+	}
+	if err := c.ValidateFlagGroups(); err != nil {
+		return err
+	}
+	if c.RunE != nil {
+		if err := c.RunE(c, args); err != nil {
+			return err
+		}
+	} else {
+		c.Run(c, args)
+	}
+	if c.PostRunE != nil {
+		if err := c.PostRunE(c, args); err != nil {
+			return err
+		}
+	} else if c.PostRun != nil {
+		c.PostRun(c, args)
+	}
+	for p := c; p != nil; p = p.Parent() {
+		if p.PersistentPostRunE != nil {
+			if err := p.PersistentPostRunE(c, args); err != nil {
+				return err
+			}
+		} else if p.PersistentPostRun != nil {
+			p.PersistentPostRun(c, args)
+		} else {
+			continue
+		}
+		if !cobra.EnableTraverseRunHooks {
+			break
+		}
+	}
+	return nil
+}
+
+// completions returns the cobra completions without their descriptions, which
+// follow a tab.
+func completions(candidates []string) []string {
+	var result []string
+	for _, candidate := range candidates {
+		if tab := strings.IndexByte(candidate, '\t'); tab >= 0 {
+			candidate = candidate[:tab]
+		}
+		result = append(result, candidate)
+	}
+	return result
+}
+
+// ToCobra returns a cobra command that runs the cmdline tree rooted at cmd.
+// The cobra command doesn't parse any flags; the args following its name are
+// passed to cmdline.ParseAndRun, so cmdline handles flags, children and help.
+// Output goes to the output of the cobra command, and the environment comes
+// from the process, as with cmdline.Main.  Error messages and usage are
+// prefixed with the path of the parent cobra command, as for external
+// children of cmdline commands; e.g. "root sub: unknown command".
+//
+// Usage errors are reported by cmdline, and other errors by cobra, unless
+// SilenceErrors is set on the cobra root.  The error returned by
+// cobra.Command.Execute is the one returned by cmdline, so cmdline.ExitCode
+// may be used to compute the exit code.  Args are completed via
+// cmdline.Command.Complete.
+func ToCobra(cmd *cmdline.Command) *cobra.Command {
+	return &cobra.Command{
+		Use:                strings.TrimSpace(cmd.Name + " " + cmd.ArgsName),
+		Short:              cmd.Short,
+		Long:               cmd.Long,
+		Annotations:        cmd.Annotations,
+		DisableFlagParsing: true,
+		SilenceErrors:      true,
+		SilenceUsage:       true,
+		RunE: func(c *cobra.Command, args []string) error {
+			env := cmdline.EnvFromOS()
+			env.Stdin, env.Stdout, env.Stderr = c.InOrStdin(), c.OutOrStdout(), c.ErrOrStderr()
+			if parent := c.Parent(); parent != nil {
+				env.Vars["CMDLINE_PREFIX"] = parent.CommandPath()
+			}
+			err := cmdline.ParseAndRun(cmd, env, args)
+			if err != nil && !errors.Is(err, cmdline.ErrUsage) && !c.Root().SilenceErrors {
+				c.PrintErrln(c.Root().ErrPrefix(), err.Error())
+			}
+			return err
+		},
+		ValidArgsFunction: func(c *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return cmd.Complete(append(args[:len(args):len(args)], toComplete)), cobra.ShellCompDirectiveNoFileComp
+		},
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cobracmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"v.io/x/lib/cmdline"
+)
+
+// verbose is the value of the flag of the root of the cobra tree for testing.
+// Parse merges the flags of the root into flag.CommandLine, so the flag of the
+// first tree that's parsed is used for all trees; the trees share the value.
+var verbose bool
+
+// newCobraTree returns a new cobra tree for testing; pflag values and Changed
+// fields aren't reset between runs, so each run needs its own tree.
+func newCobraTree() *cobra.Command {
+	var upper bool
+	var sep string
+	root := &cobra.Command{Use: "prog", Short: "Test program."}
+	root.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Print the hooks that run.")
+	root.PersistentPreRun = func(c *cobra.Command, args []string) {
+		if verbose {
+			fmt.Fprintf(c.OutOrStdout(), "pre %s %q\n", c.Name(), args)
+		}
+	}
+	root.PersistentPostRun = func(c *cobra.Command, args []string) {
+		if verbose {
+			fmt.Fprintf(c.OutOrStdout(), "post %s\n", c.Name())
+		}
+	}
+	echo := &cobra.Command{
+		Use:   "echo [flags] <text>...",
+		Short: "Print the args.",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			text := strings.Join(args, sep)
+			if upper {
+				text = strings.ToUpper(text)
+			}
+			fmt.Fprintf(c.OutOrStdout(), "%s changed=%v\n", text, c.Flags().Changed("sep"))
+			return nil
+		},
+	}
+	echo.Flags().StringVarP(&sep, "sep", "s", " ", "Separator of the args.")
+	echo.Flags().BoolVar(&upper, "upper", false, "Print in upper case.")
+	fail := &cobra.Command{
+		Use:  "fail",
+		Args: cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			return errors.New("failed")
+		},
+	}
+	greet := &cobra.Command{
+		Use: "greet",
+		Run: func(c *cobra.Command, args []string) {
+			name, _ := c.Flags().GetString("name")
+			fmt.Fprintf(c.OutOrStdout(), "hello %s\n", name)
+		},
+	}
+	greet.Flags().String("name", "", "Name to greet.")
+	greet.MarkFlagRequired("name")
+	count := &cobra.Command{
+		Use: "count",
+		Run: func(c *cobra.Command, args []string) {
+			level, _ := c.Flags().GetCount("level")
+			name, _ := c.Flags().GetString("name")
+			fmt.Fprintf(c.OutOrStdout(), "level=%d name=%s args=%q\n", level, name, args)
+		},
+	}
+	count.Flags().CountP("level", "l", "Level, incremented by each use.")
+	count.Flags().String("name", "", "Name, or dflt if given without a value.")
+	count.Flags().Lookup("name").NoOptDefVal = "dflt"
+	root.AddCommand(count, echo, fail, greet)
+	return root
+}
+
+// result is the result of a run, for comparison.
+type result struct {
+	stdout string
+	err    error
+}
+
+func runCobra(c *cobra.Command, args []string) result {
+	var stdout, stderr bytes.Buffer
+	c.SetArgs(args)
+	c.SetOut(&stdout)
+	c.SetErr(&stderr)
+	err := c.Execute()
+	return result{stdout.String(), err}
+}
+
+func runCmdline(cmd *cmdline.Command, args []string) result {
+	var stdout, stderr bytes.Buffer
+	env := &cmdline.Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{}, Deterministic: true}
+	err := cmdline.ParseAndRun(cmd, env, args)
+	return result{stdout.String(), err}
+}
+
+func TestFromCobra(t *testing.T) {
+	tests := []struct {
+		args    []string
+		stdout  string
+		wantErr bool
+	}{
+		{[]string{"echo", "a", "b"}, "a b changed=false\n", false},
+		{[]string{"echo", "-s", ",", "a", "b"}, "a,b changed=true\n", false},
+		{[]string{"echo", "--sep=,", "a", "b"}, "a,b changed=true\n", false},
+		{[]string{"echo", "a", "--sep", ",", "b", "--upper"}, "A,B changed=true\n", false},
+		{[]string{"echo", "a", "--", "--upper"}, "a --upper changed=false\n", false},
+		{[]string{"-v", "echo", "a"}, "pre echo [\"a\"]\na changed=false\npost echo\n", false},
+		{[]string{"echo", "-v", "a"}, "pre echo [\"a\"]\na changed=false\npost echo\n", false},
+		{[]string{"echo"}, "", true},
+		{[]string{"echo", "--bad", "a"}, "", true},
+		{[]string{"fail"}, "", true},
+		{[]string{"fail", "x"}, "", true},
+		{[]string{"greet"}, "", true},
+		{[]string{"greet", "--name", "world"}, "hello world\n", false},
+		{[]string{"count", "-l", "-l", "x"}, "level=2 name= args=[\"x\"]\n", false},
+		{[]string{"count", "--level", "--name", "x"}, "level=1 name=dflt args=[\"x\"]\n", false},
+		{[]string{"count", "x", "--name=n"}, "level=0 name=n args=[\"x\"]\n", false},
+	}
+	for _, test := range tests {
+		want := runCobra(newCobraTree(), test.args)
+		got := runCmdline(FromCobra(newCobraTree()), test.args)
+		if (want.err != nil) != test.wantErr {
+			t.Errorf("%q: cobra got error %v, want error %v", test.args, want.err, test.wantErr)
+		}
+		if want.err == nil && want.stdout != test.stdout {
+			t.Errorf("%q: cobra got stdout %q, want %q", test.args, want.stdout, test.stdout)
+		}
+		switch {
+		case (got.err == nil) != (want.err == nil):
+			t.Errorf("%q: got error %v, want %v", test.args, got.err, want.err)
+		case want.err == nil && got.stdout != want.stdout:
+			// On errors, cobra prints its own usage.
+			t.Errorf("%q: got stdout %q, want %q", test.args, got.stdout, want.stdout)
+		case want.err != nil && strings.HasPrefix(want.err.Error(), "unknown"):
+			// Unknown commands and flags are reported in cmdline's own words.
+			if !errors.Is(got.err, cmdline.ErrUsage) {
+				t.Errorf("%q: got error %v, want usage error", test.args, got.err)
+			}
+		case want.err != nil && !strings.Contains(got.err.Error(), want.err.Error()):
+			t.Errorf("%q: got error %v, want %v", test.args, got.err, want.err)
+		}
+	}
+}
+
+func TestFromCobraTree(t *testing.T) {
+	cmd := FromCobra(newCobraTree())
+	if err := cmd.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, child := range cmd.Children {
+		names = append(names, child.Name+" "+child.ArgsName)
+	}
+	if got, want := names, []string{"count [args]", "echo <text>...", "fail [args]", "greet [args]"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got children %q, want %q", got, want)
+	}
+	// The global flags of the test binary are also completed.
+	completions := strings.Join(cmd.Complete([]string{"echo", "--"}), " ") + " "
+	for _, want := range []string{"--s", "--sep", "--upper", "--v", "--verbose"} {
+		if !strings.Contains(completions, " "+want+" ") {
+			t.Errorf("got completions %q, want %q", completions, want)
+		}
+	}
+}
+
+// newCmdlineTree returns a new cmdline tree for testing.
+func newCmdlineTree() *cmdline.Command {
+	echo := &cmdline.Command{
+		Name:     "echo",
+		Short:    "Print the args.",
+		Long:     "Print the args.",
+		ArgsName: "[text]",
+	}
+	n := echo.Flags.Bool("n", false, "Don't print a newline.")
+	echo.Runner = cmdline.RunnerFunc(func(env *cmdline.Env, args []string) error {
+		fmt.Fprint(env.Stdout, strings.Join(args, " "))
+		if !*n {
+			fmt.Fprintln(env.Stdout)
+		}
+		return nil
+	})
+	fail := &cmdline.Command{
+		Name:  "fail",
+		Short: "Fail.",
+		Long:  "Fail.",
+		Runner: cmdline.RunnerFunc(func(env *cmdline.Env, args []string) error {
+			return errors.New("failed")
+		}),
+	}
+	return &cmdline.Command{
+		Name:     "inner",
+		Short:    "Inner program.",
+		Long:     "Inner program.",
+		Children: []*cmdline.Command{echo, fail},
+	}
+}
+
+func TestToCobra(t *testing.T) {
+	tests := [][]string{
+		{"echo", "a", "b"},
+		{"echo", "-n", "a"},
+		{"echo", "--n", "--", "-a"},
+		{"echo", "-bad"},
+		{"bad"},
+		{},
+		{"fail"},
+	}
+	for _, args := range tests {
+		want := runCmdline(newCmdlineTree(), args)
+		outer := &cobra.Command{Use: "outer"}
+		outer.AddCommand(ToCobra(newCmdlineTree()))
+		got := runCobra(outer, append([]string{"inner"}, args...))
+		if got.stdout != want.stdout {
+			t.Errorf("%q: got stdout %q, want %q", args, got.stdout, want.stdout)
+		}
+		switch {
+		case (got.err == nil) != (want.err == nil):
+			t.Errorf("%q: got error %v, want %v", args, got.err, want.err)
+		case errors.Is(got.err, cmdline.ErrUsage) != errors.Is(want.err, cmdline.ErrUsage):
+			t.Errorf("%q: got error %v, want %v", args, got.err, want.err)
+		}
+	}
+	// Errors are reported with the path of the cobra parent.
+	var stderr bytes.Buffer
+	outer := &cobra.Command{Use: "outer"}
+	outer.AddCommand(ToCobra(newCmdlineTree()))
+	outer.SetArgs([]string{"inner", "bad"})
+	outer.SetErr(&stderr)
+	outer.Execute()
+	if got, want := stderr.String(), "ERROR: outer inner: unknown command \"bad\"\n"; !strings.HasPrefix(got, want) {
+		t.Errorf("got stderr %q, want prefix %q", got, want)
+	}
+	stderr.Reset()
+	outer.SetArgs([]string{"inner", "fail"})
+	outer.Execute()
+	if got, want := stderr.String(), "Error: failed\n"; got != want {
+		t.Errorf("got stderr %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// completeFlagName is the name of the flag that lists completions, when
+// enabled via Command.CompleteFlag.
+const completeFlagName = "complete"
+
+// Complete returns the candidate completions of the last of args, given the
+// partial command line args for the command tree rooted at cmd, without the
+// program name.  The last of args is the word under the cursor, which is a
+// prefix of the candidates; it is "" after a complete word, so that all
+// candidates at that position are returned.  If args is empty, it is treated
+// as a single "" word.
+//
+// The candidates are the flags of the command selected by the preceding args
+// if the word starts with "-", and otherwise the names of its children,
+// including the help command, followed by the completions of its
+// CompleteFunc.  Flag values and args following "--" are only completed via
+// CompleteFunc.  The preceding args are never run, and flags aren't set.
+func (cmd *Command) Complete(args []string) []string {
+	initGlobalFlags()
+	cleanTree(cmd)
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	words, toComplete := args[:len(args)-1], args[len(args)-1]
+	path, positional := []*Command{cmd}, []string(nil)
+	dashDash, flagValue := false, false
+	for _, word := range words {
+		last := path[len(path)-1]
+		switch {
+		case flagValue:
+			flagValue = false
+		case dashDash || len(positional) > 0:
+			positional = append(positional, word)
+		case word == "--":
+			dashDash = true
+		case isFlagWord(word):
+			name, value := splitFlagWord(word)
+			if f := completeFlags(path).Lookup(name); f != nil && value == "" && !isBoolFlag(f) && !strings.Contains(word, "=") {
+				flagValue = true
+			}
+		default:
+			if child := findChild(cmd, last, word); child != nil {
+				path = append(path, child)
+				continue
+			}
+			if name := helpCommandName(path); needsHelpChild(path) && matchName(cmd, name, word) {
+				// The help command takes names of commands and topics, which aren't
+				// completed.
+				return nil
+			}
+			positional = append(positional, word)
+		}
+	}
+	last := path[len(path)-1]
+	var candidates []string
+	switch {
+	case flagValue:
+		// The word is the value of a flag.
+	case !dashDash && len(positional) == 0 && strings.HasPrefix(toComplete, "-"):
+		dashes := "-"
+		if strings.HasPrefix(toComplete, "--") {
+			dashes = "--"
+		}
+		visibleFlags(completeFlags(path), path).VisitAll(func(f *flag.Flag) {
+			candidates = append(candidates, dashes+f.Name)
+		})
+	case !dashDash && len(positional) == 0:
+		for _, child := range last.Children {
+			candidates = append(candidates, child.Name)
+		}
+		if needsHelpChild(path) {
+			candidates = append(candidates, helpCommandName(path))
+		}
+	}
+	if last.CompleteFunc != nil && !flagValue && (dashDash || !strings.HasPrefix(toComplete, "-")) {
+		candidates = append(candidates, last.CompleteFunc(positional, toComplete)...)
+	}
+	return filterPrefix(cmd, candidates, toComplete)
+}
+
+// completeFlags returns the flags that may be specified for the last command
+// in path; its flags, those inherited from its ancestors, and the global flags.
+func completeFlags(path []*Command) *flag.FlagSet {
+	flags := pathFlags(path)
+	mergeFlags(flags, rootGlobalFlags(path[0]))
+	return flags
+}
+
+// isFlagWord returns true iff word looks like a flag, in the same way as the
+// flag package; "-" by itself is a regular arg.
+func isFlagWord(word string) bool {
+	return len(word) > 1 && word[0] == '-'
+}
+
+// splitFlagWord returns the name and value of the flag word, which may be
+// "-name", "--name", "-name=value" or "--name=value".
+func splitFlagWord(word string) (name, value string) {
+	name = strings.TrimPrefix(strings.TrimPrefix(word, "-"), "-")
+	if eq := strings.Index(name, "="); eq >= 0 {
+		return name[:eq], name[eq+1:]
+	}
+	return name, ""
+}
+
+// isBoolFlag returns true iff f is a boolean flag, which doesn't take a
+// separate value arg.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// filterPrefix returns the candidates that start with prefix, ignoring case if
+// root.CaseInsensitive is set.
+func filterPrefix(root *Command, candidates []string, prefix string) []string {
+	var filtered []string
+	for _, candidate := range candidates {
+		if len(candidate) >= len(prefix) && matchName(root, candidate[:len(prefix)], prefix) {
+			filtered = append(filtered, candidate)
+		}
+	}
+	return filtered
+}
+
+// completeRunner is a Runner that prints the completions of args for the tree
+// rooted at root, one per line, for the flag enabled via Command.CompleteFlag.
+type completeRunner struct {
+	root *Command
+}
+
+// Run implements the Runner interface method.
+func (c completeRunner) Run(env *Env, args []string) error {
+	for _, candidate := range c.root.Complete(args) {
+		fmt.Fprintln(env.Stdout, candidate)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"encoding/json"
+	"flag"
+	"strings"
+)
+
+// describeFlagName is the name of the flag that describes a command, when
+// enabled via Command.DescribeFlag.
+const describeFlagName = "describe"
+
+// isDescribeFlag returns true iff err, returned by parsing the flags of a
+// command in the tree rooted at root, reports the describe flag, which is
+// undefined unless the command defines a flag of the same name.
+func isDescribeFlag(root *Command, err error) bool {
+	return root.DescribeFlag && err.Error() == undefinedFlagPrefix+describeFlagName
+}
+
+// describeRunner is a Runner that prints the description of the last command
+// in path, for the flag enabled via Command.DescribeFlag.
+type describeRunner struct {
+	path []*Command
+}
+
+// jsonDescription is the JSON representation of a command printed by
+// describeRunner.
+type jsonDescription struct {
+	Name     string   `json:"name"`
+	Short    string   `json:"short"`
+	ArgsName string   `json:"argsName,omitempty"`
+	Flags    []string `json:"flags,omitempty"`
+}
+
+// Run implements the Runner interface method.
+func (d describeRunner) Run(env *Env, args []string) error {
+	cmd := d.path[len(d.path)-1]
+	desc := jsonDescription{
+		Name:     cmd.Name,
+		Short:    strings.TrimSpace(cmd.Short),
+		ArgsName: cmd.ArgsName,
+	}
+	visibleFlags(pathFlags(d.path), d.path).VisitAll(func(f *flag.Flag) {
+		desc.Flags = append(desc.Flags, f.Name)
+	})
+	enc := json.NewEncoder(env.Stdout)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(desc)
+}
@@ -0,0 +1,55 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// GenerateDot writes the command tree rooted at cmd to w as a Graphviz DOT
+// digraph; e.g. render it with "dot -Tsvg".  Each command is a box labeled with
+// its name, with edges from each command to its children.  Help topics are
+// drawn as notes, with dashed edges from the command or topic they belong to.
+// Nodes are identified by their full path, so that names may be reused in
+// different parts of the tree.
+func (cmd *Command) GenerateDot(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %s {\n", dotQuote(cmd.Name))
+	fmt.Fprintf(&b, "  node [shape=box];\n")
+	writeDotCommand(&b, cmd, cmd.Name)
+	fmt.Fprintf(&b, "}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeDotCommand writes the nodes and edges for cmd, which has the given path,
+// and its descendants to b.
+func writeDotCommand(b *strings.Builder, cmd *Command, path string) {
+	fmt.Fprintf(b, "  %s [label=%s];\n", dotQuote(path), dotQuote(cmd.Name))
+	for _, child := range cmd.Children {
+		childPath := path + " " + child.Name
+		fmt.Fprintf(b, "  %s -> %s;\n", dotQuote(path), dotQuote(childPath))
+		writeDotCommand(b, child, childPath)
+	}
+	writeDotTopics(b, cmd.Topics, path)
+}
+
+// writeDotTopics writes the nodes and edges for topics, which belong to the
+// command or topic with the given path, and their sub-topics to b.
+func writeDotTopics(b *strings.Builder, topics []Topic, path string) {
+	for _, topic := range topics {
+		topicPath := path + " " + topic.Name
+		fmt.Fprintf(b, "  %s [label=%s, shape=note];\n", dotQuote(topicPath), dotQuote(topic.Name))
+		fmt.Fprintf(b, "  %s -> %s [style=dashed];\n", dotQuote(path), dotQuote(topicPath))
+		writeDotTopics(b, topic.Children, topicPath)
+	}
+}
+
+// dotQuote returns s as a quoted DOT identifier.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,45 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"flag"
+	"fmt"
+)
+
+// dumpFlagsRunner is a Runner that implements the command named by
+// Command.DumpFlagsCommandName, which prints the effective flag values of the
+// last command in path.
+type dumpFlagsRunner struct {
+	path []*Command
+}
+
+// Run implements the Runner interface method.
+func (d dumpFlagsRunner) Run(env *Env, args []string) error {
+	fmt.Fprint(env.Stdout, dumpFlags(d.path))
+	return nil
+}
+
+// dumpFlags returns the flags of the last command in path in name=value form,
+// one per line, sorted by name.  The values are those of the flags that were
+// parsed for the command, which include the flags inherited from ancestors and
+// the global flags.  The root command parses all of flag.CommandLine, so global
+// flags excluded by GlobalFlagFilter are skipped.
+func dumpFlags(path []*Command) string {
+	cmd, root := path[len(path)-1], path[0]
+	flags, global := cmd.ParsedFlags, rootGlobalFlags(root)
+	if flags == nil {
+		flags = pathFlags(path)
+		mergeFlags(flags, global)
+	}
+	var dump string
+	flags.VisitAll(func(f *flag.Flag) {
+		if cmd == root && root.flags().Lookup(f.Name) == nil && global.Lookup(f.Name) == nil {
+			return
+		}
+		dump += fmt.Sprintf("%s=%s\n", f.Name, f.Value)
+	})
+	return dump
+}
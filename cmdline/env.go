@@ -5,10 +5,12 @@
 package cmdline
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strconv"
+	"strings"
 
 	"v.io/x/lib/envvar"
 	"v.io/x/lib/lookpath"
@@ -34,30 +36,80 @@ type Env struct {
 	Stdin  io.Reader
 	Stdout io.Writer
 	Stderr io.Writer
-	Vars   map[string]string // Environment variables
 	Timer  *timing.Timer
 
+	// Vars holds the environment variables.  Variables that configure help, like
+	// CMDLINE_WIDTH and CMDLINE_STYLE, are read from Vars rather than the process
+	// environment, so that each Env may render help with its own width; e.g. in
+	// golden tests of downstream programs.
+	Vars map[string]string
+
+	// Deterministic indicates whether output must not depend on the machine the
+	// program runs on; e.g. for golden tests of help output.  If set, Stdin,
+	// Stdout and Stderr are never considered terminals, and the terminal size is
+	// never queried, so the output only depends on the args, the command tree,
+	// Vars (e.g. CMDLINE_WIDTH, CMDLINE_STYLE, CMDLINE_PREFIX, NO_COLOR and
+	// TERM) and the output of Runners.  Timing information is only printed if
+	// Timer is non-nil; the package never reads the time or os.Args itself.
+	Deterministic bool
+
 	// Usage is a function that prints usage information to w.  Typically set by
 	// calls to Main or Parse to print usage of the leaf command.
 	Usage func(env *Env, w io.Writer)
+
+	// path is the path of the command whose usage is printed by Usage, set by
+	// calls to Main or Parse.
+	path []*Command
+
+	// root is the root command, set by calls to Main or Parse.
+	root *Command
+
+	// pathPrefix is the CMDLINE_PREFIX passed to the program by its parent, saved
+	// by Parse before it's cleared.
+	pathPrefix string
+
+	// widthVar is the CMDLINE_WIDTH passed to the program, saved by Parse before
+	// it's cleared, so that output printed after the parse has the same width.
+	widthVar string
+
+	// resolved is the path of the command to start parsing from, set by
+	// ExecuteResolved.  If it's set, global flags aren't parsed.
+	resolved []*Command
+
+	// terminalWidth is the width of the terminal, queried by width at most once,
+	// so that all output of an invocation has the same width even if the
+	// terminal is resized; 0 if the size is unknown.  terminalQueried is set
+	// once it has been queried.
+	terminalWidth   int
+	terminalQueried bool
 }
 
 func (e *Env) clone() *Env {
 	return &Env{
-		Stdin:  e.Stdin,
-		Stdout: e.Stdout,
-		Stderr: e.Stderr,
-		Vars:   envvar.CopyMap(e.Vars),
-		Usage:  e.Usage,
-		Timer:  e.Timer, // use the same timer for all operations
+		Stdin:         e.Stdin,
+		Stdout:        e.Stdout,
+		Stderr:        e.Stderr,
+		Vars:          envvar.CopyMap(e.Vars),
+		Deterministic: e.Deterministic,
+		Usage:         e.Usage,
+		Timer:         e.Timer, // use the same timer for all operations
+		path:          e.path,
+		root:          e.root,
+		pathPrefix:    e.pathPrefix,
+		widthVar:      e.widthVar,
+
+		terminalWidth:   e.terminalWidth,
+		terminalQueried: e.terminalQueried,
 	}
 }
 
 // UsageErrorf prints the error message represented by the printf-style format
-// and args, followed by the output of the Usage function.  Returns ErrUsage to
-// make it easy to use from within the Runner.Run function.
+// and args, followed by the output of the Usage function.  Returns a *UsageError
+// of kind BadArgs that wraps ErrUsage, to make it easy to use from within the
+// Runner.Run function.  As with fmt.Errorf, the error also wraps each error
+// that's formatted with the %w verb.
 func (e *Env) UsageErrorf(format string, args ...interface{}) error {
-	return usageErrorf(e, e.Usage, format, args...)
+	return usageErrorf(e, BadArgs, e.path, e.Usage, format, args...)
 }
 
 // TimerPush calls e.Timer.Push(name), only if the Timer is non-nil.
@@ -90,31 +142,230 @@ func (e *Env) LookPathPrefix(prefix string, names map[string]bool) ([]string, er
 	return lookpath.LookPrefix(e.Vars, prefix, names)
 }
 
-func usageErrorf(env *Env, usage func(*Env, io.Writer), format string, args ...interface{}) error {
-	fmt.Fprint(env.Stderr, "ERROR: ")
-	fmt.Fprintf(env.Stderr, format, args...)
-	fmt.Fprint(env.Stderr, "\n\n")
+// IsStdoutTerminal returns true iff e.Stdout is a terminal.  Commands may use
+// this to decide whether to output progress and other status information,
+// which is typically unwanted when the output is captured.  Writers other than
+// an *os.File, such as a bytes.Buffer, are never terminals, and neither is any
+// writer if e is Deterministic.
+func (e *Env) IsStdoutTerminal() bool {
+	return e.isTerminal(e.Stdout)
+}
+
+// IsStderrTerminal returns true iff e.Stderr is a terminal, as described for
+// IsStdoutTerminal.
+func (e *Env) IsStderrTerminal() bool {
+	return e.isTerminal(e.Stderr)
+}
+
+// StdinIsPipe returns true iff e.Stdin is set, and isn't a terminal; e.g. when
+// the output of another program is piped to the command, or a file is
+// redirected to its stdin.  Commands may use this to read input from Stdin when
+// no args are given, similar to cat.  Readers other than an *os.File, such as
+// those set by tests, aren't terminals, so input is always read from them, as
+// it is if e is Deterministic.
+func (e *Env) StdinIsPipe() bool {
+	return e.Stdin != nil && !e.isTerminal(e.Stdin)
+}
+
+// CommandPath returns the names of the commands on the path from the root to
+// the command that is run, set by calls to Main or Parse; e.g. ["prog", "sub"].
+// If the program is run as an external child of another program, the path
+// starts with the names of the parent commands.  Runners may use it for logging.
+func (e *Env) CommandPath() []string {
+	names := strings.Fields(e.pathPrefix)
+	for _, cmd := range e.path {
+		names = append(names, cmd.Name)
+	}
+	return names
+}
+
+// isTerminal returns true iff x is a terminal, which is never the case if e is
+// Deterministic.
+func (e *Env) isTerminal(x interface{}) bool {
+	return !e.Deterministic && isTerminal(x)
+}
+
+// isTerminal returns true iff x is an *os.File that refers to a terminal.  It's
+// a variable so that tests can fake it.
+var isTerminal = func(x interface{}) bool {
+	f, ok := x.(*os.File)
+	return ok && textutil.IsTerminal(f.Fd())
+}
+
+// usageErrorf prints the error message represented by the printf-style format
+// and args, followed by the output of usage, which describes the last command
+// in path.  Returns a *UsageError with the given kind, message and command.
+func usageErrorf(env *Env, kind UsageErrorKind, path []*Command, usage func(*Env, io.Writer), format string, args ...interface{}) *UsageError {
+	msg := fmt.Errorf(format, args...)
+	usageErr := &UsageError{Kind: kind, Message: msg.Error()}
+	switch msg := msg.(type) {
+	case interface{ Unwrap() error }:
+		usageErr.Errs = []error{msg.Unwrap()}
+	case interface{ Unwrap() []error }:
+		usageErr.Errs = msg.Unwrap()
+	}
+	if len(path) > 0 {
+		usageErr.Cmd, usageErr.CmdPath = path[len(path)-1], pathName(env.prefix(), path)
+	}
+	if env.root != nil && env.root.DeferUnknownCommands {
+		var unknownCmd *UnknownCommandError
+		var unknownTopic *UnknownTopicError
+		if errors.As(usageErr, &unknownCmd) || errors.As(usageErr, &unknownTopic) {
+			return usageErr
+		}
+	}
+	var hints []string
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			var reported *UsageError
+			if errors.As(err, &reported) {
+				// The usage has already been reported; e.g. by a nested call to
+				// ParseAndRun from a Runner.
+				return usageErr
+			}
+			hints = append(hints, errorHints(err)...)
+		}
+	}
+	fmt.Fprint(env.Stderr, env.errorLabelFor(env.Stderr), " ", usageErr.Message, "\n")
+	printHints(env.Stderr, env.outputWidth(env.Stderr), hints)
+	if env.root != nil && env.root.SuppressUsageOnError {
+		return usageErr
+	}
+	fmt.Fprint(env.Stderr, "\n")
 	if usage != nil {
 		usage(env, env.Stderr)
 	} else {
 		fmt.Fprint(env.Stderr, "usage error\n")
 	}
-	return ErrUsage
+	return usageErr
+}
+
+// cmdErrorf is like usageErrorf, for errors detected by this package about the
+// command or topic with the given full name.  The message is prefixed based on
+// the ErrorPrefix of the root command.
+func cmdErrorf(env *Env, kind UsageErrorKind, path []*Command, name string, usage func(*Env, io.Writer), format string, args ...interface{}) *UsageError {
+	prefix := ErrorPrefixPath
+	if env.root != nil {
+		prefix = env.root.ErrorPrefix
+	}
+	switch prefix {
+	case ErrorPrefixRoot:
+		name = path[0].Name
+	case ErrorPrefixNone:
+		return usageErrorf(env, kind, path, usage, format, args...)
+	}
+	return usageErrorf(env, kind, path, usage, "%s: "+format, append([]interface{}{name}, args...)...)
+}
+
+// defaultErrorLabel is the default label that starts lines reporting errors.
+const defaultErrorLabel = "ERROR:"
+
+// errorLabel returns the label that starts lines reporting errors.
+func (e *Env) errorLabel() string {
+	if e.root != nil && e.root.ErrorLabel != "" {
+		return e.root.ErrorLabel
+	}
+	return defaultErrorLabel
+}
+
+// errorLabelFor returns the error label to write to w, in bold red if the label
+// is colored for w.
+func (e *Env) errorLabelFor(w io.Writer) string {
+	if e.errorColor(w) {
+		return "\x1b[1;31m" + e.errorLabel() + "\x1b[0m"
+	}
+	return e.errorLabel()
 }
 
-// defaultWidth is a reasonable default for the output width in runes.
+// errorColor returns true iff the error label is colored when written to w; by
+// default w must be a terminal, which isn't known to lack support for escape
+// sequences, and colors must not be disabled via NO_COLOR.
+func (e *Env) errorColor(w io.Writer) bool {
+	color := ErrorColorAuto
+	if e.root != nil {
+		color = e.root.ErrorColor
+	}
+	switch color {
+	case ErrorColorAlways:
+		return true
+	case ErrorColorNever:
+		return false
+	}
+	return e.isTerminal(w) && e.Vars["NO_COLOR"] == "" && e.Vars["TERM"] != "dumb"
+}
+
+// defaultWidth is a reasonable default for the output width in cells.
 const defaultWidth = 80
 
+// width returns the output width in cells.  It is resolved in order from the
+// root Width field, the CMDLINE_WIDTH variable and the terminal width, using the
+// first that is non-zero, or defaultWidth if none are.  The terminal is only
+// queried the first time it's needed by e.
 func (e *Env) width() int {
-	if width, err := strconv.Atoi(e.Vars["CMDLINE_WIDTH"]); err == nil && width != 0 {
-		return width
+	if e.root != nil && e.root.Width != 0 {
+		return e.root.Width
 	}
-	if _, width, err := textutil.TerminalSize(); err == nil && width != 0 {
+	if width := e.varWidth(); width != 0 {
 		return width
 	}
+	if e.Deterministic {
+		return defaultWidth
+	}
+	if !e.terminalQueried {
+		e.terminalQueried = true
+		if _, width, err := terminalSize(); err == nil {
+			e.terminalWidth = width
+		}
+	}
+	if e.terminalWidth != 0 {
+		return e.terminalWidth
+	}
 	return defaultWidth
 }
 
+// terminalSize returns the size of the terminal, via textutil.TerminalSize.
+// It's a variable so that tests can fake it.
+var terminalSize = textutil.TerminalSize
+
+// widthIsSet returns true iff the width is explicitly set via the root Width
+// field or CMDLINE_WIDTH.
+func (e *Env) widthIsSet() bool {
+	if e.root != nil && e.root.Width != 0 {
+		return true
+	}
+	return e.varWidth() != 0
+}
+
+// varWidth returns the width set via CMDLINE_WIDTH, or 0 if it isn't set.  The
+// value saved by Parse is used if the variable has been cleared.
+func (e *Env) varWidth() int {
+	value, ok := e.Vars["CMDLINE_WIDTH"]
+	if !ok {
+		value = e.widthVar
+	}
+	if width, err := strconv.Atoi(value); err == nil {
+		return width
+	}
+	return 0
+}
+
+// outputWidth returns the width for output written to w.  Unless the width is
+// explicitly set, the width is unlimited if w isn't a terminal, so that output
+// consumed by line-oriented tools consists of logical lines.
+func (e *Env) outputWidth(w io.Writer) int {
+	if !e.widthIsSet() && !e.isTerminal(w) {
+		return -1
+	}
+	return e.width()
+}
+
+// hyperlinks returns true iff OSC 8 hyperlinks may be written to the output;
+// both Stdout and Stderr must be terminals, which aren't known to lack support
+// for escape sequences.
+func (e *Env) hyperlinks() bool {
+	return e.isTerminal(e.Stdout) && e.isTerminal(e.Stderr) && e.Vars["TERM"] != "dumb"
+}
+
 func (e *Env) style() style {
 	style := styleCompact
 	style.Set(e.Vars["CMDLINE_STYLE"])
@@ -133,10 +384,11 @@ func (e *Env) firstCall() bool {
 type style int
 
 const (
-	styleCompact   style = iota // Default style, good for compact cmdline output.
-	styleFull                   // Similar to compact but shows all global flags.
-	styleGoDoc                  // Good for godoc processing.
-	styleShortOnly              // Only output short description.
+	styleCompact    style = iota // Default style, good for compact cmdline output.
+	styleFull                    // Similar to compact but shows all global flags.
+	styleGoDoc                   // Good for godoc processing.
+	styleShortOnly               // Only output short description.
+	styleCheatSheet              // Only output paths and short descriptions of leaf commands.
 )
 
 func (s *style) String() string {
@@ -149,6 +401,8 @@ func (s *style) String() string {
 		return "godoc"
 	case styleShortOnly:
 		return "shortonly"
+	case styleCheatSheet:
+		return "cheatsheet"
 	default:
 		panic(fmt.Errorf("unhandled style %d", *s))
 	}
@@ -165,6 +419,8 @@ func (s *style) Set(value string) error {
 		*s = styleGoDoc
 	case "shortonly":
 		*s = styleShortOnly
+	case "cheatsheet":
+		*s = styleCheatSheet
 	default:
 		return fmt.Errorf("unknown style %q", value)
 	}
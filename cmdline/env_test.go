@@ -5,8 +5,12 @@ package cmdline
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -31,9 +35,16 @@ func TestEnvUsageErrorf(t *testing.T) {
 	for _, test := range tests {
 		var buf bytes.Buffer
 		env := &Env{Stderr: &buf, Usage: test.usage}
-		if got, want := env.UsageErrorf(test.format, test.args...), ErrUsage; got != want {
+		err := env.UsageErrorf(test.format, test.args...)
+		if got, want := err, ErrUsage; !errors.Is(got, want) {
 			t.Errorf("%q got error %v, want %v", test.want, got, want)
 		}
+		var usageErr *UsageError
+		if !errors.As(err, &usageErr) {
+			t.Errorf("%q got error %T, want *UsageError", test.want, err)
+		} else if got, want := "ERROR: "+usageErr.Message, strings.SplitN(test.want, "\n", 2)[0]; got != want {
+			t.Errorf("got message %q, want %q", got, want)
+		}
 		if got, want := buf.String(), test.want; got != want {
 			t.Errorf("got %v, want %v", got, want)
 		}
@@ -58,13 +69,83 @@ func TestEnvWidth(t *testing.T) {
 			t.Errorf("%q got %v, want %v", test.value, got, want)
 		}
 		// Test using the OS environment.
-		if err := os.Setenv("CMDLINE_WIDTH", test.value); err != nil {
-			t.Errorf("Setenv(%q) failed: %v", test.value, err)
-		} else if got, want := EnvFromOS().width(), test.want; got != want {
+		t.Setenv("CMDLINE_WIDTH", test.value)
+		if got, want := EnvFromOS().width(), test.want; got != want {
 			t.Errorf("%q got %v, want %v", test.value, got, want)
 		}
 	}
-	os.Unsetenv("CMDLINE_WIDTH")
+}
+
+func TestEnvVarsWidth(t *testing.T) {
+	isolateGlobalFlags(t)
+	// The width in the OS environment is ignored, since each Env has its own.
+	t.Setenv("CMDLINE_WIDTH", "10")
+	prog := &Command{
+		Name:   "prog",
+		Short:  "Test width",
+		Long:   "Prog has a long description that is wrapped to the width.",
+		Runner: RunnerFunc(func(*Env, []string) error { return nil }),
+	}
+	tests := []struct {
+		width, want string
+	}{
+		{"20", "Prog has a long\ndescription that is\nwrapped to the\nwidth.\n"},
+		{"40", "Prog has a long description that is\nwrapped to the width.\n"},
+	}
+	for _, test := range tests {
+		var stdout bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: ioutil.Discard, Vars: map[string]string{"CMDLINE_WIDTH": test.width}, Deterministic: true}
+		if err := ParseAndRun(prog, env, []string{"-help"}); err != nil {
+			t.Errorf("%s got error %v", test.width, err)
+		}
+		if got, want := stdout.String(), test.want; !strings.HasPrefix(got, want) {
+			t.Errorf("%s got %q, want prefix %q", test.width, got, want)
+		}
+	}
+}
+
+func TestRootWidth(t *testing.T) {
+	isolateGlobalFlags(t)
+	// The root Width takes precedence over CMDLINE_WIDTH, but not the help
+	// -width flag.
+	newProg := func(width int) *Command {
+		return &Command{
+			Name:     "prog",
+			Short:    "Test width",
+			Long:     "Prog has a long description that is wrapped to the width.",
+			Children: []*Command{{Name: "child", Short: "Child", Long: "Child.", Runner: RunnerFunc(func(*Env, []string) error { return nil })}},
+			Width:    width,
+		}
+	}
+	tests := []struct {
+		width int
+		args  []string
+		want  string
+	}{
+		{20, []string{"-help"}, "Prog has a long\ndescription that is\nwrapped to the\nwidth.\n"},
+		{-1, []string{"-help"}, "Prog has a long description that is wrapped to the width.\n"},
+		{0, []string{"-help"}, "Prog has a long description that is\nwrapped to the width.\n"},
+		{20, []string{"help", "-width=40"}, "Prog has a long description that is\nwrapped to the width.\n"},
+	}
+	for _, test := range tests {
+		var stdout bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: ioutil.Discard, Vars: map[string]string{"CMDLINE_WIDTH": "40"}, Deterministic: true}
+		if err := ParseAndRun(newProg(test.width), env, test.args); err != nil {
+			t.Errorf("%d %q got error %v", test.width, test.args, err)
+		}
+		if got, want := stdout.String(), test.want; !strings.HasPrefix(got, want) {
+			t.Errorf("%d %q got %q, want prefix %q", test.width, test.args, got, want)
+		}
+	}
+	// The usage of the help -width flag describes the width set by the program.
+	var stdout bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: ioutil.Discard, Vars: map[string]string{"CMDLINE_WIDTH": "-1"}, Deterministic: true}
+	if err := ParseAndRun(newProg(-1), env, []string{"help", "help"}); err != nil {
+		t.Errorf("got error %v", err)
+	}
+	if got, want := stdout.String(), " -width=-1\n   Format output to this target width in cells, or unlimited if width < 0. Defaults to unlimited, set by the program.\n"; !strings.Contains(got, want) {
+		t.Errorf("got %q, want it to contain %q", got, want)
+	}
 }
 
 func TestEnvStyle(t *testing.T) {
@@ -86,11 +167,187 @@ func TestEnvStyle(t *testing.T) {
 			t.Errorf("%q got %v, want %v", test.value, got, want)
 		}
 		// Test using the OS environment.
-		if err := os.Setenv("CMDLINE_STYLE", test.value); err != nil {
-			t.Errorf("Setenv(%q) failed: %v", test.value, err)
-		} else if got, want := EnvFromOS().style(), test.want; got != want {
+		t.Setenv("CMDLINE_STYLE", test.value)
+		if got, want := EnvFromOS().style(), test.want; got != want {
 			t.Errorf("%q got %v, want %v", test.value, got, want)
 		}
 	}
-	os.Unsetenv("CMDLINE_STYLE")
+}
+
+func TestEnvIsTerminal(t *testing.T) {
+	file, err := ioutil.TempFile("", "cmdline-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	tests := []io.Writer{nil, new(bytes.Buffer), ioutil.Discard, file}
+	for _, test := range tests {
+		env := &Env{Stdout: test, Stderr: test}
+		if got, want := env.IsStdoutTerminal(), false; got != want {
+			t.Errorf("%T got %v, want %v", test, got, want)
+		}
+		if got, want := env.IsStderrTerminal(), false; got != want {
+			t.Errorf("%T got %v, want %v", test, got, want)
+		}
+	}
+}
+
+func TestEnvStdinIsPipe(t *testing.T) {
+	file, err := ioutil.TempFile("", "cmdline-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	defer func(orig func(interface{}) bool) { isTerminal = orig }(isTerminal)
+	isTerminal = func(x interface{}) bool { return x == os.Stdin }
+	tests := []struct {
+		stdin         io.Reader
+		deterministic bool
+		want          bool
+	}{
+		{nil, false, false},
+		{new(bytes.Buffer), false, true},
+		{file, false, true},
+		{r, false, true},
+		{os.Stdin, false, false},
+		{os.Stdin, true, true},
+	}
+	for _, test := range tests {
+		env := &Env{Stdin: test.stdin, Deterministic: test.deterministic}
+		if got, want := env.StdinIsPipe(), test.want; got != want {
+			t.Errorf("%T deterministic=%v got %v, want %v", test.stdin, test.deterministic, got, want)
+		}
+	}
+}
+
+func TestEnvCommandPath(t *testing.T) {
+	isolateGlobalFlags(t)
+	var got []string
+	child := &Command{
+		Name:   "child",
+		Short:  "Child",
+		Long:   "Child records its command path.",
+		Runner: RunnerFunc(func(env *Env, _ []string) error { got = env.CommandPath(); return nil }),
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test command path",
+		Long:     "Prog has a child.",
+		Children: []*Command{child},
+	}
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"prog", "child"}},
+		{"parent sub", []string{"parent", "sub", "prog", "child"}},
+	}
+	for _, test := range tests {
+		got = nil
+		env := &Env{Stdout: ioutil.Discard, Stderr: ioutil.Discard, Vars: map[string]string{"CMDLINE_PREFIX": test.prefix}, Deterministic: true}
+		if err := ParseAndRun(prog, env, []string{"child"}); err != nil {
+			t.Errorf("%q got error %v", test.prefix, err)
+		}
+		if want := test.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("%q got path %q, want %q", test.prefix, got, want)
+		}
+	}
+}
+
+func TestEnvDeterministic(t *testing.T) {
+	defer func(orig func(interface{}) bool) { isTerminal = orig }(isTerminal)
+	// Fake terminals, which are ignored by deterministic environments.
+	isTerminal = func(interface{}) bool { return true }
+	tests := []struct {
+		deterministic, terminal bool
+	}{
+		{false, true},
+		{true, false},
+	}
+	for _, test := range tests {
+		var stdout bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stdout, Vars: map[string]string{}, Deterministic: test.deterministic}
+		if got, want := env.IsStdoutTerminal(), test.terminal; got != want {
+			t.Errorf("%v got stdout terminal %v, want %v", test.deterministic, got, want)
+		}
+		if got, want := env.errorColor(env.Stderr), test.terminal; got != want {
+			t.Errorf("%v got error color %v, want %v", test.deterministic, got, want)
+		}
+		if got, want := env.hyperlinks(), test.terminal; got != want {
+			t.Errorf("%v got hyperlinks %v, want %v", test.deterministic, got, want)
+		}
+	}
+	// The terminal size isn't queried, and output isn't wrapped unless the width
+	// is set.
+	env := &Env{Stdout: ioutil.Discard, Vars: map[string]string{}, Deterministic: true}
+	if got, want := env.width(), defaultWidth; got != want {
+		t.Errorf("got width %v, want %v", got, want)
+	}
+	if got, want := env.outputWidth(env.Stdout), -1; got != want {
+		t.Errorf("got output width %v, want %v", got, want)
+	}
+}
+
+func TestEnvOutputWidth(t *testing.T) {
+	defer func(orig func(interface{}) bool) { isTerminal = orig }(isTerminal)
+	tests := []struct {
+		value    string
+		terminal bool
+		want     int
+	}{
+		{"123", false, 123},
+		{"123", true, 123},
+		{"-1", true, -1},
+		{"", false, -1},
+		{"0", false, -1},
+		{"foobar", false, -1},
+	}
+	for _, test := range tests {
+		isTerminal = func(interface{}) bool { return test.terminal }
+		env := &Env{Vars: map[string]string{"CMDLINE_WIDTH": test.value}}
+		if got, want := env.outputWidth(new(bytes.Buffer)), test.want; got != want {
+			t.Errorf("%q terminal %v got %v, want %v", test.value, test.terminal, got, want)
+		}
+	}
+}
+
+func TestEnvTerminalWidthOnce(t *testing.T) {
+	isolateGlobalFlags(t)
+	defer func(orig func(interface{}) bool) { isTerminal = orig }(isTerminal)
+	defer func(orig func() (int, int, error)) { terminalSize = orig }(terminalSize)
+	isTerminal = func(interface{}) bool { return true }
+	root := newBenchTree("c", 2, 2)
+	for _, args := range [][]string{
+		{"c0", "c00", "-bad"},
+		{"help", "..."},
+		{"c0", "help", "-style=full", "c00"},
+	} {
+		// The terminal is resized after the first query, which must not affect the
+		// output of the invocation.
+		calls := 0
+		terminalSize = func() (int, int, error) {
+			calls++
+			return 24, 50 + 50*(calls-1), nil
+		}
+		var stdout bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stdout, Vars: map[string]string{}}
+		ParseAndRun(root, env, args)
+		if got, want := calls, 1; got != want {
+			t.Errorf("%v: got %d terminal queries, want %d", args, got, want)
+		}
+		var want bytes.Buffer
+		env = &Env{Stdout: &want, Stderr: &want, Vars: map[string]string{"CMDLINE_WIDTH": "50"}}
+		ParseAndRun(root, env, args)
+		if got, want := stdout.String(), want.String(); got != want {
+			t.Errorf("%v: got output %q, want width 50 %q", args, got, want)
+		}
+	}
 }
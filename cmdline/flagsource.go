@@ -0,0 +1,64 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import "fmt"
+
+// Sources of the effective values of flags, as returned by FlagSource.
+const (
+	SourceFlag    = "flag"    // Set on the command line.
+	SourceEnv     = "env"     // Set from an environment variable via SetFlagFrom.
+	SourceFile    = "file"    // Set from a file via SetFlagFrom.
+	SourceDefault = "default" // Not set; the default value of the flag.
+)
+
+// SetFlagFrom sets the flag with the given name to value, and records that the
+// value came from source, which must be SourceEnv or SourceFile.  It is
+// intended for code that layers defaults from environment variables or config
+// files under the command line; e.g. called before Parse, or from PostParse.
+// The command line takes precedence: if the flag was set on the command line
+// of the last parse of cmd, its value is left unchanged, and if it is set by a
+// later parse, the value is overwritten as usual.
+//
+// The flag is looked up in the flags of cmd, and then in its ParsedFlags, which
+// also include the flags inherited from ancestors and the global flags.
+func (cmd *Command) SetFlagFrom(source, name, value string) error {
+	if source != SourceEnv && source != SourceFile {
+		return fmt.Errorf("%s: unknown flag source %q", cmd.Name, source)
+	}
+	if _, ok := cmd.cmdLineFlags[name]; ok {
+		return nil
+	}
+	f := cmd.flags().Lookup(name)
+	if f == nil && cmd.ParsedFlags != nil {
+		f = cmd.ParsedFlags.Lookup(name)
+	}
+	if f == nil {
+		return fmt.Errorf("%s: flag -%s isn't defined", cmd.Name, name)
+	}
+	if err := f.Value.Set(value); err != nil {
+		return fmt.Errorf("%s: invalid value %q for flag -%s from %s: %v", cmd.Name, value, name, source, err)
+	}
+	if cmd.flagSources == nil {
+		cmd.flagSources = make(map[string]string)
+	}
+	cmd.flagSources[name] = source
+	return nil
+}
+
+// FlagSource returns the source of the effective value of the flag with the
+// given name: SourceFlag if it was set on the command line of the last parse
+// whose path included cmd, otherwise SourceEnv or SourceFile if it was set via
+// SetFlagFrom, and otherwise SourceDefault.  It may be used to debug layered
+// configuration; e.g. from the Runner of cmd.
+func (cmd *Command) FlagSource(name string) string {
+	if _, ok := cmd.cmdLineFlags[name]; ok {
+		return SourceFlag
+	}
+	if source, ok := cmd.flagSources[name]; ok {
+		return source
+	}
+	return SourceDefault
+}
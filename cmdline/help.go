@@ -6,13 +6,23 @@ package cmdline
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"go/doc"
+	"go/doc/comment"
 	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	pathpkg "path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 	"unicode/utf8"
 
@@ -21,6 +31,16 @@ import (
 
 const missingDescription = "No description available"
 
+// minNameWidth is the minimum width of the name column in command and topic
+// listings.
+const minNameWidth = 11
+
+// defaultTabWidth is the default distance in cells between tab stops.
+const defaultTabWidth = 8
+
+// defaultIndentWidth is the default width in spaces of the indent of listings.
+const defaultIndentWidth = 3
+
 // helpRunner is a Runner that implements the "help" functionality.  Help is
 // requested for the last command in path, which must not be empty.
 type helpRunner struct {
@@ -30,54 +50,231 @@ type helpRunner struct {
 
 func makeHelpRunner(path []*Command, env *Env) helpRunner {
 	return helpRunner{path, &helpConfig{
-		style:     env.style(),
-		width:     env.width(),
-		prefix:    env.prefix(),
-		firstCall: env.firstCall(),
+		style:      env.style(),
+		width:      env.width(),
+		widthSet:   env.widthIsSet(),
+		helpFormat: newHelpFormat(path[0]),
+		hyperlinks: path[0].Hyperlinks && env.hyperlinks(),
+		prefix:     env.prefix(),
+		firstCall:  env.firstCall(),
+		terminal:   env.isTerminal,
 	}}
 }
 
 // helpConfig holds configuration data for help.  The style and width may be
 // overriden by flags if the command returned by newCommand is parsed.
 type helpConfig struct {
-	style     style
-	width     int
-	prefix    string
-	firstCall bool
+	helpFormat
+	style      style
+	width      int
+	widthSet   bool
+	hyperlinks bool
+	prefix     string
+	firstCall  bool
+	search     string
+	allFlags   bool
+	noGlobals  bool
+	strict     bool
+	terminal   func(interface{}) bool
+
+	// The flags are computed on demand and memoized, since each is needed by
+	// several sections of usage.  They don't depend on the style or width, and
+	// the config is created anew for each invocation.
+	pathFlagsMemo      map[string]*flag.FlagSet
+	globalFlagsMemo    *flag.FlagSet
+	globalFlagListMemo []*flag.Flag
+}
+
+// pathFlags returns the same flags as pathFlags(path), memoized for the
+// invocation.  The result must not be modified.
+//
+// The flags are built from the memoized flags of the parent, rather than by
+// walking all ancestors of every command printed by "help ...".
+func (config *helpConfig) pathFlags(path []*Command) *flag.FlagSet {
+	key := pathName("", path)
+	if flags, ok := config.pathFlagsMemo[key]; ok {
+		return flags
+	}
+	if config.pathFlagsMemo == nil {
+		config.pathFlagsMemo = make(map[string]*flag.FlagSet)
+	}
+	cmd := path[len(path)-1]
+	flags := copyFlags(cmd.flags())
+	if len(path) > 1 && cmd.Name != helpCommandName(path) && !cmd.DontInheritFlags && !path[len(path)-2].DontPropagateFlags {
+		mergeFlags(flags, config.pathFlags(path[:len(path)-1]))
+	}
+	config.pathFlagsMemo[key] = flags
+	return flags
+}
+
+// globalFlags returns rootGlobalFlags(root), memoized for the invocation.  The
+// result must not be modified.
+func (config *helpConfig) globalFlags(root *Command) *flag.FlagSet {
+	if config.globalFlagsMemo == nil {
+		config.globalFlagsMemo = rootGlobalFlags(root)
+		config.globalFlagListMemo = flagList(config.globalFlagsMemo, nil, nil, true)
+	}
+	return config.globalFlagsMemo
+}
+
+// globalFlagList returns the flags of globalFlags(root) in lexicographical
+// order, memoized for the invocation, so that they're only sorted once.
+func (config *helpConfig) globalFlagList(root *Command) []*flag.Flag {
+	config.globalFlags(root)
+	return config.globalFlagListMemo
+}
+
+// hasFlags returns true iff any flags may be specified for the last command in
+// path, including the global flags.
+func (config *helpConfig) hasFlags(path []*Command) bool {
+	return len(config.globalFlagList(path[0])) > 0 || countFlags(config.pathFlags(path), nil, true) > 0
 }
 
 // Run implements the Runner interface method.
 func (h helpRunner) Run(env *Env, args []string) error {
-	w := textutil.NewUTF8WrapWriter(env.Stdout, h.width)
+	cleanTree(h.path[0])
+	w := newWrapWriter(env.Stdout, h.helpConfig)
 	defer w.Flush()
 	return runHelp(w, env, args, h.path, h.helpConfig)
 }
 
 // usageFunc is used as the implementation of the Env.Usage function.
 func (h helpRunner) usageFunc(env *Env, writer io.Writer) {
-	w := textutil.NewUTF8WrapWriter(writer, h.width)
-	usage(w, env, h.path, h.helpConfig, h.helpConfig.firstCall)
+	cleanTree(h.path[0])
+	w := newWrapWriter(writer, h.helpConfig)
+	if err := usage(w, env, h.path, h.helpConfig, h.helpConfig.firstCall); err != nil {
+		fmt.Fprintln(w, env.errorLabelFor(writer), err)
+	}
 	w.Flush()
 }
 
+// newWrapWriter returns a new WrapWriter that writes to w, formatted according
+// to the width and tab width of config.  Unless the width is explicitly set,
+// the width is unlimited if w isn't a terminal, so that output consumed by
+// line-oriented tools consists of logical lines.
+func newWrapWriter(w io.Writer, config *helpConfig) *textutil.WrapWriter {
+	width := config.width
+	if !config.widthSet && !config.terminal(w) {
+		width = -1
+	}
+	ww := textutil.NewUTF8WrapWriter(w, width)
+	ww.SetTabWidth(config.tabWidth)
+	ww.SetRuneWidth(config.runeWidth)
+	return ww
+}
+
+// widthFlag implements flag.Value for the help -width flag, and records that
+// the width is explicitly set.
+type widthFlag struct {
+	*helpConfig
+}
+
+func (f widthFlag) String() string {
+	if f.helpConfig == nil {
+		return "0"
+	}
+	return strconv.Itoa(f.width)
+}
+
+func (f widthFlag) Set(value string) error {
+	width, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	f.width, f.widthSet = width, true
+	return nil
+}
+
+// widthUsage returns the usage of the help -width flag for the tree rooted at
+// root, describing the order in which Env.width resolves the default width.
+func widthUsage(root *Command) string {
+	usage := "Format output to this target width in cells, or unlimited if width < 0.\n"
+	if root.Width != 0 {
+		return usage + "Defaults to " + widthDefault(root) + ", set by the program.\n"
+	}
+	return usage + `Defaults to the terminal width if available, or unlimited if the output isn't
+a terminal.  Override the default by setting the CMDLINE_WIDTH environment
+variable.
+`
+}
+
+// widthDefault returns the default value of the help -width flag for the tree
+// rooted at root, shown in the flag usage.
+func widthDefault(root *Command) string {
+	switch {
+	case root.Width < 0:
+		return "unlimited"
+	case root.Width > 0:
+		return strconv.Itoa(root.Width)
+	}
+	return "<terminal width>"
+}
+
+// helpFormat holds formatting options for help, which are set on the root
+// command.
+type helpFormat struct {
+	tabWidth       int
+	separator      rune
+	separatorWidth int
+	indent         string
+	flagIndent     string
+	runeWidth      func(rune) int
+}
+
+// newHelpFormat returns the formatting options for help of the tree rooted at
+// root, using defaults for options that aren't set.
+func newHelpFormat(root *Command) helpFormat {
+	indentWidth := root.IndentWidth
+	if indentWidth <= 0 {
+		indentWidth = defaultIndentWidth
+	}
+	format := helpFormat{root.TabWidth, root.HelpSeparator, root.HelpSeparatorWidth, root.HelpIndent, spaces(indentWidth), root.RuneWidthFunc}
+	if format.tabWidth == 0 {
+		format.tabWidth = defaultTabWidth
+	}
+	if format.separator == 0 {
+		format.separator = '='
+	}
+	if format.indent == "" {
+		format.indent = format.flagIndent
+	}
+	if format.runeWidth == nil {
+		format.runeWidth = textutil.RuneWidth
+	}
+	return format
+}
+
 const (
 	helpName  = "help"
 	helpShort = "Display help for commands or topics"
 )
 
+// helpCommandName returns the name of the default help command for the command
+// tree rooted at path[0], or "" if the default help command is disabled.
+func helpCommandName(path []*Command) string {
+	switch root := path[0]; {
+	case root.DisableHelpCommand:
+		return ""
+	case root.HelpCommandName != "":
+		return root.HelpCommandName
+	}
+	return helpName
+}
+
 // newCommand returns a new help command that uses h as its Runner.
 func (h helpRunner) newCommand() *Command {
+	name := helpCommandName(h.path)
 	help := &Command{
 		Runner: h,
-		Name:   helpName,
+		Name:   name,
 		Short:  helpShort,
-		Long: `
+		Long: fmt.Sprintf(`
 Help with no args displays the usage of the parent command.
 
 Help with args displays the usage of the specified sub-command or help topic.
 
-"help ..." recursively displays help for all commands and topics.
-`,
+"%s ..." recursively displays help for all commands and topics.
+`, name),
 		ArgsName: "[command/topic ...]",
 		ArgsLong: `
 [command/topic ...] optionally identifies a specific sub-command or help topic.
@@ -85,46 +282,85 @@ Help with args displays the usage of the specified sub-command or help topic.
 	}
 	help.Flags.Var(&h.style, "style", `
 The formatting style for help output:
-   compact   - Good for compact cmdline output.
-   full      - Good for cmdline output, shows all global flags.
-   godoc     - Good for godoc processing.
-   shortonly - Only output short description.
+   compact    - Good for compact cmdline output.
+   full       - Good for cmdline output, shows all global flags.
+   godoc      - Good for godoc processing.
+   shortonly  - Only output short description.
+   cheatsheet - Only output the path and short description of each leaf command.
 Override the default by setting the CMDLINE_STYLE environment variable.
 `)
-	help.Flags.IntVar(&h.width, "width", h.width, `
-Format output to this target width in runes, or unlimited if width < 0.
-Defaults to the terminal width if available.  Override the default by setting
-the CMDLINE_WIDTH environment variable.
+	help.Flags.Var(widthFlag{h.helpConfig}, "width", widthUsage(h.path[0]))
+	help.Flags.StringVar(&h.search, "search", "", `
+Display the commands and topics whose name or description contains the given
+term, ignoring case, instead of displaying usage.
+`)
+	help.Flags.BoolVar(&h.allFlags, "all-flags", false, `
+Display every flag defined on the commands from the given command onward,
+sorted by command path, instead of displaying usage.
+`)
+	help.Flags.BoolVar(&h.noGlobals, "no-globals", false, `
+Omit the global flags from the usage, including for recursive help.
+`)
+	help.Flags.BoolVar(&h.strict, "strict", false, `
+Stop recursive help at the first error, e.g. a long description that can't be
+read, instead of displaying the remaining commands and topics.
 `)
 	// Override default values, so that the godoc style shows good defaults.
 	help.Flags.Lookup("style").DefValue = "compact"
-	help.Flags.Lookup("width").DefValue = "<terminal width>"
+	help.Flags.Lookup("width").DefValue = widthDefault(h.path[0])
 	cleanTree(help)
 	return help
 }
 
 // runHelp implements the run-time behavior of the help command.
 func runHelp(w *textutil.WrapWriter, env *Env, args []string, path []*Command, config *helpConfig) error {
-	if len(args) == 0 {
-		usage(w, env, path, config, config.firstCall)
+	if len(args) == 0 && config.search != "" {
+		return searchAll(w, env, path, config)
+	}
+	if len(args) == 0 && config.allFlags {
+		allFlags(w, env, path, config)
 		return nil
 	}
+	if len(args) == 0 {
+		return usage(w, env, path, config, config.firstCall)
+	}
 	if args[0] == "..." {
-		usageAll(w, env, path, config, config.firstCall)
-		return nil
+		if config.style == styleCheatSheet {
+			// The cheat sheet already covers all commands.
+			return usage(w, env, path, config, config.firstCall)
+		}
+		return usageAll(w, env, path, config, config.firstCall)
 	}
 	// Look for matching children.
 	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, path)
 	subName, subArgs := args[0], args[1:]
-	for _, child := range cmd.Children {
-		if child.Name == subName {
-			return runHelp(w, env, subArgs, append(path, child), config)
-		}
+	if child := findChild(path[0], cmd, subName); child != nil {
+		return runHelp(w, env, subArgs, append(path, child), config)
 	}
-	if helpName == subName {
+	if name := helpCommandName(path); name != "" && matchName(path[0], name, subName) {
 		help := helpRunner{path, config}.newCommand()
 		return runHelp(w, env, subArgs, append(path, help), config)
 	}
+	if isNamePattern(subName) {
+		// Display help for each child that matches the pattern, just like "...".
+		matches, err := matchChildren(cmd, subName)
+		if err != nil || len(matches) == 0 {
+			fn := helpRunner{path, config}.usageFunc
+			return cmdErrorf(env, UnknownCommand, path, cmdPath, fn, "no commands match %q", subName)
+		}
+		for _, child := range matches {
+			if len(subArgs) > 0 {
+				if err := runHelp(w, env, subArgs, append(path, child), config); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := usage(w, env, append(path, child), config, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 	if cmd.LookPath {
 		// Look for a matching executable in PATH.
 		if subCmd, _ := env.LookPath(cmd.Name + "-" + subName); subCmd != "" {
@@ -138,14 +374,530 @@ func runHelp(w *textutil.WrapWriter, env *Env, args []string, path []*Command, c
 		}
 	}
 	// Look for matching topic.
-	for _, topic := range cmd.Topics {
-		if topic.Name == subName {
-			fmt.Fprintln(w, topic.Long)
-			return nil
-		}
+	if topic, ok := findCmdTopic(path[0], cmd, subName); ok {
+		return runHelpTopic(w, env, subArgs, path, []Topic{topic}, config)
 	}
 	fn := helpRunner{path, config}.usageFunc
-	return usageErrorf(env, fn, "%s: unknown command or topic %q", cmdPath, subName)
+	unknown := &UnknownTopicError{Parent: cmd, Name: subName, Args: subArgs}
+	return cmdErrorf(env, UnknownTopic, path, cmdPath, fn, "%w", unknown)
+}
+
+// runHelpTopic implements the run-time behavior of the help command for the
+// last topic in topics, which are nested topics under the last command in path.
+func runHelpTopic(w *textutil.WrapWriter, env *Env, args []string, path []*Command, topics []Topic, config *helpConfig) error {
+	if len(args) == 0 {
+		return topicUsage(w, path, topics, config)
+	}
+	// Look for matching sub-topic.
+	topic := topics[len(topics)-1]
+	subName, subArgs := args[0], args[1:]
+	if child, ok := findTopic(path[0], topic.Children, subName); ok {
+		return runHelpTopic(w, env, subArgs, path, append(topics, child), config)
+	}
+	fn := func(env *Env, writer io.Writer) {
+		w := newWrapWriter(writer, config)
+		if err := topicUsage(w, path, topics, config); err != nil {
+			fmt.Fprintln(w, env.errorLabelFor(writer), err)
+		}
+		w.Flush()
+	}
+	unknown := &UnknownTopicError{Parent: path[len(path)-1], Topic: topic.Name, Name: subName, Args: subArgs}
+	return cmdErrorf(env, UnknownTopic, path, topicPathName(config.prefix, path, topics), fn, "%w", unknown)
+}
+
+// appendURL returns the long description of a topic, followed by a paragraph
+// that links to url, if it's non-empty.
+func appendURL(long, url string) string {
+	if url == "" {
+		return long
+	}
+	if long != "" {
+		long += "\n\n"
+	}
+	return long + "See: " + url
+}
+
+// topicPathName returns the name of the last topic in topics, which are nested
+// topics under the last command in path.
+func topicPathName(prefix string, path []*Command, topics []Topic) string {
+	name := pathName(prefix, path)
+	for _, topic := range topics {
+		name += " " + topic.Name
+	}
+	return name
+}
+
+// topicUsage prints the usage of the last topic in topics to w, which is the
+// Long description followed by the sub-topics, if any.
+func topicUsage(w *textutil.WrapWriter, path []*Command, topics []Topic, config *helpConfig) error {
+	topic, topicPath := topics[len(topics)-1], topicPathName(config.prefix, path, topics)
+	long, err := readLong(path, topicPath, topic.Long, topic.LongFile)
+	if err != nil {
+		return err
+	}
+	printLong(w, appendURL(long, topic.URL), config.hyperlinks)
+	if len(topic.Children) == 0 {
+		return nil
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "The", topicPath, "sub-topics are:")
+	printTopics(w, config.indent, topic.Children)
+	if name := helpCommandName(path); name != "" && config.style != styleGoDoc {
+		cmdPath := pathName(config.prefix, path)
+		fmt.Fprintf(w, "Run \"%s %s %s [topic]\" for topic details.\n", cmdPath, name, strings.TrimPrefix(topicPath, cmdPath+" "))
+	}
+	return nil
+}
+
+// readLong returns the Long description of the command or topic with the given
+// path name.  If file is non-empty the description is read from that file in
+// the DocsFS of the root command, otherwise long is used.  The description is
+// normalized via NormalizeLong, so that all renderers process it the same way.
+func readLong(path []*Command, name, long, file string) (string, error) {
+	if file == "" {
+		return NormalizeLong(long), nil
+	}
+	docs := path[0].DocsFS
+	if docs == nil {
+		return "", fmt.Errorf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+LongFile %q is specified, but DocsFS isn't set on the root command.`, name, file)
+	}
+	data, err := fs.ReadFile(docs, file)
+	if err != nil {
+		return "", fmt.Errorf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+Can't read LongFile %q: %v`, name, file, err)
+	}
+	return NormalizeLong(string(data)), nil
+}
+
+// listItemRE matches the marker at the start of a list item; e.g. "- ", "* " or
+// "1. ", along with any trailing spaces.
+var listItemRE = regexp.MustCompile(`^([-*]|[0-9]+\.) +`)
+
+// printLong prints the Long description of a command or topic to w, followed
+// by a newline.  List items are wrapped as separate paragraphs, with a hanging
+// indent aligned under the item text, so that the structure of lists is
+// preserved.  Indented lines following an item are continuations of the item,
+// and nested items keep their relative indent.  All other lines are printed
+// as-is.
+//
+// Links written as [text](url) are printed as OSC 8 hyperlinks if hyperlinks
+// is true, otherwise as "text (url)".
+func printLong(w *textutil.WrapWriter, long string, hyperlinks bool) {
+	long = formatLinks(long, hyperlinks)
+	itemIndent := -1 // Indent of the current list item, or -1 if none.
+	for _, line := range strings.Split(long, "\n") {
+		text := strings.TrimLeft(line, " ")
+		indent := len(line) - len(text)
+		if marker := listItemRE.FindString(text); marker != "" {
+			w.SetIndents(spaces(indent), spaces(indent+len(marker)))
+			fmt.Fprint(w, text)
+			itemIndent = indent
+			continue
+		}
+		if itemIndent != -1 {
+			if text != "" && indent > itemIndent {
+				// The newline is converted to a space within the paragraph.
+				fmt.Fprint(w, "\n"+text)
+				continue
+			}
+			w.SetIndents()
+			itemIndent = -1
+		}
+		fmt.Fprintln(w, line)
+	}
+	if itemIndent != -1 {
+		w.SetIndents()
+	}
+}
+
+// linkRE matches links in descriptions, written as [text](url), where the url
+// is absolute.  Bare urls aren't matched.
+var linkRE = regexp.MustCompile(`\[([^\[\]]+)\]\((https?://[^()\s]+)\)`)
+
+// formatLinks returns s with each link written as [text](url) replaced by an
+// OSC 8 hyperlink escape sequence if hyperlinks is true, otherwise replaced by
+// "text (url)".
+func formatLinks(s string, hyperlinks bool) string {
+	if hyperlinks {
+		return linkRE.ReplaceAllString(s, "\x1b]8;;$2\x1b\\$1\x1b]8;;\x1b\\")
+	}
+	return linkRE.ReplaceAllString(s, "$1 ($2)")
+}
+
+// printTopics prints topics as a table with aligned columns Name and Short,
+// where each row is indented by indent.  Topics with sub-topics are marked,
+// since the sub-topics aren't listed.
+func printTopics(w *textutil.WrapWriter, indent string, topics []Topic) {
+	nameWidth := minNameWidth
+	for _, topic := range topics {
+		if cells := w.StringWidth(topic.Name); cells > nameWidth {
+			nameWidth = cells
+		}
+	}
+	w.SetIndents(indent, indent+spaces(nameWidth+1))
+	for _, topic := range topics {
+		short := topic.Short
+		if len(topic.Children) > 0 {
+			short += " (has sub-topics)"
+		}
+		fmt.Fprintf(w, "%s %s", padRight(w, topic.Name, nameWidth), short)
+		w.Flush()
+	}
+	w.SetIndents()
+}
+
+// printExamples prints each example as its description, followed by its
+// command line on its own line.  The description is indented by indent, and the
+// command line is indented twice as much, and never wrapped.
+func printExamples(w *textutil.WrapWriter, indent string, examples []Example) {
+	for ex, example := range examples {
+		if ex > 0 {
+			fmt.Fprintln(w)
+		}
+		w.SetIndents(indent)
+		fmt.Fprintln(w, example.Description)
+		w.Flush()
+		w.ForceVerbatim(true)
+		fmt.Fprintln(w, indent+example.Command)
+		w.ForceVerbatim(false)
+	}
+	w.SetIndents()
+}
+
+// GenerateDocs writes documentation for cmd and all of its descendants to dir,
+// using the given help style.  Each command is written to its own file, named
+// by joining the names in its path with "-"; e.g. "prog-sub.txt".  Each file
+// starts with frontmatter containing the Name and Short of the command.  An
+// additional "index.txt" file lists all of the generated files.
+//
+// The commands are listed in the index in the same order as "help ...".
+// External commands found via LookPath are not documented, since they're
+// separate programs.
+//
+// The files are rendered and written concurrently, by up to GOMAXPROCS
+// workers; their contents don't depend on the number of workers.  The index is
+// written after all other files.  If any file fails, the remaining files aren't
+// started, the index isn't written, and the errors are returned together.  Any
+// HelpFunc or DocsFS of the tree must be safe for concurrent use.
+func (cmd *Command) GenerateDocs(dir, style string) error {
+	return cmd.generateDocs(dir, style, runtime.GOMAXPROCS(0))
+}
+
+// generateDocs implements GenerateDocs, with the given number of workers.
+func (cmd *Command) generateDocs(dir, style string, workers int) error {
+	env := EnvFromOS()
+	env.Timer = nil
+	config := &helpConfig{width: defaultWidth, widthSet: true, helpFormat: newHelpFormat(cmd), firstCall: true}
+	if err := config.style.Set(style); err != nil {
+		return err
+	}
+	initGlobalFlags()
+	cleanTree(cmd)
+	path := []*Command{cmd}
+	if err := checkTreeInvariants(path, env); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	docs := &docsVisitor{dir: dir, env: env, config: config}
+	walkHelp(env, path, config, true, docs)
+	if err := docs.generate(workers); err != nil {
+		return err
+	}
+	var index bytes.Buffer
+	for _, path := range docs.paths {
+		fmt.Fprintf(&index, "%s - %s\n", docsFileName(path), path[len(path)-1].Short)
+	}
+	return writeDocsFile(dir, "index.txt", cmd.Name, cmd.Short, index.Bytes())
+}
+
+// DumpJSON writes a JSON description of cmd and all of its descendants to w,
+// including the flags, topics and annotations of each command.  Topics are
+// nested under the command that declares them, and sub-topics under their
+// parent topic.  The default help command and external commands found via
+// LookPath are omitted.
+func (cmd *Command) DumpJSON(w io.Writer) error {
+	cleanTree(cmd)
+	path := []*Command{cmd}
+	if err := checkTreeInvariants(path, &Env{}); err != nil {
+		return err
+	}
+	dump, err := jsonDump(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dump)
+}
+
+// Summary returns the name and short description of cmd, in the same format as
+// the listing of commands in help, wrapped to the default width of 80 runes.
+// Widths are measured with the RuneWidthFunc of cmd, if set.
+func (cmd *Command) Summary() string {
+	var buf bytes.Buffer
+	w := textutil.NewUTF8WrapWriter(&buf, defaultWidth)
+	w.SetRuneWidth(cmd.RuneWidthFunc)
+	writeSummary(w, "", summaryNameWidth(w, []*Command{cmd}), cmd)
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// SummaryTree writes the summary of cmd and all of its descendants to w, one
+// per line, indented by depth.  Each summary is in the same format as Summary.
+func (cmd *Command) SummaryTree(w io.Writer) error {
+	ww := textutil.NewUTF8WrapWriter(w, defaultWidth)
+	ww.SetRuneWidth(cmd.RuneWidthFunc)
+	writeSummaryTree(ww, "", []*Command{cmd})
+	return ww.Flush()
+}
+
+func writeSummaryTree(w *textutil.WrapWriter, indent string, cmds []*Command) {
+	nameWidth := summaryNameWidth(w, cmds)
+	for _, cmd := range cmds {
+		writeSummary(w, indent, nameWidth, cmd)
+		writeSummaryTree(w, indent+spaces(3), cmd.Children)
+	}
+}
+
+// writeSummary writes the summary of cmd to w, with the name in a column of the
+// given width, followed by the short description.
+func writeSummary(w *textutil.WrapWriter, indent string, nameWidth int, cmd *Command) {
+	short := strings.TrimSpace(cmd.Short)
+	if short == "" {
+		short = missingDescription
+	}
+	w.SetIndents(indent, indent+spaces(nameWidth+1))
+	fmt.Fprintf(w, "%s %s", padRight(w, strings.TrimSpace(cmd.Name), nameWidth), short)
+	w.SetIndents()
+}
+
+// summaryNameWidth returns the width of the name column for the summary of
+// cmds, written to w.
+func summaryNameWidth(w *textutil.WrapWriter, cmds []*Command) int {
+	nameWidth := minNameWidth
+	for _, cmd := range cmds {
+		if cells := w.StringWidth(strings.TrimSpace(cmd.Name)); cells > nameWidth {
+			nameWidth = cells
+		}
+	}
+	return nameWidth
+}
+
+// jsonCommand is the JSON representation of a command, used by DumpJSON.
+type jsonCommand struct {
+	Name        string            `json:"name"`
+	Short       string            `json:"short"`
+	Long        string            `json:"long"`
+	ArgsName    string            `json:"argsName,omitempty"`
+	ArgsLong    string            `json:"argsLong,omitempty"`
+	Flags       []jsonFlag        `json:"flags,omitempty"`
+	Children    []jsonCommand     `json:"children,omitempty"`
+	Topics      []jsonTopic       `json:"topics,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// jsonFlag is the JSON representation of a flag, used by DumpJSON.
+type jsonFlag struct {
+	Name     string `json:"name"`
+	Usage    string `json:"usage"`
+	DefValue string `json:"default"`
+}
+
+// jsonTopic is the JSON representation of a topic, used by DumpJSON.
+type jsonTopic struct {
+	Name     string      `json:"name"`
+	Short    string      `json:"short"`
+	Long     string      `json:"long"`
+	URL      string      `json:"url,omitempty"`
+	Children []jsonTopic `json:"children,omitempty"`
+}
+
+// jsonDump returns the JSON representation of the last command in path.
+func jsonDump(path []*Command) (jsonCommand, error) {
+	cmd, cmdPath := path[len(path)-1], pathName("", path)
+	long, err := readLong(path, cmdPath, cmd.Long, cmd.LongFile)
+	if err != nil {
+		return jsonCommand{}, err
+	}
+	dump := jsonCommand{
+		Name:        cmd.Name,
+		Short:       cmd.Short,
+		Long:        long,
+		ArgsName:    cmd.ArgsName,
+		ArgsLong:    cmd.ArgsLong,
+		Annotations: cmd.Annotations,
+	}
+	visibleFlags(cmd.flags(), path).VisitAll(func(f *flag.Flag) {
+		dump.Flags = append(dump.Flags, jsonFlag{f.Name, f.Usage, f.DefValue})
+	})
+	for _, child := range cmd.Children {
+		childDump, err := jsonDump(append(path, child))
+		if err != nil {
+			return jsonCommand{}, err
+		}
+		dump.Children = append(dump.Children, childDump)
+	}
+	if dump.Topics, err = jsonTopics(path, cmdPath, cmd.Topics); err != nil {
+		return jsonCommand{}, err
+	}
+	return dump, nil
+}
+
+// jsonTopics returns the JSON representation of topics, which are nested under
+// the command or topic with the given path name.
+func jsonTopics(path []*Command, name string, topics []Topic) ([]jsonTopic, error) {
+	var dumps []jsonTopic
+	for _, topic := range topics {
+		topicPath := name + " " + topic.Name
+		long, err := readLong(path, topicPath, topic.Long, topic.LongFile)
+		if err != nil {
+			return nil, err
+		}
+		children, err := jsonTopics(path, topicPath, topic.Children)
+		if err != nil {
+			return nil, err
+		}
+		dumps = append(dumps, jsonTopic{topic.Name, topic.Short, long, topic.URL, children})
+	}
+	return dumps, nil
+}
+
+// docsVisitor is the helpVisitor that implements GenerateDocs.  The commands
+// are collected in walk order, and documented afterwards by generate.
+type docsVisitor struct {
+	dir    string
+	env    *Env
+	config *helpConfig
+	paths  [][]*Command
+}
+
+// visitCommand collects the path of each command to document.  The flags of
+// each command are computed up front, so that FlagsFunc is called before the
+// workers share the tree.
+func (d *docsVisitor) visitCommand(path []*Command, _ bool) {
+	path[len(path)-1].flags()
+	d.paths = append(d.paths, append([]*Command(nil), path...))
+}
+
+func (d *docsVisitor) visitExternal(path []*Command, subCmd string) {}
+
+func (d *docsVisitor) visitTopic(path []*Command, topics []Topic) {}
+
+// generate writes the file for each of d.paths, via the given number of
+// workers.  Each worker has its own copy of d.config, since the memoized flags
+// aren't safe for concurrent use.  Once any file fails, the remaining files
+// aren't started; the errors of the files that were started are returned in
+// the order of d.paths.
+func (d *docsVisitor) generate(workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+	errs := make([]error, len(d.paths))
+	next, failed := make(chan int), make(chan struct{})
+	var failOnce sync.Once
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		config := *d.config
+		config.pathFlagsMemo, config.globalFlagsMemo, config.globalFlagListMemo = nil, nil, nil
+		go func() {
+			defer wg.Done()
+			for index := range next {
+				if errs[index] = d.generateFile(d.paths[index], &config); errs[index] != nil {
+					failOnce.Do(func() { close(failed) })
+				}
+			}
+		}()
+	}
+send:
+	for index := range d.paths {
+		// Check for a failure first, since select chooses randomly among the
+		// ready cases.
+		select {
+		case <-failed:
+			break send
+		default:
+		}
+		select {
+		case next <- index:
+		case <-failed:
+			break send
+		}
+	}
+	close(next)
+	wg.Wait()
+	var list errorList
+	for _, err := range errs {
+		if err != nil {
+			list = append(list, err)
+		}
+	}
+	switch len(list) {
+	case 0:
+		return nil
+	case 1:
+		return list[0]
+	}
+	return fmt.Errorf("%d errors generating docs:%w", len(list), list)
+}
+
+// generateFile renders the usage of the last command in path, and writes it
+// to its file in d.dir.
+func (d *docsVisitor) generateFile(path []*Command, config *helpConfig) error {
+	var buf bytes.Buffer
+	w := newWrapWriter(&buf, config)
+	if err := usage(w, d.env, path, config, true); err != nil {
+		return err
+	}
+	w.Flush()
+	cmd := path[len(path)-1]
+	return writeDocsFile(d.dir, docsFileName(path), cmd.Name, cmd.Short, buf.Bytes())
+}
+
+// writeDocsFile writes data to the file with the given name in dir, preceded
+// by frontmatter containing the name and short description.
+func writeDocsFile(dir, file, name, short string, data []byte) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "---\nname: %q\nshort: %q\n---\n", name, short)
+	buf.Write(data)
+	return ioutil.WriteFile(filepath.Join(dir, file), buf.Bytes(), 0644)
+}
+
+// docsFileName returns the name of the file that GenerateDocs uses for the last
+// command in path.
+func docsFileName(path []*Command) string {
+	var names []string
+	for _, cmd := range path {
+		names = append(names, cmd.Name)
+	}
+	return strings.Join(names, "-") + ".txt"
+}
+
+// isNamePattern returns true iff name is a glob pattern that may be used to
+// match the names of commands in help.
+func isNamePattern(name string) bool {
+	return strings.ContainsAny(name, "*?")
+}
+
+// matchChildren returns the children of cmd whose names match the glob
+// pattern, using the syntax of path.Match.
+func matchChildren(cmd *Command, pattern string) ([]*Command, error) {
+	var matches []*Command
+	for _, child := range cmd.Children {
+		match, err := pathpkg.Match(pattern, child.Name)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			matches = append(matches, child)
+		}
+	}
+	return matches, nil
 }
 
 func godocHeader(path, short string) string {
@@ -168,13 +920,17 @@ func godocHeader(path, short string) string {
 	//
 	// For more details see the comments and implementation of doc.ToHTML:
 	// http://golang.org/pkg/go/doc/#ToHTML
+	//
+	// The text is parsed with the same parser as doc.ToHTML, but the heading is
+	// found in the parsed blocks, rather than by rendering HTML.
 	header := firstRuneToUpper(path + " - " + short)
-	var buf bytes.Buffer
-	doc.ToHTML(&buf, "before\n\n"+header+"\n\nafter", nil)
-	if !bytes.Contains(buf.Bytes(), []byte("<h")) {
-		return firstRuneToUpper(path)
+	parsed := new(doc.Package).Parser().Parse("before\n\n" + header + "\n\nafter")
+	for _, block := range parsed.Content {
+		if _, ok := block.(*comment.Heading); ok {
+			return header
+		}
 	}
-	return header
+	return firstRuneToUpper(path)
 }
 
 func firstRuneToUpper(s string) string {
@@ -185,120 +941,512 @@ func firstRuneToUpper(s string) string {
 	return string(unicode.ToUpper(r)) + s[n:]
 }
 
-func lineBreak(w *textutil.WrapWriter, style style) {
+// lineBreak prints a line that separates the usage of each command, based on
+// the style, separator and separator width of config.
+func lineBreak(w *textutil.WrapWriter, config *helpConfig) {
 	w.Flush()
-	switch style {
+	switch config.style {
 	case styleCompact, styleFull:
-		width := w.Width()
+		width := config.separatorWidth
+		if width == 0 {
+			width = w.Width()
+		}
 		if width < 0 {
 			// If the user has chosen an "unlimited" word-wrapping width, we still
 			// need a reasonable width for our visual line break.
 			width = defaultWidth
 		}
-		fmt.Fprintln(w, strings.Repeat("=", width))
+		if runeWidth := w.StringWidth(string(config.separator)); runeWidth > 1 {
+			width /= runeWidth
+		}
+		fmt.Fprintln(w, strings.Repeat(string(config.separator), width))
 	case styleGoDoc:
 		fmt.Fprintln(w)
 	}
 	w.Flush()
 }
 
-// needsHelpChild returns true if cmd needs a default help command to be
-// appended to its children.  Every command that has children and doesn't
-// already have a "help" command needs a help child.
-func needsHelpChild(cmd *Command) bool {
+// needsHelpChild returns true if the last command in path needs a default help
+// command to be appended to its children.  Every command that has children and
+// doesn't already have a "help" command needs a help child, unless the help
+// command is disabled.
+func needsHelpChild(path []*Command) bool {
+	cmd, name := path[len(path)-1], helpCommandName(path)
+	if name == "" {
+		return false
+	}
 	for _, child := range cmd.Children {
-		if child.Name == helpName {
+		if child.Name == name {
 			return false
 		}
 	}
 	return len(cmd.Children) > 0
 }
 
-// usageAll prints usage recursively via DFS from the path onward.
-func usageAll(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig, firstCall bool) {
-	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, path)
-	usage(w, env, path, config, firstCall)
+// helpVisitor is implemented by the visitors passed to walkHelp.
+type helpVisitor interface {
+	// visitCommand is called for each command; the bool firstCall is only true
+	// for the command that the walk started from.
+	visitCommand(path []*Command, firstCall bool)
+	// visitExternal is called for each external child of the last command in
+	// path, where subCmd is the absolute path of the external binary.
+	visitExternal(path []*Command, subCmd string)
+	// visitTopic is called for each topic of the last command in path,
+	// including nested topics.  The visited topic is the last one in topics,
+	// preceded by the topics it is nested under.
+	visitTopic(path []*Command, topics []Topic)
+}
+
+// walkHelp visits the commands and topics via DFS from the path onward.  This
+// is the traversal used by "help ...", so anything built on walkHelp shows
+// commands and topics in the same order as the recursive help output.
+func walkHelp(env *Env, path []*Command, config *helpConfig, firstCall bool, v helpVisitor) {
+	cmd := path[len(path)-1]
+	v.visitCommand(path, firstCall)
 	for _, child := range cmd.Children {
-		usageAll(w, env, append(path, child), config, false)
+		walkHelp(env, append(path, child), config, false, v)
 	}
-	if firstCall && needsHelpChild(cmd) {
+	if firstCall && needsHelpChild(path) {
 		help := helpRunner{path, config}.newCommand()
-		usageAll(w, env, append(path, help), config, false)
+		walkHelp(env, append(path, help), config, false, v)
 	}
 	if cmd.LookPath {
 		cmdPrefix := cmd.Name + "-"
-		subCmds, _ := env.LookPathPrefix(cmdPrefix, cmd.subNames(cmdPrefix))
+		subCmds, _ := env.LookPathPrefix(cmdPrefix, cmd.subNames(cmdPrefix, helpCommandName(path)))
 		for _, subCmd := range subCmds {
-			runner := binaryRunner{subCmd, cmdPath}
-			var buffer bytes.Buffer
-			envCopy := env.clone()
-			envCopy.Stdout = &buffer
-			envCopy.Stderr = &buffer
-			envCopy.Vars["CMDLINE_FIRST_CALL"] = "false"
-			envCopy.Vars["CMDLINE_STYLE"] = config.style.String()
-			if err := runner.Run(envCopy, []string{helpName, "..."}); err == nil {
-				// The external child supports "help".
-				if config.style == styleGoDoc {
-					// The textutil package will discard any leading empty lines
-					// produced by the child process output, so we need to
-					// output it here.
-					fmt.Fprintln(w)
-				}
-				fmt.Fprint(w, buffer.String())
-				continue
-			}
-			buffer.Reset()
-			if err := runner.Run(envCopy, []string{"-help"}); err == nil {
-				// The external child supports "-help".
-				if config.style == styleGoDoc {
-					// The textutil package will discard any leading empty lines
-					// produced by the child process output, so we need to
-					// output it here.
-					fmt.Fprintln(w)
-				}
-				fmt.Fprint(w, buffer.String())
-				continue
-			}
-			// The external child does not support "help" or "-help".
-			lineBreak(w, config.style)
-			subName := strings.TrimPrefix(filepath.Base(subCmd), cmdPrefix)
-			fmt.Fprintln(w, godocHeader(cmdPath+" "+subName, missingDescription))
+			v.visitExternal(path, subCmd)
 		}
 	}
 	for _, topic := range cmd.Topics {
-		lineBreak(w, config.style)
-		w.ForceVerbatim(true)
-		fmt.Fprintln(w, godocHeader(cmdPath+" "+topic.Name, topic.Short))
-		w.ForceVerbatim(false)
-		fmt.Fprintln(w)
-		fmt.Fprintln(w, topic.Long)
+		walkTopic(path, []Topic{topic}, v)
+	}
+}
+
+// walkTopic visits the last topic in topics and its sub-topics via DFS.
+func walkTopic(path []*Command, topics []Topic, v helpVisitor) {
+	v.visitTopic(path, topics)
+	for _, child := range topics[len(topics)-1].Children {
+		walkTopic(path, append(topics, child), v)
+	}
+}
+
+// usageAll prints usage recursively via DFS from the path onward.
+func usageAll(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig, firstCall bool) error {
+	u := &usageAllVisitor{w: w, env: env, config: config}
+	walkHelp(env, path, config, firstCall, u)
+	return u.err
+}
+
+// usageAllVisitor is the helpVisitor that implements usageAll.  The first error
+// is retained in err, and the usage of subsequent commands is still printed,
+// unless config.strict is set.
+type usageAllVisitor struct {
+	w      *textutil.WrapWriter
+	env    *Env
+	config *helpConfig
+	err    error
+}
+
+// stopped returns true iff nothing more should be printed, since there's an
+// error and config.strict is set.
+func (u *usageAllVisitor) stopped() bool {
+	return u.err != nil && u.config.strict
+}
+
+func (u *usageAllVisitor) visitCommand(path []*Command, firstCall bool) {
+	if u.stopped() {
+		return
+	}
+	if err := usage(u.w, u.env, path, u.config, firstCall); err != nil && u.err == nil {
+		u.err = err
+	}
+}
+
+func (u *usageAllVisitor) visitExternal(path []*Command, subCmd string) {
+	if u.stopped() {
+		return
+	}
+	w, config := u.w, u.config
+	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, path)
+	runner := binaryRunner{subCmd, cmdPath}
+	var buffer bytes.Buffer
+	envCopy := u.env.clone()
+	envCopy.Stdout = &buffer
+	envCopy.Stderr = &buffer
+	envCopy.Vars["CMDLINE_FIRST_CALL"] = "false"
+	envCopy.Vars["CMDLINE_STYLE"] = config.style.String()
+	if err := runner.Run(envCopy, []string{helpName, "..."}); err == nil {
+		// The external child supports "help".
+		if config.style == styleGoDoc {
+			// The textutil package will discard any leading empty lines
+			// produced by the child process output, so we need to
+			// output it here.
+			fmt.Fprintln(w)
+		}
+		buffer.WriteTo(w)
+		return
+	}
+	buffer.Reset()
+	if err := runner.Run(envCopy, []string{"-help"}); err == nil {
+		// The external child supports "-help".
+		if config.style == styleGoDoc {
+			// The textutil package will discard any leading empty lines
+			// produced by the child process output, so we need to
+			// output it here.
+			fmt.Fprintln(w)
+		}
+		buffer.WriteTo(w)
+		return
+	}
+	// The external child does not support "help" or "-help".
+	lineBreak(w, config)
+	subName := strings.TrimPrefix(filepath.Base(subCmd), cmd.Name+"-")
+	fmt.Fprintln(w, godocHeader(cmdPath+" "+subName, missingDescription))
+}
+
+func (u *usageAllVisitor) visitTopic(path []*Command, topics []Topic) {
+	if u.stopped() {
+		return
+	}
+	w, topic := u.w, topics[len(topics)-1]
+	topicPath := topicPathName(u.config.prefix, path, topics)
+	lineBreak(w, u.config)
+	w.ForceVerbatim(true)
+	fmt.Fprintln(w, godocHeader(topicPath, topic.Short))
+	w.ForceVerbatim(false)
+	fmt.Fprintln(w)
+	long, err := readLong(path, topicPath, topic.Long, topic.LongFile)
+	if err != nil && u.err == nil {
+		u.err = err
+	}
+	printLong(w, appendURL(long, topic.URL), u.config.hyperlinks)
+}
+
+// SearchField is the field of a command or topic that matches a search term;
+// see Command.Search.
+type SearchField int
+
+const (
+	SearchName  SearchField = iota // The name matches.
+	SearchShort                    // The short description matches.
+	SearchLong                     // The long description matches.
+)
+
+// SearchResult describes a command or topic that matches a search term; see
+// Command.Search.
+type SearchResult struct {
+	Path  string      // Path of the command or topic; e.g. "prog sub".
+	Short string      // Short description of the command or topic.
+	Topic bool        // Whether the result is a help topic.
+	Field SearchField // First of the name, short and long that matches.
+}
+
+// Search returns the commands and topics in the tree rooted at cmd whose name,
+// short description or long description contains term, ignoring case.  The
+// results are ranked by the field that matches, so that name matches come
+// before short matches, which come before long matches; results with the same
+// rank are in the same order as "help ...".  This is the search used by the
+// -search flag of the help command, and may be used to implement similar
+// commands; e.g. "prog apropos <term>".  External commands found via LookPath
+// aren't searched.
+func (cmd *Command) Search(term string) []SearchResult {
+	cleanTree(cmd)
+	env := &Env{Vars: map[string]string{}}
+	config := &helpConfig{helpFormat: newHelpFormat(cmd), firstCall: true}
+	v := &searchVisitor{config: config, term: strings.ToLower(term)}
+	walkHelp(env, []*Command{cmd}, config, true, v)
+	return v.ranked()
+}
+
+// searchAll prints a line "path — short" for every command and topic from the
+// path onward whose name or description contains config.search, ignoring case.
+// The results are ranked as for Search.  Returns ErrExitCode(1) if nothing
+// matches, similar to grep.
+func searchAll(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig) error {
+	v := &searchVisitor{config: config, term: strings.ToLower(config.search)}
+	walkHelp(env, path, config, config.firstCall, v)
+	if len(v.results) == 0 {
+		return ErrExitCode(1)
+	}
+	for _, result := range v.ranked() {
+		w.SetIndents("", spaces(3))
+		fmt.Fprintln(w, result.Path, "—", result.Short)
+		w.SetIndents()
+	}
+	return nil
+}
+
+// searchVisitor is the helpVisitor that implements Search and searchAll.  The
+// matches are appended to results in the order they're visited.
+type searchVisitor struct {
+	config  *helpConfig
+	term    string
+	results []SearchResult
+}
+
+// ranked returns the results ranked by the field that matches, keeping the
+// order they were visited within each rank.
+func (s *searchVisitor) ranked() []SearchResult {
+	sort.SliceStable(s.results, func(i, j int) bool {
+		return s.results[i].Field < s.results[j].Field
+	})
+	return s.results
+}
+
+// match appends a result for the command or topic with the given path and
+// descriptions, if any of name, short or long contains the term.
+func (s *searchVisitor) match(path, name, short, long string, topic bool) {
+	for field, text := range []string{name, short, long} {
+		if strings.Contains(strings.ToLower(text), s.term) {
+			s.results = append(s.results, SearchResult{path, short, topic, SearchField(field)})
+			return
+		}
+	}
+}
+
+func (s *searchVisitor) visitCommand(path []*Command, _ bool) {
+	cmd, cmdPath := path[len(path)-1], pathName(s.config.prefix, path)
+	// Errors reading the long description are reported by the regular help.
+	long, _ := readLong(path, cmdPath, cmd.Long, cmd.LongFile)
+	s.match(cmdPath, cmd.Name, cmd.Short, long, false)
+}
+
+func (s *searchVisitor) visitExternal(path []*Command, subCmd string) {
+	// We only match on the name of external commands, since retrieving their
+	// descriptions requires running each binary.
+	subName := strings.TrimPrefix(filepath.Base(subCmd), path[len(path)-1].Name+"-")
+	if strings.Contains(strings.ToLower(subName), s.term) {
+		s.results = append(s.results, SearchResult{pathName(s.config.prefix, path) + " " + subName, missingDescription, false, SearchName})
+	}
+}
+
+func (s *searchVisitor) visitTopic(path []*Command, topics []Topic) {
+	topic, topicPath := topics[len(topics)-1], topicPathName(s.config.prefix, path, topics)
+	long, _ := readLong(path, topicPath, topic.Long, topic.LongFile)
+	s.match(topicPath, topic.Name, topic.Short, long, true)
+}
+
+// allFlags prints every flag defined on the commands from the path onward, one
+// per line with its command path and default value, followed by its usage.
+// The flags are sorted by command path, and by name within each command.
+// Flags of external commands aren't printed.
+func allFlags(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig) {
+	v := &allFlagsVisitor{prefix: config.prefix}
+	walkHelp(env, path, config, config.firstCall, v)
+	sort.SliceStable(v.flags, func(i, j int) bool {
+		return v.flags[i].cmdPath < v.flags[j].cmdPath
+	})
+	for _, f := range v.flags {
+		fmt.Fprintf(w, "%s -%s=%v", f.cmdPath, f.Name, f.DefValue)
+		w.SetIndents(config.flagIndent)
+		fmt.Fprintln(w, f.Usage)
+		w.SetIndents()
 	}
 }
 
+// allFlagsVisitor is the helpVisitor that collects the flags of allFlags.
+type allFlagsVisitor struct {
+	prefix string
+	flags  []pathFlag
+}
+
+// pathFlag is a flag along with the path of the command that defines it.
+type pathFlag struct {
+	*flag.Flag
+	cmdPath string
+}
+
+func (a *allFlagsVisitor) visitCommand(path []*Command, _ bool) {
+	cmdPath := pathName(a.prefix, path)
+	visibleFlags(path[len(path)-1].flags(), path).VisitAll(func(f *flag.Flag) {
+		a.flags = append(a.flags, pathFlag{f, cmdPath})
+	})
+}
+
+func (a *allFlagsVisitor) visitExternal([]*Command, string) {}
+func (a *allFlagsVisitor) visitTopic([]*Command, []Topic)   {}
+
+// cheatSheet prints the path and short description of each leaf command via
+// DFS from the path onward, in two aligned columns.  External commands are
+// treated as leaves, and topics are omitted.
+func cheatSheet(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig, firstCall bool) {
+	v := &cheatSheetVisitor{prefix: config.prefix}
+	walkHelp(env, path, config, firstCall, v)
+	nameWidth := 0
+	for _, line := range v.lines {
+		if width := w.StringWidth(line[0]); width > nameWidth {
+			nameWidth = width
+		}
+	}
+	w.SetIndents("", spaces(nameWidth+2))
+	for _, line := range v.lines {
+		fmt.Fprintf(w, "%s  %s", padRight(w, line[0], nameWidth), line[1])
+		w.Flush()
+	}
+	w.SetIndents()
+}
+
+// cheatSheetVisitor is the helpVisitor that collects the lines of cheatSheet,
+// each holding a command path and its short description.
+type cheatSheetVisitor struct {
+	prefix string
+	lines  [][2]string
+}
+
+func (c *cheatSheetVisitor) visitCommand(path []*Command, _ bool) {
+	if cmd := path[len(path)-1]; len(cmd.Children) == 0 {
+		c.lines = append(c.lines, [2]string{pathName(c.prefix, path), cmd.Short})
+	}
+}
+
+func (c *cheatSheetVisitor) visitExternal(path []*Command, subCmd string) {
+	subName := strings.TrimPrefix(filepath.Base(subCmd), path[len(path)-1].Name+"-")
+	c.lines = append(c.lines, [2]string{pathName(c.prefix, path) + " " + subName, missingDescription})
+}
+
+func (c *cheatSheetVisitor) visitTopic([]*Command, []Topic) {}
+
 // usage prints the usage of the last command in path to w.  The bool firstCall
 // is set to false when printing usage for multiple commands, and is used to
 // avoid printing redundant information (e.g. help command, global flags).
-func usage(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig, firstCall bool) {
+//
+// If the command has a HelpFunc, it is called to print the usage instead, and
+// its error is returned.
+func usage(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig, firstCall bool) error {
 	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, path)
 	env.TimerPush("usage " + cmdPath)
 	defer env.TimerPop()
 	if config.style == styleShortOnly {
 		fmt.Fprintln(w, cmd.Short)
-		return
+		return nil
+	}
+	if config.style == styleCheatSheet {
+		cheatSheet(w, env, path, config, firstCall)
+		return nil
 	}
 	if !firstCall {
-		lineBreak(w, config.style)
+		lineBreak(w, config)
 		w.ForceVerbatim(true)
 		fmt.Fprintln(w, godocHeader(cmdPath, cmd.Short))
 		w.ForceVerbatim(false)
 		fmt.Fprintln(w)
 	}
-	fmt.Fprintln(w, cmd.Long)
-	fmt.Fprintln(w)
-	// Usage line.
+	if cmd.HelpFunc != nil {
+		// The HelpFunc formats its own output, so don't wrap it.
+		w.ForceVerbatim(true)
+		defer w.ForceVerbatim(false)
+		return cmd.HelpFunc(cmd, w, config.style.String(), w.Width())
+	}
+	long, err := readLong(path, cmdPath, cmd.Long, cmd.LongFile)
+	if err != nil {
+		return err
+	}
+	var extChildren []string
+	cmdPrefix := cmd.Name + "-"
+	if cmd.LookPath {
+		extChildren, _ = env.LookPathPrefix(cmdPrefix, cmd.subNames(cmdPrefix, helpCommandName(path)))
+	}
+	hasSubcommands := len(cmd.Children) > 0 || len(extChildren) > 0
+	// Each section starts with a blank line, unless it's the first section.
+	printed := false
+	sep := func() {
+		if printed {
+			fmt.Fprintln(w)
+		}
+		printed = true
+	}
+	hidden := false
+	sections := map[string]func(){
+		"long": func() {
+			sep()
+			printLong(w, long, config.hyperlinks)
+		},
+		"usage": func() {
+			sep()
+			usageLines(w, path, cmdPath, extChildren, config)
+		},
+		"commands": func() {
+			if hasSubcommands {
+				sep()
+				commandsUsage(w, env, path, cmdPath, extChildren, config, firstCall)
+			}
+		},
+		"args": func() {
+			if cmd.Runner != nil && cmd.ArgsLong != "" {
+				sep()
+				fmt.Fprintln(w, cmd.ArgsLong)
+			}
+		},
+		"examples": func() {
+			if len(cmd.Examples) > 0 {
+				sep()
+				fmt.Fprintln(w, "Examples:")
+				printExamples(w, config.indent, cmd.Examples)
+			}
+		},
+		"topics": func() {
+			if len(cmd.Topics) > 0 {
+				sep()
+				fmt.Fprintln(w, "The", cmdPath, "additional help topics are:")
+				printTopics(w, config.indent, cmd.Topics)
+				if name := helpCommandName(path); name != "" && firstCall && config.style != styleGoDoc {
+					fmt.Fprintf(w, "Run \"%s %s [topic]\" for topic details.\n", cmdPath, name)
+				}
+			}
+		},
+		"flags": func() {
+			hidden = flagsUsage(w, path, config, sep) || hidden
+		},
+		"globals": func() {
+			// Only show global flags on the first call.
+			if firstCall && !config.noGlobals {
+				hidden = globalFlagsUsage(w, path, config, sep) || hidden
+			}
+		},
+	}
+	order := cmd.HelpSections
+	if order == nil {
+		order = defaultHelpSections
+	}
+	for _, name := range order {
+		sections[name]()
+	}
+	if hidden {
+		fmt.Fprintln(w)
+		name := helpCommandName(path)
+		fullhelp := fmt.Sprintf(`Run "%s %s -style=full" to show all flags.`, cmdPath, name)
+		if len(cmd.Children) == 0 || name == "" {
+			if len(path) > 1 && name != "" {
+				parentPath := pathName(config.prefix, path[:len(path)-1])
+				fullhelp = fmt.Sprintf(`Run "%s %s -style=full %s" to show all flags.`, parentPath, name, cmd.Name)
+			} else {
+				fullhelp = fmt.Sprintf(`Run "CMDLINE_STYLE=full %s -help" to show all flags.`, cmdPath)
+			}
+		}
+		fmt.Fprintln(w, fullhelp)
+	}
+	return nil
+}
+
+// defaultHelpSections is the default order of the sections of usage output.
+var defaultHelpSections = []string{"long", "usage", "commands", "args", "examples", "topics", "flags", "globals"}
+
+// isHelpSection returns true iff name is the name of a section of usage output.
+func isHelpSection(name string) bool {
+	for _, section := range defaultHelpSections {
+		if name == section {
+			return true
+		}
+	}
+	return false
+}
+
+// usageLines prints the usage lines of the last command in path.
+func usageLines(w *textutil.WrapWriter, path []*Command, cmdPath string, extChildren []string, config *helpConfig) {
+	cmd := path[len(path)-1]
 	fmt.Fprintln(w, "Usage:")
-	cmdPathF := "   " + cmdPath
-	if countFlags(pathFlags(path), nil, true) > 0 || countFlags(globalFlags, nil, true) > 0 {
+	cmdPathF := config.indent + cmdPath
+	if config.hasFlags(path) {
 		cmdPathF += " [flags]"
 	}
 	if cmd.Runner != nil {
@@ -308,31 +1456,33 @@ func usage(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig
 			fmt.Fprintln(w, cmdPathF)
 		}
 	}
-	var extChildren []string
-	cmdPrefix := cmd.Name + "-"
-	if cmd.LookPath {
-		extChildren, _ = env.LookPathPrefix(cmdPrefix, cmd.subNames(cmdPrefix))
-	}
-	hasSubcommands := len(cmd.Children) > 0 || len(extChildren) > 0
-	if hasSubcommands {
-		fmt.Fprintln(w, cmdPathF, "<command>")
-		fmt.Fprintln(w)
+	if len(cmd.Children) > 0 || len(extChildren) > 0 {
+		if path[0].CompactUsage {
+			fmt.Fprintln(w, cmdPathF, synopsis(cmd, extChildren))
+		} else {
+			fmt.Fprintln(w, cmdPathF, "<command>")
+		}
 	}
+}
+
+// commandsUsage prints the built-in and external children of the last command
+// in path, as tables with aligned columns Name and Short.
+func commandsUsage(w *textutil.WrapWriter, env *Env, path []*Command, cmdPath string, extChildren []string, config *helpConfig, firstCall bool) {
+	cmd, cmdPrefix := path[len(path)-1], path[len(path)-1].Name+"-"
 	printShort := func(width int, name, short string) {
-		fmt.Fprintf(w, "%-[1]*[2]s %[3]s", width, name, short)
+		fmt.Fprintf(w, "%s %s", padRight(w, name, width), short)
 		w.Flush()
 	}
-	const minNameWidth = 11
 	nameWidth := minNameWidth
 	for _, child := range cmd.Children {
-		if w := len(child.Name); w > nameWidth {
-			nameWidth = w
+		if cells := w.StringWidth(child.Name); cells > nameWidth {
+			nameWidth = cells
 		}
 	}
 	for _, extCmd := range extChildren {
 		extName := strings.TrimPrefix(filepath.Base(extCmd), cmdPrefix)
-		if w := len(extName); w > nameWidth {
-			nameWidth = w
+		if cells := w.StringWidth(extName); cells > nameWidth {
+			nameWidth = cells
 		}
 	}
 	// Built-in commands.
@@ -340,13 +1490,13 @@ func usage(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig
 		w.SetIndents()
 		fmt.Fprintln(w, "The", cmdPath, "commands are:")
 		// Print as a table with aligned columns Name and Short.
-		w.SetIndents(spaces(3), spaces(3+nameWidth+1))
+		w.SetIndents(config.indent, config.indent+spaces(nameWidth+1))
 		for _, child := range cmd.Children {
 			printShort(nameWidth, child.Name, child.Short)
 		}
 		// Default help command.
-		if firstCall && needsHelpChild(cmd) {
-			printShort(nameWidth, helpName, helpShort)
+		if firstCall && needsHelpChild(path) {
+			printShort(nameWidth, helpCommandName(path), helpShort)
 		}
 	}
 	// External commands.
@@ -354,7 +1504,7 @@ func usage(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig
 		w.SetIndents()
 		fmt.Fprintln(w, "The", cmdPath, "external commands are:")
 		// Print as a table with aligned columns Name and Short.
-		w.SetIndents(spaces(3), spaces(3+nameWidth+1))
+		w.SetIndents(config.indent, config.indent+spaces(nameWidth+1))
 		for _, extCmd := range extChildren {
 			runner := binaryRunner{extCmd, cmdPath}
 			var buffer bytes.Buffer
@@ -372,109 +1522,125 @@ func usage(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig
 		}
 	}
 	// Command footer.
-	if hasSubcommands {
-		w.SetIndents()
-		if firstCall && config.style != styleGoDoc {
-			fmt.Fprintf(w, "Run \"%s help [command]\" for command usage.\n", cmdPath)
-		}
-	}
-	// Args.
-	if cmd.Runner != nil && cmd.ArgsLong != "" {
-		fmt.Fprintln(w)
-		fmt.Fprintln(w, cmd.ArgsLong)
-	}
-	// Help topics.
-	if len(cmd.Topics) > 0 {
-		fmt.Fprintln(w)
-		fmt.Fprintln(w, "The", cmdPath, "additional help topics are:")
-		nameWidth := minNameWidth
-		for _, topic := range cmd.Topics {
-			if w := len(topic.Name); w > nameWidth {
-				nameWidth = w
-			}
-		}
-		// Print as a table with aligned columns Name and Short.
-		w.SetIndents(spaces(3), spaces(3+nameWidth+1))
-		for _, topic := range cmd.Topics {
-			printShort(nameWidth, topic.Name, topic.Short)
-		}
-		w.SetIndents()
-		if firstCall && config.style != styleGoDoc {
-			fmt.Fprintf(w, "Run \"%s help [topic]\" for topic details.\n", cmdPath)
-		}
-	}
-	hidden := flagsUsage(w, path, config)
-	// Only show global flags on the first call.
-	if firstCall {
-		hidden = globalFlagsUsage(w, config) || hidden
-	}
-	if hidden {
-		fmt.Fprintln(w)
-		fullhelp := fmt.Sprintf(`Run "%s help -style=full" to show all flags.`, cmdPath)
-		if len(cmd.Children) == 0 {
-			if len(path) > 1 {
-				parentPath := pathName(config.prefix, path[:len(path)-1])
-				fullhelp = fmt.Sprintf(`Run "%s help -style=full %s" to show all flags.`, parentPath, cmd.Name)
-			} else {
-				fullhelp = fmt.Sprintf(`Run "CMDLINE_STYLE=full %s -help" to show all flags.`, cmdPath)
-			}
-		}
-		fmt.Fprintln(w, fullhelp)
+	w.SetIndents()
+	if name := helpCommandName(path); name != "" && firstCall && config.style != styleGoDoc {
+		fmt.Fprintf(w, "Run \"%s %s [command]\" for command usage.\n", cmdPath, name)
 	}
 }
 
-func flagsUsage(w *textutil.WrapWriter, path []*Command, config *helpConfig) bool {
+func flagsUsage(w *textutil.WrapWriter, path []*Command, config *helpConfig, sep func()) bool {
 	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, path)
-	allFlags := pathFlags(path)
-	numCompact := countFlags(&cmd.Flags, nil, true)
-	numFull := countFlags(allFlags, nil, true) - numCompact
+	cmdFlags := visibleFlagList(cmd.flags(), nil, path)
+	numCompact := len(cmdFlags)
+	numFull := countVisibleFlags(config.pathFlags(path), path) - numCompact
 	if config.style == styleCompact {
 		// Compact style, only show compact flags.
 		if numCompact > 0 {
-			fmt.Fprintln(w)
+			sep()
 			fmt.Fprintln(w, "The", cmdPath, "flags are:")
-			printFlags(w, &cmd.Flags, nil, config.style, nil, true)
+			printFlagGroups(w, cmd, cmdFlags, config)
 		}
 		return numFull > 0
 	}
 	// Non-compact style, always show all flags.
 	if numCompact > 0 || numFull > 0 {
-		fmt.Fprintln(w)
+		sep()
 		fmt.Fprintln(w, "The", cmdPath, "flags are:")
-		printFlags(w, &cmd.Flags, nil, config.style, nil, true)
+		printFlagGroups(w, cmd, cmdFlags, config)
 		if numCompact > 0 && numFull > 0 {
 			fmt.Fprintln(w)
 		}
-		printFlags(w, allFlags, &cmd.Flags, config.style, nil, true)
+		printFlagList(w, visibleFlagList(config.pathFlags(path), cmd.flags(), path), config)
 	}
 	return false
 }
 
-func globalFlagsUsage(w *textutil.WrapWriter, config *helpConfig) bool {
-	numCompact := countFlags(globalFlags, nonHiddenGlobalFlags, true)
-	numFull := countFlags(globalFlags, nonHiddenGlobalFlags, false)
+func globalFlagsUsage(w *textutil.WrapWriter, path []*Command, config *helpConfig, sep func()) bool {
+	print, flags := printFlagList, config.globalFlagList(path[0])
+	if path[0].AlignGlobalFlags {
+		print = printFlagListAligned
+	}
 	if config.style == styleCompact {
 		// Compact style, only show compact flags.
-		if numCompact > 0 {
-			fmt.Fprintln(w)
+		compact, rest := splitFlags(flags, compactGlobalFlags(path[len(path)-1]))
+		if len(compact) > 0 {
+			sep()
 			fmt.Fprintln(w, "The global flags are:")
-			printFlags(w, globalFlags, nil, config.style, nonHiddenGlobalFlags, true)
+			print(w, compact, config)
 		}
-		return numFull > 0
+		return len(rest) > 0
 	}
 	// Non-compact style, always show all global flags.
-	if numCompact > 0 || numFull > 0 {
-		fmt.Fprintln(w)
+	compact, full := splitFlags(flags, nonHiddenGlobalFlags)
+	if len(compact) > 0 || len(full) > 0 {
+		sep()
 		fmt.Fprintln(w, "The global flags are:")
-		printFlags(w, globalFlags, nil, config.style, nonHiddenGlobalFlags, true)
-		if numCompact > 0 && numFull > 0 {
+		print(w, compact, config)
+		if len(compact) > 0 && len(full) > 0 {
 			fmt.Fprintln(w)
 		}
-		printFlags(w, globalFlags, nil, config.style, nonHiddenGlobalFlags, false)
+		print(w, full, config)
 	}
 	return false
 }
 
+// splitFlags returns the flags whose names match regexps, and those that don't,
+// in the same order as flags.
+func splitFlags(flags []*flag.Flag, regexps []*regexp.Regexp) (match, nomatch []*flag.Flag) {
+	for _, f := range flags {
+		if matchRegexps(regexps, f.Name) {
+			match = append(match, f)
+		} else {
+			nomatch = append(nomatch, f)
+		}
+	}
+	return
+}
+
+// compactGlobalFlags returns the regexps matching the names of the global flags
+// shown in the compact-style usage of cmd; those that aren't hidden, and are
+// relevant to cmd.
+func compactGlobalFlags(cmd *Command) []*regexp.Regexp {
+	if cmd.relevantGlobalFlags == nil {
+		return nonHiddenGlobalFlags
+	}
+	regexps := []*regexp.Regexp{}
+	for _, name := range cmd.relevantGlobalFlags {
+		if matchRegexps(nonHiddenGlobalFlags, name) {
+			regexps = append(regexps, regexp.MustCompile("^"+regexp.QuoteMeta(name)+"$"))
+		}
+	}
+	return regexps
+}
+
+// countVisibleFlags returns the number of flags that aren't hidden via HideFlag
+// on any command in path; the same as counting visibleFlags(flags, path),
+// without copying the flags.
+func countVisibleFlags(flags *flag.FlagSet, path []*Command) (num int) {
+	hidden := hiddenFlags(path)
+	flags.VisitAll(func(f *flag.Flag) {
+		if !hidden[f.Name] {
+			num++
+		}
+	})
+	return
+}
+
+// visibleFlagList returns the flags that aren't in filter, or hidden via
+// HideFlag on any command in path, in lexicographical order.  Each section of
+// usage is printed from a single such list, rather than copying the flags into
+// a new FlagSet, which sorts them again whenever they're visited.
+func visibleFlagList(flags, filter *flag.FlagSet, path []*Command) []*flag.Flag {
+	hidden := hiddenFlags(path)
+	var list []*flag.Flag
+	visitFlags(flags, filter, nil, true, func(f *flag.Flag) {
+		if !hidden[f.Name] {
+			list = append(list, f)
+		}
+	})
+	return list
+}
+
 func countFlags(flags *flag.FlagSet, regexps []*regexp.Regexp, match bool) (num int) {
 	flags.VisitAll(func(f *flag.Flag) {
 		if match == matchRegexps(regexps, f.Name) {
@@ -484,7 +1650,93 @@ func countFlags(flags *flag.FlagSet, regexps []*regexp.Regexp, match bool) (num
 	return
 }
 
-func printFlags(w *textutil.WrapWriter, flags, filter *flag.FlagSet, style style, regexps []*regexp.Regexp, match bool) {
+// printFlagList prints each of flags, with its usage on the following lines.
+func printFlagList(w *textutil.WrapWriter, flags []*flag.Flag, config *helpConfig) {
+	for _, f := range flags {
+		fmt.Fprintf(w, " -%s=%v", f.Name, flagValue(f, config.style))
+		w.SetIndents(config.flagIndent)
+		fmt.Fprintln(w, f.Usage)
+		w.SetIndents()
+	}
+}
+
+// printFlagGroups prints flags, which are the visible flags of cmd, under the
+// titles of the groups defined via FlagGroup, followed by the ungrouped flags.
+// If cmd has no groups, the flags are printed without titles.  The flags are
+// split into groups in a single pass, and each group keeps the order of flags.
+func printFlagGroups(w *textutil.WrapWriter, cmd *Command, flags []*flag.Flag, config *helpConfig) {
+	if len(cmd.flagGroups) == 0 {
+		printFlagList(w, flags, config)
+		return
+	}
+	other := len(cmd.flagGroups)
+	groupOf := make(map[string]int)
+	for gx, g := range cmd.flagGroups {
+		for _, name := range g.names {
+			groupOf[name] = gx
+		}
+	}
+	groups := make([][]*flag.Flag, other+1)
+	for _, f := range flags {
+		gx, ok := groupOf[f.Name]
+		if !ok {
+			gx = other
+		}
+		groups[gx] = append(groups[gx], f)
+	}
+	first := true
+	for gx, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		if !first {
+			fmt.Fprintln(w)
+		}
+		first = false
+		title := "Other flags"
+		if gx < other {
+			title = cmd.flagGroups[gx].title
+		}
+		w.Flush()
+		fmt.Fprintln(w, title+":")
+		w.Flush()
+		printFlagList(w, group, config)
+	}
+}
+
+// printFlagListAligned is like printFlagList, but prints the flags as a table
+// with aligned columns for the flag and its usage, similar to the commands.
+//
+// The width of the flag column is computed once for the list, from the names
+// formatted in the first pass.
+func printFlagListAligned(w *textutil.WrapWriter, flags []*flag.Flag, config *helpConfig) {
+	names, nameWidth := make([]string, len(flags)), 0
+	for fx, f := range flags {
+		names[fx] = fmt.Sprintf("-%s=%v", f.Name, flagValue(f, config.style))
+		if cells := w.StringWidth(names[fx]); cells > nameWidth {
+			nameWidth = cells
+		}
+	}
+	w.SetIndents(spaces(1), spaces(1+nameWidth+2))
+	for fx, f := range flags {
+		fmt.Fprintf(w, "%s  %s", padRight(w, names[fx], nameWidth), f.Usage)
+		w.Flush()
+	}
+	w.SetIndents()
+}
+
+// flagList returns the flags visited by visitFlags, in the same order.
+func flagList(flags, filter *flag.FlagSet, regexps []*regexp.Regexp, match bool) []*flag.Flag {
+	var list []*flag.Flag
+	visitFlags(flags, filter, regexps, match, func(f *flag.Flag) {
+		list = append(list, f)
+	})
+	return list
+}
+
+// visitFlags calls fn for each flag in flags in lexicographical order, skipping
+// flags that are in filter, or don't have the given match result for regexps.
+func visitFlags(flags, filter *flag.FlagSet, regexps []*regexp.Regexp, match bool, fn func(*flag.Flag)) {
 	flags.VisitAll(func(f *flag.Flag) {
 		if filter != nil && filter.Lookup(f.Name) != nil {
 			return
@@ -492,23 +1744,46 @@ func printFlags(w *textutil.WrapWriter, flags, filter *flag.FlagSet, style style
 		if match != matchRegexps(regexps, f.Name) {
 			return
 		}
-		value := f.Value.String()
-		if style == styleGoDoc {
-			// When using styleGoDoc we use the default value, so that e.g. regular
-			// help will show "/usr/home/me/foo" while godoc will show "$HOME/foo".
-			value = f.DefValue
-		}
-		fmt.Fprintf(w, " -%s=%v", f.Name, value)
-		w.SetIndents(spaces(3))
-		fmt.Fprintln(w, f.Usage)
-		w.SetIndents()
+		fn(f)
 	})
 }
 
+// flagValue returns the value of f to display in the given style.
+func flagValue(f *flag.Flag, style style) string {
+	if style == styleGoDoc {
+		// When using styleGoDoc we use the default value, so that e.g. regular
+		// help will show "/usr/home/me/foo" while godoc will show "$HOME/foo".
+		return f.DefValue
+	}
+	return f.Value.String()
+}
+
 func spaces(count int) string {
 	return strings.Repeat(" ", count)
 }
 
+// synopsis returns the names of the children and external children of cmd as
+// a brace-delimited alternation, followed by "...".
+func synopsis(cmd *Command, extChildren []string) string {
+	var names []string
+	for _, child := range cmd.Children {
+		names = append(names, child.Name)
+	}
+	for _, extCmd := range extChildren {
+		names = append(names, strings.TrimPrefix(filepath.Base(extCmd), cmd.Name+"-"))
+	}
+	return "{" + strings.Join(names, "|") + "} ..."
+}
+
+// padRight returns s padded with spaces on the right, so that it occupies at
+// least width display cells when written to w.
+func padRight(w *textutil.WrapWriter, s string, width int) string {
+	if pad := width - w.StringWidth(s); pad > 0 {
+		return s + spaces(pad)
+	}
+	return s
+}
+
 func matchRegexps(regexps []*regexp.Regexp, name string) bool {
 	// We distinguish nil regexps from empty regexps; the former means "all names
 	// match", while the latter means "no names match".
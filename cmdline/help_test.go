@@ -4,7 +4,21 @@
 
 package cmdline
 
-import "testing"
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
 
 func TestGodocHeader(t *testing.T) {
 	tests := []struct {
@@ -28,3 +42,345 @@ func TestGodocHeader(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerateDocs(t *testing.T) {
+	isolateGlobalFlags(t)
+	dir, err := ioutil.TempDir("", "cmdline-docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	echo := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout.",
+		ArgsName: "[strings]",
+		Runner:   RunnerFunc(func(*Env, []string) error { return nil }),
+	}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Test docs generation",
+		Long:     "Prog has an echo command.",
+		Children: []*Command{echo},
+	}
+	if err := prog.GenerateDocs(dir, "bad"); err == nil {
+		t.Errorf("GenerateDocs with bad style should fail")
+	}
+	if err := prog.GenerateDocs(dir, "godoc"); err != nil {
+		t.Fatalf("GenerateDocs failed: %v", err)
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if got, want := names, []string{"index.txt", "prog-echo.txt", "prog-help.txt", "prog.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got files %v, want %v", got, want)
+	}
+	tests := []struct {
+		File, Prefix string
+	}{
+		{"index.txt", `---
+name: "prog"
+short: "Test docs generation"
+---
+prog.txt - Test docs generation
+prog-echo.txt - Print strings on stdout
+prog-help.txt - Display help for commands or topics
+`},
+		{"prog-echo.txt", `---
+name: "echo"
+short: "Print strings on stdout"
+---
+Echo prints any strings passed in to stdout.
+
+Usage:
+   prog echo [flags] [strings]
+`},
+	}
+	for _, test := range tests {
+		data, err := ioutil.ReadFile(filepath.Join(dir, test.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(data), test.Prefix; !strings.HasPrefix(got, want) {
+			t.Errorf("%s got %q, want prefix %q", test.File, got, want)
+		}
+	}
+}
+
+// TestGenerateDocsWorkers checks that the generated files don't depend on the
+// number of workers, and that the errors of all files are returned.
+func TestGenerateDocsWorkers(t *testing.T) {
+	isolateGlobalFlags(t)
+	root := newBenchTree("c", 3, 3)
+	readDir := func(dir string) map[string]string {
+		files := map[string]string{}
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range infos {
+			data, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[info.Name()] = string(data)
+		}
+		return files
+	}
+	serial, parallel := t.TempDir(), t.TempDir()
+	if err := root.generateDocs(serial, "compact", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.generateDocs(parallel, "compact", 8); err != nil {
+		t.Fatal(err)
+	}
+	want, got := readDir(serial), readDir(parallel)
+	if len(want) != 42 {
+		t.Errorf("got %d files, want 42", len(want))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got different files with 8 workers than with 1")
+	}
+
+	missing := &Command{Name: "missing", Short: "Missing docs", LongFile: "missing.txt", Runner: RunnerFunc(runEcho)}
+	other := &Command{Name: "other", Short: "Missing docs", LongFile: "other.txt", Runner: RunnerFunc(runEcho)}
+	prog := &Command{Name: "prog", Short: "Prog", Long: "Prog.", Children: []*Command{missing, other}, DocsFS: fstest.MapFS{}}
+	dir := t.TempDir()
+	err := prog.generateDocs(dir, "compact", 1)
+	if err == nil || !strings.Contains(err.Error(), `"missing.txt"`) || strings.Contains(err.Error(), `"other.txt"`) {
+		t.Errorf("got error %v, want only the missing.txt error", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index.txt")); !os.IsNotExist(err) {
+		t.Errorf("got index.txt after an error, stat error %v", err)
+	}
+	// Neither file fails until both are being read, so both errors are returned.
+	prog.DocsFS = &barrierFS{n: 2, ready: make(chan struct{})}
+	err = prog.generateDocs(dir, "compact", 4)
+	if err == nil || !strings.HasPrefix(err.Error(), "2 errors generating docs:") || !strings.Contains(err.Error(), `"other.txt"`) {
+		t.Errorf("got error %v, want 2 errors", err)
+	}
+}
+
+// barrierFS is a file system where every Open fails with fs.ErrNotExist, but
+// only once n calls are in progress.
+type barrierFS struct {
+	mu    sync.Mutex
+	n     int
+	ready chan struct{}
+}
+
+func (b *barrierFS) Open(name string) (fs.File, error) {
+	b.mu.Lock()
+	if b.n--; b.n == 0 {
+		close(b.ready)
+	}
+	b.mu.Unlock()
+	<-b.ready
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func TestSummary(t *testing.T) {
+	echo := &Command{Name: "echo", Short: "Print strings on stdout"}
+	long := &Command{Name: "long", Short: strings.Repeat("word ", 15)}
+	prog := &Command{
+		Name:     "prog",
+		Short:    "Top level prog",
+		Children: []*Command{echo, {Name: "sub", Children: []*Command{long}}},
+	}
+	if got, want := echo.Summary(), "echo        Print strings on stdout"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	var buf bytes.Buffer
+	if err := prog.SummaryTree(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `prog        Top level prog
+   echo        Print strings on stdout
+   sub         No description available
+      long        word word word word word word word word word word word word
+                  word word word
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestHelpPathFlags checks that the flags memoized by helpConfig match
+// pathFlags, including commands that stop inheriting or propagating flags.
+func TestHelpPathFlags(t *testing.T) {
+	newCmd := func(name string, children ...*Command) *Command {
+		cmd := &Command{Name: name, Short: name, Long: name, Children: children}
+		if len(children) == 0 {
+			cmd.Runner = RunnerFunc(runEcho)
+		}
+		cmd.Flags.Bool(name, false, name)
+		cmd.Flags.Bool("shared", false, name)
+		return cmd
+	}
+	noInherit, noPropagate := newCmd("e", newCmd("f")), newCmd("c", newCmd("d"))
+	noInherit.DontInheritFlags = true
+	noPropagate.DontPropagateFlags = true
+	root := newCmd("a", newCmd("b", noPropagate, noInherit), newCmd("g"))
+	config := &helpConfig{helpFormat: newHelpFormat(root), firstCall: true}
+	env := &Env{Vars: map[string]string{}}
+	walkHelp(env, []*Command{root}, config, true, visitCommandFunc(func(path []*Command) {
+		var got, want []string
+		config.pathFlags(path).VisitAll(func(f *flag.Flag) { got = append(got, f.Name+"="+f.Usage) })
+		pathFlags(path).VisitAll(func(f *flag.Flag) { want = append(want, f.Name+"="+f.Usage) })
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got flags %v, want %v", pathName("", path), got, want)
+		}
+	}))
+}
+
+// visitCommandFunc is a helpVisitor that calls the function for each command.
+type visitCommandFunc func(path []*Command)
+
+func (f visitCommandFunc) visitCommand(path []*Command, _ bool) { f(path) }
+func (f visitCommandFunc) visitExternal([]*Command, string)     {}
+func (f visitCommandFunc) visitTopic([]*Command, []Topic)       {}
+
+// TestHelpFlagsMemo checks that the flags memoized while printing help aren't
+// shared across invocations, which may differ in width or follow changes to
+// the tree.
+func TestHelpFlagsMemo(t *testing.T) {
+	isolateGlobalFlags(t)
+	root := newBenchTree("c", 1, 2)
+	help := func(width string) string {
+		var stdout bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stdout, Vars: map[string]string{"CMDLINE_WIDTH": width}, Deterministic: true}
+		if err := ParseAndRun(root, env, []string{"help", "-style=full", "..."}); err != nil {
+			t.Fatal(err)
+		}
+		return stdout.String()
+	}
+	wide, narrow := help("80"), help("40")
+	if wide == narrow {
+		t.Errorf("got the same output for widths 80 and 40:\n%s", wide)
+	}
+	if got := help("80"); got != wide {
+		t.Errorf("got different output for width 80:\n%s\nwant:\n%s", got, wide)
+	}
+	root.Children[0].Flags.Bool("added", false, "A flag added after the first run.")
+	if got := help("80"); !strings.Contains(got, "-added=false") {
+		t.Errorf("got output without the added flag:\n%s", got)
+	}
+}
+
+// newBenchTree returns a synthetic tree where each command has fanout children
+// down to the given depth, and each command has a couple of flags.
+func newBenchTree(name string, depth, fanout int) *Command {
+	cmd := &Command{
+		Name:  name,
+		Short: "Short description of " + name,
+		Long:  strings.Repeat("Long description of "+name+", which wraps over a few lines. ", 4),
+	}
+	cmd.Flags.Bool(name+"-verbose", false, "Enable verbose output for "+name+".")
+	cmd.Flags.String(name+"-format", "text", "Output format of "+name+"; one of text, json or yaml.")
+	if depth == 0 {
+		cmd.ArgsName = "[args]"
+		cmd.ArgsLong = "[args] are passed to " + name + "."
+		cmd.Runner = RunnerFunc(runEcho)
+		return cmd
+	}
+	for i := 0; i < fanout; i++ {
+		cmd.Children = append(cmd.Children, newBenchTree(fmt.Sprintf("%s%d", name, i), depth-1, fanout))
+	}
+	return cmd
+}
+
+// BenchmarkHelpRecursive benchmarks "help ..." on a tree of 364 commands.
+func BenchmarkHelpRecursive(b *testing.B) {
+	benchmarkHelpRecursive(b, newBenchTree("c", 5, 3))
+}
+
+// BenchmarkHelpRecursiveWide benchmarks "help ..." on a tree of 931 commands,
+// most of which are leaves with many siblings.
+func BenchmarkHelpRecursiveWide(b *testing.B) {
+	benchmarkHelpRecursive(b, newBenchTree("c", 2, 30))
+}
+
+// BenchmarkHelpRecursiveDeep benchmarks "help ..." on a tree of 1023 commands,
+// 10 levels deep.
+func BenchmarkHelpRecursiveDeep(b *testing.B) {
+	benchmarkHelpRecursive(b, newBenchTree("c", 9, 2))
+}
+
+// BenchmarkGenerateDocs benchmarks GenerateDocs on a tree of 1093 commands,
+// with a single worker and with GOMAXPROCS workers.
+func BenchmarkGenerateDocs(b *testing.B) {
+	root := newBenchTree("c", 6, 3)
+	counts := []int{1}
+	if n := runtime.GOMAXPROCS(0); n > 1 {
+		counts = append(counts, n)
+	}
+	for _, workers := range counts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := root.generateDocs(b.TempDir(), "compact", workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func benchmarkHelpRecursive(b *testing.B, root *Command) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		env := &Env{Stdout: ioutil.Discard, Stderr: ioutil.Discard, Vars: map[string]string{"CMDLINE_WIDTH": "80"}, Deterministic: true}
+		if err := ParseAndRun(root, env, []string{"help", "..."}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkHelpGlobalFlags benchmarks help on a program with 300 global flags.
+func BenchmarkHelpGlobalFlags(b *testing.B) {
+	initGlobalFlags()
+	saved := globalFlags
+	defer func() { globalFlags = saved }()
+	globalFlags = new(flag.FlagSet)
+	for i := 0; i < 300; i++ {
+		globalFlags.String(fmt.Sprintf("global-%03d", i), "default", fmt.Sprintf("Global flag %d, registered by some library.", i))
+	}
+	root := newBenchTree("c", 1, 3)
+	for _, style := range []string{"compact", "full"} {
+		b.Run(style, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				env := &Env{Stdout: ioutil.Discard, Stderr: ioutil.Discard, Vars: map[string]string{"CMDLINE_WIDTH": "80"}, Deterministic: true}
+				if err := ParseAndRun(root, env, []string{"help", "-style=" + style, "c0"}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkHelpManyFlags benchmarks help for a command with many flags, which
+// should scale linearly with the number of flags.
+func BenchmarkHelpManyFlags(b *testing.B) {
+	for _, num := range []int{50, 500, 5000} {
+		root := newBenchTree("c", 1, 1)
+		cmd := root.Children[0]
+		for i := 0; i < num; i++ {
+			cmd.Flags.String(fmt.Sprintf("flag-%04d", i), "default", fmt.Sprintf("Flag %d of a generated command, with a usage that is long enough to wrap onto a second line.", i))
+		}
+		b.Run(fmt.Sprintf("flags=%d", num), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				env := &Env{Stdout: ioutil.Discard, Stderr: ioutil.Discard, Vars: map[string]string{"CMDLINE_WIDTH": "80"}, Deterministic: true}
+				if err := ParseAndRun(root, env, []string{"help", cmd.Name}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
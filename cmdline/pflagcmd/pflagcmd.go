@@ -0,0 +1,150 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package pflagcmd defines the flags of spf13/pflag FlagSets on cmdline
+// commands, so that flag values and conventions that live in pflag may be used
+// with cmdline, without converting them by hand:
+//
+//   fs := pflag.NewFlagSet("serve", pflag.ContinueOnError)
+//   port := fs.IntP("port", "p", 8080, "Port to listen on.")
+//   pflagcmd.AddFlags(cmdServe, fs)
+//
+// The flags are then parsed by cmdline, and shown in its help output, like any
+// other flags of the command.
+//
+// This is a bridge, rather than native support for pflag in cmdline: the Flags
+// of a command remain a flag.FlagSet, and cmdline doesn't depend on pflag.  So
+// each shorthand is shown as a separate flag in help output, combined
+// shorthands like "-abc" aren't supported, and a flag set via its shorthand is
+// reported under the shorthand by the ParsedFlags of the command; use the
+// Changed field of each pflag, or pflags.Visit, to find the flags that were set.
+package pflagcmd
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"v.io/x/lib/cmdline"
+)
+
+// AddFlags defines each flag of pflags on the Flags of cmd, with the same
+// value; a shorthand becomes a separate flag with the same value.  Values are
+// set via pflags.Set, so the Changed field of each pflag, and pflags.Visit,
+// report the flags that were specified on the command line, as with
+// pflag.FlagSet.Parse.  Flags with a NoOptDefVal may be specified without a
+// value, like bool flags; e.g. "-v -v" for a count flag.  Hidden and deprecated
+// flags are hidden via HideFlag.  A "help" flag is skipped, since cmdline has
+// its own.
+//
+// If cmd has no children, flags may follow the args, as with pflag by default;
+// PreParse is set to move them before the args, after calling the previous
+// PreParse, if any.  It is set even if pflags has no flags, since flags
+// inherited from ancestors may also follow the args.  Only the flags of pflags
+// are known to take separate values, so other flags that follow the args must
+// use the "-flag=value" form unless they're bool-like.  Combined shorthands
+// like "-abc" and name normalization aren't supported.
+func AddFlags(cmd *cmdline.Command, pflags *pflag.FlagSet) {
+	pflags.VisitAll(func(f *pflag.Flag) {
+		if f.Name == "help" {
+			return
+		}
+		var value flag.Value = flagValue{pflags, f}
+		if f.NoOptDefVal != "" {
+			value = noOptFlagValue{flagValue{pflags, f}}
+		}
+		cmd.Flags.Var(value, f.Name, f.Usage)
+		if f.Hidden || f.Deprecated != "" {
+			cmd.HideFlag(f.Name)
+		}
+		if f.Shorthand != "" && cmd.Flags.Lookup(f.Shorthand) == nil {
+			cmd.Flags.Var(value, f.Shorthand, "Shorthand for -"+f.Name+".")
+			if f.Hidden || f.Deprecated != "" || f.ShorthandDeprecated != "" {
+				cmd.HideFlag(f.Shorthand)
+			}
+		}
+	})
+	preParse := cmd.PreParse
+	cmd.PreParse = func(args []string) ([]string, error) {
+		if preParse != nil {
+			var err error
+			if args, err = preParse(args); err != nil {
+				return nil, err
+			}
+		}
+		if len(cmd.Children) > 0 || cmd.PassthroughArgs {
+			// The first arg that isn't a flag is the name of a child.
+			return args, nil
+		}
+		return interspersed(pflags, args), nil
+	}
+}
+
+// flagValue adapts a pflag to a flag.Value, which is set via the FlagSet of the
+// pflag.
+type flagValue struct {
+	pflags *pflag.FlagSet
+	flag   *pflag.Flag
+}
+
+// String implements the flag.Value interface method.
+func (v flagValue) String() string { return v.flag.Value.String() }
+
+// Set implements the flag.Value interface method.
+func (v flagValue) Set(s string) error { return v.pflags.Set(v.flag.Name, s) }
+
+// noOptFlagValue adapts a pflag with a NoOptDefVal to a flag.Value, which may
+// be specified without a value, like a bool flag.
+type noOptFlagValue struct {
+	flagValue
+}
+
+// IsBoolFlag implements the interface checked by the flag package.
+func (noOptFlagValue) IsBoolFlag() bool { return true }
+
+// Set implements the flag.Value interface method.  The flag package sets
+// flags without a value to "true", which is replaced by the NoOptDefVal.
+func (v noOptFlagValue) Set(s string) error {
+	if s == "true" {
+		s = v.flag.NoOptDefVal
+	}
+	return v.flagValue.Set(s)
+}
+
+// interspersed returns args with the flags moved before the other args, since
+// the flag package stops parsing flags at the first arg that isn't a flag,
+// but pflag doesn't.  Args following "--" aren't moved.
+func interspersed(pflags *pflag.FlagSet, args []string) []string {
+	var flagArgs, otherArgs []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return append(append(append(flagArgs, arg), otherArgs...), args[i+1:]...)
+		case len(arg) < 2 || arg[0] != '-':
+			otherArgs = append(otherArgs, arg)
+		default:
+			flagArgs = append(flagArgs, arg)
+			if takesValue(pflags, arg) && i+1 < len(args) {
+				i++
+				flagArgs = append(flagArgs, args[i])
+			}
+		}
+	}
+	return append(flagArgs, otherArgs...)
+}
+
+// takesValue returns true iff arg is a flag of pflags without "=value" that's
+// followed by a separate value.
+func takesValue(pflags *pflag.FlagSet, arg string) bool {
+	name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+	if strings.Contains(name, "=") {
+		return false
+	}
+	f := pflags.Lookup(name)
+	if f == nil && len(name) == 1 {
+		f = pflags.ShorthandLookup(name)
+	}
+	return f != nil && f.NoOptDefVal == ""
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pflagcmd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"v.io/x/lib/cmdline"
+)
+
+// newTree returns a new cmdline tree with pflags for testing; pflag values and
+// Changed fields aren't reset between runs, so each run needs its own tree.
+func newTree() *cmdline.Command {
+	fs := pflag.NewFlagSet("serve", pflag.ContinueOnError)
+	port := fs.IntP("port", "p", 8080, "Port to listen on.")
+	tags := fs.StringSlice("tags", nil, "Tags of the server.")
+	level := fs.CountP("level", "l", "Level of logging.")
+	fs.Bool("secret", false, "A hidden flag.")
+	fs.MarkHidden("secret")
+	serve := &cmdline.Command{
+		Name:     "serve",
+		Short:    "Serve.",
+		Long:     "Serve serves.",
+		ArgsName: "[args]",
+		Runner: cmdline.RunnerFunc(func(env *cmdline.Env, args []string) error {
+			var changed []string
+			fs.Visit(func(f *pflag.Flag) { changed = append(changed, f.Name) })
+			fmt.Fprintf(env.Stdout, "port=%d tags=%q level=%d args=%q changed=%q\n", *port, *tags, *level, args, changed)
+			return nil
+		}),
+	}
+	AddFlags(serve, fs)
+	other := &cmdline.Command{
+		Name:     "other",
+		Short:    "Other.",
+		Long:     "Other does nothing.",
+		ArgsName: "[args]",
+		Runner:   cmdline.RunnerFunc(func(*cmdline.Env, []string) error { return nil }),
+	}
+	return &cmdline.Command{
+		Name:     "prog",
+		Short:    "Prog.",
+		Long:     "Prog has pflags.",
+		Children: []*cmdline.Command{serve, other},
+	}
+}
+
+func run(args ...string) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+	env := &cmdline.Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{}, Deterministic: true}
+	err := cmdline.ParseAndRun(newTree(), env, args)
+	return stdout.String(), stderr.String(), err
+}
+
+func TestAddFlags(t *testing.T) {
+	tests := []struct {
+		args   []string
+		stdout string
+	}{
+		{[]string{"serve"}, "port=8080 tags=[] level=0 args=[] changed=[]\n"},
+		{[]string{"serve", "-p", "80", "--tags=a,b", "x"}, "port=80 tags=[\"a\" \"b\"] level=0 args=[\"x\"] changed=[\"port\" \"tags\"]\n"},
+		{[]string{"serve", "x", "--port", "80", "y", "-l", "-l"}, "port=80 tags=[] level=2 args=[\"x\" \"y\"] changed=[\"level\" \"port\"]\n"},
+		{[]string{"serve", "x", "--", "-p", "80"}, "port=8080 tags=[] level=0 args=[\"x\" \"-p\" \"80\"] changed=[]\n"},
+	}
+	for _, test := range tests {
+		stdout, _, err := run(test.args...)
+		if err != nil {
+			t.Errorf("%q: %v", test.args, err)
+		}
+		if stdout != test.stdout {
+			t.Errorf("%q: got stdout %q, want %q", test.args, stdout, test.stdout)
+		}
+	}
+	if _, _, err := run("serve", "-p", "x"); err == nil || !strings.Contains(err.Error(), `invalid argument "x"`) {
+		t.Errorf("got error %v, want invalid argument", err)
+	}
+}
+
+func TestAddFlagsHelp(t *testing.T) {
+	stdout, _, err := run("help", "serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{" -l=0\n", " -level=0\n", " -p=8080\n", " -port=8080\n", "Port to listen on.", " -tags=[]\n"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("got help %q, want %q", stdout, want)
+		}
+	}
+	if strings.Contains(stdout, "secret") {
+		t.Errorf("got help %q, want hidden flag omitted", stdout)
+	}
+	// Unknown flags are suggested from the pflags of siblings.
+	_, stderr, err := run("other", "-port", "80")
+	if err == nil {
+		t.Fatal("got no error, want unknown flag")
+	}
+	if want := `Did you mean "prog serve -port"?`; !strings.Contains(stderr, want) {
+		t.Errorf("got stderr %q, want %q", stderr, want)
+	}
+}
@@ -156,6 +156,8 @@ func runEnviron(binDir string) []string {
 	if !updatedPath {
 		out = append(out, "PATH="+binDir)
 	}
-	out = append(out, "CMDLINE_STYLE=godoc")
+	// The output is captured rather than written to a terminal, so the width must
+	// be set explicitly to wrap the output.
+	out = append(out, "CMDLINE_STYLE=godoc", "CMDLINE_WIDTH=80")
 	return out
 }
@@ -0,0 +1,133 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// NewTreeCommand returns a new command that displays the hierarchy of the
+// command tree it belongs to, one line per command.  The tree command isn't
+// added by default; add it to the Children of the root command to enable it.
+func NewTreeCommand() *Command {
+	config := new(treeConfig)
+	tree := &Command{
+		Name:  "tree",
+		Short: "Display the command hierarchy",
+		Long: `
+Tree displays the hierarchy of commands, one line per command along with its
+short description.  Commands are displayed in the same order as help.
+`,
+		Runner: treeRunner{config},
+	}
+	tree.Flags.BoolVar(&config.topics, "topics", false, "Include help topics.")
+	tree.Flags.IntVar(&config.depth, "depth", 0, "Maximum depth of commands to display, or unlimited if depth <= 0.")
+	return tree
+}
+
+// treeConfig holds the flags of the tree command.
+type treeConfig struct {
+	topics bool
+	depth  int
+}
+
+// treeRunner is a Runner that implements the tree command.
+type treeRunner struct {
+	*treeConfig
+}
+
+// Run implements the Runner interface method.
+func (t treeRunner) Run(env *Env, args []string) error {
+	return runTree(env, *t.treeConfig)
+}
+
+// treeLine is a single line of tree output.  The name includes the drawing
+// characters that precede it.
+type treeLine struct {
+	name, short string
+}
+
+func runTree(env *Env, config treeConfig) error {
+	if env.root == nil {
+		return errors.New("tree: root command unknown; use Parse to set it")
+	}
+	root, runeWidth := env.root, newHelpFormat(env.root).runeWidth
+	cleanTree(root)
+	lines := []treeLine{{pathName(env.prefix(), []*Command{root}), root.Short}}
+	lines = appendTree(lines, root, "", 1, config)
+	nameWidth := 0
+	for _, line := range lines {
+		if w := stringWidth(line.name, runeWidth); w > nameWidth {
+			nameWidth = w
+		}
+	}
+	width := env.outputWidth(env.Stdout)
+	for _, line := range lines {
+		text := line.name + spaces(nameWidth-stringWidth(line.name, runeWidth)) + "  " + line.short
+		fmt.Fprintln(env.Stdout, strings.TrimRight(truncateCells(text, width, runeWidth), " "))
+	}
+	return nil
+}
+
+// appendTree appends the lines for the children of cmd to lines, where depth is
+// the depth of the children, and indent precedes the drawing characters.
+func appendTree(lines []treeLine, cmd *Command, indent string, depth int, config treeConfig) []treeLine {
+	if config.depth > 0 && depth > config.depth {
+		return lines
+	}
+	type node struct {
+		cmd   *Command
+		topic Topic
+	}
+	var nodes []node
+	for _, child := range cmd.Children {
+		nodes = append(nodes, node{cmd: child})
+	}
+	if config.topics {
+		for _, topic := range cmd.Topics {
+			nodes = append(nodes, node{topic: topic})
+		}
+	}
+	for i, n := range nodes {
+		branch, next := "├── ", "│   "
+		if i == len(nodes)-1 {
+			branch, next = "└── ", "    "
+		}
+		if n.cmd == nil {
+			lines = append(lines, treeLine{indent + branch + n.topic.Name, "[topic] " + n.topic.Short})
+			continue
+		}
+		lines = append(lines, treeLine{indent + branch + n.cmd.Name, n.cmd.Short})
+		lines = appendTree(lines, n.cmd, indent+next, depth+1, config)
+	}
+	return lines
+}
+
+// stringWidth returns the number of display cells occupied by s, where
+// runeWidth returns the width of each rune.
+func stringWidth(s string, runeWidth func(rune) int) int {
+	cells := 0
+	for _, r := range s {
+		cells += runeWidth(r)
+	}
+	return cells
+}
+
+// truncateCells returns s truncated to at most width display cells, or s if
+// width < 0, where runeWidth returns the width of each rune.
+func truncateCells(s string, width int, runeWidth func(rune) int) string {
+	if width < 0 {
+		return s
+	}
+	cells := 0
+	for ix, r := range s {
+		if cells += runeWidth(r); cells > width {
+			return s[:ix]
+		}
+	}
+	return s
+}
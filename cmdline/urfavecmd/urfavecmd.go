@@ -0,0 +1,312 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package urfavecmd converts the commands of urfave/cli v2 apps into cmdline
+// commands, so that they may be mounted as a subtree of a cmdline program:
+//
+//   children, err := urfavecmd.FromApp(app)
+//   if err != nil {
+//     panic(err)
+//   }
+//   cmdRoot.Children = append(cmdRoot.Children, children...)
+//
+// Help output is always rendered by cmdline; the conversion preserves how
+// commands are run, not how they're described.
+package urfavecmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"v.io/x/lib/cmdline"
+)
+
+// FromApp returns cmdline commands equivalent to the commands of app.  The
+// Name, Usage, Description and ArgsUsage of each command become its Name,
+// Short, Long and ArgsName, and its Subcommands become its Children.  If
+// ArgsUsage is empty, a command without subcommands gets the ArgsName
+// "[args]", since urfave/cli commands take any args.
+//
+// The Flags of each command are applied to its cmdline Flags via the Apply
+// method of each flag, so all names of a flag are defined, with the same
+// destination; e.g. string, bool, int, duration and slice flags.  Environment
+// variables of the flags are read when they're applied, here.  The Flags of
+// app are applied to each of its commands.  As with urfave/cli, the flags of a
+// command aren't inherited by its subcommands; they must be specified before
+// the name of the subcommand.  Hidden flags are hidden via HideFlag, and
+// required flags are checked before the command runs.
+//
+// Each command with an Action is run by its Runner in the same way as by
+// cli.App.Run: the After function of the app and of each command in the path
+// is deferred, and the Before functions are called from the app down; then the
+// Action is called with a *cli.Context whose Args are the args of the Runner,
+// and whose lineage has the flags parsed for each command in the path; the
+// context of the Before and After functions of the app also has the flags of
+// the top-level command, since they're parsed together.  Output
+// written to the Writer and ErrWriter of the app goes to the Env of the run.
+// Errors that implement cli.ExitCoder are printed, and returned as
+// cmdline.ErrExitCode.  A command without an Action or subcommands prints its
+// usage if it's invoked.  Since a cmdline command with children can't take
+// args, an Action of a command with subcommands is only run without args.
+//
+// Constructs without a cmdline equivalent are reported as an error, rather
+// than being silently dropped; e.g. Aliases and Hidden commands, or the Action
+// of the app.  Fields that only affect help output, such as Category and
+// UsageText, are ignored.
+func FromApp(app *cli.App) ([]*cmdline.Command, error) {
+	c := &converter{app: app}
+	if app.Action != nil {
+		c.unsupported(nil, "Action of the app")
+	}
+	if app.DefaultCommand != "" {
+		c.unsupported(nil, "DefaultCommand")
+	}
+	if app.CommandNotFound != nil {
+		c.unsupported(nil, "CommandNotFound")
+	}
+	if app.OnUsageError != nil {
+		c.unsupported(nil, "OnUsageError")
+	}
+	if app.ExitErrHandler != nil {
+		c.unsupported(nil, "ExitErrHandler")
+	}
+	if app.UseShortOptionHandling {
+		c.unsupported(nil, "UseShortOptionHandling")
+	}
+	if app.SkipFlagParsing {
+		c.unsupported(nil, "SkipFlagParsing of the app")
+	}
+	var cmds []*cmdline.Command
+	for _, cmd := range app.Commands {
+		cmds = append(cmds, c.convert(nil, nil, cmd))
+	}
+	if len(c.problems) > 0 {
+		return nil, fmt.Errorf("%s: unsupported by cmdline:\n%s", app.Name, strings.Join(c.problems, "\n"))
+	}
+	return cmds, nil
+}
+
+// FromCommands is like FromApp, for commands without an app.
+func FromCommands(cmds []*cli.Command) ([]*cmdline.Command, error) {
+	return FromApp(&cli.App{Commands: cmds})
+}
+
+// converter converts the commands of app, collecting the problems it finds.
+type converter struct {
+	app      *cli.App
+	problems []string
+}
+
+// unsupported records that the named construct of the last command in path
+// isn't supported.
+func (c *converter) unsupported(path []*cli.Command, what string) {
+	var names []string
+	for _, cmd := range path {
+		names = append(names, cmd.Name)
+	}
+	if len(names) > 0 {
+		what = strings.Join(names, " ") + ": " + what
+	}
+	c.problems = append(c.problems, what)
+}
+
+// convert returns the cmdline command for cmd, whose ancestors are path, and
+// whose cmdline ancestors are cmdPath.
+func (c *converter) convert(path []*cli.Command, cmdPath []*cmdline.Command, cmd *cli.Command) *cmdline.Command {
+	path = append(path[:len(path):len(path)], cmd)
+	result := &cmdline.Command{
+		Name:             cmd.Name,
+		Short:            cmd.Usage,
+		Long:             cmd.Description,
+		ArgsName:         cmd.ArgsUsage,
+		DontInheritFlags: true,
+	}
+	cmdPath = append(cmdPath[:len(cmdPath):len(cmdPath)], result)
+	if len(cmd.Aliases) > 0 {
+		c.unsupported(path, "Aliases")
+	}
+	if cmd.Hidden {
+		c.unsupported(path, "Hidden")
+	}
+	if cmd.OnUsageError != nil {
+		c.unsupported(path, "OnUsageError")
+	}
+	if cmd.UseShortOptionHandling {
+		c.unsupported(path, "UseShortOptionHandling")
+	}
+	if cmd.BashComplete != nil {
+		c.unsupported(path, "BashComplete")
+	}
+	c.applyFlags(path, result, c.flags(path))
+	for _, sub := range cmd.Subcommands {
+		result.Children = append(result.Children, c.convert(path, cmdPath, sub))
+	}
+	hasChildren := len(result.Children) > 0
+	switch {
+	case hasChildren:
+		// A Runner can't take args if there are also Children.
+		result.ArgsName = ""
+	case cmd.SkipFlagParsing:
+		result.PassthroughArgs = true
+	}
+	if result.ArgsName == "" && !hasChildren {
+		result.ArgsName = "[args]"
+	}
+	switch {
+	case cmd.Action != nil:
+		result.Runner = cmdline.RunnerFunc(func(env *cmdline.Env, args []string) error {
+			return c.run(env, path, cmdPath, args)
+		})
+	case !hasChildren:
+		result.Runner = cmdline.RunnerFunc(func(env *cmdline.Env, _ []string) error {
+			env.Usage(env, env.Stdout)
+			return nil
+		})
+	}
+	return result
+}
+
+// flags returns the flags of the last command in path, including those of the
+// app for top-level commands.
+func (c *converter) flags(path []*cli.Command) []cli.Flag {
+	flags := path[len(path)-1].Flags
+	if len(path) == 1 {
+		flags = append(c.app.Flags[:len(c.app.Flags):len(c.app.Flags)], flags...)
+	}
+	return flags
+}
+
+// applyFlags applies flags to the Flags of cmd, the cmdline command for the
+// last command in path.
+func (c *converter) applyFlags(path []*cli.Command, cmd *cmdline.Command, flags []cli.Flag) {
+flags:
+	for _, f := range flags {
+		if f == cli.HelpFlag {
+			// The help flag is added by cli.App.Run; cmdline has its own.
+			continue
+		}
+		names := f.Names()
+		for _, name := range names {
+			if cmd.Flags.Lookup(name) != nil {
+				c.unsupported(path, fmt.Sprintf("flag %q is defined more than once", name))
+				continue flags
+			}
+		}
+		if err := f.Apply(&cmd.Flags); err != nil {
+			c.unsupported(path, fmt.Sprintf("flag %q: %v", names[0], err))
+			continue
+		}
+		if v, ok := f.(cli.VisibleFlag); ok && !v.IsVisible() {
+			for _, name := range names {
+				cmd.HideFlag(name)
+			}
+		}
+	}
+}
+
+// run runs the Action of the last command in path with args, in the same way
+// as cli.App.Run, where cmdPath holds the corresponding cmdline commands.
+func (c *converter) run(env *cmdline.Env, path []*cli.Command, cmdPath []*cmdline.Command, args []string) (err error) {
+	app := *c.app
+	app.Reader, app.Writer, app.ErrWriter = env.Stdin, env.Stdout, env.Stderr
+	defer func() {
+		err = exitError(env, err)
+	}()
+	// The flags of the app are parsed with the top-level command.
+	ctx := cli.NewContext(&app, cmdPath[0].ParsedFlags, nil)
+	ctx.Context = context.Background()
+	appCtx := ctx
+	for i, cmd := range path {
+		cmd, set := cmd, cmdPath[i].ParsedFlags
+		if i == len(path)-1 && cmd.SkipFlagParsing {
+			// No flags are parsed, but the Action gets the args via the FlagSet.
+			set = flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+			set.Parse(append([]string{"--"}, args...))
+		}
+		ctx = cli.NewContext(&app, set, ctx)
+		ctx.Command = cmd
+		if err := requiredFlags(c.flags(path[:i+1]), set); err != nil {
+			return env.UsageErrorf("%v", err)
+		}
+		if i == 0 {
+			if app.After != nil {
+				defer func() { err = after(err, app.After(appCtx)) }()
+			}
+			if app.Before != nil {
+				if err := app.Before(appCtx); err != nil {
+					return err
+				}
+			}
+		}
+		if cmd.After != nil {
+			ctx := ctx
+			defer func() { err = after(err, cmd.After(ctx)) }()
+		}
+		if cmd.Before != nil {
+			if err := cmd.Before(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return path[len(path)-1].Action(ctx)
+}
+
+// requiredFlags returns an error if any of the required flags weren't set in
+// set, worded in the same way as by urfave/cli.
+func requiredFlags(flags []cli.Flag, set *flag.FlagSet) error {
+	isSet := map[string]bool{}
+	if set != nil {
+		set.Visit(func(f *flag.Flag) { isSet[f.Name] = true })
+	}
+	var missing []string
+	for _, f := range flags {
+		if r, ok := f.(cli.RequiredFlag); !ok || !r.IsRequired() || f.IsSet() {
+			continue
+		}
+		found := false
+		for _, name := range f.Names() {
+			found = found || isSet[name]
+		}
+		if !found {
+			missing = append(missing, f.Names()[0])
+		}
+	}
+	switch len(missing) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("Required flag %q not set", missing[0])
+	}
+	return fmt.Errorf("Required flags %q not set", strings.Join(missing, ", "))
+}
+
+// after returns the combination of err, returned before calling an After
+// function, and afterErr, returned by the After function.
+func after(err, afterErr error) error {
+	switch {
+	case afterErr == nil:
+		return err
+	case err == nil:
+		return afterErr
+	}
+	return errors.Join(err, afterErr)
+}
+
+// exitError returns err, with errors that implement cli.ExitCoder printed to
+// env.Stderr and converted to cmdline.ErrExitCode, as they'd otherwise be
+// handled by cli.HandleExitCoder.
+func exitError(env *cmdline.Env, err error) error {
+	var exit cli.ExitCoder
+	if !errors.As(err, &exit) || errors.Is(err, cmdline.ErrUsage) {
+		return err
+	}
+	if msg := err.Error(); msg != "" {
+		fmt.Fprintln(env.Stderr, msg)
+	}
+	return cmdline.ErrExitCode(exit.ExitCode())
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package urfavecmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+	"v.io/x/lib/cmdline"
+)
+
+// newApp returns a new app for testing; urfave/cli modifies the app and its
+// flags when it runs, so each run needs its own app.
+func newApp() *cli.App {
+	// The context of the hooks of the app also has the flags of the top-level
+	// command when converted, so only the hooks of commands print them.
+	hook := func(name, flag string) func(*cli.Context) error {
+		return func(ctx *cli.Context) error {
+			if ctx.Bool("verbose") {
+				fmt.Fprintf(ctx.App.Writer, "%s %s\n", name, ctx.String(flag))
+			}
+			return nil
+		}
+	}
+	add := &cli.Command{
+		Name: "add",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "name", Required: true},
+			&cli.BoolFlag{Name: "force", Aliases: []string{"f"}},
+			&cli.IntFlag{Name: "retries", Value: 3},
+			&cli.DurationFlag{Name: "timeout", Value: 1e9},
+			&cli.StringSliceFlag{Name: "tag"},
+			&cli.IntSliceFlag{Name: "port"},
+		},
+		Action: func(ctx *cli.Context) error {
+			fmt.Fprintf(ctx.App.Writer, "add name=%s force=%v retries=%d timeout=%v tag=%q port=%v format=%s args=%q set=%v\n",
+				ctx.String("name"), ctx.Bool("force"), ctx.Int("retries"), ctx.Duration("timeout"),
+				ctx.StringSlice("tag"), ctx.IntSlice("port"), ctx.String("format"), ctx.Args().Slice(), ctx.IsSet("retries"))
+			return nil
+		},
+	}
+	list := &cli.Command{
+		Name: "list",
+		Action: func(ctx *cli.Context) error {
+			fmt.Fprintf(ctx.App.Writer, "list format=%s args=%q\n", ctx.String("format"), ctx.Args().Slice())
+			return nil
+		},
+	}
+	remote := &cli.Command{
+		Name:        "remote",
+		Usage:       "Manage remotes.",
+		Flags:       []cli.Flag{&cli.StringFlag{Name: "format", Value: "text"}},
+		Before:      hook("remote before", "format"),
+		After:       hook("remote after", "format"),
+		Subcommands: []*cli.Command{add, list},
+	}
+	fail := &cli.Command{
+		Name: "fail",
+		Action: func(ctx *cli.Context) error {
+			return cli.Exit("fail: bad", 3)
+		},
+	}
+	raw := &cli.Command{
+		Name:            "raw",
+		SkipFlagParsing: true,
+		Action: func(ctx *cli.Context) error {
+			fmt.Fprintf(ctx.App.Writer, "raw args=%q\n", ctx.Args().Slice())
+			return nil
+		},
+	}
+	return &cli.App{
+		Name:     "app",
+		Flags:    []cli.Flag{&cli.BoolFlag{Name: "verbose"}},
+		Before:   hook("app before", "verbose"),
+		After:    hook("app after", "verbose"),
+		Commands: []*cli.Command{remote, fail, raw},
+	}
+}
+
+// result is the result of a run, for comparison.
+type result struct {
+	stdout string
+	err    error
+}
+
+func runApp(args []string) result {
+	var stdout, stderr bytes.Buffer
+	app := newApp()
+	app.Writer, app.ErrWriter = &stdout, &stderr
+	err := app.Run(append([]string{"app"}, args...))
+	return result{stdout.String(), err}
+}
+
+func runCmdline(t *testing.T, args []string) result {
+	children, err := FromApp(newApp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := &cmdline.Command{Name: "umbrella", Short: "Umbrella.", Long: "Umbrella.", Children: children}
+	var stdout, stderr bytes.Buffer
+	env := &cmdline.Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{}, Deterministic: true}
+	err = cmdline.ParseAndRun(root, env, args)
+	return result{stdout.String(), err}
+}
+
+func TestFromApp(t *testing.T) {
+	// Exit errors would otherwise exit the test.
+	exiter, errWriter := cli.OsExiter, cli.ErrWriter
+	defer func() { cli.OsExiter, cli.ErrWriter = exiter, errWriter }()
+	cli.OsExiter = func(int) {}
+	tests := []struct {
+		cliArgs []string
+		cmdArgs []string // The flags of the app follow the top-level command.
+		stdout  string
+		wantErr bool
+	}{
+		{
+			cliArgs: []string{"remote", "add", "--name", "n", "a", "b"},
+			stdout:  "add name=n force=false retries=3 timeout=1s tag=[] port=[] format=text args=[\"a\" \"b\"] set=false\n",
+		},
+		{
+			cliArgs: []string{"remote", "--format=json", "add", "--name=n", "-f", "--retries", "5", "--timeout", "2m", "--tag", "x", "--tag", "y", "--port", "80", "--port", "81", "a"},
+			stdout:  "add name=n force=true retries=5 timeout=2m0s tag=[\"x\" \"y\"] port=[80 81] format=json args=[\"a\"] set=true\n",
+		},
+		{
+			cliArgs: []string{"remote", "add", "a"},
+			wantErr: true,
+		},
+		{
+			cliArgs: []string{"remote", "add", "--name", "n", "--retries", "x"},
+			wantErr: true,
+		},
+		{
+			cliArgs: []string{"--verbose", "remote", "--format", "json", "list", "x"},
+			cmdArgs: []string{"remote", "--verbose", "--format", "json", "list", "x"},
+			stdout:  "app before true\nremote before json\nlist format=json args=[\"x\"]\nremote after json\napp after true\n",
+		},
+		{
+			cliArgs: []string{"raw", "-x", "--y", "z"},
+			stdout:  "raw args=[\"-x\" \"--y\" \"z\"]\n",
+		},
+		{
+			cliArgs: []string{"fail"},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		cli.ErrWriter = new(bytes.Buffer)
+		cmdArgs := test.cmdArgs
+		if cmdArgs == nil {
+			cmdArgs = test.cliArgs
+		}
+		want := runApp(test.cliArgs)
+		got := runCmdline(t, cmdArgs)
+		if (want.err != nil) != test.wantErr {
+			t.Errorf("%q: cli got error %v, want error %v", test.cliArgs, want.err, test.wantErr)
+		}
+		if want.err == nil && want.stdout != test.stdout {
+			t.Errorf("%q: cli got stdout %q, want %q", test.cliArgs, want.stdout, test.stdout)
+		}
+		var exit cli.ExitCoder
+		switch {
+		case (got.err == nil) != (want.err == nil):
+			t.Errorf("%q: got error %v, want %v", cmdArgs, got.err, want.err)
+		case want.err == nil && got.stdout != want.stdout:
+			// On errors, urfave/cli prints its own usage.
+			t.Errorf("%q: got stdout %q, want %q", cmdArgs, got.stdout, want.stdout)
+		case errors.As(want.err, &exit):
+			if got, want := cmdline.ExitCode(got.err, nil), exit.ExitCode(); got != want {
+				t.Errorf("%q: got exit code %d, want %d", cmdArgs, got, want)
+			}
+		case want.err != nil && !errors.Is(got.err, cmdline.ErrUsage):
+			t.Errorf("%q: got error %v, want usage error", cmdArgs, got.err)
+		case want.err != nil && strings.HasPrefix(want.err.Error(), "Required") && !strings.Contains(got.err.Error(), want.err.Error()):
+			t.Errorf("%q: got error %v, want %v", cmdArgs, got.err, want.err)
+		}
+	}
+}
+
+func TestFromAppUnsupported(t *testing.T) {
+	app := newApp()
+	app.Action = func(*cli.Context) error { return nil }
+	app.Commands[0].Aliases = []string{"r"}
+	// Each unsupported construct of a command is reported.
+	app.Commands[0].Subcommands[0].Aliases = []string{"a"}
+	app.Commands[0].Subcommands[0].Hidden = true
+	app.Commands[0].Subcommands[1].Hidden = true
+	app.Commands[1].Flags = []cli.Flag{&cli.StringFlag{Name: "a"}, &cli.BoolFlag{Name: "b", Aliases: []string{"a"}}}
+	_, err := FromApp(app)
+	want := `app: unsupported by cmdline:
+Action of the app
+remote: Aliases
+remote add: Aliases
+remote add: Hidden
+remote list: Hidden
+fail: flag "a" is defined more than once`
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %v", err, want)
+	}
+}
@@ -81,6 +81,7 @@ func FlushRuneChunk(d RuneChunkDecoder, fn func(rune) error) error {
 
 // bytePos and runePos distinguish positions that are used in either domain;
 // we're trying to avoid silly mistakes like adding a bytePos to a runePos.
+// Rune positions are measured in display cells, as returned by RuneWidth.
 type bytePos int
 type runePos int
 
@@ -89,6 +90,9 @@ type byteRuneBuffer struct {
 	enc     RuneEncoder
 	buf     bytes.Buffer
 	runeLen runePos
+	// width returns the width of a rune in display cells; RuneWidth is used if
+	// width is nil.
+	width func(rune) int
 }
 
 func (b *byteRuneBuffer) ByteLen() bytePos { return bytePos(b.buf.Len()) }
@@ -100,10 +104,18 @@ func (b *byteRuneBuffer) Reset() {
 	b.runeLen = 0
 }
 
-// WriteRune writes r into b.
+// WriteRune writes r into b, incrementing the rune length by the width of r.
 func (b *byteRuneBuffer) WriteRune(r rune) {
 	b.enc.Encode(r, &b.buf)
-	b.runeLen++
+	b.runeLen += runePos(b.runeWidth(r))
+}
+
+// runeWidth returns the width of r in display cells.
+func (b *byteRuneBuffer) runeWidth(r rune) int {
+	if b.width != nil {
+		return b.width(r)
+	}
+	return RuneWidth(r)
 }
 
 // WriteString writes str into b.
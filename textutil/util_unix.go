@@ -0,0 +1,26 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package textutil
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func terminalSize(fd uintptr) (int, int, error) {
+	var ws winsize
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws))); err != 0 {
+		return 0, 0, err
+	}
+	return int(ws.row), int(ws.col), nil
+}
+
+// winsize must correspond to the struct defined in "sys/ioctl.h".  Do not
+// export this struct; it's a platform-specific implementation detail.
+type winsize struct {
+	row, col, xpixel, ypixel uint16
+}
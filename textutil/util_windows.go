@@ -0,0 +1,54 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package textutil
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procGetConsoleScreenBufferInfo = syscall.NewLazyDLL("kernel32.dll").NewProc("GetConsoleScreenBufferInfo")
+
+// getConsoleScreenBufferInfo fills info for the console screen buffer with the
+// given handle, and returns an error if the handle isn't a console; e.g. if
+// the output is redirected.  It's a variable so that tests can fake it.
+var getConsoleScreenBufferInfo = func(handle syscall.Handle, info *consoleScreenBufferInfo) error {
+	if ok, _, err := procGetConsoleScreenBufferInfo.Call(uintptr(handle), uintptr(unsafe.Pointer(info))); ok == 0 {
+		return err
+	}
+	return nil
+}
+
+func terminalSize(fd uintptr) (int, int, error) {
+	var info consoleScreenBufferInfo
+	if err := getConsoleScreenBufferInfo(syscall.Handle(fd), &info); err != nil {
+		return 0, 0, err
+	}
+	// The screen buffer may be larger than the window, e.g. to hold scrollback
+	// lines, so we use the dimensions of the visible window.
+	win := info.window
+	return int(win.bottom-win.top) + 1, int(win.right-win.left) + 1, nil
+}
+
+// consoleScreenBufferInfo, coord and smallRect must correspond to the structs
+// CONSOLE_SCREEN_BUFFER_INFO, COORD and SMALL_RECT defined in "wincon.h".  Do
+// not export these structs; they're platform-specific implementation details.
+type consoleScreenBufferInfo struct {
+	size              coord
+	cursorPosition    coord
+	attributes        uint16
+	window            smallRect
+	maximumWindowSize coord
+}
+
+type coord struct {
+	x, y int16
+}
+
+type smallRect struct {
+	left, top, right, bottom int16
+}
@@ -0,0 +1,51 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textutil
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestTerminalSizeWindows(t *testing.T) {
+	errNotConsole := errors.New("not a console")
+	defer func(orig func(syscall.Handle, *consoleScreenBufferInfo) error) {
+		getConsoleScreenBufferInfo = orig
+	}(getConsoleScreenBufferInfo)
+	tests := []struct {
+		Consoles map[syscall.Handle]smallRect
+		Row, Col int
+		Err      error
+	}{
+		// The size of the window is used, even if the buffer is larger.
+		{map[syscall.Handle]smallRect{syscall.Stdout: {0, 0, 159, 49}}, 50, 160, nil},
+		{map[syscall.Handle]smallRect{syscall.Stdout: {10, 100, 129, 139}}, 40, 120, nil},
+		// Redirected stdout falls back to stderr and stdin.
+		{map[syscall.Handle]smallRect{syscall.Stderr: {0, 0, 99, 29}}, 30, 100, nil},
+		{map[syscall.Handle]smallRect{syscall.Stdin: {0, 0, 119, 24}}, 25, 120, nil},
+		// No consoles.
+		{nil, 0, 0, errNotConsole},
+	}
+	for _, test := range tests {
+		getConsoleScreenBufferInfo = func(handle syscall.Handle, info *consoleScreenBufferInfo) error {
+			win, ok := test.Consoles[handle]
+			if !ok {
+				return errNotConsole
+			}
+			info.size = coord{win.right + 1, 9999}
+			info.window = win
+			return nil
+		}
+		row, col, err := TerminalSize()
+		if row != test.Row || col != test.Col || err != test.Err {
+			t.Errorf("%v got (%d, %d, %v), want (%d, %d, %v)", test.Consoles, row, col, err, test.Row, test.Col, test.Err)
+		}
+		_, isTerm := test.Consoles[syscall.Stdout]
+		if got, want := IsTerminal(uintptr(syscall.Stdout)), isTerm; got != want {
+			t.Errorf("%v got IsTerminal %v, want %v", test.Consoles, got, want)
+		}
+	}
+}
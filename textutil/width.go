@@ -0,0 +1,114 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textutil
+
+import (
+	"sort"
+	"unicode"
+)
+
+// RuneWidth returns the number of display cells occupied by r on a terminal
+// with a fixed-width font.  Wide and fullwidth East Asian runes occupy 2 cells,
+// combining marks and other zero-width runes occupy 0 cells, and all other
+// runes occupy 1 cell.
+//
+// Runes with ambiguous East Asian width are treated as occupying 1 cell, which
+// matches most terminals outside of East Asian locales.
+func RuneWidth(r rune) int {
+	switch {
+	case r < 0x300:
+		// Fast path for Latin text; there are no wide or zero-width runes.
+		return 1
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf), r >= 0x1160 && r <= 0x11ff:
+		// Combining marks, format runes like U+200B ZERO WIDTH SPACE, and Hangul
+		// medial vowels and final consonants, which combine with the initial.
+		return 0
+	case isWide(r):
+		return 2
+	}
+	return 1
+}
+
+// StringWidth returns the number of display cells occupied by s on a terminal
+// with a fixed-width font.  It is the sum of RuneWidth over each rune in s.
+func StringWidth(s string) int {
+	width := 0
+	for _, r := range s {
+		width += RuneWidth(r)
+	}
+	return width
+}
+
+// wideRanges holds the sorted ranges of runes with East Asian width Wide (W) or
+// Fullwidth (F), from Unicode Standard Annex #11.
+//
+//   http://www.unicode.org/reports/tr11 [East Asian Width]
+var wideRanges = [][2]rune{
+	{0x1100, 0x115f}, // Hangul Jamo initial consonants
+	{0x231a, 0x231b},
+	{0x2329, 0x232a},
+	{0x23e9, 0x23ec},
+	{0x23f0, 0x23f0},
+	{0x23f3, 0x23f3},
+	{0x25fd, 0x25fe},
+	{0x2614, 0x2615},
+	{0x2648, 0x2653},
+	{0x267f, 0x267f},
+	{0x2693, 0x2693},
+	{0x26a1, 0x26a1},
+	{0x26aa, 0x26ab},
+	{0x26bd, 0x26be},
+	{0x26c4, 0x26c5},
+	{0x26ce, 0x26ce},
+	{0x26d4, 0x26d4},
+	{0x26ea, 0x26ea},
+	{0x26f2, 0x26f3},
+	{0x26f5, 0x26f5},
+	{0x26fa, 0x26fa},
+	{0x26fd, 0x26fd},
+	{0x2705, 0x2705},
+	{0x270a, 0x270b},
+	{0x2728, 0x2728},
+	{0x274c, 0x274c},
+	{0x274e, 0x274e},
+	{0x2753, 0x2755},
+	{0x2757, 0x2757},
+	{0x2795, 0x2797},
+	{0x27b0, 0x27b0},
+	{0x27bf, 0x27bf},
+	{0x2b1b, 0x2b1c},
+	{0x2b50, 0x2b50},
+	{0x2b55, 0x2b55},
+	{0x2e80, 0x303e},   // CJK radicals, Kangxi, ideographic description, CJK punctuation
+	{0x3041, 0x33ff},   // Hiragana, Katakana, Bopomofo, CJK compatibility
+	{0x3400, 0x4dbf},   // CJK unified ideographs extension A
+	{0x4e00, 0x9fff},   // CJK unified ideographs
+	{0xa000, 0xa4cf},   // Yi
+	{0xa960, 0xa97f},   // Hangul Jamo extended A
+	{0xac00, 0xd7a3},   // Hangul syllables
+	{0xf900, 0xfaff},   // CJK compatibility ideographs
+	{0xfe10, 0xfe19},   // Vertical forms
+	{0xfe30, 0xfe6f},   // CJK compatibility forms, small form variants
+	{0xff00, 0xff60},   // Fullwidth forms
+	{0xffe0, 0xffe6},   // Fullwidth signs
+	{0x16fe0, 0x16fe4}, // Ideographic symbols and punctuation
+	{0x17000, 0x18aff}, // Tangut
+	{0x1b000, 0x1b2ff}, // Kana supplement, Nushu
+	{0x1f004, 0x1f004},
+	{0x1f0cf, 0x1f0cf},
+	{0x1f18e, 0x1f18e},
+	{0x1f191, 0x1f19a},
+	{0x1f200, 0x1f251}, // Enclosed ideographic supplement
+	{0x1f300, 0x1f64f}, // Pictographs and emoticons
+	{0x1f680, 0x1f6ff}, // Transport and map symbols
+	{0x1f900, 0x1f9ff}, // Supplemental symbols and pictographs
+	{0x20000, 0x2fffd}, // CJK unified ideographs extensions B-F
+	{0x30000, 0x3fffd}, // CJK unified ideographs extension G
+}
+
+func isWide(r rune) bool {
+	ix := sort.Search(len(wideRanges), func(i int) bool { return wideRanges[i][1] >= r })
+	return ix < len(wideRanges) && wideRanges[ix][0] <= r
+}
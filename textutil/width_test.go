@@ -0,0 +1,62 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textutil
+
+import (
+	"testing"
+)
+
+func TestRuneWidth(t *testing.T) {
+	tests := []struct {
+		R    rune
+		Want int
+	}{
+		{'a', 1},
+		{' ', 1},
+		{'Δ', 1},
+		{'é', 1},
+		// Combining and zero-width runes.
+		{'\u0301', 0},
+		{'\u200b', 0},
+		{'\u1161', 0},
+		// Wide and fullwidth runes.
+		{'王', 2},
+		{'中', 2},
+		{'あ', 2},
+		{'한', 2},
+		{'Ａ', 2},
+		{'\u3000', 2},
+		{'\U0001F680', 2},
+		{'\U00020000', 2},
+		// Ambiguous width runes are narrow.
+		{'·', 1},
+		{'①', 1},
+	}
+	for _, test := range tests {
+		if got, want := RuneWidth(test.R), test.Want; got != want {
+			t.Errorf("%q got %d, want %d", test.R, got, want)
+		}
+	}
+}
+
+func TestStringWidth(t *testing.T) {
+	tests := []struct {
+		S    string
+		Want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"ΔΘΠ", 3},
+		{"王普澤", 6},
+		{"a王b", 4},
+		{"e\u0301", 1},
+		{"ＡＢＣ", 6},
+	}
+	for _, test := range tests {
+		if got, want := StringWidth(test.S), test.Want; got != want {
+			t.Errorf("%q got %d, want %d", test.S, got, want)
+		}
+	}
+}
@@ -5,13 +5,15 @@
 package textutil
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"strings"
 	"unicode"
 )
 
 // WrapWriter implements an io.Writer filter that formats input text into output
-// lines with a given target width in runes.
+// lines with a given target width in display cells.
 //
 // Each input rune is classified into one of three kinds:
 //   EOL:    end-of-line, consisting of \f, \n, \r, \v, U+2028 or U+2029
@@ -27,7 +29,8 @@ import (
 // boundaries.  Output lines are usually no longer than the target width.  The
 // exceptions are single words longer than the target width, which are output on
 // their own line, and verbatim lines, which may be arbitrarily longer or
-// shorter than the width.
+// shorter than the width.  Words are never split, so long URLs and file paths
+// remain intact.
 //
 // Output lines never contain trailing spaces.  Only verbatim output lines may
 // contain leading spaces.  Spaces separating input words are output verbatim,
@@ -38,9 +41,17 @@ import (
 // be output as a single space ' ' to maintain word separation.
 //
 // The algorithm greedily fills each output line with as many words as it can,
-// assuming that all Unicode code points have the same width.  Invalid UTF-8 is
-// silently transformed to the replacement character U+FFFD and treated as a
-// single rune.
+// measuring the width of each rune in display cells via RuneWidth, or the
+// function set via SetRuneWidth; e.g. wide East Asian runes occupy 2 cells, and
+// combining marks occupy 0 cells.  The target width is also in display cells.
+// Invalid UTF-8 is silently transformed to the replacement character U+FFFD and
+// treated as a single rune.
+//
+// ANSI escape sequences (e.g. CSI sequences to set colors, and OSC sequences)
+// have no width, and are never split across lines.  If an SGR sequence that
+// sets colors or other attributes is active at the end of an output line, the
+// attributes are reset before the line terminator, and set again after the
+// indent of the next line, so that the indents and separators aren't affected.
 //
 // Flush must be called after the last call to Write; the input is buffered.
 //
@@ -61,6 +72,7 @@ type WrapWriter struct {
 	paragraphSep  string
 	indents       []string
 	forceVerbatim bool
+	tabWidth      runePos
 
 	// The buffer contains a single output line.
 	lineBuf byteRuneBuffer
@@ -83,6 +95,92 @@ type WrapWriter struct {
 	terminateParagraph bool
 	paragraphLineIndex int
 	wroteFirstLine     bool
+
+	// Keep track of ANSI escape sequences; escState is the parsing state of the
+	// current sequence, and sgr holds the SGR sequences that are active at the
+	// end of the last output line.
+	escState escState
+	sgr      string
+}
+
+// escState describes the parsing state of ANSI escape sequences.
+type escState int
+
+const (
+	escNone   escState = iota // Not in an escape sequence [start state]
+	escStart                  // Seen ESC
+	escCSI                    // In a CSI sequence, seen ESC [
+	escOSC                    // In an OSC sequence, seen ESC ]
+	escOSCEnd                 // Seen ESC in an OSC sequence, expecting \
+)
+
+// nextEscState returns the escape sequence parsing state after r, and whether r
+// is part of an escape sequence.
+func nextEscState(prev escState, r rune) (escState, bool) {
+	switch prev {
+	case escNone:
+		if r == '\x1b' {
+			return escStart, true
+		}
+		return escNone, false
+	case escStart:
+		switch r {
+		case '[':
+			return escCSI, true
+		case ']':
+			return escOSC, true
+		}
+		// Two-rune sequences like ESC c.
+		return escNone, true
+	case escCSI:
+		if r >= 0x40 && r <= 0x7e {
+			// Final rune of the CSI sequence.
+			return escNone, true
+		}
+		return escCSI, true
+	case escOSC:
+		switch r {
+		case '\a':
+			return escNone, true
+		case '\x1b':
+			return escOSCEnd, true
+		}
+		return escOSC, true
+	case escOSCEnd:
+		return escNone, true
+	}
+	panic(fmt.Errorf("textutil: nextEscState unhandled state %d", prev))
+}
+
+// sgrReset is the SGR sequence that resets all attributes.
+const sgrReset = "\x1b[0m"
+
+// updateSGR returns the SGR sequences that are active after writing data, given
+// that the sgr sequences were active before.  All sequences since the last
+// reset are retained, since each only changes some of the attributes.
+func updateSGR(sgr string, data []byte) string {
+	for {
+		ix := bytes.Index(data, []byte("\x1b["))
+		if ix == -1 {
+			return sgr
+		}
+		data = data[ix+2:]
+		end := bytes.IndexFunc(data, func(r rune) bool { return r >= 0x40 && r <= 0x7e })
+		if end == -1 {
+			return sgr
+		}
+		if data[end] == 'm' {
+			switch params := string(data[:end]); {
+			case params == "" || params == "0":
+				sgr = ""
+			case strings.HasPrefix(params, "0;"):
+				sgr = "\x1b[" + params + "m"
+			default:
+				sgr += "\x1b[" + params + "m"
+			}
+		}
+		data = data[end+1:]
+	}
 }
 
 type state int
@@ -93,9 +191,9 @@ const (
 	stateSkipSpace              // Skip spaces in input line.
 )
 
-// NewWrapWriter returns a new WrapWriter with the given target width in runes,
-// producing output on the underlying writer w.  The dec and enc are used to
-// respectively decode runes from Write calls, and encode runes to w.
+// NewWrapWriter returns a new WrapWriter with the given target width in display
+// cells, producing output on the underlying writer w.  The dec and enc are used
+// to respectively decode runes from Write calls, and encode runes to w.
 func NewWrapWriter(w io.Writer, width int, dec RuneChunkDecoder, enc RuneEncoder) *WrapWriter {
 	ret := &WrapWriter{
 		w:            w,
@@ -117,7 +215,7 @@ func NewUTF8WrapWriter(w io.Writer, width int) *WrapWriter {
 	return NewWrapWriter(w, width, &UTF8ChunkDecoder{}, UTF8Encoder{})
 }
 
-// Width returns the target width in runes.  If width < 0 the width is
+// Width returns the target width in display cells.  If width < 0 the width is
 // unlimited; each paragraph is output as a single line.
 func (w *WrapWriter) Width() int { return int(w.width) }
 
@@ -184,6 +282,49 @@ func (w *WrapWriter) SetIndents(indents ...string) error {
 	return nil
 }
 
+// SetTabWidth sets the distance between tab stops for subsequent Write calls.
+// If width > 0, each tab in the input is expanded to one or more spaces, up to
+// the next tab stop, where tab stops are every width display cells from the
+// start of the output line, including the indent.  The expanded spaces count
+// toward the target width, and are handled like other spaces; e.g. lines
+// starting with a tab are treated verbatim.  If width <= 0, tabs are treated as
+// a single space rune.  A new WrapWriter instance doesn't expand tabs.
+//
+// Calls Flush internally, and returns any Flush error.
+func (w *WrapWriter) SetTabWidth(width int) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	w.tabWidth = runePos(width)
+	return nil
+}
+
+// SetRuneWidth sets the function that returns the width of each rune in
+// display cells for subsequent Write calls; the width of a line is the sum of
+// the widths of its runes.  If fn is nil, RuneWidth is used, which treats East
+// Asian wide and fullwidth runes as two cells.  A new WrapWriter instance uses
+// RuneWidth by default.
+//
+// Calls Flush internally, and returns any Flush error.
+func (w *WrapWriter) SetRuneWidth(fn func(rune) int) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	w.lineBuf.width = fn
+	return nil
+}
+
+// StringWidth returns the number of display cells occupied by s, measured
+// with the rune width function of w; e.g. to align columns of output written
+// to w.
+func (w *WrapWriter) StringWidth(s string) int {
+	width := 0
+	for _, r := range s {
+		width += w.lineBuf.runeWidth(r)
+	}
+	return width
+}
+
 // ForceVerbatim forces w to stay in verbatim mode if v is true, or lets w
 // perform its regular line writing algorithm if v is false.  This is useful if
 // there is a sequence of lines that should be written verbatim, even if the
@@ -227,6 +368,19 @@ func (w *WrapWriter) Flush() error {
 
 // addRune is called every time w.runeDecoder decodes a full rune.
 func (w *WrapWriter) addRune(r rune) error {
+	var isEsc bool
+	if w.escState, isEsc = nextEscState(w.escState, r); isEsc {
+		// Escape sequences are buffered as part of the current word, so they're
+		// never split across lines, but they don't consume any width.
+		if w.newWordStart == -1 {
+			w.newWordStart = w.lineBuf.ByteLen()
+		}
+		w.lineBuf.WriteString0Runes(string(r))
+		return nil
+	}
+	if r == '\t' && w.tabWidth > 0 {
+		return w.addTab()
+	}
 	state, lineBreak := w.nextState(r, w.updateRune(r))
 	if lineBreak {
 		if err := w.writeLine(); err != nil {
@@ -239,6 +393,22 @@ func (w *WrapWriter) addRune(r rune) error {
 	return nil
 }
 
+// addTab expands a tab into spaces, up to the next tab stop.  The spaces are
+// added one at a time, since the first may cause a line break; we stop early
+// if a space is dropped, e.g. if it would be a leading space.
+func (w *WrapWriter) addTab() error {
+	for ix := runePos(0); ix < w.tabWidth; ix++ {
+		before := w.lineBuf.RuneLen()
+		if err := w.addRune(' '); err != nil {
+			return err
+		}
+		if after := w.lineBuf.RuneLen(); after == before || after%w.tabWidth == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
 // We classify each incoming rune into three kinds for easier handling.
 type kind int
 
@@ -381,7 +551,7 @@ func (w *WrapWriter) nextState(r rune, forceLineBreak bool) (state, bool) {
 		// case kindLetter falls through
 	}
 	// Handle the newWordStart case in the above table.
-	if w.width >= 0 && w.width < w.lineBuf.RuneLen()+1 && w.newWordStart != w.lineStart {
+	if w.width >= 0 && w.width < w.lineBuf.RuneLen()+runePos(w.lineBuf.runeWidth(r)) && w.newWordStart != w.lineStart {
 		return stateWordWrap, true
 	}
 	// Stay in the wordWrap state and don't break the line.
@@ -396,10 +566,20 @@ func (w *WrapWriter) writeLine() error {
 		return nil
 	}
 	// Write the line (without trailing spaces) followed by the line terminator.
+	// Reset any active SGR attributes first, so they don't bleed into the next
+	// indent; they're set again in resetLine.
 	line := w.lineBuf.Bytes()[:w.lastWordEnd]
 	if _, err := w.w.Write(line); err != nil {
 		return err
 	}
+	if w.lineStart < w.lastWordEnd {
+		w.sgr = updateSGR(w.sgr, line[w.lineStart:])
+	}
+	if w.sgr != "" {
+		if _, err := io.WriteString(w.w, sgrReset); err != nil {
+			return err
+		}
+	}
 	if _, err := w.w.Write(w.lineTerm); err != nil {
 		return err
 	}
@@ -438,6 +618,8 @@ func (w *WrapWriter) resetLine() {
 		indent = w.indents[len(w.indents)-1]
 	}
 	w.lineBuf.WriteString(indent)
+	// Set any SGR attributes that were active at the end of the last line.
+	w.lineBuf.WriteString0Runes(w.sgr)
 	w.lineStart = w.lineBuf.ByteLen()
 }
 
@@ -7,8 +7,10 @@ package textutil
 import (
 	"bytes"
 	"io"
+	"regexp"
 	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 type lp struct {
@@ -216,6 +218,162 @@ func TestWrapWriterForceVerbatim(t *testing.T) {
 	}
 }
 
+func TestWrapWriterEscapes(t *testing.T) {
+	const (
+		red   = "\x1b[31m"
+		bold  = "\x1b[1m"
+		reset = "\x1b[0m"
+		link  = "\x1b]8;;http://x\x1b\\"
+	)
+	tests := []struct {
+		Indents []int
+		In      string
+		Want    string
+	}{
+		{nil, "", ""},
+		{nil, red + "abc" + reset, red + "abc" + reset + "\n"},
+		// Escape sequences have no width.
+		{nil, red + "aaaa bbbb cccc dddd" + reset + " eeee",
+			red + "aaaa bbbb cccc dddd" + reset + "\neeee\n"},
+		{nil, link + "aaaa bbbb" + link + " cccc dddd eeee",
+			link + "aaaa bbbb" + link + " cccc dddd\neeee\n"},
+		// Active attributes are reset at the end of each line, and set again after
+		// the indent of the next line.
+		{nil, "aaaa " + red + "bbbb cccc dddd eeee ffff" + reset + " gggg",
+			"aaaa " + red + "bbbb cccc dddd" + reset + "\n" + red + "eeee ffff" + reset + " gggg\n"},
+		{[]int{0, 2}, red + "aaaa " + bold + "bbbb cccc dddd eeee" + reset,
+			red + "aaaa " + bold + "bbbb cccc dddd" + reset + "\n  " + red + bold + "eeee" + reset + "\n"},
+		// Sequences at the start of a wrapped word move with the word.
+		{nil, "aaaa bbbb cccc dddd " + red + "eeee" + reset,
+			"aaaa bbbb cccc dddd\n" + red + "eeee" + reset + "\n"},
+	}
+	stripEscapes := regexp.MustCompile("\x1b(\\[[^@-~]*[@-~]|\\][^\x07\x1b]*(\x07|\x1b\\\\))")
+	for _, test := range tests {
+		// Run with a variety of chunk sizes.
+		for _, sizes := range [][]int{nil, {1}, {2}, {1, 2}, {2, 1}} {
+			var buf bytes.Buffer
+			w := newUTF8WrapWriter(t, &buf, 20, lp{}, test.Indents)
+			wrapWriterWriteFlush(t, w, test.In, sizes)
+			if got, want := buf.String(), test.Want; got != want {
+				t.Errorf("%q sizes:%v got %q, want %q", test.In, sizes, got, want)
+			}
+			for _, line := range strings.Split(buf.String(), "\n") {
+				if got := utf8.RuneCountInString(stripEscapes.ReplaceAllString(line, "")); got > 20 {
+					t.Errorf("%q sizes:%v got line %q with %d visible columns, want <= 20", test.In, sizes, line, got)
+				}
+			}
+		}
+	}
+}
+
+func TestWrapWriterWide(t *testing.T) {
+	tests := []struct {
+		In   string
+		Want string
+	}{
+		{"", ""},
+		{"王普澤", "王普澤\n"},
+		// Wide runes occupy 2 cells each.
+		{"王普 澤世 界王", "王普 澤世\n界王\n"},
+		{"ab 王普 cd", "ab 王普\ncd\n"},
+		{"abcdefg 王", "abcdefg\n王\n"},
+		// Combining runes have no width.
+		{"e\u0301e\u0301e\u0301 e\u0301e\u0301e\u0301 x", "e\u0301e\u0301e\u0301 e\u0301e\u0301e\u0301 x\n"},
+		{"e\u0301e\u0301e\u0301 e\u0301e\u0301e\u0301 xy", "e\u0301e\u0301e\u0301 e\u0301e\u0301e\u0301\nxy\n"},
+	}
+	for _, test := range tests {
+		// Run with a variety of chunk sizes.
+		for _, sizes := range [][]int{nil, {1}, {2}, {1, 2}, {2, 1}} {
+			var buf bytes.Buffer
+			w := newUTF8WrapWriter(t, &buf, 9, lp{}, nil)
+			wrapWriterWriteFlush(t, w, test.In, sizes)
+			if got, want := buf.String(), test.Want; got != want {
+				t.Errorf("%q sizes:%v got %q, want %q", test.In, sizes, got, want)
+			}
+			for _, line := range strings.Split(buf.String(), "\n") {
+				if got := StringWidth(line); got > 9 {
+					t.Errorf("%q sizes:%v got line %q with %d cells, want <= 9", test.In, sizes, line, got)
+				}
+			}
+		}
+	}
+}
+
+func TestWrapWriterRuneWidth(t *testing.T) {
+	oneCell := func(rune) int { return 1 }
+	// wideX treats 'x' as 3 cells, and all other runes as 1 cell.
+	wideX := func(r rune) int {
+		if r == 'x' {
+			return 3
+		}
+		return 1
+	}
+	tests := []struct {
+		Width func(rune) int
+		In    string
+		Want  string
+	}{
+		{nil, "王普 澤世 界王", "王普 澤世\n界王\n"},
+		{oneCell, "王普 澤世 界王", "王普 澤世 界王\n"},
+		{oneCell, "王普澤世界 王普澤世", "王普澤世界\n王普澤世\n"},
+		{wideX, "ab cd ef", "ab cd ef\n"},
+		{wideX, "ab xx ef", "ab xx\nef\n"},
+		{wideX, "xxx xx", "xxx\nxx\n"},
+	}
+	for _, test := range tests {
+		// Run with a variety of chunk sizes.
+		for _, sizes := range [][]int{nil, {1}, {2}, {1, 2}, {2, 1}} {
+			var buf bytes.Buffer
+			w := newUTF8WrapWriter(t, &buf, 9, lp{}, nil)
+			if err := w.SetRuneWidth(test.Width); err != nil {
+				t.Errorf("SetRuneWidth failed: %v", err)
+			}
+			wrapWriterWriteFlush(t, w, test.In, sizes)
+			if got, want := buf.String(), test.Want; got != want {
+				t.Errorf("%q sizes:%v got %q, want %q", test.In, sizes, got, want)
+			}
+		}
+	}
+}
+
+func TestWrapWriterTabs(t *testing.T) {
+	tests := []struct {
+		Indents []int
+		In      string
+		Want    string
+	}{
+		{nil, "", ""},
+		{nil, "a\tb", "a   b\n"},
+		{nil, "abc\tde", "abc de\n"},
+		{nil, "abcd\te", "abcd    e\n"},
+		{nil, "a \tb", "a   b\n"},
+		{nil, "a\t\tb", "a       b\n"},
+		// Tab stops include the indent.
+		{[]int{2}, "a\tb", "  a b\n"},
+		{[]int{0, 2}, "aaaa bbbb cccc dddd eeee\tf", "aaaa bbbb cccc dddd\n  eeee  f\n"},
+		// Lines starting with tabs are verbatim.
+		{nil, "\tabc\tdef", "    abc def\n"},
+		{nil, "abc\n\tdef\tg\nhij", "abc\n    def g\nhij\n"},
+		// Expanded spaces count toward the width.
+		{nil, "aaaa bbbb cccc\tdddd", "aaaa bbbb cccc  dddd\n"},
+		{nil, "aaaa bbbb cc\tddddd", "aaaa bbbb cc\nddddd\n"},
+	}
+	for _, test := range tests {
+		// Run with a variety of chunk sizes.
+		for _, sizes := range [][]int{nil, {1}, {2}, {1, 2}, {2, 1}} {
+			var buf bytes.Buffer
+			w := newUTF8WrapWriter(t, &buf, 20, lp{}, test.Indents)
+			if err := w.SetTabWidth(4); err != nil {
+				t.Errorf("SetTabWidth failed: %v", err)
+			}
+			wrapWriterWriteFlush(t, w, test.In, sizes)
+			if got, want := buf.String(), test.Want; got != want {
+				t.Errorf("%q sizes:%v got %q, want %q", test.In, sizes, got, want)
+			}
+		}
+	}
+}
+
 // xlateIn translates our test.In pattern into an actual input string to feed
 // into the writer.  The point is to make it easy to specify the various control
 // sequences in a single character, so it's easier to understand.